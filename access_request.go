@@ -0,0 +1,318 @@
+package tvm
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"goji.io/pat"
+)
+
+type AccessRequestStatus string
+
+const (
+	AccessRequestPending  AccessRequestStatus = "pending"
+	AccessRequestApproved AccessRequestStatus = "approved"
+	AccessRequestDenied   AccessRequestStatus = "denied"
+
+	// AccessRequestIssued means that the request was approved and the
+	// requester has received their credentials. Each approval is good for
+	// one issuance, within Config.ApprovalLifetimeSeconds of the decision.
+	AccessRequestIssued AccessRequestStatus = "issued"
+)
+
+// defaultApprovalLifetime is how long an approval may be used for when
+// Config.ApprovalLifetimeSeconds is zero.
+const defaultApprovalLifetime = time.Hour
+
+// approvalLifetime returns how long after it is approved a request may be
+// used to get credentials.
+func (c Config) approvalLifetime() time.Duration {
+	if c.ApprovalLifetimeSeconds > 0 {
+		return time.Duration(c.ApprovalLifetimeSeconds) * time.Second
+	}
+	return defaultApprovalLifetime
+}
+
+// AccessRequest is a request for credentials for a role that requires
+// approval.
+type AccessRequest struct {
+	ID              string
+	UserID          string
+	Role            string
+	DurationSeconds int
+	Justification   string
+	Ticket          string
+	Created         time.Time
+	Status          AccessRequestStatus
+
+	// DecidedBy is the ID of the user who approved or denied the request.
+	DecidedBy string
+	Decided   time.Time
+
+	// Version is incremented by each call to Store.UpdateAccessRequest.
+	Version int64
+}
+
+var (
+	errAccessRequestPending = errors.New("access request is pending")
+	errAccessRequestDenied  = errors.New("access request was denied")
+	errAccessRequestUsed    = errors.New("access request has already been used")
+	errAccessRequestExpired = errors.New("access request approval has expired")
+	errAccessRequestDecided = errors.New("access request has already been decided")
+	errAccessRequestWrong   = errors.New("access request is for another user or role")
+	errNotApprover          = errors.New("you are not an approver for this role")
+)
+
+//go:embed access_requests.tmpl.html
+var accessRequestsTemplateStr string
+
+var accessRequestsTemplate = template.Must(template.New("access_requests").Parse(accessRequestsTemplateStr))
+
+// checkAccessRequest implements the approval workflow for roles that require
+// it. The first time through, it creates an access request and redirects
+// back to the same URL with the request ID added. Thereafter it shows a
+// waiting page until the request is decided. It returns the request once it
+// has been approved, or nil if credentials may not be issued. The caller
+// must mark the request issued with useAccessRequest once it has the
+// credentials.
+func (s *Server) checkAccessRequest(w http.ResponseWriter, r *http.Request, user *User, role string) *AccessRequest {
+	requestID := r.URL.Query().Get("request")
+	if requestID == "" {
+		request := AccessRequest{
+			ID:              newID(),
+			UserID:          user.ID,
+			Role:            role,
+			DurationSeconds: s.Config.sessionSeconds(role),
+			Justification:   strings.TrimSpace(r.URL.Query().Get("reason")),
+			Ticket:          strings.TrimSpace(r.URL.Query().Get("ticket")),
+			Created:         time.Now(),
+			Status:          AccessRequestPending,
+		}
+		if err := s.Store.PutAccessRequest(r.Context(), request); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil
+		}
+		s.audit(r.Context(), r, AuditEvent{
+			Type:            AuditAccessRequest,
+			Actor:           user.ID,
+			Role:            role,
+			DurationSeconds: request.DurationSeconds,
+			Reason:          request.Justification,
+			Ticket:          request.Ticket,
+			Message:         fmt.Sprintf("request %s", request.ID),
+		})
+
+		query := r.URL.Query()
+		query.Set("request", request.ID)
+		http.Redirect(w, r, "/?"+query.Encode(), http.StatusFound)
+		return nil
+	}
+
+	request, err := s.Store.GetAccessRequest(r.Context(), requestID)
+	if err == nil {
+		err = s.checkApproved(*request, user.ID, role)
+	}
+	switch err {
+	case nil:
+		return request
+	case errAccessRequestPending:
+		approveURL := s.Config.RootURL
+		approveURL.Path = "/requests/" + requestID
+		fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head>
+  <meta http-equiv="refresh" content="5">
+  <title>Waiting for approval</title>
+</head>
+<body>
+<h1>Waiting for approval</h1>
+<p>Access to %s requires approval. Ask an approver to visit <a href="%s">%s</a>
+or run <code>tvm approve %s</code>.</p>
+<p>This page will continue when the request is decided.</p>
+</body>
+</html>
+`, template.HTMLEscapeString(role), template.HTMLEscapeString(approveURL.String()),
+			template.HTMLEscapeString(approveURL.String()), template.HTMLEscapeString(requestID))
+	case errAccessRequestDenied:
+		http.Error(w, fmt.Sprintf("access request was denied by %s", request.DecidedBy), http.StatusForbidden)
+	case ErrNotFound, errAccessRequestWrong, errAccessRequestUsed, errAccessRequestExpired:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// checkApproved returns nil if request is an approval, not yet used or
+// expired, for the user with ID userID to get credentials for role.
+func (s *Server) checkApproved(request AccessRequest, userID, role string) error {
+	if request.UserID != userID || request.Role != role {
+		return errAccessRequestWrong
+	}
+	switch request.Status {
+	case AccessRequestPending:
+		return errAccessRequestPending
+	case AccessRequestDenied:
+		return errAccessRequestDenied
+	case AccessRequestIssued:
+		return errAccessRequestUsed
+	}
+	if time.Since(request.Decided) > s.Config.approvalLifetime() {
+		return errAccessRequestExpired
+	}
+	return nil
+}
+
+// useAccessRequest marks the approved request with ID requestID issued, so
+// that it cannot be used again. It fails if the request has been used or
+// has expired since it was checked.
+func (s *Server) useAccessRequest(ctx context.Context, requestID, userID, role string) error {
+	return s.Store.UpdateAccessRequest(ctx, requestID, func(request *AccessRequest) error {
+		if err := s.checkApproved(*request, userID, role); err != nil {
+			return err
+		}
+		request.Status = AccessRequestIssued
+		return nil
+	})
+}
+
+// handleAccessRequests shows the pending requests that the current user
+// can approve.
+func (s *Server) handleAccessRequests(w http.ResponseWriter, r *http.Request) {
+	s.serveAccessRequests(w, r, "", "")
+}
+
+// handleAccessRequest shows a single request to its requester, an approver
+// for its role or an admin.
+func (s *Server) handleAccessRequest(w http.ResponseWriter, r *http.Request) {
+	s.serveAccessRequests(w, r, pat.Param(r, "id"), "")
+}
+
+func (s *Server) serveAccessRequests(w http.ResponseWriter, r *http.Request, requestID string, flash string) {
+	user := s.currentUser(r)
+	if user == nil {
+		s.redirectToApprove(w, r, requestID)
+		return
+	}
+
+	requests, err := s.Store.ListAccessRequests(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var rv []AccessRequest
+	for _, request := range requests {
+		if requestID != "" {
+			if request.ID == requestID && (request.UserID == user.ID || user.IsApproverFor(request.Role) || user.Admin) {
+				rv = append(rv, request)
+			}
+			continue
+		}
+		if request.Status == AccessRequestPending && request.UserID != user.ID && user.IsApproverFor(request.Role) {
+			rv = append(rv, request)
+		}
+	}
+	if requestID != "" && len(rv) == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Created.Before(rv[j].Created) })
+
+	accessRequestsTemplate.Execute(w, struct {
+		User     *User
+		Requests []AccessRequest
+		Flash    string
+	}{
+		User:     user,
+		Requests: rv,
+		Flash:    flash,
+	})
+}
+
+// handleAccessRequestOp approves or denies a request.
+func (s *Server) handleAccessRequestOp(w http.ResponseWriter, r *http.Request) {
+	requestID := pat.Param(r, "id")
+	approver := s.currentUser(r)
+	if approver == nil {
+		s.redirectToApprove(w, r, requestID)
+		return
+	}
+
+	var status AccessRequestStatus
+	switch r.FormValue("op") {
+	case "approve":
+		status = AccessRequestApproved
+	case "deny":
+		status = AccessRequestDenied
+	default:
+		http.Error(w, "unknown operation", http.StatusBadRequest)
+		return
+	}
+
+	var decided AccessRequest
+	err := s.Store.UpdateAccessRequest(r.Context(), requestID, func(request *AccessRequest) error {
+		if request.UserID == approver.ID || !approver.IsApproverFor(request.Role) {
+			return errNotApprover
+		}
+		if request.Status != AccessRequestPending {
+			return errAccessRequestDecided
+		}
+		request.Status = status
+		request.DecidedBy = approver.ID
+		request.Decided = time.Now()
+		decided = *request
+		return nil
+	})
+	switch err {
+	case nil:
+	case ErrNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errNotApprover:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case errAccessRequestDecided:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	eventType := AuditAccessApprove
+	if status == AccessRequestDenied {
+		eventType = AuditAccessDeny
+	}
+	s.audit(r.Context(), r, AuditEvent{
+		Type:            eventType,
+		Actor:           approver.ID,
+		Subject:         decided.UserID,
+		Role:            decided.Role,
+		DurationSeconds: decided.DurationSeconds,
+		Reason:          decided.Justification,
+		Ticket:          decided.Ticket,
+		Message:         fmt.Sprintf("request %s", decided.ID),
+	})
+
+	s.serveAccessRequests(w, r, requestID, fmt.Sprintf("%s request %s from %s for %s",
+		status, decided.ID, decided.UserID, decided.Role))
+}
+
+// redirectToApprove sends the user through the login flow, returning to
+// the requests page afterwards.
+func (s *Server) redirectToApprove(w http.ResponseWriter, r *http.Request, requestID string) {
+	query := url.Values{"format": {"approve"}}
+	if requestID != "" {
+		query.Set("request", requestID)
+	}
+	http.Redirect(w, r, "/?"+query.Encode(), http.StatusFound)
+}
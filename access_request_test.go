@@ -0,0 +1,224 @@
+package tvm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestAccessRequest(t *testing.T) {
+	s, stsSvc := newTestServer(t, Config{
+		Roles: map[string]RoleConfig{
+			"prod": {RequireApproval: true},
+		},
+	})
+
+	alice := loginAs(t, s, User{ID: "alice", Roles: []RoleGrant{{Role: "prod"}}})
+	bob := loginAs(t, s, User{ID: "bob", ApproverFor: []string{"prod"}})
+	carol := loginAs(t, s, User{ID: "carol", ApproverFor: []string{"dev"}})
+
+	// request creates a new access request and returns its ID
+	request := func(t *testing.T) string {
+		w := do(s, "GET", "/?role=prod&format=sh&reason=deploy", nil, alice)
+		assert.Assert(t, is.Equal(http.StatusFound, w.Code))
+		location, err := url.Parse(w.Header().Get("Location"))
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal("sh", location.Query().Get("format")))
+		id := location.Query().Get("request")
+		assert.Assert(t, id != "")
+		return id
+	}
+
+	t.Run("approve", func(t *testing.T) {
+		id := request(t)
+
+		w := do(s, "GET", "/?role=prod&format=sh&request="+id, nil, alice)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+		assert.Check(t, is.Contains(w.Body.String(), "Waiting for approval"))
+		assert.Check(t, is.Len(stsSvc.inputs, 0))
+
+		w = do(s, "POST", "/requests/"+id, url.Values{"op": {"approve"}}, carol)
+		assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+		w = do(s, "POST", "/requests/"+id, url.Values{"op": {"approve"}}, alice)
+		assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+
+		w = do(s, "GET", "/requests", nil, bob)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+		assert.Check(t, is.Contains(w.Body.String(), "deploy"))
+		w = do(s, "GET", "/requests", nil, carol)
+		assert.Check(t, !strings.Contains(w.Body.String(), "deploy"))
+
+		// a single request is shown only to its requester and approvers
+		w = do(s, "GET", "/requests/"+id, nil, alice)
+		assert.Check(t, is.Contains(w.Body.String(), "deploy"))
+		w = do(s, "GET", "/requests/"+id, nil, bob)
+		assert.Check(t, is.Contains(w.Body.String(), "deploy"))
+		w = do(s, "GET", "/requests/"+id, nil, carol)
+		assert.Check(t, is.Equal(http.StatusNotFound, w.Code))
+		assert.Check(t, !strings.Contains(w.Body.String(), "deploy"))
+
+		w = do(s, "POST", "/requests/"+id, url.Values{"op": {"approve"}}, bob)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+		w = do(s, "POST", "/requests/"+id, url.Values{"op": {"deny"}}, bob)
+		assert.Check(t, is.Equal(http.StatusConflict, w.Code))
+
+		w = do(s, "GET", "/?role=prod&format=sh&request="+id, nil, alice)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+		assert.Check(t, is.Contains(w.Body.String(), "export AWS_ACCESS_KEY_ID=ASIAEXAMPLE"))
+		assert.Check(t, is.Len(stsSvc.inputs, 1))
+
+		// each approval is good for one issuance
+		w = do(s, "GET", "/?role=prod&format=sh&request="+id, nil, alice)
+		assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+		assert.Check(t, is.Len(stsSvc.inputs, 1))
+	})
+
+	t.Run("deny", func(t *testing.T) {
+		id := request(t)
+
+		w := do(s, "POST", "/requests/"+id, url.Values{"op": {"deny"}}, bob)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+
+		w = do(s, "GET", "/?role=prod&format=sh&request="+id, nil, alice)
+		assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+		assert.Check(t, is.Contains(w.Body.String(), "denied by bob"))
+	})
+
+	t.Run("approved reason", func(t *testing.T) {
+		id := request(t)
+		w := do(s, "POST", "/requests/"+id, url.Values{"op": {"approve"}}, bob)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+
+		// the reason is the one bob approved, not one added to the URL since
+		w = do(s, "GET", "/?role=prod&format=sh&reason=something+else&request="+id, nil, alice)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+		events, err := s.Store.ListAuditEvents(context.Background(), AuditFilter{Type: AuditCredentialsIssue, Limit: 1})
+		assert.NilError(t, err)
+		assert.Assert(t, is.Len(events, 1))
+		assert.Check(t, is.Equal("deploy", events[0].Reason))
+	})
+
+	t.Run("failed issuance", func(t *testing.T) {
+		id := request(t)
+		w := do(s, "POST", "/requests/"+id, url.Values{"op": {"approve"}}, bob)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+
+		// the approval is not used up when STS fails
+		stsSvc.err = errors.New("throttled")
+		w = do(s, "GET", "/?role=prod&format=sh&request="+id, nil, alice)
+		stsSvc.err = nil
+		assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+		assert.Check(t, is.Contains(w.Body.String(), "sts.AssumeRole failed"))
+
+		w = do(s, "GET", "/?role=prod&format=sh&request="+id, nil, alice)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+		assert.Check(t, is.Contains(w.Body.String(), "export AWS_ACCESS_KEY_ID=ASIAEXAMPLE"))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		id := request(t)
+		w := do(s, "POST", "/requests/"+id, url.Values{"op": {"approve"}}, bob)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+		err := s.Store.UpdateAccessRequest(context.Background(), id, func(request *AccessRequest) error {
+			request.Decided = request.Decided.Add(-defaultApprovalLifetime - time.Minute)
+			return nil
+		})
+		assert.NilError(t, err)
+
+		n := len(stsSvc.inputs)
+		w = do(s, "GET", "/?role=prod&format=sh&request="+id, nil, alice)
+		assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+		assert.Check(t, is.Contains(w.Body.String(), "approval has expired"))
+		assert.Check(t, is.Len(stsSvc.inputs, n))
+	})
+
+	t.Run("requires login", func(t *testing.T) {
+		w := do(s, "GET", "/requests/someid", nil, "")
+		assert.Check(t, is.Equal(http.StatusFound, w.Code))
+		assert.Check(t, is.Equal("/?format=approve&request=someid", w.Header().Get("Location")))
+	})
+
+	t.Run("audited", func(t *testing.T) {
+		events, err := s.Store.ListAuditEvents(context.Background(), AuditFilter{Type: AuditAccessApprove})
+		assert.NilError(t, err)
+		assert.Assert(t, is.Len(events, 4))
+		assert.Check(t, is.Equal("bob", events[0].Actor))
+		assert.Check(t, is.Equal("alice", events[0].Subject))
+	})
+}
+
+func TestAccessRequestChainedDuration(t *testing.T) {
+	s, _ := newTestServer(t, Config{
+		CredentialLifetimeSeconds: 43200,
+		Roles: map[string]RoleConfig{
+			"arn:aws:iam::2:role/prod": {RequireApproval: true, Chain: []RoleHop{{Role: "arn:aws:iam::1:role/hub"}}},
+		},
+	})
+	alice := loginAs(t, s, User{ID: "alice", Roles: []RoleGrant{{Role: "arn:aws:iam::2:role/prod"}}})
+
+	w := do(s, "GET", "/?role=arn:aws:iam::2:role/prod&format=sh", nil, alice)
+	assert.Assert(t, is.Equal(http.StatusFound, w.Code))
+	requests, err := s.Store.ListAccessRequests(context.Background())
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(requests, 1))
+	assert.Check(t, is.Equal(maxChainedSessionSeconds, requests[0].DurationSeconds))
+}
+
+func TestApproverAdmin(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{
+		Roles: map[string]RoleConfig{
+			"arn:aws:iam::1:role/prod": {Alias: "prod", RequireApproval: true},
+			"arn:aws:iam::1:role/dev":  {Alias: "dev"},
+		},
+	})
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+	loginAs(t, s, User{ID: "bob"})
+	approverFor := func() []string {
+		user, err := s.Store.GetUser(ctx, "bob")
+		assert.NilError(t, err)
+		return user.ApproverFor
+	}
+
+	// admin UI
+	w := do(s, "POST", "/admin/op", url.Values{"op": {"add_approver"}, "user": {"bob"}, "role": {"arn:aws:iam::1:role/prod"}}, admin)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.DeepEqual([]string{"arn:aws:iam::1:role/prod"}, approverFor()))
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"add_approver"}, "user": {"bob"}, "role": {"arn:aws:iam::1:role/dev"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"delete_approver"}, "user": {"bob"}, "role": {"arn:aws:iam::1:role/prod"}}, admin)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.Len(approverFor(), 0))
+
+	// tvm admin
+	_, err := runAdmin(t, s, "user add-approver bob prod")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"arn:aws:iam::1:role/prod"}, approverFor()))
+	_, err = runAdmin(t, s, "user remove-approver bob prod")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(approverFor(), 0))
+
+	// API
+	token := newAPIToken(t, s, admin, ScopeUsersWrite)
+	code := doAPI(t, s, "POST", "/api/v1/users/bob/approver", map[string]string{"role": "prod"}, token, nil)
+	assert.Check(t, is.Equal(http.StatusForbidden, code))
+	token = newAPIToken(t, s, admin, ScopeAdminsWrite)
+	var user apiUser
+	code = doAPI(t, s, "POST", "/api/v1/users/bob/approver", map[string]string{"role": "prod"}, token, &user)
+	assert.Check(t, is.Equal(http.StatusOK, code))
+	assert.Check(t, is.DeepEqual([]string{"arn:aws:iam::1:role/prod"}, user.ApproverFor))
+	code = doAPI(t, s, "DELETE", "/api/v1/users/bob/approver?role=prod", nil, token, &user)
+	assert.Check(t, is.Equal(http.StatusOK, code))
+	assert.Check(t, is.Len(user.ApproverFor, 0))
+
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditAdmin, Subject: "bob"})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(events, 6))
+}
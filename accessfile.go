@@ -0,0 +1,623 @@
+package tvm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// AccessFile declares who may do what, so that access can be reviewed in
+// pull requests rather than changed in the admin UI. PlanAccess compares it
+// with the store and ApplyAccess makes the store match it.
+//
+// The file is authoritative for the role grants, admin and break-glass
+// flags and approver roles of every user, and for every group that is not
+// synchronized from elsewhere. Users not listed have none of these. It does
+// not manage users' status, devices or sessions.
+type AccessFile struct {
+	// Roles is the role catalog, as in Config.Roles. Grants may name roles
+	// by ARN or alias, and must name roles in the catalog if there is one.
+	Roles map[string]RoleConfig
+
+	// Admins are the IDs or email addresses of the admins.
+	Admins []string
+
+	Users  []AccessFileUser
+	Groups []AccessFileGroup
+}
+
+// AccessFileUser is a user in an AccessFile.
+type AccessFileUser struct {
+	// User is the user's ID or email address. Users named by an email
+	// address that no user has are created, as if invited.
+	User string
+
+	Roles       []RoleGrant
+	BreakGlass  bool
+	ApproverFor []string
+}
+
+// AccessFileGroup is a group in an AccessFile.
+type AccessFileGroup struct {
+	ID          string
+	DisplayName string
+
+	// Members are the IDs or email addresses of the group's members.
+	Members []string
+
+	Roles []RoleGrant
+}
+
+// ReadAccessFile reads the access file at path, which is YAML if its name
+// ends in .yaml or .yml and JSON otherwise. Field names are those of
+// AccessFile, matched without regard to case. Unknown fields are errors, so
+// that typos are not silently ignored.
+func ReadAccessFile(path string) (*AccessFile, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if buf, err = yamlToJSON(buf); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	var rv AccessFile
+	if err := dec.Decode(&rv); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &rv, nil
+}
+
+// yamlToJSON converts a YAML document to JSON, so that it is decoded by the
+// same rules as a JSON access file.
+func yamlToJSON(buf []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(buf, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue(v))
+}
+
+// jsonValue replaces the map[interface{}]interface{} values that the YAML
+// decoder produces with maps that encoding/json can encode.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		rv := map[string]interface{}{}
+		for key, value := range v {
+			rv[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return rv
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+var errManagedAccess = errors.New("access is managed by the access file; change it there")
+
+// AccessChange is a change that ApplyAccess makes to bring the store in
+// line with an access file.
+type AccessChange struct {
+	// Kind is "user" or "group".
+	Kind string
+	ID   string
+
+	// Op is "create", "update" or "delete".
+	Op string
+
+	// Details describe each difference, e.g. "+admin" or "-role arn:...".
+	Details []string
+
+	ops   []accessOp
+	user  *User
+	group *Group
+}
+
+// accessOp is one difference in an AccessChange, as the admin operation
+// that makes it, so that it is audited as if an admin had made it.
+type accessOp struct {
+	// op is as in userChange or groupChange, e.g. "add_role".
+	op     string
+	detail string
+
+	// grant is the grant for add_role, and its role for delete_role.
+	grant RoleGrant
+
+	// value is the role for add_approver and delete_approver, and the user
+	// ID for add_member and remove_member.
+	value string
+}
+
+// accessChange returns a change made up of ops.
+func accessChange(kind, id, op string, ops []accessOp) AccessChange {
+	change := AccessChange{Kind: kind, ID: id, Op: op, ops: ops}
+	for _, o := range ops {
+		change.Details = append(change.Details, o.detail)
+	}
+	return change
+}
+
+func (c AccessChange) String() string {
+	if len(c.Details) == 0 {
+		return fmt.Sprintf("%s %s %s", c.Op, c.Kind, c.ID)
+	}
+	return fmt.Sprintf("%s %s %s: %s", c.Op, c.Kind, c.ID, strings.Join(c.Details, ", "))
+}
+
+// accessPlanner works out the changes needed to apply an access file.
+type accessPlanner struct {
+	s       *Server
+	file    AccessFile
+	now     time.Time
+	created map[string]*User
+}
+
+// resolveRole returns the ARN of the role named in the access file.
+func (p *accessPlanner) resolveRole(name string) (string, error) {
+	if _, _, ok := parseOrganizationRole(name); ok {
+		return name, nil
+	}
+	catalog := Config{Roles: p.file.Roles}
+	if len(catalog.Roles) == 0 {
+		catalog.Roles = p.s.Config.Roles
+	}
+	if len(catalog.Roles) == 0 {
+		return name, nil
+	}
+	if role, ok := catalog.resolveRole(name); ok {
+		return role, nil
+	}
+	return "", fmt.Errorf("unknown role %q", name)
+}
+
+// grants returns the unexpired grants in the access file, keyed by role.
+func (p *accessPlanner) grants(grants []RoleGrant) (map[string]RoleGrant, error) {
+	rv := map[string]RoleGrant{}
+	for _, grant := range grants {
+		role, err := p.resolveRole(grant.Role)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := rv[role]; ok {
+			return nil, fmt.Errorf("role %s is granted more than once", role)
+		}
+		grant.Role = role
+		if !grant.Expired(p.now) {
+			rv[role] = grant
+		}
+	}
+	return rv, nil
+}
+
+// userID returns the ID of the user named in the access file, planning to
+// create them if they do not exist.
+func (p *accessPlanner) userID(ctx context.Context, idOrEmail string) (string, error) {
+	user, err := p.s.lookupUser(ctx, idOrEmail)
+	switch {
+	case err == nil:
+		return user.ID, nil
+	case err != ErrNotFound:
+		return "", fmt.Errorf("%s: %w", idOrEmail, err)
+	}
+	email := strings.ToLower(strings.TrimSpace(idOrEmail))
+	if !strings.Contains(email, "@") || strings.ContainsAny(email, "/\\ ") {
+		return "", fmt.Errorf("%s: no such user", idOrEmail)
+	}
+	if _, ok := p.created[email]; !ok {
+		p.created[email] = &User{ID: email, Email: email}
+	}
+	return email, nil
+}
+
+// diffGrants returns the operations that change the grants from have to
+// want.
+func diffGrants(have []RoleGrant, want map[string]RoleGrant) []accessOp {
+	var ops []accessOp
+	haveByRole := map[string]RoleGrant{}
+	for _, grant := range have {
+		haveByRole[grant.Role] = grant
+		w, ok := want[grant.Role]
+		switch {
+		case !ok:
+			ops = append(ops, accessOp{op: "delete_role", detail: "-role " + grant.String(), grant: grant})
+		case !w.NotBefore.Equal(grant.NotBefore) || !w.NotAfter.Equal(grant.NotAfter):
+			ops = append(ops, accessOp{op: "add_role", detail: fmt.Sprintf("~role %s -> %s", grant, w), grant: w})
+		}
+	}
+	for _, grant := range sortedGrants(want) {
+		if _, ok := haveByRole[grant.Role]; !ok {
+			ops = append(ops, accessOp{op: "add_role", detail: "+role " + grant.String(), grant: grant})
+		}
+	}
+	return ops
+}
+
+// diffStrings returns the operations, addOp and removeOp, that change the
+// set of what from have to want.
+func diffStrings(what, addOp, removeOp string, have, want []string) []accessOp {
+	var ops []accessOp
+	haveSet := map[string]bool{}
+	for _, h := range have {
+		haveSet[h] = true
+	}
+	wantSet := map[string]bool{}
+	for _, w := range want {
+		wantSet[w] = true
+		if !haveSet[w] {
+			ops = append(ops, accessOp{op: addOp, detail: fmt.Sprintf("+%s %s", what, w), value: w})
+		}
+	}
+	for _, h := range have {
+		if !wantSet[h] {
+			ops = append(ops, accessOp{op: removeOp, detail: fmt.Sprintf("-%s %s", what, h), value: h})
+		}
+	}
+	return ops
+}
+
+// diffBool returns the operation, addOp or deleteOp, that changes what
+// from have to want.
+func diffBool(what, addOp, deleteOp string, have, want bool) []accessOp {
+	switch {
+	case want && !have:
+		return []accessOp{{op: addOp, detail: "+" + what}}
+	case have && !want:
+		return []accessOp{{op: deleteOp, detail: "-" + what}}
+	}
+	return nil
+}
+
+func sortedGrants(grants map[string]RoleGrant) []RoleGrant {
+	var rv []RoleGrant
+	for _, grant := range grants {
+		rv = append(rv, grant)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Role < rv[j].Role })
+	return rv
+}
+
+// PlanAccess returns the changes that ApplyAccess would make to the store
+// to match file.
+func (s *Server) PlanAccess(ctx context.Context, file AccessFile) ([]AccessChange, error) {
+	p := &accessPlanner{s: s, file: file, now: time.Now(), created: map[string]*User{}}
+
+	type wantUser struct {
+		grants      map[string]RoleGrant
+		admin       bool
+		breakGlass  bool
+		approverFor []string
+	}
+	want := map[string]*wantUser{}
+	for _, u := range file.Users {
+		id, err := p.userID(ctx, u.User)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := want[id]; ok {
+			return nil, fmt.Errorf("%s: listed more than once", u.User)
+		}
+		grants, err := p.grants(u.Roles)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", u.User, err)
+		}
+		w := &wantUser{grants: grants, breakGlass: u.BreakGlass}
+		for _, name := range u.ApproverFor {
+			role, err := p.resolveRole(name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", u.User, err)
+			}
+			w.approverFor = append(w.approverFor, role)
+		}
+		want[id] = w
+	}
+	for _, admin := range file.Admins {
+		id, err := p.userID(ctx, admin)
+		if err != nil {
+			return nil, err
+		}
+		if want[id] == nil {
+			want[id] = &wantUser{grants: map[string]RoleGrant{}}
+		}
+		want[id].admin = true
+	}
+
+	groups, err := s.Store.ListGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]Group{}
+	for _, group := range groups {
+		existing[group.ID] = group
+	}
+	type wantGroup struct {
+		AccessFileGroup
+		grants map[string]RoleGrant
+	}
+	var wantGroups []wantGroup
+	listed := map[string]bool{}
+	for _, g := range file.Groups {
+		if !groupIDPattern.MatchString(g.ID) || strings.HasPrefix(g.ID, ".") {
+			return nil, fmt.Errorf("group %s: %w", g.ID, errBadGroupID)
+		}
+		if listed[g.ID] {
+			return nil, fmt.Errorf("group %s: listed more than once", g.ID)
+		}
+		listed[g.ID] = true
+		grants, err := p.grants(g.Roles)
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %w", g.ID, err)
+		}
+		var members []string
+		for _, member := range g.Members {
+			id, err := p.userID(ctx, member)
+			if err != nil {
+				return nil, fmt.Errorf("group %s: %w", g.ID, err)
+			}
+			members = append(members, id)
+		}
+		g.Members = members
+		wantGroups = append(wantGroups, wantGroup{g, grants})
+	}
+
+	users, err := s.Store.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, created := range p.created {
+		users = append(users, *created)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	var changes []AccessChange
+	for _, user := range users {
+		w := want[user.ID]
+		if w == nil {
+			w = &wantUser{}
+		}
+		var ops []accessOp
+		ops = append(ops, diffGrants(user.Roles, w.grants)...)
+		ops = append(ops, diffBool("admin", "add_admin", "delete_admin", user.Admin, w.admin)...)
+		ops = append(ops, diffBool("break-glass", "add_break_glass", "delete_break_glass", user.BreakGlass, w.breakGlass)...)
+		ops = append(ops, diffStrings("approver", "add_approver", "delete_approver", user.ApproverFor, w.approverFor)...)
+
+		_, isNew := p.created[user.ID]
+		if len(ops) == 0 && !isNew {
+			continue
+		}
+		desired := user
+		desired.Roles = sortedGrants(w.grants)
+		desired.Admin = w.admin
+		desired.BreakGlass = w.breakGlass
+		desired.ApproverFor = w.approverFor
+		op := "update"
+		if isNew {
+			op = "create"
+		}
+		change := accessChange("user", user.ID, op, ops)
+		change.user = &desired
+		changes = append(changes, change)
+	}
+
+	for _, g := range wantGroups {
+		grants, members := g.grants, g.Members
+		have, ok := existing[g.ID]
+		if ok && have.Source != "" {
+			return nil, fmt.Errorf("group %s: synchronized from %s, so cannot be managed in the access file", g.ID, have.Source)
+		}
+		var ops []accessOp
+		ops = append(ops, diffStrings("member", "add_member", "remove_member", have.Members, members)...)
+		ops = append(ops, diffGrants(have.Roles, grants)...)
+		if g.DisplayName != have.DisplayName {
+			ops = append(ops, accessOp{op: "rename_group", detail: fmt.Sprintf("~name %q -> %q", have.DisplayName, g.DisplayName), value: g.DisplayName})
+		}
+		if len(ops) == 0 && ok {
+			continue
+		}
+		desired := have
+		desired.ID = g.ID
+		desired.DisplayName = g.DisplayName
+		desired.Members = members
+		desired.Roles = sortedGrants(grants)
+		op := "update"
+		if !ok {
+			op = "create"
+		}
+		change := accessChange("group", g.ID, op, ops)
+		change.group = &desired
+		changes = append(changes, change)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	for _, group := range groups {
+		if listed[group.ID] || group.Source != "" {
+			continue
+		}
+		changes = append(changes, AccessChange{Kind: "group", ID: group.ID, Op: "delete", Details: []string{"not in access file"}})
+	}
+	return changes, nil
+}
+
+// ApplyAccess makes the store match file, auditing each change as actor,
+// and returns the changes it made. Each difference is audited as the admin
+// operation that makes it, e.g. "add_admin", so that it is reported as if
+// an admin had made it, and the apply as a whole as "apply".
+func (s *Server) ApplyAccess(ctx context.Context, actor string, file AccessFile) ([]AccessChange, error) {
+	changes, err := s.PlanAccess(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		var events []AuditEvent
+		switch {
+		case change.Kind == "user" && change.Op == "create":
+			user := User{ID: change.user.ID, Email: change.user.Email}
+			events = append(events, AuditEvent{
+				Subject: change.ID,
+				Op:      "invite",
+				After:   newAuditUserState(user),
+				Message: fmt.Sprintf("Invited %s", change.ID),
+			})
+			events = append(events, applyUserOps(&user, change.ops)...)
+			err = s.Store.PutUser(ctx, *change.user)
+
+		case change.Kind == "user":
+			err = s.Store.UpdateUser(ctx, change.ID, func(user *User) error {
+				events = applyUserOps(user, change.ops)
+				user.Roles = change.user.Roles
+				user.Admin = change.user.Admin
+				user.BreakGlass = change.user.BreakGlass
+				user.ApproverFor = change.user.ApproverFor
+				return nil
+			})
+
+		case change.Op == "create":
+			events = append(events, AuditEvent{Op: "create_group"})
+			events = append(events, groupOpEvents(change.ops)...)
+			err = s.Store.PutGroup(ctx, *change.group)
+
+		case change.Op == "update":
+			events = groupOpEvents(change.ops)
+			err = s.Store.UpdateGroup(ctx, change.ID, func(group *Group) error {
+				group.DisplayName = change.group.DisplayName
+				group.Members = change.group.Members
+				group.Roles = change.group.Roles
+				return nil
+			})
+
+		case change.Op == "delete":
+			events = append(events, AuditEvent{Op: "delete_group"})
+			err = s.Store.DeleteGroup(ctx, change.ID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", change, err)
+		}
+		for _, event := range events {
+			event.Type = AuditAdmin
+			event.Actor = actor
+			if change.Kind == "group" {
+				event.Group = change.ID
+				event.Op = "group." + event.Op
+				if event.Message == "" {
+					event.Message = fmt.Sprintf("%s group %s", change.Op, change.ID)
+				}
+			}
+			s.audit(ctx, nil, event)
+		}
+	}
+	s.audit(ctx, nil, AuditEvent{
+		Type:    AuditAdmin,
+		Actor:   actor,
+		Op:      "apply",
+		Message: fmt.Sprintf("applied access file: %d changes", len(changes)),
+	})
+	return changes, nil
+}
+
+// applyUserOps makes ops to user one at a time, returning an audit event
+// for each.
+func applyUserOps(user *User, ops []accessOp) []AuditEvent {
+	var events []AuditEvent
+	for _, op := range ops {
+		event := AuditEvent{
+			Subject: user.ID,
+			Op:      op.op,
+			Role:    op.grant.Role,
+			Before:  newAuditUserState(*user),
+			Message: fmt.Sprintf("%s: %s", user.ID, op.detail),
+		}
+		switch op.op {
+		case "add_role":
+			user.Roles = addGrant(user.Roles, op.grant)
+		case "delete_role":
+			user.Roles = removeGrant(user.Roles, op.grant.Role)
+		case "add_admin", "delete_admin":
+			user.Admin = op.op == "add_admin"
+		case "add_break_glass", "delete_break_glass":
+			user.BreakGlass = op.op == "add_break_glass"
+		case "add_approver":
+			event.Role = op.value
+			user.ApproverFor = append(user.ApproverFor, op.value)
+		case "delete_approver":
+			event.Role = op.value
+			user.ApproverFor = removeMember(user.ApproverFor, op.value)
+		}
+		event.After = newAuditUserState(*user)
+		events = append(events, event)
+	}
+	return events
+}
+
+// groupOpEvents returns an audit event for each of ops to a group.
+func groupOpEvents(ops []accessOp) []AuditEvent {
+	var events []AuditEvent
+	for _, op := range ops {
+		event := AuditEvent{Op: op.op, Role: op.grant.Role, Message: op.detail}
+		if op.op == "add_member" || op.op == "remove_member" {
+			event.Subject = op.value
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// AccessDrift is a difference between the store and the access file, along
+// with the admin changes since the access file was last applied that may
+// have caused it.
+type AccessDrift struct {
+	Change AccessChange
+	Events []AuditEvent
+}
+
+// DriftAccess reports the ways in which the store has drifted from file,
+// for example through changes made in the admin UI.
+func (s *Server) DriftAccess(ctx context.Context, file AccessFile) ([]AccessDrift, error) {
+	changes, err := s.PlanAccess(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditAdmin})
+	if err != nil {
+		return nil, err
+	}
+	// events are newest first; only those since the last apply are drift
+	for i, event := range events {
+		if event.Op == "apply" {
+			events = events[:i]
+			break
+		}
+	}
+
+	var rv []AccessDrift
+	for _, change := range changes {
+		drift := AccessDrift{Change: change}
+		for _, event := range events {
+			if (change.Kind == "user" && event.Subject == change.ID && event.Group == "") ||
+				(change.Kind == "group" && event.Group == change.ID) {
+				drift.Events = append(drift.Events, event)
+			}
+		}
+		rv = append(rv, drift)
+	}
+	return rv, nil
+}
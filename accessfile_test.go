@@ -0,0 +1,207 @@
+package tvm
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestPlanAndApplyAccess(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{})
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "accounts.google.com:1", Subject: "1", Email: "alice@example.com", Admin: true}))
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "accounts.google.com:2", Subject: "2", Email: "bob@example.com", Roles: []RoleGrant{{Role: "arn:aws:iam::1:role/prod"}}}))
+	assert.NilError(t, s.Store.PutGroup(ctx, Group{ID: "old"}))
+	assert.NilError(t, s.Store.PutGroup(ctx, Group{ID: "synced", Source: "google", Members: []string{"accounts.google.com:2"}}))
+
+	file := AccessFile{
+		Roles: map[string]RoleConfig{
+			"arn:aws:iam::1:role/dev":  {Alias: "dev"},
+			"arn:aws:iam::1:role/prod": {Alias: "prod"},
+		},
+		Admins: []string{"alice@example.com"},
+		Users: []AccessFileUser{
+			{User: "bob@example.com", Roles: []RoleGrant{{Role: "dev"}}},
+			{User: "carol@example.com", Roles: []RoleGrant{{Role: "prod"}}, BreakGlass: true},
+		},
+		Groups: []AccessFileGroup{
+			{ID: "eng", Members: []string{"bob@example.com", "carol@example.com"}, Roles: []RoleGrant{{Role: "dev"}}},
+		},
+	}
+
+	changes, err := s.PlanAccess(ctx, file)
+	assert.NilError(t, err)
+	var plan []string
+	for _, change := range changes {
+		plan = append(plan, change.String())
+	}
+	assert.Check(t, is.DeepEqual([]string{
+		"update user accounts.google.com:2: -role arn:aws:iam::1:role/prod, +role arn:aws:iam::1:role/dev",
+		"create user carol@example.com: +role arn:aws:iam::1:role/prod, +break-glass",
+		"create group eng: +member accounts.google.com:2, +member carol@example.com, +role arn:aws:iam::1:role/dev",
+		"delete group old: not in access file",
+	}, plan))
+
+	// planning changes nothing
+	bob, err := s.Store.GetUser(ctx, "accounts.google.com:2")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("arn:aws:iam::1:role/prod", bob.Roles[0].Role))
+
+	_, err = s.ApplyAccess(ctx, "cli:root", file)
+	assert.NilError(t, err)
+	bob, err = s.Store.GetUser(ctx, "accounts.google.com:2")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]RoleGrant{{Role: "arn:aws:iam::1:role/dev"}}, bob.Roles))
+	carol, err := s.Store.GetUser(ctx, "carol@example.com")
+	assert.NilError(t, err)
+	assert.Check(t, carol.BreakGlass)
+	_, err = s.Store.GetGroup(ctx, "old")
+	assert.Check(t, is.Equal(ErrNotFound, err))
+	synced, err := s.Store.GetGroup(ctx, "synced")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(synced.Members, 1))
+
+	// each difference is audited as the admin operation that makes it
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditAdmin, Actor: "cli:root"})
+	assert.NilError(t, err)
+	var ops []string
+	for _, event := range events {
+		ops = append(ops, event.Op)
+	}
+	assert.Check(t, is.DeepEqual([]string{
+		"apply",
+		"group.delete_group",
+		"group.add_role",
+		"group.add_member",
+		"group.add_member",
+		"group.create_group",
+		"add_break_glass",
+		"add_role",
+		"invite",
+		"add_role",
+		"delete_role",
+	}, ops))
+	assert.Check(t, is.Equal("arn:aws:iam::1:role/prod", events[10].Role))
+	assert.Check(t, is.Len(events[10].Before.Roles, 1))
+	assert.Check(t, is.Len(events[10].After.Roles, 0))
+
+	// applying again does nothing
+	changes, err = s.PlanAccess(ctx, file)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(changes, 0))
+
+	// roles must be in the catalog
+	file.Users[0].Roles = []RoleGrant{{Role: "nosuch"}}
+	_, err = s.PlanAccess(ctx, file)
+	assert.Check(t, is.ErrorContains(err, `unknown role "nosuch"`))
+
+	// synchronized groups belong to the directory
+	file.Users[0].Roles = nil
+	file.Groups = append(file.Groups, AccessFileGroup{ID: "synced"})
+	_, err = s.PlanAccess(ctx, file)
+	assert.Check(t, is.ErrorContains(err, "synchronized from google"))
+}
+
+func TestDriftAccess(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{})
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+	file := AccessFile{
+		Admins: []string{"admin"},
+		Users:  []AccessFileUser{{User: "bob@example.com", Roles: []RoleGrant{{Role: "dev"}}}},
+	}
+	_, err := s.ApplyAccess(ctx, "cli:root", file)
+	assert.NilError(t, err)
+	drifts, err := s.DriftAccess(ctx, file)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(drifts, 0))
+
+	token := newAPIToken(t, s, admin, ScopeAdminsWrite)
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "PUT", "/api/v1/users/bob@example.com/admin", map[string]bool{"admin": true}, token, nil)))
+
+	drifts, err = s.DriftAccess(ctx, file)
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(drifts, 1))
+	assert.Check(t, is.Equal("update user bob@example.com: -admin", drifts[0].Change.String()))
+	assert.Assert(t, is.Len(drifts[0].Events, 1))
+	assert.Check(t, is.Equal("admin", drifts[0].Events[0].Actor))
+	assert.Check(t, is.Equal("add_admin", drifts[0].Events[0].Op))
+	assert.Check(t, drifts[0].Events[0].APIToken != "")
+
+	path := filepath.Join(t.TempDir(), "access.json")
+	assert.NilError(t, os.WriteFile(path, []byte(`{"Admins": ["admin"], "Users": [{"User": "bob@example.com", "Roles": [{"Role": "dev"}]}]}`), 0600))
+	out, err := runAdmin(t, s, "drift "+path)
+	assert.Check(t, is.Equal(errDrift, err))
+	assert.Check(t, is.Contains(out, "Added admin to bob@example.com"))
+	_, err = runAdmin(t, s, "apply "+path)
+	assert.NilError(t, err)
+	out, err = runAdmin(t, s, "plan "+path)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("No changes.\n", out))
+
+	assert.NilError(t, os.WriteFile(path, []byte(`{"Admin": ["admin"]}`), 0600))
+	_, err = ReadAccessFile(path)
+	assert.Check(t, is.ErrorContains(err, `unknown field "Admin"`))
+
+	// access files may be YAML, with the same rules
+	path = filepath.Join(t.TempDir(), "access.yaml")
+	assert.NilError(t, os.WriteFile(path, []byte(`
+admins: [admin]
+users:
+  - user: bob@example.com
+    roles:
+      - role: dev
+        notAfter: 2030-01-02T03:04:05Z
+`), 0600))
+	yamlFile, err := ReadAccessFile(path)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"admin"}, yamlFile.Admins))
+	assert.Assert(t, is.Len(yamlFile.Users, 1))
+	assert.Check(t, is.Equal("dev", yamlFile.Users[0].Roles[0].Role))
+	assert.Check(t, is.Equal(2030, yamlFile.Users[0].Roles[0].NotAfter.Year()))
+	assert.NilError(t, os.WriteFile(path, []byte("admin: [admin]\n"), 0600))
+	_, err = ReadAccessFile(path)
+	assert.Check(t, is.ErrorContains(err, `unknown field "admin"`))
+}
+
+func TestApplyAccessAdminPromotion(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{})
+	sink := &WebhookSink{Config: WebhookConfig{AdminPromotion: true}}
+
+	_, err := s.ApplyAccess(ctx, "cli:root", AccessFile{Admins: []string{"alice@example.com"}})
+	assert.NilError(t, err)
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditAdmin})
+	assert.NilError(t, err)
+	var triggers []string
+	for _, event := range events {
+		if trigger := sink.trigger(event); trigger != "" {
+			triggers = append(triggers, trigger)
+		}
+	}
+	assert.Check(t, is.DeepEqual([]string{"admin_promotion"}, triggers))
+}
+
+func TestManagedAccess(t *testing.T) {
+	s, _ := newTestServer(t, Config{ManagedAccess: true})
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+	loginAs(t, s, User{ID: "bob", Admin: true})
+
+	w := do(s, "POST", "/admin/op", url.Values{"op": {"add_role"}, "user": {"bob"}, "role": {"dev"}}, admin)
+	assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+	w = do(s, "POST", "/admin/groups", url.Values{"op": {"create_group"}, "group": {"eng"}}, admin)
+	assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+
+	token := newAPIToken(t, s, admin, ScopeAdminsWrite)
+	assert.Check(t, is.Equal(http.StatusForbidden, doAPI(t, s, "PUT", "/api/v1/users/bob/admin", map[string]bool{"admin": false}, token, nil)))
+
+	// operational changes are still allowed
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"suspend_user"}, "user": {"bob"}, "reason": {"left"}}, admin)
+	assert.Check(t, is.Equal(http.StatusSeeOther, w.Code))
+}
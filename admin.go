@@ -1,78 +1,165 @@
 package tvm
 
 import (
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go/service/iam"
 	"html/template"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// go:embed admin.tmpl.html
+//go:embed admin.tmpl.html
 var adminTemplateStr string
 
 var adminTemplate = template.Must(template.New("admin").Parse(adminTemplateStr))
 
-func (s *Server) handleAdminRoot(w http.ResponseWriter, r *http.Request) {
-	s.serveAdminRoot(w,r,"")
+//go:embed admin_user.tmpl.html
+var adminUserTemplateStr string
+
+var adminUserTemplate = template.Must(template.New("admin_user").Parse(adminUserTemplateStr))
+
+var errUnknownOperation = errors.New("unknown operation")
+var errBadDuration = errors.New("cannot parse duration")
+
+// adminPageSize is the number of users shown on each page of the admin
+// overview.
+const adminPageSize = 50
+
+// adminRole is a role offered when granting roles: one in the catalog, found
+// by role discovery, or a standard role in the organization.
+type adminRole struct {
+	Role string
+
+	// Label is the role's alias or a description of it.
+	Label string
 }
 
-func (s *Server) handleAdminOp(w http.ResponseWriter, r *http.Request) {
-	if !s.isAuthorizedAdmin(r) {
-		http.Redirect(w,r,"/?format=admin", http.StatusFound)
-		return
+// adminRoles returns the roles to offer when granting roles, sorted.
+func (s *Server) adminRoles(ctx context.Context) []adminRole {
+	offered := map[string]string{}
+	for arn, role := range s.Config.Roles {
+		offered[arn] = role.Alias
+	}
+	if s.Config.RoleDiscovery.Enabled() {
+		for _, role := range s.DiscoveredRoles(ctx).Roles {
+			if _, ok := offered[role.ARN]; !ok {
+				offered[role.ARN] = ""
+			}
+		}
+	}
+	// The organization is listed on first use, which may fail; the accounts
+	// page reports why.
+	if organization, _ := s.Organization(ctx); organization != nil {
+		for _, name := range s.Config.Organization.StandardRoles {
+			for _, account := range organization.Accounts {
+				if _, ok := offered[account.RoleARN(name)]; !ok {
+					offered[account.RoleARN(name)] = fmt.Sprintf("%s in %s", name, account.Name)
+				}
+			}
+			for _, unit := range organization.Units {
+				offered[unit.Role(name)] = fmt.Sprintf("%s in every account under %s", name, unit.Path)
+			}
+		}
 	}
 
-	user, err := s.Store.GetUser(r.Context(), r.FormValue("user"))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	var roles []adminRole
+	for role, label := range offered {
+		roles = append(roles, adminRole{Role: role, Label: label})
 	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Role < roles[j].Role })
+	return roles
+}
 
-	var flash string
+// handleAdminRefreshRoles discovers roles again, for when they have changed
+// in IAM.
+func (s *Server) handleAdminRefreshRoles(w http.ResponseWriter, r *http.Request) {
+	if !s.isAuthorizedAdmin(r) {
+		http.Redirect(w, r, "/?format=admin", http.StatusFound)
+		return
+	}
+	s.RefreshDiscoveredRoles(r.Context())
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
 
-	switch r.FormValue("op") {
-	case "add_role":
-		user.Roles = append(user.Roles, r.FormValue("role"))
-		flash = fmt.Sprintf("Added role %s to %s", r.FormValue("role"), user.ID)
-	case "delete_role":
-		roles := user.Roles[:0]
-		for _, existingRole := range user.Roles {
-			if existingRole == r.FormValue("role") {
-				continue
-			}
-			roles = append(roles, existingRole)
-		}
-		user.Roles = roles
-		flash = fmt.Sprintf("Removed role %s from %s", r.FormValue("role"), user.ID)
-	case "delete_admin":
-		user.Admin = false
-		flash = fmt.Sprintf("Removed admin from %s", user.ID)
+func (s *Server) handleAdminRoot(w http.ResponseWriter, r *http.Request) {
+	s.serveAdminRoot(w, r, "")
+}
 
-	case "add_admin":
-		user.Admin = true
-		flash = fmt.Sprintf("Added admin to %s", user.ID)
+func (s *Server) handleAdminUser(w http.ResponseWriter, r *http.Request) {
+	if !s.isAuthorizedAdmin(r) {
+		http.Redirect(w, r, "/?format=admin", http.StatusFound)
+		return
+	}
+	s.serveAdminUser(w, r, pathParam(r, "id"), "")
+}
 
-	case "reset_devices":
-		user.U2FDevices = nil
-		flash = fmt.Sprintf("Reset devices for %s", user.ID)
+// adminUserPath returns the path of the admin page for the user with ID
+// userID.
+func adminUserPath(userID string) string {
+	return "/admin/users/" + url.PathEscape(userID)
+}
 
-	default:
-		http.Error(w, "unknown operation", http.StatusBadRequest)
+func (s *Server) handleAdminOp(w http.ResponseWriter, r *http.Request) {
+	admin := s.authorizedAdmin(r)
+	if admin == nil {
+		http.Redirect(w, r, "/?format=admin", http.StatusFound)
 		return
 	}
 
-	if err := s.Store.PutUser(r.Context(), *user); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	op := r.FormValue("op")
+	change := userChange{
+		Op:      op,
+		Role:    r.FormValue("role"),
+		Reason:  r.FormValue("reason"),
+		Device:  r.FormValue("device"),
+		Confirm: r.FormValue("confirm"),
+	}
+	userID := r.FormValue("user")
+	var err error
+	if op != "invite" {
+		userID, err = s.formUserID(r)
+	}
+	if err == nil && op == "add_role" {
+		change.Grant, err = grantFromForm(r)
+	}
+	var flash string
+	if err == nil {
+		flash, err = s.changeUser(r.Context(), r, adminActor{UserID: admin.ID}, userID, change)
+	}
+	if err != nil {
+		adminFormError(w, err)
 		return
 	}
 
-	s.serveAdminRoot(w, r, flash)
+	switch op {
+	case "delete_user":
+		http.Redirect(w, r, "/admin", http.StatusSeeOther)
+	case "invite":
+		http.Redirect(w, r, adminUserPath(strings.ToLower(strings.TrimSpace(userID))), http.StatusSeeOther)
+	case "suspend_user", "unsuspend_user":
+		http.Redirect(w, r, adminUserPath(userID), http.StatusSeeOther)
+	default:
+		s.serveAdminUser(w, r, userID, flash)
+	}
+}
+
+// matchesUserQuery returns true if q is empty or appears in the user's ID or
+// email address, ignoring case.
+func matchesUserQuery(user User, q string) bool {
+	q = strings.ToLower(q)
+	return strings.Contains(strings.ToLower(user.ID), q) ||
+		strings.Contains(strings.ToLower(user.PrimaryEmail()), q)
 }
 
 func (s *Server) serveAdminRoot(w http.ResponseWriter, r *http.Request, flash string) {
 	if !s.isAuthorizedAdmin(r) {
-		http.Redirect(w,r,"/?format=admin", http.StatusFound)
+		http.Redirect(w, r, "/?format=admin", http.StatusFound)
 		return
 	}
 
@@ -81,45 +168,187 @@ func (s *Server) serveAdminRoot(w http.ResponseWriter, r *http.Request, flash st
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].PrimaryEmail() != users[j].PrimaryEmail() {
+			return users[i].PrimaryEmail() < users[j].PrimaryEmail()
+		}
+		return users[i].ID < users[j].ID
+	})
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	var matched []User
+	for _, user := range users {
+		if matchesUserQuery(user, q) {
+			matched = append(matched, user)
+		}
+	}
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	start := (page - 1) * adminPageSize
+	if start > len(matched) {
+		start = len(matched)
+	}
+	end := start + adminPageSize
+	if end > len(matched) {
+		end = len(matched)
+	}
+	pageURL := func(page int) string {
+		v := url.Values{"page": {strconv.Itoa(page)}}
+		if q != "" {
+			v.Set("q", q)
+		}
+		return "/admin?" + v.Encode()
+	}
+	var prevPage, nextPage string
+	if page > 1 {
+		prevPage = pageURL(page - 1)
+	}
+	if end < len(matched) {
+		nextPage = pageURL(page + 1)
+	}
+
+	groups, err := s.Store.ListGroups(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+
+	var pending []User
+	for _, user := range users {
+		if user.Status == UserPending {
+			pending = append(pending, user)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].StatusTime.Before(pending[j].StatusTime) })
 
-	var roles []string
-	iamSvc := iam.New(nil)
-	if err := iamSvc.ListRolesPagesWithContext(r.Context(), &iam.ListRolesInput{}, func(output *iam.ListRolesOutput, b bool) bool {
-		for _, x := range output.Roles {
-			roles = append(roles, *x.Arn)
+	reviews, err := s.Store.ListReviewItems(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var openReviews []ReviewItem
+	for _, item := range reviews {
+		if item.Status == ReviewOpen {
+			openReviews = append(openReviews, item)
 		}
-		return true
-	}); err != nil {
+	}
+	sort.Slice(openReviews, func(i, j int) bool { return openReviews[i].Created.Before(openReviews[j].Created) })
+
+	tokens, err := s.Store.ListAPITokens(r.Context())
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+
+	var discovery *RoleDiscovery
+	if s.Config.RoleDiscovery.Enabled() {
+		d := s.DiscoveredRoles(r.Context())
+		discovery = &d
+	}
 
 	args := struct {
-		Roles []string
-		Users []User
-		Flash string
+		Roles         []adminRole
+		Discovery     *RoleDiscovery
+		Users         []User
+		Shown         []User
+		Matched       int
+		Page          int
+		PrevPage      string
+		NextPage      string
+		Query         string
+		Pending       []User
+		Groups        []Group
+		Reviews       []ReviewItem
+		Tokens        []APIToken
+		Scopes        []APIScope
+		Flash         string
+		ManagedAccess bool
 	}{
-		Roles: roles,
-		Users: users,
-		Flash: flash,
+		Roles:         s.adminRoles(r.Context()),
+		Discovery:     discovery,
+		Users:         users,
+		Shown:         matched[start:end],
+		Matched:       len(matched),
+		Page:          page,
+		PrevPage:      prevPage,
+		NextPage:      nextPage,
+		Query:         q,
+		Pending:       pending,
+		Groups:        groups,
+		Reviews:       openReviews,
+		Tokens:        tokens,
+		Scopes:        apiScopes,
+		Flash:         flash,
+		ManagedAccess: s.Config.ManagedAccess,
 	}
 
 	adminTemplate.Execute(w, args)
 }
 
-func (s *Server) isAuthorizedAdmin(r *http.Request) bool {
-	cookie, err := r.Cookie("session")
-	if err != nil {
-		return false
+// serveAdminUser shows the admin page for the user with ID userID.
+func (s *Server) serveAdminUser(w http.ResponseWriter, r *http.Request, userID string, flash string) {
+	user, err := s.lookupUser(r.Context(), userID)
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	session, err := s.Store.GetSession(r.Context(), cookie.Value)
+	groups, err := s.Store.ListGroups(r.Context())
 	if err != nil {
-		return false
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	user, err := s.Store.GetUser(r.Context(), session.UserID)
-	if err != nil {
-		return false
+	var memberOf []Group
+	for _, group := range groups {
+		for _, member := range group.Members {
+			if member == user.ID {
+				memberOf = append(memberOf, group)
+				break
+			}
+		}
+	}
+	sort.Slice(memberOf, func(i, j int) bool { return memberOf[i].ID < memberOf[j].ID })
+
+	args := struct {
+		User           User
+		Groups         []Group
+		EffectiveRoles []EffectiveRole
+		Roles          []adminRole
+		ApprovalRoles  []string
+		Flash          string
+		ManagedAccess  bool
+	}{
+		User:           *user,
+		Groups:         memberOf,
+		EffectiveRoles: EffectiveRoles(*user, groups, time.Now()),
+		Roles:          s.adminRoles(r.Context()),
+		ApprovalRoles:  s.Config.approvalRoles(),
+		Flash:          flash,
+		ManagedAccess:  s.Config.ManagedAccess,
+	}
+
+	adminUserTemplate.Execute(w, args)
+}
+
+func (s *Server) isAuthorizedAdmin(r *http.Request) bool {
+	return s.authorizedAdmin(r) != nil
+}
+
+// authorizedAdmin returns the admin user making the request r, or nil if
+// the request is not from an admin who has logged in and signed with their
+// key.
+func (s *Server) authorizedAdmin(r *http.Request) *User {
+	user := s.currentUser(r)
+	if user == nil || !user.Admin {
+		return nil
 	}
-	return user.Admin
+	return user
 }
@@ -0,0 +1,88 @@
+package tvm
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+)
+
+//go:embed admin_accounts.tmpl.html
+var adminAccountsTemplateStr string
+
+var adminAccountsTemplate = template.Must(template.New("admin_accounts").Parse(adminAccountsTemplateStr))
+
+// handleAdminAccounts shows the accounts in the organization and the ARN of
+// each standard role in each, and the organization roles that grant a
+// standard role in every account under a root or organizational unit.
+func (s *Server) handleAdminAccounts(w http.ResponseWriter, r *http.Request) {
+	if !s.isAuthorizedAdmin(r) {
+		http.Redirect(w, r, "/?format=admin", http.StatusFound)
+		return
+	}
+
+	organization, err := s.Organization(r.Context())
+	var problem string
+	if err != nil {
+		problem = err.Error()
+	}
+
+	type accountRow struct {
+		OrganizationAccount
+		RoleARNs []string
+	}
+	type unitRow struct {
+		OrganizationalUnit
+		Roles    []string
+		Accounts int
+	}
+	var accounts []accountRow
+	var units []unitRow
+	if organization != nil {
+		for _, account := range organization.Accounts {
+			row := accountRow{OrganizationAccount: account}
+			for _, name := range s.Config.Organization.StandardRoles {
+				row.RoleARNs = append(row.RoleARNs, account.RoleARN(name))
+			}
+			accounts = append(accounts, row)
+		}
+		for _, unit := range organization.Units {
+			row := unitRow{OrganizationalUnit: unit, Accounts: len(organization.AccountsUnder(unit.ID))}
+			for _, name := range s.Config.Organization.StandardRoles {
+				row.Roles = append(row.Roles, unit.Role(name))
+			}
+			units = append(units, row)
+		}
+	}
+
+	args := struct {
+		Configured    bool
+		Organization  *Organization
+		Problem       string
+		StandardRoles []string
+		Accounts      []accountRow
+		Units         []unitRow
+	}{
+		Configured:    s.Organizations != nil,
+		Organization:  organization,
+		Problem:       problem,
+		StandardRoles: s.Config.Organization.StandardRoles,
+		Accounts:      accounts,
+		Units:         units,
+	}
+
+	adminAccountsTemplate.Execute(w, args)
+}
+
+// handleAdminRefreshAccounts lists the organization again, for when accounts
+// have been added or moved.
+func (s *Server) handleAdminRefreshAccounts(w http.ResponseWriter, r *http.Request) {
+	if !s.isAuthorizedAdmin(r) {
+		http.Redirect(w, r, "/?format=admin", http.StatusFound)
+		return
+	}
+	if err := s.RefreshOrganization(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, "/admin/accounts", http.StatusSeeOther)
+}
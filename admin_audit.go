@@ -0,0 +1,153 @@
+package tvm
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed admin_audit.tmpl.html
+var adminAuditTemplateStr string
+
+var adminAuditTemplate = template.Must(template.New("admin_audit").Parse(adminAuditTemplateStr))
+
+// defaultAuditPageLimit is the number of events shown on the audit page
+// when the request does not specify a limit. Exports are not limited.
+const defaultAuditPageLimit = 500
+
+func (s *Server) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if !s.isAuthorizedAdmin(r) {
+		http.Redirect(w, r, "/?format=admin", http.StatusFound)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	filter, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if format == "" && filter.Limit == 0 {
+		filter.Limit = defaultAuditPageLimit
+	}
+
+	events, err := s.Store.ListAuditEvents(r.Context(), filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.json"`)
+		if events == nil {
+			events = []AuditEvent{}
+		}
+		json.NewEncoder(w).Encode(events)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+		writeAuditCSV(w, events)
+	case "":
+		args := struct {
+			Types  []AuditEventType
+			Filter url.Values
+			Events []AuditEvent
+			Limit  int
+		}{
+			Types:  auditEventTypes,
+			Filter: r.URL.Query(),
+			Events: events,
+			Limit:  filter.Limit,
+		}
+		adminAuditTemplate.Execute(w, args)
+	default:
+		http.Error(w, "unknown format", http.StatusBadRequest)
+	}
+}
+
+// parseAuditFilter builds an AuditFilter from query parameters. Times may be
+// given as RFC 3339 timestamps or as dates.
+func parseAuditFilter(query url.Values) (AuditFilter, error) {
+	filter := AuditFilter{
+		Type:    AuditEventType(query.Get("type")),
+		Actor:   query.Get("actor"),
+		Subject: query.Get("subject"),
+		Role:    query.Get("role"),
+	}
+
+	var err error
+	if filter.Since, err = parseAuditTime(query.Get("since")); err != nil {
+		return filter, fmt.Errorf("cannot parse since: %s", err)
+	}
+	if filter.Until, err = parseAuditTime(query.Get("until")); err != nil {
+		return filter, fmt.Errorf("cannot parse until: %s", err)
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			return filter, fmt.Errorf("cannot parse limit: %s", err)
+		}
+	}
+	return filter, nil
+}
+
+func parseAuditTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// csvCell returns s, which comes from a user, as a CSV cell that
+// spreadsheets will not evaluate. A cell that begins with =, +, - or @ is
+// read as a formula.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func writeAuditCSV(w http.ResponseWriter, events []AuditEvent) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"ID", "Time", "Type", "Actor", "Subject", "Op", "Role",
+		"DurationSeconds", "AccessKeyID", "SourceIP", "UserAgent", "Before",
+		"After", "Message", "Reason", "Ticket", "Severity", "Group", "APIToken"})
+	for _, event := range events {
+		before, _ := json.Marshal(event.Before)
+		after, _ := json.Marshal(event.After)
+		cw.Write([]string{
+			event.ID,
+			event.Time.Format(time.RFC3339),
+			string(event.Type),
+			csvCell(event.Actor),
+			csvCell(event.Subject),
+			event.Op,
+			event.Role,
+			strconv.Itoa(event.DurationSeconds),
+			event.AccessKeyID,
+			event.SourceIP,
+			csvCell(event.UserAgent),
+			string(before),
+			string(after),
+			csvCell(event.Message),
+			csvCell(event.Reason),
+			csvCell(event.Ticket),
+			string(event.Severity),
+			csvCell(event.Group),
+			event.APIToken,
+		})
+	}
+	cw.Flush()
+}
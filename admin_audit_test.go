@@ -0,0 +1,101 @@
+package tvm
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestAdminAudit(t *testing.T) {
+	tempdir, err := os.MkdirTemp("", "")
+	assert.Check(t, err)
+	defer os.RemoveAll(tempdir)
+
+	ctx := context.Background()
+
+	s, err := NewServer(Config{})
+	assert.Check(t, err)
+	s.Store = LocalStore{Path: tempdir}
+
+	err = s.Store.PutUser(ctx, User{ID: "adminuser", Admin: true})
+	assert.Check(t, err)
+	err = s.Store.PutUser(ctx, User{ID: "userid"})
+	assert.Check(t, err)
+	err = s.Store.PutSession(ctx, Session{ID: "sessionid", UserID: "adminuser", U2F: true})
+	assert.Check(t, err)
+	err = s.Store.PutSession(ctx, Session{ID: "nonadminsessionid", UserID: "userid", U2F: true})
+	assert.Check(t, err)
+
+	now := time.Now()
+	for _, event := range []AuditEvent{
+		{ID: "1", Time: now.Add(-3 * time.Minute), Type: AuditLogin, Actor: "userid"},
+		{ID: "2", Time: now.Add(-2 * time.Minute), Type: AuditCredentialsIssue, Actor: "userid", Role: "myrole", AccessKeyID: "AKIAEXAMPLE",
+			Reason: `=HYPERLINK("https://evil.example")`, UserAgent: "curl"},
+		{ID: "3", Time: now.Add(-1 * time.Minute), Type: AuditAdmin, Actor: "adminuser", Subject: "userid", Op: "add_admin",
+			Before: &AuditUserState{}, After: &AuditUserState{Admin: true}},
+	} {
+		err = s.Store.PutAuditEvent(ctx, event)
+		assert.Check(t, err)
+	}
+
+	get := func(path, session string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.AddCookie(&http.Cookie{Name: "session", Value: session})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("requires admin", func(t *testing.T) {
+		w := get("/admin/audit", "nonadminsessionid")
+		assert.Equal(t, http.StatusFound, w.Code)
+		assert.Equal(t, "/?format=admin", w.Header().Get("Location"))
+	})
+
+	t.Run("page", func(t *testing.T) {
+		w := get("/admin/audit?actor=userid", "sessionid")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Check(t, is.Contains(w.Body.String(), "AKIAEXAMPLE"))
+		assert.Check(t, !strings.Contains(w.Body.String(), "add_admin"))
+	})
+
+	t.Run("json", func(t *testing.T) {
+		w := get("/admin/audit?format=json", "sessionid")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var events []AuditEvent
+		err := json.Unmarshal(w.Body.Bytes(), &events)
+		assert.Check(t, err)
+		assert.Assert(t, is.Len(events, 3))
+		assert.Check(t, is.Equal("3", events[0].ID))
+		assert.Check(t, events[0].After.Admin)
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		w := get("/admin/audit?format=csv&type=credentials.issue", "sessionid")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+
+		records, err := csv.NewReader(w.Body).ReadAll()
+		assert.Check(t, err)
+		assert.Assert(t, is.Len(records, 2))
+		assert.Check(t, is.Equal("AccessKeyID", records[0][8]))
+		assert.Check(t, is.Equal("AKIAEXAMPLE", records[1][8]))
+		assert.Check(t, is.Equal("curl", records[1][10]))
+		assert.Check(t, is.Equal(`'=HYPERLINK("https://evil.example")`, records[1][14]))
+	})
+
+	t.Run("bad filter", func(t *testing.T) {
+		w := get("/admin/audit?since=yesterday", "sessionid")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
@@ -3,6 +3,7 @@ package tvm
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"gotest.tools/golden"
 	"net/http"
 	"net/http/httptest"
@@ -11,6 +12,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/tstranex/u2f"
 	"gotest.tools/assert"
 	is "gotest.tools/assert/cmp"
 )
@@ -22,14 +24,38 @@ func TestAdmin(t *testing.T) {
 
 	ctx := context.Background()
 
-	s, err := NewServer(Config{})
+	s, err := NewServer(Config{Roles: map[string]RoleConfig{
+		"arn:aws:iam::1:role/dev":  {Alias: "dev"},
+		"arn:aws:iam::1:role/prod": {},
+	}})
 	assert.Check(t, err)
 	s.Store = LocalStore{Path: tempdir}
 
 	err = s.Store.PutUser(ctx, User{ID: "userid", Admin: true})
 	assert.Check(t, err)
-	err = s.Store.PutSession(ctx, Session{ID: "sessionid", UserID: "userid"})
+	err = s.Store.PutSession(ctx, Session{ID: "sessionid", UserID: "userid", U2F: true})
+	assert.Check(t, err)
+	err = s.Store.PutUser(ctx, User{
+		ID:         "accounts.google.com:2",
+		Issuer:     googleIssuer,
+		Subject:    "2",
+		Email:      "bob@example.com",
+		Roles:      []RoleGrant{{Role: "arn:aws:iam::1:role/dev"}},
+		U2FDevices: []U2FDevice{{Counter: 7}},
+	})
+	assert.Check(t, err)
+	err = s.Store.PutUser(ctx, User{ID: "carol@example.com", Email: "carol@example.com"})
 	assert.Check(t, err)
+	err = s.Store.PutGroup(ctx, Group{ID: "eng", Members: []string{"accounts.google.com:2"}, Roles: []RoleGrant{{Role: "arn:aws:iam::1:role/prod"}}})
+	assert.Check(t, err)
+
+	get := func(t *testing.T, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.AddCookie(&http.Cookie{Name: "session", Value: "sessionid"})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
 
 	t.Run("authenticated", func(t *testing.T) {
 		r := httptest.NewRequest("GET", "/admin", nil)
@@ -47,6 +73,35 @@ func TestAdmin(t *testing.T) {
 		golden.Assert(t, string(buf.Bytes()), "authenticated")
 	})
 
+	t.Run("search", func(t *testing.T) {
+		w := get(t, "/admin?q=BOB")
+		assert.Equal(t, 200, w.Code)
+		golden.Assert(t, w.Body.String(), "admin_search")
+	})
+
+	t.Run("user", func(t *testing.T) {
+		w := get(t, "/admin/users/accounts.google.com:2")
+		assert.Equal(t, 200, w.Code)
+		golden.Assert(t, w.Body.String(), "admin_user")
+	})
+
+	t.Run("unbound user", func(t *testing.T) {
+		w := get(t, "/admin/users/carol@example.com")
+		assert.Equal(t, 200, w.Code)
+		golden.Assert(t, w.Body.String(), "admin_user_unbound")
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		w := get(t, "/admin/users/nosuch")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("audit", func(t *testing.T) {
+		w := get(t, "/admin/audit")
+		assert.Equal(t, 200, w.Code)
+		golden.Assert(t, w.Body.String(), "admin_audit")
+	})
+
 	t.Run("requires auth", func(t *testing.T) {
 		r := httptest.NewRequest("GET", "/admin", nil)
 		r.AddCookie(&http.Cookie{
@@ -99,7 +154,7 @@ func TestAdminOp(t *testing.T) {
 	assert.Check(t, err)
 	err = s.Store.PutUser(ctx, User{ID: "adminuser", Admin: true})
 	assert.Check(t, err)
-	err = s.Store.PutSession(ctx, Session{ID: "sessionid", UserID: "adminuser"})
+	err = s.Store.PutSession(ctx, Session{ID: "sessionid", UserID: "adminuser", U2F: true})
 	assert.Check(t, err)
 
 	t.Run("requires auth", func(t *testing.T) {
@@ -119,7 +174,7 @@ func TestAdminOp(t *testing.T) {
 	})
 
 	t.Run("requires admin", func(t *testing.T) {
-		err = s.Store.PutSession(ctx, Session{ID: "nonadminsessionid", UserID: "userid"})
+		err = s.Store.PutSession(ctx, Session{ID: "nonadminsessionid", UserID: "userid", U2F: true})
 		assert.Check(t, err)
 
 		r := httptest.NewRequest("POST", "/admin/op", nil)
@@ -145,6 +200,7 @@ func TestAdminOp(t *testing.T) {
 				"user": {"userid"},
 				"role": {"myrole"},
 			}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		r.AddCookie(&http.Cookie{Name:  "session", Value: "sessionid"})
 
 		w := httptest.NewRecorder()
@@ -156,7 +212,7 @@ func TestAdminOp(t *testing.T) {
 
 		newUser, err := s.Store.GetUser(ctx, "userid")
 		assert.Check(t, err)
-		assert.Equal(t, newUser.Roles, []string{"myrole"})
+		assert.DeepEqual(t, newUser.Roles, []RoleGrant{{Role: "myrole"}})
 	})
 
 
@@ -167,6 +223,7 @@ func TestAdminOp(t *testing.T) {
 				"user": {"userid"},
 				"role": {"myrole"},
 			}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		r.AddCookie(&http.Cookie{Name:  "session", Value: "sessionid"})
 
 		w := httptest.NewRecorder()
@@ -178,7 +235,7 @@ func TestAdminOp(t *testing.T) {
 
 		newUser, err := s.Store.GetUser(ctx, "userid")
 		assert.Check(t, err)
-		assert.Equal(t, newUser.Roles, []string{})
+		assert.Check(t, is.Len(newUser.Roles, 0))
 	})
 
 	t.Run("add_admin", func(t *testing.T) {
@@ -187,6 +244,7 @@ func TestAdminOp(t *testing.T) {
 				"op": {"add_admin"},
 				"user": {"userid"},
 			}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		r.AddCookie(&http.Cookie{Name:  "session", Value: "sessionid"})
 
 		w := httptest.NewRecorder()
@@ -206,6 +264,7 @@ func TestAdminOp(t *testing.T) {
 				"op": {"delete_admin"},
 				"user": {"userid"},
 			}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		r.AddCookie(&http.Cookie{Name:  "session", Value: "sessionid"})
 
 		w := httptest.NewRecorder()
@@ -226,6 +285,7 @@ func TestAdminOp(t *testing.T) {
 				"op": {"reset_devices"},
 				"user": {"userid"},
 			}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		r.AddCookie(&http.Cookie{Name:  "session", Value: "sessionid"})
 
 		w := httptest.NewRecorder()
@@ -246,6 +306,7 @@ func TestAdminOp(t *testing.T) {
 				"op": {"unknown_operation"},
 				"user": {"userid"},
 			}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		r.AddCookie(&http.Cookie{Name:  "session", Value: "sessionid"})
 
 		w := httptest.NewRecorder()
@@ -261,6 +322,7 @@ func TestAdminOp(t *testing.T) {
 				"op": {"delete_admin"},
 				"user": {"baduserid"},
 			}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		r.AddCookie(&http.Cookie{Name:  "session", Value: "sessionid"})
 
 		w := httptest.NewRecorder()
@@ -270,4 +332,62 @@ func TestAdminOp(t *testing.T) {
 		w.Result().Write(buf)
 		assert.Equal(t, 400, w.Code)
 	})
-}
\ No newline at end of file
+}
+
+func TestAdminPagination(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{})
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+	for i := 0; i < adminPageSize+5; i++ {
+		assert.NilError(t, s.Store.PutUser(ctx, User{ID: fmt.Sprintf("user%02d@example.com", i)}))
+	}
+
+	w := do(s, "GET", "/admin", nil, admin)
+	assert.Check(t, is.Contains(w.Body.String(), "56 users, page 1."))
+	assert.Check(t, is.Contains(w.Body.String(), `<a href="/admin?page=2">Next</a>`))
+	assert.Check(t, is.Contains(w.Body.String(), "user48@example.com"))
+	assert.Check(t, !strings.Contains(w.Body.String(), "user49@example.com"))
+
+	w = do(s, "GET", "/admin?page=2", nil, admin)
+	assert.Check(t, is.Contains(w.Body.String(), `<a href="/admin?page=1">Previous</a>`))
+	assert.Check(t, is.Contains(w.Body.String(), "user54@example.com"))
+	assert.Check(t, !strings.Contains(w.Body.String(), "user48@example.com"))
+	assert.Check(t, !strings.Contains(w.Body.String(), "Next"))
+
+	w = do(s, "GET", "/admin?q=user5", nil, admin)
+	assert.Check(t, is.Contains(w.Body.String(), "5 users, page 1."))
+}
+
+func TestAdminUserOps(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{})
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+	devices := []U2FDevice{
+		{Registration: u2f.Registration{KeyHandle: []byte("one")}},
+		{Registration: u2f.Registration{KeyHandle: []byte("two")}},
+	}
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "bob", U2FDevices: devices}))
+
+	w := do(s, "POST", "/admin/op", url.Values{"op": {"remove_device"}, "user": {"bob"}, "device": {devices[0].ID()}}, admin)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.Contains(w.Body.String(), "Removed device "+devices[0].ID()+" from bob"))
+	bob, err := s.Store.GetUser(ctx, "bob")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(devices[1:], bob.U2FDevices))
+
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"remove_device"}, "user": {"bob"}, "device": {devices[0].ID()}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+
+	// admins can add users before they first log in
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"invite"}, "user": {"Carol@example.com"}}, admin)
+	assert.Check(t, is.Equal(http.StatusSeeOther, w.Code))
+	assert.Check(t, is.Equal("/admin/users/carol@example.com", w.Header().Get("Location")))
+	_, err = s.Store.GetUser(ctx, "carol@example.com")
+	assert.NilError(t, err)
+
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"delete_user"}, "user": {"carol@example.com"}, "confirm": {"carol@example.com"}}, admin)
+	assert.Check(t, is.Equal(http.StatusSeeOther, w.Code))
+	assert.Check(t, is.Equal("/admin", w.Header().Get("Location")))
+	_, err = s.Store.GetUser(ctx, "carol@example.com")
+	assert.Check(t, is.Equal(ErrNotFound, err))
+}
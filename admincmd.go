@@ -0,0 +1,478 @@
+package tvm
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// RunAdminCommand runs a `tvm admin` subcommand, given as args, directly
+// against s.Store, writing its output to w. It is for operators with
+// access to the store, and so needs no admin user; changes are audited as
+// actor. RunAdminCommand does not use s.Mux, s.STS or s.OAuth2.
+func (s *Server) RunAdminCommand(ctx context.Context, w io.Writer, actor string, args []string) error {
+	if len(args) == 0 {
+		return errAdminUsage
+	}
+	cmd := adminCommand{Server: s, W: w, Actor: adminActor{UserID: actor}}
+	switch args[0] {
+	case "bootstrap":
+		return cmd.bootstrap(ctx, args[1:])
+	case "user":
+		if len(args) < 2 {
+			return errAdminUsage
+		}
+		return cmd.user(ctx, args[1], args[2:])
+	case "session":
+		if len(args) < 2 {
+			return errAdminUsage
+		}
+		return cmd.session(ctx, args[1], args[2:])
+	case "plan", "apply", "drift":
+		return cmd.access(ctx, args[0], args[1:])
+	case "roles":
+		if len(args) < 2 {
+			return errAdminUsage
+		}
+		return cmd.roles(ctx, args[1], args[2:])
+	default:
+		return errAdminUsage
+	}
+}
+
+var errAdminUsage = errors.New(`usage:
+  tvm admin bootstrap [-lifetime 24h] <email>
+  tvm admin plan <access-file>
+  tvm admin apply <access-file>
+  tvm admin drift <access-file>
+  tvm admin user list [-email <email>]
+  tvm admin user show <user>
+  tvm admin user grant [-duration <duration>] <user> <role>
+  tvm admin user revoke <user> <role>
+  tvm admin user promote <user>
+  tvm admin user demote <user>
+  tvm admin user add-approver <user> <role>
+  tvm admin user remove-approver <user> <role>
+  tvm admin user reset-devices <user>
+  tvm admin user delete <user>
+  tvm admin session list [-user <user>]
+  tvm admin session revoke <session>
+  tvm admin roles check
+  tvm admin roles discover
+  tvm admin roles accounts
+  tvm admin roles trust-policy [-principal <arn>] <role>
+
+Users may be given by ID or email address. Roles may be given by ARN or alias.`)
+
+type adminCommand struct {
+	*Server
+	W     io.Writer
+	Actor adminActor
+}
+
+// parse parses the flags in fs from args and returns the remaining n
+// arguments.
+func (c adminCommand) parse(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("%s: %w", fs.Name(), err)
+	}
+	if fs.NArg() != n {
+		return nil, errAdminUsage
+	}
+	return fs.Args(), nil
+}
+
+func (c adminCommand) bootstrap(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+	lifetime := fs.Duration("lifetime", 24*time.Hour, "How long the enrollment code is valid for")
+	args, err := c.parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	code, err := c.Bootstrap(ctx, c.Actor.UserID, args[0], *lifetime)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.W, "%s will become an admin when they log in with enrollment code\n\n  %s\n\n", args[0], code)
+	if c.Config.RootURL.Host != "" {
+		fmt.Fprintf(c.W, "Send them this link:\n\n  %s\n\n", c.Config.EnrollmentURL(code))
+	}
+	fmt.Fprintf(c.W, "The code expires at %s.\n", time.Now().Add(*lifetime).Format(time.RFC3339))
+	return nil
+}
+
+func (c adminCommand) user(ctx context.Context, sub string, args []string) error {
+	if sub == "list" {
+		return c.listUsers(ctx, args)
+	}
+
+	fs := flag.NewFlagSet(sub, flag.ContinueOnError)
+	var change userChange
+	n := 1
+	switch sub {
+	case "show":
+	case "grant":
+		n = 2
+		change.Op = "add_role"
+	case "revoke":
+		n = 2
+		change.Op = "delete_role"
+	case "promote":
+		change.Op = "add_admin"
+	case "demote":
+		change.Op = "delete_admin"
+	case "add-approver":
+		n = 2
+		change.Op = "add_approver"
+	case "remove-approver":
+		n = 2
+		change.Op = "delete_approver"
+	case "reset-devices":
+		change.Op = "reset_devices"
+	case "delete":
+		change.Op = "delete_user"
+	default:
+		return errAdminUsage
+	}
+	duration := fs.Duration("duration", 0, "How long the role grant lasts. Zero means permanently")
+	args, err := c.parse(fs, args, n)
+	if err != nil {
+		return err
+	}
+
+	user, err := c.lookupUser(ctx, args[0])
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+	if sub == "show" {
+		return c.showUser(ctx, *user)
+	}
+
+	if n == 2 {
+		change.Role = args[1]
+		if role, ok := c.Config.resolveRole(args[1]); ok {
+			change.Role = role
+		}
+		change.Grant = RoleGrant{Role: change.Role}
+		if *duration < 0 {
+			return errBadDuration
+		}
+		if *duration > 0 {
+			change.Grant.NotAfter = time.Now().Add(*duration)
+		}
+	}
+	// The operator named the user to delete on the command line, which is
+	// confirmation enough.
+	change.Confirm = args[0]
+
+	flash, err := c.changeUser(ctx, nil, c.Actor, user.ID, change)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.W, flash)
+	return nil
+}
+
+func (c adminCommand) listUsers(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	email := fs.String("email", "", "Only list users with this email address")
+	if _, err := c.parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	users, err := c.Store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].PrimaryEmail() < users[j].PrimaryEmail() })
+
+	tw := tabwriter.NewWriter(c.W, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tEMAIL\tSTATUS\tADMIN\tROLES")
+	for _, user := range users {
+		if *email != "" && !strings.EqualFold(*email, user.PrimaryEmail()) {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%d\n", user.ID, user.PrimaryEmail(), userStatusString(user), user.Admin, len(user.Roles))
+	}
+	return tw.Flush()
+}
+
+func (c adminCommand) showUser(ctx context.Context, user User) error {
+	groups, err := c.Store.ListGroups(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(c.W, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID:\t%s\n", user.ID)
+	fmt.Fprintf(tw, "Email:\t%s\n", user.PrimaryEmail())
+	fmt.Fprintf(tw, "Status:\t%s\n", userStatusString(user))
+	if user.StatusReason != "" {
+		fmt.Fprintf(tw, "Reason:\t%s\n", user.StatusReason)
+	}
+	fmt.Fprintf(tw, "Admin:\t%v\n", user.Admin)
+	fmt.Fprintf(tw, "Break glass:\t%v\n", user.BreakGlass)
+	for _, role := range user.ApproverFor {
+		fmt.Fprintf(tw, "Approver for:\t%s\n", role)
+	}
+	fmt.Fprintf(tw, "Devices:\t%d\n", len(user.U2FDevices))
+	for _, grant := range user.Roles {
+		fmt.Fprintf(tw, "Grant:\t%s\n", grant)
+	}
+	for _, role := range EffectiveRoles(user, groups, time.Now()) {
+		fmt.Fprintf(tw, "Role:\t%s\n", role)
+	}
+	return tw.Flush()
+}
+
+func userStatusString(user User) string {
+	if user.Active() {
+		return "active"
+	}
+	return string(user.Status)
+}
+
+func (c adminCommand) session(ctx context.Context, sub string, args []string) error {
+	switch sub {
+	case "list":
+		fs := flag.NewFlagSet("list", flag.ContinueOnError)
+		userFlag := fs.String("user", "", "Only list this user's sessions")
+		if _, err := c.parse(fs, args, 0); err != nil {
+			return err
+		}
+		userID := *userFlag
+		if userID != "" {
+			user, err := c.lookupUser(ctx, userID)
+			if err != nil {
+				return fmt.Errorf("%s: %w", userID, err)
+			}
+			userID = user.ID
+		}
+
+		sessions, err := c.Store.ListSessions(ctx)
+		if err != nil {
+			return err
+		}
+		sort.Slice(sessions, func(i, j int) bool { return sessions[i].UserID < sessions[j].UserID })
+		tw := tabwriter.NewWriter(c.W, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "SESSION\tUSER\tAUTHENTICATED\tEXPIRES")
+		for _, session := range sessions {
+			if session.UserID == "" || (userID != "" && session.UserID != userID) {
+				continue
+			}
+			expires := "never"
+			if !session.Expires.IsZero() {
+				expires = session.Expires.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%v\t%s\n", sessionHandle(session.ID), session.UserID, session.U2F, expires)
+		}
+		return tw.Flush()
+
+	case "revoke":
+		args, err := c.parse(flag.NewFlagSet("revoke", flag.ContinueOnError), args, 1)
+		if err != nil {
+			return err
+		}
+		sessions, err := c.Store.ListSessions(ctx)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			if sessionHandle(session.ID) == args[0] {
+				flash, err := c.revokeSession(ctx, nil, c.Actor, session)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(c.W, flash)
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: %w", args[0], ErrNotFound)
+
+	default:
+		return errAdminUsage
+	}
+}
+
+// errDrift is returned by drift when the store does not match the access
+// file, so that the command fails.
+var errDrift = errors.New("the store has drifted from the access file")
+
+func (c adminCommand) access(ctx context.Context, sub string, args []string) error {
+	args, err := c.parse(flag.NewFlagSet(sub, flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	file, err := ReadAccessFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "plan":
+		changes, err := c.PlanAccess(ctx, *file)
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			fmt.Fprintln(c.W, "No changes.")
+		}
+		for _, change := range changes {
+			fmt.Fprintln(c.W, change)
+		}
+		return nil
+
+	case "apply":
+		changes, err := c.ApplyAccess(ctx, c.Actor.UserID, *file)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			fmt.Fprintln(c.W, change)
+		}
+		fmt.Fprintf(c.W, "Applied %d changes.\n", len(changes))
+		return nil
+
+	default:
+		drifts, err := c.DriftAccess(ctx, *file)
+		if err != nil {
+			return err
+		}
+		if len(drifts) == 0 {
+			fmt.Fprintln(c.W, "No drift.")
+			return nil
+		}
+		for _, drift := range drifts {
+			fmt.Fprintln(c.W, drift.Change)
+			for _, event := range drift.Events {
+				by := event.Actor
+				if event.APIToken != "" {
+					by += " (API token " + event.APIToken + ")"
+				}
+				fmt.Fprintf(c.W, "  %s %s: %s\n", event.Time.Format(time.RFC3339), by, event.Message)
+			}
+		}
+		return errDrift
+	}
+}
+
+// errBrokenRoles is returned by roles check when some granted roles cannot
+// be assumed, so that the command fails.
+var errBrokenRoles = errors.New("TVM cannot assume some granted roles")
+
+func (c adminCommand) roles(ctx context.Context, sub string, args []string) error {
+	switch sub {
+	case "check":
+		if _, err := c.parse(flag.NewFlagSet("check", flag.ContinueOnError), args, 0); err != nil {
+			return err
+		}
+		if c.IAM == nil {
+			return errors.New("cannot check roles without IAM")
+		}
+		problems, err := c.CheckRoles(ctx)
+		if err != nil {
+			return err
+		}
+		if len(problems) == 0 {
+			fmt.Fprintln(c.W, "All granted roles can be assumed.")
+			return nil
+		}
+		for _, problem := range problems {
+			fmt.Fprintln(c.W, problem.Error())
+			for _, user := range problem.Users {
+				fmt.Fprintf(c.W, "  granted to user %s\n", user)
+			}
+			for _, group := range problem.Groups {
+				fmt.Fprintf(c.W, "  granted to group %s\n", group)
+			}
+		}
+		return errBrokenRoles
+
+	case "discover":
+		if _, err := c.parse(flag.NewFlagSet("discover", flag.ContinueOnError), args, 0); err != nil {
+			return err
+		}
+		if !c.Config.RoleDiscovery.Enabled() {
+			return errors.New("role discovery is not configured")
+		}
+		discovery := c.RefreshDiscoveredRoles(ctx)
+		for _, role := range discovery.Roles {
+			fmt.Fprintln(c.W, role.ARN)
+		}
+		if len(discovery.Problems) > 0 {
+			return errors.New(strings.Join(discovery.Problems, "; "))
+		}
+		return nil
+
+	case "accounts":
+		if _, err := c.parse(flag.NewFlagSet("accounts", flag.ContinueOnError), args, 0); err != nil {
+			return err
+		}
+		if c.Organizations == nil {
+			return errors.New("AWS Organizations is not configured")
+		}
+		if err := c.RefreshOrganization(ctx); err != nil {
+			return err
+		}
+		organization, err := c.Organization(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(c.W, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "UNIT\tID\tACCOUNTS\tROLES")
+		for _, unit := range organization.Units {
+			var roles []string
+			for _, name := range c.Config.Organization.StandardRoles {
+				roles = append(roles, unit.Role(name))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", unit.Path, unit.ID, len(organization.AccountsUnder(unit.ID)), strings.Join(roles, " "))
+		}
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "ACCOUNT\tID\tUNIT\tROLES")
+		for _, account := range organization.Accounts {
+			var roles []string
+			for _, name := range c.Config.Organization.StandardRoles {
+				roles = append(roles, account.RoleARN(name))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", account.Name, account.ID, account.Path, strings.Join(roles, " "))
+		}
+		return tw.Flush()
+
+	case "trust-policy":
+		fs := flag.NewFlagSet("trust-policy", flag.ContinueOnError)
+		principal := fs.String("principal", "", "The ARN that TVM assumes roles as. Defaults to the last hub in the role's chain, the configured principal or the identity of the current AWS credentials")
+		args, err := c.parse(fs, args, 1)
+		if err != nil {
+			return err
+		}
+		role := args[0]
+		if resolved, ok := c.Config.resolveRole(role); ok {
+			role = resolved
+		}
+		if *principal == "" {
+			*principal = c.Config.lastHub(role)
+		}
+		if *principal == "" {
+			if *principal, err = c.principal(ctx); err != nil {
+				return err
+			}
+		}
+		statement, err := c.Config.TrustStatement(role, *principal)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.W, "Add this statement to the trust policy of %s:\n\n%s\n", role, statement)
+		return nil
+
+	default:
+		return errAdminUsage
+	}
+}
@@ -0,0 +1,131 @@
+package tvm
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func runAdmin(t *testing.T, s *Server, args string) (string, error) {
+	var out bytes.Buffer
+	err := s.RunAdminCommand(context.Background(), &out, "cli:root", strings.Fields(args))
+	return out.String(), err
+}
+
+func TestBootstrap(t *testing.T) {
+	ctx := context.Background()
+	r := httptest.NewRequest("GET", "/oauth2/callback", nil)
+	s, _ := newTestServer(t, Config{Enrollment: EnrollmentConfig{Policy: EnrollInvite}})
+	s.Config.RootURL.Scheme = "https"
+	s.Config.RootURL.Host = "tvm.example.com"
+
+	out, err := runAdmin(t, s, "bootstrap alice@example.com")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(out, "https://tvm.example.com/?enroll="))
+	code := regexp.MustCompile(`enroll=([A-Za-z0-9_-]+)`).FindStringSubmatch(out)[1]
+
+	user, err := s.Store.GetUser(ctx, "alice@example.com")
+	assert.NilError(t, err)
+	assert.Check(t, user.Admin)
+	assert.Check(t, is.Equal(UserPending, user.Status))
+	assert.Check(t, !strings.Contains(user.EnrollmentCode, code))
+
+	// logging in binds alice, but she is not active without the code
+	idToken := IDToken{Iss: googleIssuer, Sub: "1", Email: "alice@example.com", EmailVerified: true}
+	user, err = s.enrollUser(ctx, r, idToken)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(UserPending, user.Status))
+
+	_, err = s.redeemEnrollmentCode(ctx, r, user, "guess")
+	assert.Check(t, is.Equal(errBadEnrollmentCode, err))
+	user, err = s.redeemEnrollmentCode(ctx, r, user, code)
+	assert.NilError(t, err)
+	assert.Check(t, user.Active())
+	assert.Check(t, user.Admin)
+	assert.Check(t, is.Equal("accounts.google.com:1", user.ID))
+
+	// the code works only once
+	_, err = s.redeemEnrollmentCode(ctx, r, user, code)
+	assert.Check(t, is.Equal(errBadEnrollmentCode, err))
+
+	// and there can be only one first admin
+	_, err = runAdmin(t, s, "bootstrap bob@example.com")
+	assert.Check(t, is.Equal(errHasAdmin, err))
+
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Actor: "cli:root"})
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(events, 1))
+	assert.Check(t, is.Equal("bootstrap", events[0].Op))
+}
+
+func TestBootstrapExpired(t *testing.T) {
+	ctx := context.Background()
+	r := httptest.NewRequest("GET", "/oauth2/callback", nil)
+	s, _ := newTestServer(t, Config{})
+
+	code, err := s.Bootstrap(ctx, "cli:root", "alice@example.com", -time.Minute)
+	assert.NilError(t, err)
+	user, err := s.Store.GetUser(ctx, "alice@example.com")
+	assert.NilError(t, err)
+	_, err = s.redeemEnrollmentCode(ctx, r, user, code)
+	assert.Check(t, is.Equal(errBadEnrollmentCode, err))
+}
+
+func TestAdminCommand(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{Roles: map[string]RoleConfig{"arn:aws:iam::1:role/dev": {Alias: "dev"}}})
+	bobSession := loginAs(t, s, User{ID: "accounts.google.com:2", Subject: "2", Email: "bob@example.com"})
+
+	_, err := runAdmin(t, s, "user grant -duration -4h bob@example.com dev")
+	assert.Check(t, is.Equal(errBadDuration, err))
+	out, err := runAdmin(t, s, "user grant -duration 4h bob@example.com dev")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(out, "Added role arn:aws:iam::1:role/dev"))
+	out, err = runAdmin(t, s, "user promote bob@example.com")
+	assert.NilError(t, err)
+
+	out, err = runAdmin(t, s, "user list")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(out, "accounts.google.com:2  bob@example.com  active  true"))
+	out, err = runAdmin(t, s, "user show bob@example.com")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(out, "arn:aws:iam::1:role/dev (direct)"))
+
+	_, err = runAdmin(t, s, "user revoke bob@example.com dev")
+	assert.NilError(t, err)
+	user, err := s.Store.GetUser(ctx, "accounts.google.com:2")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(user.Roles, 0))
+	assert.Check(t, user.Admin)
+
+	out, err = runAdmin(t, s, "session list -user bob@example.com")
+	assert.NilError(t, err)
+	handle := sessionHandle(bobSession)
+	assert.Check(t, is.Contains(out, handle))
+	assert.Check(t, !strings.Contains(out, bobSession))
+	_, err = runAdmin(t, s, "session revoke "+handle)
+	assert.NilError(t, err)
+	_, err = s.Store.GetSession(ctx, bobSession)
+	assert.Check(t, is.Equal(ErrNotFound, err))
+
+	_, err = runAdmin(t, s, "user delete bob@example.com")
+	assert.NilError(t, err)
+	_, err = runAdmin(t, s, "user show bob@example.com")
+	assert.Check(t, is.ErrorContains(err, "not found"))
+
+	_, err = runAdmin(t, s, "user frobnicate bob@example.com")
+	assert.Check(t, is.Equal(errAdminUsage, err))
+	_, err = runAdmin(t, s, "user grant bob@example.com")
+	assert.Check(t, is.Equal(errAdminUsage, err))
+
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditAdmin, Actor: "cli:root"})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(events, 5))
+}
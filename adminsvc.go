@@ -0,0 +1,439 @@
+package tvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The admin service layer makes changes to users, groups and sessions on
+// behalf of an admin, checking and auditing each one. The HTML admin UI and
+// the JSON API are both clients of it.
+
+var (
+	errNoSuspendReason = errors.New("a reason is required to suspend a user")
+	errNotSuspended    = errors.New("user is not suspended")
+	errNotActive       = errors.New("only active users can be suspended")
+	errNotConfirmed    = errors.New("type the user's email address to confirm")
+	errSelf            = errors.New("you cannot do that to yourself")
+	errNoDevice        = errors.New("user has no such device")
+	errNoApproval      = errors.New("role does not require approval")
+)
+
+// adminActor is who is making an admin change: an admin using the UI, or a
+// program using an API token that an admin created.
+type adminActor struct {
+	UserID string
+
+	// TokenID is the ID of the API token used, if any.
+	TokenID string
+}
+
+func (a adminActor) String() string {
+	if a.TokenID != "" {
+		return fmt.Sprintf("%s (API token %s)", a.UserID, a.TokenID)
+	}
+	return a.UserID
+}
+
+// auditAdmin records an admin change made by actor.
+func (s *Server) auditAdmin(ctx context.Context, r *http.Request, actor adminActor, event AuditEvent) {
+	event.Type = AuditAdmin
+	event.Actor = actor.UserID
+	event.APIToken = actor.TokenID
+	s.audit(ctx, r, event)
+}
+
+// userChange is an admin change to a user. Op says what to do, and the
+// other fields are its parameters.
+type userChange struct {
+	// Op is one of add_role, delete_role, add_admin, delete_admin,
+	// add_break_glass, delete_break_glass, add_approver, delete_approver,
+	// approve_user, reject_user, reset_devices, remove_device,
+	// suspend_user, unsuspend_user, delete_user and invite.
+	Op string
+
+	// Grant is the role to add for add_role.
+	Grant RoleGrant
+
+	// Role is the role to remove for delete_role, or that the user may or
+	// may no longer approve requests for, for add_approver and
+	// delete_approver.
+	Role string
+
+	// Reason says why, for suspend_user.
+	Reason string
+
+	// Device is the ID of the device to remove for remove_device.
+	Device string
+
+	// Confirm must be the user's ID or email address for delete_user.
+	Confirm string
+}
+
+// changeUser makes change to the user with ID userID, or for invite, with
+// that email address. It returns a description of what it did.
+func (s *Server) changeUser(ctx context.Context, r *http.Request, actor adminActor, userID string, change userChange) (string, error) {
+	if s.Config.ManagedAccess {
+		switch change.Op {
+		case "add_role", "delete_role", "add_admin", "delete_admin", "add_break_glass", "delete_break_glass", "add_approver", "delete_approver", "invite":
+			return "", errManagedAccess
+		}
+	}
+
+	switch change.Op {
+	case "invite":
+		return s.inviteUser(ctx, r, actor, userID)
+	case "delete_user":
+		return s.deleteUser(ctx, r, actor, userID, change.Confirm)
+	case "suspend_user":
+		if userID == actor.UserID {
+			return "", errSelf
+		}
+	case "add_role":
+		if err := s.checkRole(ctx, change.Grant.Role); err != nil {
+			return "", err
+		}
+	case "add_approver":
+		if !s.Config.Roles[change.Role].RequireApproval {
+			return "", errNoApproval
+		}
+	}
+
+	var flash string
+	var before, after *AuditUserState
+	err := s.Store.UpdateUser(ctx, userID, func(user *User) error {
+		before = newAuditUserState(*user)
+		switch change.Op {
+		case "add_role":
+			user.Roles = addGrant(user.Roles, change.Grant)
+			flash = fmt.Sprintf("Added role %s to %s", change.Grant, user.ID)
+
+		case "delete_role":
+			user.Roles = removeGrant(user.Roles, change.Role)
+			flash = fmt.Sprintf("Removed role %s from %s", change.Role, user.ID)
+
+		case "delete_admin":
+			user.Admin = false
+			flash = fmt.Sprintf("Removed admin from %s", user.ID)
+
+		case "add_admin":
+			user.Admin = true
+			flash = fmt.Sprintf("Added admin to %s", user.ID)
+
+		case "add_break_glass":
+			user.BreakGlass = true
+			flash = fmt.Sprintf("Allowed break-glass access for %s", user.ID)
+
+		case "delete_break_glass":
+			user.BreakGlass = false
+			flash = fmt.Sprintf("Removed break-glass access from %s", user.ID)
+
+		case "add_approver":
+			if !user.IsApproverFor(change.Role) {
+				user.ApproverFor = append(user.ApproverFor, change.Role)
+			}
+			flash = fmt.Sprintf("Allowed %s to approve requests for %s", user.ID, change.Role)
+
+		case "delete_approver":
+			var kept []string
+			for _, role := range user.ApproverFor {
+				if role != change.Role {
+					kept = append(kept, role)
+				}
+			}
+			user.ApproverFor = kept
+			flash = fmt.Sprintf("Removed approval of requests for %s from %s", change.Role, user.ID)
+
+		case "approve_user":
+			if user.Status != UserPending {
+				return errNotPending
+			}
+			user.Status = UserActive
+			user.StatusReason = ""
+			user.StatusTime = time.Now()
+			flash = fmt.Sprintf("Approved %s", user.ID)
+
+		case "reject_user":
+			if user.Status != UserPending {
+				return errNotPending
+			}
+			user.Status = UserRejected
+			user.StatusReason = fmt.Sprintf("rejected by %s", actor)
+			user.StatusTime = time.Now()
+			flash = fmt.Sprintf("Rejected %s", user.ID)
+
+		case "reset_devices":
+			user.U2FDevices = nil
+			flash = fmt.Sprintf("Reset devices for %s", user.ID)
+
+		case "remove_device":
+			var kept []U2FDevice
+			for _, device := range user.U2FDevices {
+				if device.ID() != change.Device {
+					kept = append(kept, device)
+				}
+			}
+			if len(kept) == len(user.U2FDevices) {
+				return errNoDevice
+			}
+			user.U2FDevices = kept
+			flash = fmt.Sprintf("Removed device %s from %s", change.Device, user.ID)
+
+		case "suspend_user":
+			if change.Reason == "" {
+				return errNoSuspendReason
+			}
+			// Suspending a disabled, pending or rejected user would
+			// lose that status when they are unsuspended.
+			if user.Status != UserActive {
+				return errNotActive
+			}
+			user.Status = UserSuspended
+			user.StatusReason = fmt.Sprintf("%s (suspended by %s)", change.Reason, actor)
+			user.StatusTime = time.Now()
+			flash = fmt.Sprintf("Suspended %s", user.ID)
+
+		case "unsuspend_user":
+			if user.Status != UserSuspended {
+				return errNotSuspended
+			}
+			user.Status = UserActive
+			user.StatusReason = ""
+			user.StatusTime = time.Now()
+			flash = fmt.Sprintf("Unsuspended %s", user.ID)
+
+		default:
+			return errUnknownOperation
+		}
+		after = newAuditUserState(*user)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if change.Op == "suspend_user" {
+		if err := s.revokeSessions(ctx, userID); err != nil {
+			return "", err
+		}
+	}
+
+	role := change.Role
+	if change.Op == "add_role" {
+		role = change.Grant.Role
+	}
+	s.auditAdmin(ctx, r, actor, AuditEvent{
+		Subject: userID,
+		Op:      change.Op,
+		Role:    role,
+		Before:  before,
+		After:   after,
+		Message: flash,
+	})
+	return flash, nil
+}
+
+// inviteUser creates a user ahead of their first login so that they may
+// enroll under EnrollInvite.
+func (s *Server) inviteUser(ctx context.Context, r *http.Request, actor adminActor, email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !strings.Contains(email, "@") || strings.ContainsAny(email, "/\\ ") {
+		return "", errBadEmail
+	}
+	user := User{ID: email, Email: email}
+
+	existing, err := s.usersByEmail(ctx, email)
+	if err != nil {
+		return "", err
+	}
+	for _, u := range existing {
+		if u.Active() {
+			return "", errUserExists
+		}
+	}
+	if _, err := s.Store.GetUser(ctx, user.ID); err == nil {
+		return "", errUserExists
+	} else if err != ErrNotFound {
+		return "", err
+	}
+	if err := s.Store.PutUser(ctx, user); err != nil {
+		return "", err
+	}
+
+	flash := fmt.Sprintf("Invited %s", user.ID)
+	s.auditAdmin(ctx, r, actor, AuditEvent{
+		Subject: user.ID,
+		Op:      "invite",
+		After:   newAuditUserState(user),
+		Message: flash,
+	})
+	return flash, nil
+}
+
+// deleteUser removes a user entirely, along with their group memberships
+// and sessions. confirm must be the user's ID or email address.
+func (s *Server) deleteUser(ctx context.Context, r *http.Request, actor adminActor, userID, confirm string) (string, error) {
+	if userID == actor.UserID {
+		return "", errSelf
+	}
+	user, err := s.Store.GetUser(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	if confirm != userID && !strings.EqualFold(confirm, user.PrimaryEmail()) {
+		return "", errNotConfirmed
+	}
+	if err := s.Store.DeleteUser(ctx, userID); err != nil {
+		return "", err
+	}
+	if err := s.removeFromGroups(ctx, userID); err != nil {
+		return "", err
+	}
+	if err := s.revokeSessions(ctx, userID); err != nil {
+		return "", err
+	}
+
+	flash := fmt.Sprintf("Deleted %s", userID)
+	s.auditAdmin(ctx, r, actor, AuditEvent{
+		Subject: userID,
+		Op:      "delete_user",
+		Before:  newAuditUserState(*user),
+		Message: flash,
+	})
+	return flash, nil
+}
+
+// groupChange is an admin change to a group, in the same way as
+// userChange.
+type groupChange struct {
+	// Op is one of create_group, delete_group, add_member, remove_member,
+	// add_role and delete_role.
+	Op string
+
+	// UserID is the member to add or remove.
+	UserID string
+
+	Grant RoleGrant
+	Role  string
+}
+
+// changeGroup makes change to the group with ID groupID. It returns a
+// description of what it did.
+func (s *Server) changeGroup(ctx context.Context, r *http.Request, actor adminActor, groupID string, change groupChange) (string, error) {
+	if s.Config.ManagedAccess {
+		return "", errManagedAccess
+	}
+
+	var flash string
+	var err error
+	switch change.Op {
+	case "create_group":
+		if !groupIDPattern.MatchString(groupID) || strings.HasPrefix(groupID, ".") {
+			err = errBadGroupID
+		} else if _, err = s.Store.GetGroup(ctx, groupID); err == nil {
+			err = errGroupExists
+		} else if err == ErrNotFound {
+			err = s.Store.PutGroup(ctx, Group{ID: groupID})
+		}
+		flash = fmt.Sprintf("Created group %s", groupID)
+
+	case "delete_group":
+		err = s.Store.DeleteGroup(ctx, groupID)
+		flash = fmt.Sprintf("Deleted group %s", groupID)
+
+	default:
+		if change.Op == "add_role" {
+			if err := s.checkRole(ctx, change.Grant.Role); err != nil {
+				return "", err
+			}
+		}
+		err = s.Store.UpdateGroup(ctx, groupID, func(group *Group) error {
+			switch change.Op {
+			case "add_member":
+				if !group.HasMember(change.UserID) {
+					group.Members = append(group.Members, change.UserID)
+				}
+				flash = fmt.Sprintf("Added %s to group %s", change.UserID, group.ID)
+			case "remove_member":
+				group.Members = removeMember(group.Members, change.UserID)
+				flash = fmt.Sprintf("Removed %s from group %s", change.UserID, group.ID)
+			case "add_role":
+				group.Roles = addGrant(group.Roles, change.Grant)
+				flash = fmt.Sprintf("Added role %s to group %s", change.Grant, group.ID)
+			case "delete_role":
+				group.Roles = removeGrant(group.Roles, change.Role)
+				flash = fmt.Sprintf("Removed role %s from group %s", change.Role, group.ID)
+			default:
+				return errUnknownOperation
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+
+	role := change.Role
+	if change.Op == "add_role" {
+		role = change.Grant.Role
+	}
+	s.auditAdmin(ctx, r, actor, AuditEvent{
+		Subject: change.UserID,
+		Group:   groupID,
+		Op:      "group." + change.Op,
+		Role:    role,
+		Message: flash,
+	})
+	return flash, nil
+}
+
+// revokeSession ends one session.
+func (s *Server) revokeSession(ctx context.Context, r *http.Request, actor adminActor, session Session) (string, error) {
+	if err := s.Store.DeleteSession(ctx, session.ID); err != nil {
+		return "", err
+	}
+	flash := fmt.Sprintf("Revoked session %s of %s", sessionHandle(session.ID), session.UserID)
+	s.auditAdmin(ctx, r, actor, AuditEvent{
+		Subject: session.UserID,
+		Op:      "revoke_session",
+		Message: flash,
+	})
+	return flash, nil
+}
+
+// adminErrorStatus returns the HTTP status for an error from the admin
+// service layer.
+func adminErrorStatus(err error) int {
+	var problem *RoleProblem
+	if errors.As(err, &problem) {
+		return http.StatusBadRequest
+	}
+	switch err {
+	case ErrNotFound:
+		return http.StatusNotFound
+	case errUserExists, errGroupExists:
+		return http.StatusConflict
+	case errManagedAccess:
+		return http.StatusForbidden
+	case errUnknownOperation, errBadDuration, errBadGroupID, errBadEmail, errAmbiguousEmail,
+		errNotPending, errSelf, errNoRole, errNotConfirmed, errNoSuspendReason, errNotSuspended, errNotActive, errNoDevice,
+		errNoApproval:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// adminFormError reports an error from the admin service layer to the HTML
+// admin UI. Forms that name something that does not exist are bad requests.
+func adminFormError(w http.ResponseWriter, err error) {
+	status := adminErrorStatus(err)
+	if status == http.StatusNotFound {
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,618 @@
+package tvm
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"goji.io/pat"
+)
+
+// The admin API is a JSON API under /api/v1 for automating administration.
+// Callers authenticate with an API token created in the admin UI, and each
+// endpoint requires one of the token's scopes. openapi.json describes it.
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+var errNoRole = errors.New("role is required")
+
+func (s *Server) registerAPI() {
+	s.Mux.HandleFunc(pat.Get("/api/v1/openapi.json"), handleOpenAPI)
+
+	s.Mux.HandleFunc(pat.Get("/api/v1/users"), s.api(ScopeUsersRead, s.handleAPIListUsers))
+	s.Mux.HandleFunc(pat.Post("/api/v1/users"), s.api(ScopeUsersWrite, s.handleAPIInviteUser))
+	s.Mux.HandleFunc(pat.Get("/api/v1/users/:id"), s.api(ScopeUsersRead, s.handleAPIGetUser))
+	s.Mux.HandleFunc(pat.Delete("/api/v1/users/:id"), s.api(ScopeUsersWrite, s.handleAPIDeleteUser))
+	s.Mux.HandleFunc(pat.Post("/api/v1/users/:id/roles"), s.api(ScopeUsersWrite, s.handleAPIAddUserRole))
+	s.Mux.HandleFunc(pat.Delete("/api/v1/users/:id/roles"), s.api(ScopeUsersWrite, s.handleAPIDeleteUserRole))
+	s.Mux.HandleFunc(pat.Put("/api/v1/users/:id/admin"), s.api(ScopeAdminsWrite, s.handleAPISetAdmin))
+	s.Mux.HandleFunc(pat.Put("/api/v1/users/:id/break-glass"), s.api(ScopeAdminsWrite, s.handleAPISetBreakGlass))
+	s.Mux.HandleFunc(pat.Post("/api/v1/users/:id/approver"), s.api(ScopeAdminsWrite, s.handleAPIAddApprover))
+	s.Mux.HandleFunc(pat.Delete("/api/v1/users/:id/approver"), s.api(ScopeAdminsWrite, s.handleAPIDeleteApprover))
+	s.Mux.HandleFunc(pat.Delete("/api/v1/users/:id/devices"), s.api(ScopeUsersWrite, s.handleAPIResetDevices))
+	s.Mux.HandleFunc(pat.Put("/api/v1/users/:id/status"), s.api(ScopeUsersWrite, s.handleAPISetStatus))
+
+	s.Mux.HandleFunc(pat.Get("/api/v1/groups"), s.api(ScopeGroupsRead, s.handleAPIListGroups))
+	s.Mux.HandleFunc(pat.Post("/api/v1/groups"), s.api(ScopeGroupsWrite, s.handleAPICreateGroup))
+	s.Mux.HandleFunc(pat.Get("/api/v1/groups/:id"), s.api(ScopeGroupsRead, s.handleAPIGetGroup))
+	s.Mux.HandleFunc(pat.Delete("/api/v1/groups/:id"), s.api(ScopeGroupsWrite, s.handleAPIDeleteGroup))
+	s.Mux.HandleFunc(pat.Put("/api/v1/groups/:id/members/:user"), s.api(ScopeGroupsWrite, s.handleAPIAddMember))
+	s.Mux.HandleFunc(pat.Delete("/api/v1/groups/:id/members/:user"), s.api(ScopeGroupsWrite, s.handleAPIRemoveMember))
+	s.Mux.HandleFunc(pat.Post("/api/v1/groups/:id/roles"), s.api(ScopeGroupsWrite, s.handleAPIAddGroupRole))
+	s.Mux.HandleFunc(pat.Delete("/api/v1/groups/:id/roles"), s.api(ScopeGroupsWrite, s.handleAPIDeleteGroupRole))
+
+	s.Mux.HandleFunc(pat.Get("/api/v1/sessions"), s.api(ScopeSessionsRead, s.handleAPIListSessions))
+	s.Mux.HandleFunc(pat.Delete("/api/v1/sessions/:id"), s.api(ScopeSessionsWrite, s.handleAPIRevokeSession))
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+// apiHandler is an admin API endpoint, called with the admin on whose
+// behalf the API token acts.
+type apiHandler func(w http.ResponseWriter, r *http.Request, actor adminActor)
+
+// statusRecorder remembers the status code written to it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// api wraps an endpoint that requires scope. It authenticates the request
+// and audits the call, whether or not it succeeds.
+func (s *Server) api(scope APIScope, fn apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		event := AuditEvent{
+			Type: AuditAPI,
+			Op:   r.Method + " " + r.URL.Path,
+		}
+		token, err := s.authenticateAPIToken(r)
+		switch {
+		case err == errBadAPIToken || err == errTokenExpired:
+			event.Message = err.Error()
+			s.audit(r.Context(), r, event)
+			writeAPIError(w, http.StatusUnauthorized, err)
+			return
+		case err != nil:
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		event.Actor = token.CreatedBy
+		event.APIToken = token.ID
+		if !token.HasScope(scope) {
+			event.Message = fmt.Sprintf("token lacks scope %s", scope)
+			s.audit(r.Context(), r, event)
+			writeAPIError(w, http.StatusForbidden, fmt.Errorf("this token lacks the %s scope", scope))
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		fn(rec, r, adminActor{UserID: token.CreatedBy, TokenID: token.ID})
+		event.Message = fmt.Sprintf("%d %s", rec.status, http.StatusText(rec.status))
+		s.audit(r.Context(), r, event)
+	}
+}
+
+func writeAPI(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPI(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+func writeAPIServiceError(w http.ResponseWriter, err error) {
+	writeAPIError(w, adminErrorStatus(err), err)
+}
+
+// readAPIRequest decodes the JSON body of r into v, reporting any error to
+// w.
+func readAPIRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("cannot parse request: %w", err))
+		return false
+	}
+	return true
+}
+
+// pathParam returns the unescaped path parameter name.
+func pathParam(r *http.Request, name string) string {
+	v, err := url.PathUnescape(pat.Param(r, name))
+	if err != nil {
+		return pat.Param(r, name)
+	}
+	return v
+}
+
+type apiGrant struct {
+	Role      string     `json:"role"`
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	NotAfter  *time.Time `json:"notAfter,omitempty"`
+}
+
+func toAPIGrants(grants []RoleGrant) []apiGrant {
+	rv := []apiGrant{}
+	for _, grant := range grants {
+		g := apiGrant{Role: grant.Role}
+		if !grant.NotBefore.IsZero() {
+			g.NotBefore = &grant.NotBefore
+		}
+		if !grant.NotAfter.IsZero() {
+			g.NotAfter = &grant.NotAfter
+		}
+		rv = append(rv, g)
+	}
+	return rv
+}
+
+type apiUser struct {
+	ID             string     `json:"id"`
+	Email          string     `json:"email"`
+	Issuer         string     `json:"issuer,omitempty"`
+	Subject        string     `json:"subject,omitempty"`
+	Roles          []apiGrant `json:"roles"`
+	EffectiveRoles []string   `json:"effectiveRoles"`
+	Admin          bool       `json:"admin"`
+	BreakGlass     bool       `json:"breakGlass"`
+	ApproverFor    []string   `json:"approverFor"`
+	Devices        int        `json:"devices"`
+	Status         string     `json:"status"`
+	StatusReason   string     `json:"statusReason,omitempty"`
+	Version        int64      `json:"version"`
+}
+
+func toAPIUser(user User, groups []Group, now time.Time) apiUser {
+	status := string(user.Status)
+	if user.Active() {
+		status = "active"
+	}
+	effective := []string{}
+	for _, role := range EffectiveRoles(user, groups, now) {
+		effective = append(effective, role.Role)
+	}
+	return apiUser{
+		ID:             user.ID,
+		Email:          user.PrimaryEmail(),
+		Issuer:         user.Issuer,
+		Subject:        user.Subject,
+		Roles:          toAPIGrants(user.Roles),
+		EffectiveRoles: effective,
+		Admin:          user.Admin,
+		BreakGlass:     user.BreakGlass,
+		ApproverFor:    append([]string{}, user.ApproverFor...),
+		Devices:        len(user.U2FDevices),
+		Status:         status,
+		StatusReason:   user.StatusReason,
+		Version:        user.Version,
+	}
+}
+
+// writeAPIUser responds with the current state of the user with ID userID.
+func (s *Server) writeAPIUser(w http.ResponseWriter, r *http.Request, status int, userID string) {
+	user, err := s.Store.GetUser(r.Context(), userID)
+	if err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	groups, err := s.Store.ListGroups(r.Context())
+	if err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	writeAPI(w, status, toAPIUser(*user, groups, time.Now()))
+}
+
+// apiUserID returns the ID of the user named by the id path parameter,
+// which may be an ID or an email address.
+func (s *Server) apiUserID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, err := s.lookupUser(r.Context(), pathParam(r, "id"))
+	if err != nil {
+		writeAPIServiceError(w, err)
+		return "", false
+	}
+	return user.ID, true
+}
+
+// changeAPIUser makes change to the user named in the path and responds
+// with their new state.
+func (s *Server) changeAPIUser(w http.ResponseWriter, r *http.Request, actor adminActor, change userChange) {
+	userID, ok := s.apiUserID(w, r)
+	if !ok {
+		return
+	}
+	if _, err := s.changeUser(r.Context(), r, actor, userID, change); err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	s.writeAPIUser(w, r, http.StatusOK, userID)
+}
+
+func (s *Server) handleAPIListUsers(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	users, err := s.Store.ListUsers(r.Context())
+	if err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	groups, err := s.Store.ListGroups(r.Context())
+	if err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	email := r.URL.Query().Get("email")
+	now := time.Now()
+	rv := []apiUser{}
+	for _, user := range users {
+		if email == "" || strings.EqualFold(email, user.PrimaryEmail()) {
+			rv = append(rv, toAPIUser(user, groups, now))
+		}
+	}
+	writeAPI(w, http.StatusOK, rv)
+}
+
+func (s *Server) handleAPIInviteUser(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+	if _, err := s.changeUser(r.Context(), r, actor, req.Email, userChange{Op: "invite"}); err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	s.writeAPIUser(w, r, http.StatusCreated, strings.ToLower(strings.TrimSpace(req.Email)))
+}
+
+func (s *Server) handleAPIGetUser(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	userID, ok := s.apiUserID(w, r)
+	if !ok {
+		return
+	}
+	s.writeAPIUser(w, r, http.StatusOK, userID)
+}
+
+func (s *Server) handleAPIDeleteUser(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	userID, ok := s.apiUserID(w, r)
+	if !ok {
+		return
+	}
+	if _, err := s.changeUser(r.Context(), r, actor, userID, userChange{Op: "delete_user", Confirm: userID}); err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiGrantRequest is the body of a request to add a role grant.
+type apiGrantRequest struct {
+	Role string `json:"role"`
+
+	// Duration limits the grant, e.g. "4h". Empty means permanent.
+	Duration string `json:"duration"`
+}
+
+func (s *Server) grantFromAPI(req apiGrantRequest) (RoleGrant, error) {
+	grant := RoleGrant{Role: req.Role}
+	if role, ok := s.Config.resolveRole(req.Role); ok {
+		grant.Role = role
+	}
+	if grant.Role == "" {
+		return grant, errNoRole
+	}
+	if req.Duration != "" {
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			return grant, errBadDuration
+		}
+		grant.NotAfter = time.Now().Add(duration)
+	}
+	return grant, nil
+}
+
+func (s *Server) handleAPIAddUserRole(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	var req apiGrantRequest
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+	grant, err := s.grantFromAPI(req)
+	if err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	s.changeAPIUser(w, r, actor, userChange{Op: "add_role", Grant: grant})
+}
+
+func (s *Server) handleAPIDeleteUserRole(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	role := r.URL.Query().Get("role")
+	if resolved, ok := s.Config.resolveRole(role); ok {
+		role = resolved
+	}
+	s.changeAPIUser(w, r, actor, userChange{Op: "delete_role", Role: role})
+}
+
+func (s *Server) handleAPISetAdmin(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	var req struct {
+		Admin bool `json:"admin"`
+	}
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+	op := "delete_admin"
+	if req.Admin {
+		op = "add_admin"
+	}
+	s.changeAPIUser(w, r, actor, userChange{Op: op})
+}
+
+func (s *Server) handleAPISetBreakGlass(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	var req struct {
+		BreakGlass bool `json:"breakGlass"`
+	}
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+	op := "delete_break_glass"
+	if req.BreakGlass {
+		op = "add_break_glass"
+	}
+	s.changeAPIUser(w, r, actor, userChange{Op: op})
+}
+
+func (s *Server) handleAPIAddApprover(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	var req struct {
+		Role string `json:"role"`
+	}
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+	role := req.Role
+	if resolved, ok := s.Config.resolveRole(role); ok {
+		role = resolved
+	}
+	s.changeAPIUser(w, r, actor, userChange{Op: "add_approver", Role: role})
+}
+
+func (s *Server) handleAPIDeleteApprover(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	role := r.URL.Query().Get("role")
+	if resolved, ok := s.Config.resolveRole(role); ok {
+		role = resolved
+	}
+	s.changeAPIUser(w, r, actor, userChange{Op: "delete_approver", Role: role})
+}
+
+func (s *Server) handleAPIResetDevices(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	s.changeAPIUser(w, r, actor, userChange{Op: "reset_devices"})
+}
+
+// handleAPISetStatus moves a user to the requested status: "active" to
+// approve a pending user or unsuspend a suspended one, "suspended" (with a
+// reason) or "rejected" for a pending user.
+func (s *Server) handleAPISetStatus(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	var req struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+	userID, ok := s.apiUserID(w, r)
+	if !ok {
+		return
+	}
+	user, err := s.Store.GetUser(r.Context(), userID)
+	if err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+
+	change := userChange{Reason: req.Reason}
+	switch {
+	case req.Status == "active" && user.Status == UserPending:
+		change.Op = "approve_user"
+	case req.Status == "active":
+		change.Op = "unsuspend_user"
+	case req.Status == string(UserSuspended):
+		change.Op = "suspend_user"
+	case req.Status == string(UserRejected):
+		change.Op = "reject_user"
+	default:
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("cannot change status to %q", req.Status))
+		return
+	}
+	s.changeAPIUser(w, r, actor, change)
+}
+
+type apiGroup struct {
+	ID          string     `json:"id"`
+	DisplayName string     `json:"displayName,omitempty"`
+	Source      string     `json:"source,omitempty"`
+	Members     []string   `json:"members"`
+	Roles       []apiGrant `json:"roles"`
+	Version     int64      `json:"version"`
+}
+
+func toAPIGroup(group Group) apiGroup {
+	members := append([]string{}, group.Members...)
+	return apiGroup{
+		ID:          group.ID,
+		DisplayName: group.DisplayName,
+		Source:      group.Source,
+		Members:     members,
+		Roles:       toAPIGrants(group.Roles),
+		Version:     group.Version,
+	}
+}
+
+// changeAPIGroup makes change to the group named in the path and responds
+// with its new state.
+func (s *Server) changeAPIGroup(w http.ResponseWriter, r *http.Request, actor adminActor, status int, groupID string, change groupChange) {
+	if _, err := s.changeGroup(r.Context(), r, actor, groupID, change); err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	group, err := s.Store.GetGroup(r.Context(), groupID)
+	if err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	writeAPI(w, status, toAPIGroup(*group))
+}
+
+func (s *Server) handleAPIListGroups(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	groups, err := s.Store.ListGroups(r.Context())
+	if err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	rv := []apiGroup{}
+	for _, group := range groups {
+		rv = append(rv, toAPIGroup(group))
+	}
+	writeAPI(w, http.StatusOK, rv)
+}
+
+func (s *Server) handleAPICreateGroup(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	var req struct {
+		ID string `json:"id"`
+	}
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+	s.changeAPIGroup(w, r, actor, http.StatusCreated, req.ID, groupChange{Op: "create_group"})
+}
+
+func (s *Server) handleAPIGetGroup(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	group, err := s.Store.GetGroup(r.Context(), pathParam(r, "id"))
+	if err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	writeAPI(w, http.StatusOK, toAPIGroup(*group))
+}
+
+func (s *Server) handleAPIDeleteGroup(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	if _, err := s.changeGroup(r.Context(), r, actor, pathParam(r, "id"), groupChange{Op: "delete_group"}); err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleAPIAddMember(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	user, err := s.lookupUser(r.Context(), pathParam(r, "user"))
+	if err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	s.changeAPIGroup(w, r, actor, http.StatusOK, pathParam(r, "id"), groupChange{Op: "add_member", UserID: user.ID})
+}
+
+func (s *Server) handleAPIRemoveMember(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	userID := pathParam(r, "user")
+	if user, err := s.lookupUser(r.Context(), userID); err == nil {
+		userID = user.ID
+	}
+	s.changeAPIGroup(w, r, actor, http.StatusOK, pathParam(r, "id"), groupChange{Op: "remove_member", UserID: userID})
+}
+
+func (s *Server) handleAPIAddGroupRole(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	var req apiGrantRequest
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+	grant, err := s.grantFromAPI(req)
+	if err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	s.changeAPIGroup(w, r, actor, http.StatusOK, pathParam(r, "id"), groupChange{Op: "add_role", Grant: grant})
+}
+
+func (s *Server) handleAPIDeleteGroupRole(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	role := r.URL.Query().Get("role")
+	if resolved, ok := s.Config.resolveRole(role); ok {
+		role = resolved
+	}
+	s.changeAPIGroup(w, r, actor, http.StatusOK, pathParam(r, "id"), groupChange{Op: "delete_role", Role: role})
+}
+
+// apiSession describes a session without revealing its ID, which is a
+// bearer credential. Sessions are named by a hash of their ID instead.
+type apiSession struct {
+	ID            string     `json:"id"`
+	UserID        string     `json:"userId"`
+	Authenticated bool       `json:"authenticated"`
+	Expires       *time.Time `json:"expires,omitempty"`
+}
+
+func (s *Server) handleAPIListSessions(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	sessions, err := s.Store.ListSessions(r.Context())
+	if err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	userID := r.URL.Query().Get("user")
+	if user, err := s.lookupUser(r.Context(), userID); userID != "" && err == nil {
+		userID = user.ID
+	}
+
+	rv := []apiSession{}
+	for _, session := range sessions {
+		if session.UserID == "" || (userID != "" && session.UserID != userID) {
+			continue
+		}
+		as := apiSession{
+			ID:            sessionHandle(session.ID),
+			UserID:        session.UserID,
+			Authenticated: session.U2F,
+		}
+		if !session.Expires.IsZero() {
+			as.Expires = &session.Expires
+		}
+		rv = append(rv, as)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].ID < rv[j].ID })
+	writeAPI(w, http.StatusOK, rv)
+}
+
+func (s *Server) handleAPIRevokeSession(w http.ResponseWriter, r *http.Request, actor adminActor) {
+	sessions, err := s.Store.ListSessions(r.Context())
+	if err != nil {
+		writeAPIServiceError(w, err)
+		return
+	}
+	handle := pathParam(r, "id")
+	for _, session := range sessions {
+		if sessionHandle(session.ID) != handle {
+			continue
+		}
+		if _, err := s.revokeSession(r.Context(), r, actor, session); err != nil {
+			writeAPIServiceError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeAPIServiceError(w, ErrNotFound)
+}
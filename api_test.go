@@ -0,0 +1,232 @@
+package tvm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// newAPIToken creates an API token through the admin UI and returns it.
+func newAPIToken(t *testing.T, s *Server, adminSession string, scopes ...APIScope) string {
+	form := url.Values{"name": {"automation"}, "duration": {"168h"}}
+	for _, scope := range scopes {
+		form.Add("scope", string(scope))
+	}
+	w := do(s, "POST", "/admin/tokens", form, adminSession)
+	assert.Assert(t, is.Equal(http.StatusOK, w.Code), w.Body.String())
+	assert.Check(t, is.Equal("no-store", w.Header().Get("Cache-Control")))
+	token := regexp.MustCompile(`tvm_[0-9a-f]+_[A-Za-z0-9_-]+`).FindString(w.Body.String())
+	assert.Assert(t, token != "")
+	return token
+}
+
+// doAPI makes an admin API request to s with the given token, and decodes
+// the response into v if it is not nil.
+func doAPI(t *testing.T, s *Server, method, path string, body interface{}, token string, v interface{}) int {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		assert.NilError(t, err)
+		reader = strings.NewReader(string(b))
+	}
+	r := httptest.NewRequest(method, path, reader)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if v != nil && w.Code < 300 {
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), v))
+	}
+	return w.Code
+}
+
+func TestAPIAuthentication(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{})
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+	token := newAPIToken(t, s, admin, ScopeUsersRead)
+
+	tokens, err := s.Store.ListAPITokens(ctx)
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(tokens, 1))
+	assert.Check(t, !strings.Contains(token, tokens[0].Hash))
+	assert.Check(t, is.Equal("admin", tokens[0].CreatedBy))
+
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "GET", "/api/v1/users", nil, token, nil)))
+	assert.Check(t, is.Equal(http.StatusUnauthorized, doAPI(t, s, "GET", "/api/v1/users", nil, "", nil)))
+	assert.Check(t, is.Equal(http.StatusUnauthorized, doAPI(t, s, "GET", "/api/v1/users", nil, token+"x", nil)))
+	assert.Check(t, is.Equal(http.StatusForbidden, doAPI(t, s, "PUT", "/api/v1/users/admin/admin", map[string]bool{"admin": false}, token, nil)))
+
+	// the admin session cookie is not enough
+	w := do(s, "GET", "/api/v1/users", nil, admin)
+	assert.Check(t, is.Equal(http.StatusUnauthorized, w.Code))
+
+	// tokens stop working when they expire
+	tokens[0].Expires = time.Now().Add(-time.Minute)
+	assert.NilError(t, s.Store.PutAPIToken(ctx, tokens[0]))
+	assert.Check(t, is.Equal(http.StatusUnauthorized, doAPI(t, s, "GET", "/api/v1/users", nil, token, nil)))
+
+	// or when their creator is no longer an admin
+	token = newAPIToken(t, s, admin, ScopeUsersRead)
+	assert.NilError(t, s.Store.UpdateUser(ctx, "admin", func(user *User) error {
+		user.Admin = false
+		return nil
+	}))
+	assert.Check(t, is.Equal(http.StatusUnauthorized, doAPI(t, s, "GET", "/api/v1/users", nil, token, nil)))
+
+	// scopes and lifetimes are checked
+	assert.NilError(t, s.Store.UpdateUser(ctx, "admin", func(user *User) error {
+		user.Admin = true
+		return nil
+	}))
+	w = do(s, "POST", "/admin/tokens", url.Values{"name": {"x"}, "duration": {"168h"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+	w = do(s, "POST", "/admin/tokens", url.Values{"name": {"x"}, "duration": {"168h"}, "scope": {"everything"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+	w = do(s, "POST", "/admin/tokens", url.Values{"name": {"x"}, "duration": {"8760h"}, "scope": {"users:read"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+
+	// minting a token needs a session signed with a key
+	assert.NilError(t, s.Store.PutSession(ctx, Session{ID: "session-nokey", UserID: "admin"}))
+	w = do(s, "POST", "/admin/tokens", url.Values{"name": {"x"}, "duration": {"168h"}, "scope": {string(ScopeAdminsWrite)}}, "session-nokey")
+	assert.Check(t, is.Equal(http.StatusFound, w.Code))
+	tokens, err = s.Store.ListAPITokens(ctx)
+	assert.NilError(t, err)
+	for _, token := range tokens {
+		assert.Check(t, token.Name != "x")
+	}
+
+	// revoking a token
+	tokens, err = s.Store.ListAPITokens(ctx)
+	assert.NilError(t, err)
+	for _, tok := range tokens {
+		w = do(s, "POST", "/admin/tokens/"+tok.ID+"/revoke", nil, admin)
+		assert.Check(t, is.Equal(http.StatusSeeOther, w.Code))
+	}
+	assert.Check(t, is.Equal(http.StatusUnauthorized, doAPI(t, s, "GET", "/api/v1/users", nil, token, nil)))
+}
+
+func TestAPIUsers(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{Roles: map[string]RoleConfig{"arn:aws:iam::1:role/dev": {Alias: "dev"}}})
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "accounts.google.com:1", Subject: "1", Email: "bob@example.com"}))
+	token := newAPIToken(t, s, admin, ScopeUsersRead, ScopeUsersWrite)
+
+	var users []apiUser
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "GET", "/api/v1/users?email=bob@example.com", nil, token, &users)))
+	assert.Assert(t, is.Len(users, 1))
+	assert.Check(t, is.Equal("accounts.google.com:1", users[0].ID))
+	assert.Check(t, is.Equal("active", users[0].Status))
+
+	var user apiUser
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "POST", "/api/v1/users/bob@example.com/roles", map[string]string{"role": "dev", "duration": "4h"}, token, &user)))
+	assert.Assert(t, is.Len(user.Roles, 1))
+	assert.Check(t, is.Equal("arn:aws:iam::1:role/dev", user.Roles[0].Role))
+	assert.Check(t, user.Roles[0].NotAfter != nil)
+	assert.Check(t, is.DeepEqual([]string{"arn:aws:iam::1:role/dev"}, user.EffectiveRoles))
+	assert.Check(t, is.Equal(http.StatusBadRequest, doAPI(t, s, "POST", "/api/v1/users/bob@example.com/roles", map[string]string{"role": "dev", "duration": "soon"}, token, nil)))
+	assert.Check(t, is.Equal(http.StatusBadRequest, doAPI(t, s, "POST", "/api/v1/users/bob@example.com/roles", map[string]string{"role": "dev", "duration": "-4h"}, token, nil)))
+
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "DELETE", "/api/v1/users/bob@example.com/roles?role=dev", nil, token, &user)))
+	assert.Check(t, is.Len(user.Roles, 0))
+
+	// making admins needs a scope of its own
+	assert.Check(t, is.Equal(http.StatusForbidden, doAPI(t, s, "PUT", "/api/v1/users/accounts.google.com:1/admin", map[string]bool{"admin": true}, token, nil)))
+	assert.Check(t, is.Equal(http.StatusForbidden, doAPI(t, s, "PUT", "/api/v1/users/accounts.google.com:1/break-glass", map[string]bool{"breakGlass": true}, token, nil)))
+	adminsToken := newAPIToken(t, s, admin, ScopeAdminsWrite)
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "PUT", "/api/v1/users/accounts.google.com:1/admin", map[string]bool{"admin": true}, adminsToken, &user)))
+	assert.Check(t, user.Admin)
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "PUT", "/api/v1/users/accounts.google.com:1/break-glass", map[string]bool{"breakGlass": true}, adminsToken, &user)))
+	assert.Check(t, user.BreakGlass)
+
+	assert.Check(t, is.Equal(http.StatusBadRequest, doAPI(t, s, "PUT", "/api/v1/users/bob@example.com/status", map[string]string{"status": "suspended"}, token, nil)))
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "PUT", "/api/v1/users/bob@example.com/status", map[string]string{"status": "suspended", "reason": "left"}, token, &user)))
+	assert.Check(t, is.Equal("suspended", user.Status))
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "PUT", "/api/v1/users/bob@example.com/status", map[string]string{"status": "active"}, token, &user)))
+	assert.Check(t, is.Equal("active", user.Status))
+
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "DELETE", "/api/v1/users/bob@example.com/devices", nil, token, &user)))
+	assert.Check(t, is.Equal(0, user.Devices))
+
+	assert.Check(t, is.Equal(http.StatusCreated, doAPI(t, s, "POST", "/api/v1/users", map[string]string{"email": "Carol@example.com"}, token, &user)))
+	assert.Check(t, is.Equal("carol@example.com", user.ID))
+	assert.Check(t, is.Equal(http.StatusConflict, doAPI(t, s, "POST", "/api/v1/users", map[string]string{"email": "carol@example.com"}, token, nil)))
+	assert.Check(t, is.Equal(http.StatusBadRequest, doAPI(t, s, "POST", "/api/v1/users", "carol", token, nil)))
+
+	assert.Check(t, is.Equal(http.StatusNoContent, doAPI(t, s, "DELETE", "/api/v1/users/carol@example.com", nil, token, nil)))
+	assert.Check(t, is.Equal(http.StatusNotFound, doAPI(t, s, "GET", "/api/v1/users/carol@example.com", nil, token, nil)))
+	assert.Check(t, is.Equal(http.StatusBadRequest, doAPI(t, s, "DELETE", "/api/v1/users/admin", nil, token, nil)))
+
+	// changes are audited as the token's creator, and so is every call
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditAdmin, Subject: "accounts.google.com:1"})
+	assert.NilError(t, err)
+	assert.Assert(t, len(events) > 0)
+	assert.Check(t, is.Equal("admin", events[0].Actor))
+	assert.Check(t, events[0].APIToken != "")
+	events, err = s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditAPI})
+	assert.NilError(t, err)
+	assert.Assert(t, len(events) > 0)
+	assert.Check(t, is.Equal("DELETE /api/v1/users/admin", events[0].Op))
+	assert.Check(t, is.Contains(events[0].Message, "400"))
+}
+
+func TestAPIGroupsAndSessions(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{})
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+	bobSession := loginAs(t, s, User{ID: "bob"})
+	token := newAPIToken(t, s, admin, ScopeGroupsRead, ScopeGroupsWrite, ScopeSessionsRead, ScopeSessionsWrite)
+
+	var group apiGroup
+	assert.Check(t, is.Equal(http.StatusCreated, doAPI(t, s, "POST", "/api/v1/groups", map[string]string{"id": "eng"}, token, &group)))
+	assert.Check(t, is.Equal(http.StatusConflict, doAPI(t, s, "POST", "/api/v1/groups", map[string]string{"id": "eng"}, token, nil)))
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "PUT", "/api/v1/groups/eng/members/bob", nil, token, &group)))
+	assert.Check(t, is.DeepEqual([]string{"bob"}, group.Members))
+	assert.Check(t, is.Equal(http.StatusNotFound, doAPI(t, s, "PUT", "/api/v1/groups/eng/members/nobody", nil, token, nil)))
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "POST", "/api/v1/groups/eng/roles", map[string]string{"role": "dev"}, token, &group)))
+	assert.Check(t, is.Len(group.Roles, 1))
+
+	var groups []apiGroup
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "GET", "/api/v1/groups", nil, token, &groups)))
+	assert.Check(t, is.Len(groups, 1))
+
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "DELETE", "/api/v1/groups/eng/roles?role=dev", nil, token, &group)))
+	assert.Check(t, is.Len(group.Roles, 0))
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "DELETE", "/api/v1/groups/eng/members/bob", nil, token, &group)))
+	assert.Check(t, is.Len(group.Members, 0))
+	assert.Check(t, is.Equal(http.StatusNoContent, doAPI(t, s, "DELETE", "/api/v1/groups/eng", nil, token, nil)))
+	assert.Check(t, is.Equal(http.StatusNotFound, doAPI(t, s, "GET", "/api/v1/groups/eng", nil, token, nil)))
+
+	// sessions are listed by handle, never by ID
+	var sessions []apiSession
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "GET", "/api/v1/sessions?user=bob", nil, token, &sessions)))
+	assert.Assert(t, is.Len(sessions, 1))
+	assert.Check(t, sessions[0].ID != bobSession)
+	assert.Check(t, is.Equal(http.StatusNoContent, doAPI(t, s, "DELETE", "/api/v1/sessions/"+sessions[0].ID, nil, token, nil)))
+	_, err := s.Store.GetSession(ctx, bobSession)
+	assert.Check(t, is.Equal(ErrNotFound, err))
+	assert.Check(t, is.Equal(http.StatusNotFound, doAPI(t, s, "DELETE", "/api/v1/sessions/"+sessions[0].ID, nil, token, nil)))
+}
+
+func TestOpenAPI(t *testing.T) {
+	s, _ := newTestServer(t, Config{})
+	var doc struct {
+		OpenAPI string                 `json:"openapi"`
+		Paths   map[string]interface{} `json:"paths"`
+	}
+	assert.Check(t, is.Equal(http.StatusOK, doAPI(t, s, "GET", "/api/v1/openapi.json", nil, "", &doc)))
+	assert.Check(t, is.Equal("3.0.3", doc.OpenAPI))
+	assert.Check(t, doc.Paths["/users/{id}/roles"] != nil)
+}
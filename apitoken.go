@@ -0,0 +1,262 @@
+package tvm
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"goji.io/pat"
+)
+
+// APIScope limits what an API token may do.
+type APIScope string
+
+const (
+	ScopeUsersRead     APIScope = "users:read"
+	ScopeUsersWrite    APIScope = "users:write"
+	ScopeGroupsRead    APIScope = "groups:read"
+	ScopeGroupsWrite   APIScope = "groups:write"
+	ScopeSessionsRead  APIScope = "sessions:read"
+	ScopeSessionsWrite APIScope = "sessions:write"
+
+	// ScopeAdminsWrite allows changes that give a user power over others
+	// or a way around approval: admin, break-glass and approver.
+	ScopeAdminsWrite APIScope = "admins:write"
+)
+
+var apiScopes = []APIScope{
+	ScopeUsersRead,
+	ScopeUsersWrite,
+	ScopeGroupsRead,
+	ScopeGroupsWrite,
+	ScopeSessionsRead,
+	ScopeSessionsWrite,
+	ScopeAdminsWrite,
+}
+
+// APIToken lets a program use the admin API with the authority of the admin
+// who created it, limited to Scopes. Only a hash of the token's secret is
+// stored.
+type APIToken struct {
+	ID   string
+	Name string
+
+	// Hash is the hex SHA-256 of the token's secret.
+	Hash string
+
+	Scopes    []APIScope
+	CreatedBy string
+	Created   time.Time
+	Expires   time.Time
+}
+
+// HasScope returns true if the token grants scope.
+func (t APIToken) HasScope(scope APIScope) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiTokenPrefix starts every API token, so that they are easy to spot in
+// code and logs. A token is the prefix, its ID, an underscore and its
+// secret.
+const apiTokenPrefix = "tvm_"
+
+// maxAPITokenLifetime is the longest an API token may be valid for.
+const maxAPITokenLifetime = 90 * 24 * time.Hour
+
+var (
+	errBadAPIToken  = errors.New("invalid API token")
+	errNoScopes     = errors.New("choose at least one scope")
+	errBadScope     = errors.New("unknown scope")
+	errBadLifetime  = errors.New("API tokens must expire within 90 days")
+	errTokenExpired = errors.New("API token has expired")
+)
+
+// newSecret returns a random string suitable for a bearer credential.
+func newSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashSecret returns the hex SHA-256 of secret, for storing in its place.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// createAPIToken stores a new API token and returns it along with the token
+// string to give to the program that will use it. The token string cannot
+// be recovered later.
+func (s *Server) createAPIToken(ctx context.Context, r *http.Request, actor adminActor, name string, scopes []APIScope, lifetime time.Duration) (*APIToken, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", errNoScopes
+	}
+	for _, scope := range scopes {
+		known := false
+		for _, s := range apiScopes {
+			known = known || s == scope
+		}
+		if !known {
+			return nil, "", errBadScope
+		}
+	}
+	if lifetime <= 0 || lifetime > maxAPITokenLifetime {
+		return nil, "", errBadLifetime
+	}
+
+	secretStr, err := newSecret()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	token := APIToken{
+		ID:        newID(),
+		Name:      name,
+		Hash:      hashSecret(secretStr),
+		Scopes:    scopes,
+		CreatedBy: actor.UserID,
+		Created:   now,
+		Expires:   now.Add(lifetime),
+	}
+	if err := s.Store.PutAPIToken(ctx, token); err != nil {
+		return nil, "", err
+	}
+	s.auditAdmin(ctx, r, actor, AuditEvent{
+		Op:      "create_api_token",
+		Message: fmt.Sprintf("Created API token %s (%s) with scopes %v, expiring %s", token.ID, name, scopes, token.Expires.Format(time.RFC3339)),
+	})
+	return &token, apiTokenPrefix + token.ID + "_" + secretStr, nil
+}
+
+// revokeAPIToken deletes an API token.
+func (s *Server) revokeAPIToken(ctx context.Context, r *http.Request, actor adminActor, id string) (string, error) {
+	if err := s.Store.DeleteAPIToken(ctx, id); err != nil {
+		return "", err
+	}
+	flash := fmt.Sprintf("Revoked API token %s", id)
+	s.auditAdmin(ctx, r, actor, AuditEvent{
+		Op:      "revoke_api_token",
+		Message: flash,
+	})
+	return flash, nil
+}
+
+// authenticateAPIToken returns the API token given as a bearer token in r.
+// The token's creator must still be an active admin.
+func (s *Server) authenticateAPIToken(r *http.Request) (*APIToken, error) {
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !strings.HasPrefix(bearer, apiTokenPrefix) {
+		return nil, errBadAPIToken
+	}
+	parts := strings.SplitN(strings.TrimPrefix(bearer, apiTokenPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, errBadAPIToken
+	}
+
+	token, err := s.Store.GetAPIToken(r.Context(), parts[0])
+	if err == ErrNotFound {
+		return nil, errBadAPIToken
+	} else if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(parts[1])), []byte(token.Hash)) != 1 {
+		return nil, errBadAPIToken
+	}
+	if time.Now().After(token.Expires) {
+		return nil, errTokenExpired
+	}
+
+	creator, err := s.Store.GetUser(r.Context(), token.CreatedBy)
+	if err == ErrNotFound || (err == nil && (!creator.Admin || !creator.Active())) {
+		return nil, errBadAPIToken
+	} else if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+var apiTokenCreatedTemplate = template.Must(template.New("apitoken").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <title>TVM API token</title>
+</head>
+<body>
+<h1>API token {{ .Token.Name }}</h1>
+<p>Copy this token now. It will not be shown again.</p>
+<pre>{{ .Secret }}</pre>
+<p>Scopes: {{ range .Token.Scopes }}{{ . }} {{ end }}</p>
+<p>Expires: {{ .Token.Expires.Format "2006-01-02 15:04:05 MST" }}</p>
+<p><a href="/admin">Back to admin</a></p>
+</body>
+</html>
+`))
+
+// handleAdminCreateAPIToken creates an API token and shows it to the admin
+// once.
+func (s *Server) handleAdminCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	admin := s.authorizedAdmin(r)
+	if admin == nil {
+		http.Redirect(w, r, "/?format=admin", http.StatusFound)
+		return
+	}
+
+	r.ParseForm()
+	var scopes []APIScope
+	for _, scope := range r.PostForm["scope"] {
+		scopes = append(scopes, APIScope(scope))
+	}
+	lifetime, err := time.ParseDuration(r.FormValue("duration"))
+	if err != nil {
+		http.Error(w, errBadDuration.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, secret, err := s.createAPIToken(r.Context(), r, adminActor{UserID: admin.ID}, r.FormValue("name"), scopes, lifetime)
+	switch err {
+	case nil:
+	case errNoScopes, errBadScope, errBadLifetime:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	apiTokenCreatedTemplate.Execute(w, struct {
+		Token  *APIToken
+		Secret string
+	}{token, secret})
+}
+
+// handleAdminRevokeAPIToken revokes an API token.
+func (s *Server) handleAdminRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	admin := s.authorizedAdmin(r)
+	if admin == nil {
+		http.Redirect(w, r, "/?format=admin", http.StatusFound)
+		return
+	}
+	if _, err := s.revokeAPIToken(r.Context(), r, adminActor{UserID: admin.ID}, pat.Param(r, "id")); err != nil {
+		adminFormError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,245 @@
+package tvm
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type AuditEventType string
+
+const (
+	AuditLogin            AuditEventType = "login"
+	AuditKeyRegister      AuditEventType = "key.register"
+	AuditKeySign          AuditEventType = "key.sign"
+	AuditKeySignFailed    AuditEventType = "key.sign_failed"
+	AuditCredentialsIssue AuditEventType = "credentials.issue"
+	AuditAdmin            AuditEventType = "admin"
+	AuditWebhookFailed    AuditEventType = "webhook.failed"
+	AuditAccessRequest    AuditEventType = "access.request"
+	AuditAccessApprove    AuditEventType = "access.approve"
+	AuditAccessDeny       AuditEventType = "access.deny"
+	AuditGrantExpired     AuditEventType = "grant.expired"
+	AuditBreakGlass       AuditEventType = "break_glass"
+	AuditDirectorySync    AuditEventType = "directory.sync"
+	AuditSCIM             AuditEventType = "scim"
+	AuditEnroll           AuditEventType = "user.enroll"
+	AuditIdentity         AuditEventType = "user.identity"
+	AuditAPI              AuditEventType = "api"
+	AuditRoleCheck        AuditEventType = "role.check"
+)
+
+type AuditSeverity string
+
+// AuditSeverityHigh marks events that someone should look at promptly.
+const AuditSeverityHigh AuditSeverity = "high"
+
+var auditEventTypes = []AuditEventType{
+	AuditLogin,
+	AuditKeyRegister,
+	AuditKeySign,
+	AuditKeySignFailed,
+	AuditCredentialsIssue,
+	AuditAdmin,
+	AuditWebhookFailed,
+	AuditAccessRequest,
+	AuditAccessApprove,
+	AuditAccessDeny,
+	AuditGrantExpired,
+	AuditBreakGlass,
+	AuditDirectorySync,
+	AuditSCIM,
+	AuditEnroll,
+	AuditIdentity,
+	AuditAPI,
+	AuditRoleCheck,
+}
+
+// AuditEvent records something security relevant that happened. Audit
+// events are append-only: once written they are never changed or removed.
+type AuditEvent struct {
+	ID   string
+	Time time.Time
+	Type AuditEventType
+
+	// Severity is empty for routine events.
+	Severity AuditSeverity
+
+	// Actor is the ID of the user who did the thing, if known.
+	Actor string
+
+	// APIToken is the ID of the admin API token the actor used, if any.
+	APIToken string
+
+	// Subject is the ID of the user the thing was done to, for admin
+	// operations.
+	Subject string
+
+	// Group is the ID of the group an admin operation changed.
+	Group string
+
+	// Op is the admin operation, e.g. "add_role".
+	Op string
+
+	Role            string
+	DurationSeconds int
+	AccessKeyID     string
+
+	// Reason and Ticket are the justification given for the event.
+	Reason string
+	Ticket string
+
+	SourceIP  string
+	UserAgent string
+
+	// Before and After hold the state of the subject before and after an
+	// admin operation.
+	Before *AuditUserState
+	After  *AuditUserState
+
+	Message string
+}
+
+// AuditUserState is the part of a User that is recorded in the audit log.
+type AuditUserState struct {
+	ID      string `json:",omitempty"`
+	Email   string `json:",omitempty"`
+	Roles   []RoleGrant
+	Admin   bool
+	Devices int
+	Status  UserStatus `json:",omitempty"`
+
+	ApproverFor []string `json:",omitempty"`
+}
+
+func newAuditUserState(user User) *AuditUserState {
+	return &AuditUserState{
+		ID:      user.ID,
+		Email:   user.PrimaryEmail(),
+		Roles:   append([]RoleGrant{}, user.Roles...),
+		Admin:   user.Admin,
+		Devices: len(user.U2FDevices),
+		Status:  user.Status,
+
+		ApproverFor: append([]string(nil), user.ApproverFor...),
+	}
+}
+
+// AuditFilter selects audit events. Zero-valued fields match everything.
+type AuditFilter struct {
+	Type    AuditEventType
+	Actor   string
+	Subject string
+	Role    string
+	Since   time.Time
+	Until   time.Time
+
+	// Limit is the maximum number of events to return. Zero means no limit.
+	Limit int
+}
+
+// Match returns true if event is selected by f. It ignores Limit.
+func (f AuditFilter) Match(event AuditEvent) bool {
+	if f.Type != "" && f.Type != event.Type {
+		return false
+	}
+	if f.Actor != "" && f.Actor != event.Actor {
+		return false
+	}
+	if f.Subject != "" && f.Subject != event.Subject {
+		return false
+	}
+	if f.Role != "" && f.Role != event.Role {
+		return false
+	}
+	if !f.Since.IsZero() && event.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !event.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// audit fills in the common fields of event, including those from r if it
+// is not nil, sends it to each sink and writes it to the store. Errors are
+// logged and returned; callers that must not proceed without an audit
+// record should check the error.
+func (s *Server) audit(ctx context.Context, r *http.Request, event AuditEvent) error {
+	if event.ID == "" {
+		event.ID = newID()
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if r != nil {
+		event.SourceIP = s.sourceIP(r)
+		event.UserAgent = r.UserAgent()
+	}
+
+	for _, sink := range s.Sinks {
+		if err := sink.Send(ctx, event); err != nil {
+			log.Printf("cannot send audit event %s %s: %v", event.Type, event.ID, err)
+		}
+	}
+
+	if err := s.Store.PutAuditEvent(ctx, event); err != nil {
+		log.Printf("cannot write audit event %s %s: %v", event.Type, event.ID, err)
+		return err
+	}
+	return nil
+}
+
+func newID() string {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// sourceIP returns the address of the client that made r. Each trusted
+// proxy appends the address it saw to X-Forwarded-For, so the client is the
+// last entry that is not itself a trusted proxy. Anyone can send
+// X-Forwarded-For, so it is ignored unless r comes from a trusted proxy.
+func (s *Server) sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !s.isTrustedProxy(host) {
+		return host
+	}
+	xff := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(xff) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(xff[i])
+		if addr == "" {
+			continue
+		}
+		host = addr
+		if !s.isTrustedProxy(addr) {
+			break
+		}
+	}
+	return host
+}
+
+// isTrustedProxy returns true if addr is in Config.TrustedProxies.
+func (s *Server) isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package tvm
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A new TVM has no admin to invite anyone. Bootstrap creates the first one
+// directly in the store, pending until they log in with an enrollment code
+// that only the operator who ran it knows. Otherwise, whoever first
+// controlled that email address would become an admin.
+
+var (
+	errHasAdmin          = errors.New("TVM already has an admin; use tvm admin user promote instead")
+	errBadEnrollmentCode = errors.New("invalid or expired enrollment code")
+)
+
+const enrollmentCodePending = "waiting to log in with an enrollment code"
+
+// Bootstrap makes the user with the given email address an admin, creating
+// them if necessary, and returns an enrollment code that activates them
+// when they log in with it before lifetime passes. It fails if there is
+// already an active admin.
+func (s *Server) Bootstrap(ctx context.Context, actor string, email string, lifetime time.Duration) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !strings.Contains(email, "@") || strings.ContainsAny(email, "/\\ ") {
+		return "", errBadEmail
+	}
+	users, err := s.Store.ListUsers(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, user := range users {
+		if user.Admin && user.Active() {
+			return "", errHasAdmin
+		}
+	}
+
+	code, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+	bootstrap := func(user *User) {
+		user.Admin = true
+		user.Status = UserPending
+		user.StatusReason = enrollmentCodePending
+		user.StatusTime = time.Now()
+		user.EnrollmentCode = hashSecret(code)
+		user.EnrollmentCodeExpires = time.Now().Add(lifetime)
+	}
+
+	var before, after *AuditUserState
+	user, err := s.lookupUser(ctx, email)
+	switch err {
+	case nil:
+		err = s.Store.UpdateUser(ctx, user.ID, func(user *User) error {
+			before = newAuditUserState(*user)
+			bootstrap(user)
+			after = newAuditUserState(*user)
+			return nil
+		})
+	case ErrNotFound:
+		user = &User{ID: email, Email: email}
+		bootstrap(user)
+		after = newAuditUserState(*user)
+		err = s.Store.PutUser(ctx, *user)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	s.audit(ctx, nil, AuditEvent{
+		Type:    AuditAdmin,
+		Actor:   actor,
+		Subject: user.ID,
+		Op:      "bootstrap",
+		Before:  before,
+		After:   after,
+		Message: fmt.Sprintf("Bootstrapped %s as the first admin", email),
+	})
+	return code, nil
+}
+
+// EnrollmentURL returns the link that a user follows to log in with an
+// enrollment code.
+func (c Config) EnrollmentURL(code string) string {
+	u := c.RootURL
+	u.Path = "/"
+	u.RawQuery = url.Values{"format": {"admin"}, "enroll": {code}}.Encode()
+	return u.String()
+}
+
+// redeemEnrollmentCode activates user if code is their enrollment code.
+func (s *Server) redeemEnrollmentCode(ctx context.Context, r *http.Request, user *User, code string) (*User, error) {
+	var before, after *AuditUserState
+	err := s.Store.UpdateUser(ctx, user.ID, func(user *User) error {
+		if user.EnrollmentCode == "" || time.Now().After(user.EnrollmentCodeExpires) ||
+			subtle.ConstantTimeCompare([]byte(hashSecret(code)), []byte(user.EnrollmentCode)) != 1 {
+			return errBadEnrollmentCode
+		}
+		before = newAuditUserState(*user)
+		user.EnrollmentCode = ""
+		user.EnrollmentCodeExpires = time.Time{}
+		user.Status = UserActive
+		user.StatusReason = ""
+		user.StatusTime = time.Now()
+		after = newAuditUserState(*user)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.audit(ctx, r, AuditEvent{
+		Type:    AuditEnroll,
+		Actor:   user.ID,
+		Subject: user.ID,
+		Before:  before,
+		After:   after,
+		Message: "enrolled with an enrollment code",
+	})
+	return s.Store.GetUser(ctx, user.ID)
+}
@@ -0,0 +1,197 @@
+package tvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"goji.io/pat"
+)
+
+type ReviewStatus string
+
+const (
+	ReviewOpen   ReviewStatus = "open"
+	ReviewClosed ReviewStatus = "closed"
+)
+
+// ReviewItem records a use of break-glass access. Each one must be reviewed
+// after the incident and closed by an admin.
+type ReviewItem struct {
+	ID string
+
+	// EventID is the ID of the break_glass audit event for the use.
+	EventID string
+
+	UserID  string
+	Role    string
+	Reason  string
+	Ticket  string
+	Created time.Time
+	Status  ReviewStatus
+
+	// ClosedBy is the ID of the admin who closed the review, and Notes are
+	// what they found.
+	ClosedBy string
+	Closed   time.Time
+	Notes    string
+
+	// Version is incremented by each call to Store.UpdateReviewItem.
+	Version int64
+}
+
+var errReviewClosed = errors.New("review has already been closed")
+
+// breakGlassSessionLifetime is how long a session started by
+// handleBreakGlassLogin lasts.
+const breakGlassSessionLifetime = 5 * time.Minute
+
+// breakGlass issues credentials for the break-glass role to a user who is
+// designated for it. It skips the usual role and approval checks, but
+// always requires a reason, records a review item once the credentials are
+// issued and audits the use as a high-severity event, which every webhook
+// is notified of.
+func (s *Server) breakGlass(w http.ResponseWriter, r *http.Request, user *User) {
+	role := s.Config.BreakGlassRole
+	if role == "" {
+		http.Error(w, "break-glass access is not configured", http.StatusNotFound)
+		return
+	}
+	if !user.BreakGlass {
+		http.Error(w, "you are not designated for break-glass access", http.StatusForbidden)
+		return
+	}
+
+	roleConfig := s.Config.Roles[role]
+	roleConfig.RequireReason = true
+	if !s.checkJustification(w, r, role, roleConfig) {
+		return
+	}
+
+	item := ReviewItem{
+		ID:      newID(),
+		EventID: newID(),
+		UserID:  user.ID,
+		Role:    role,
+		Reason:  strings.TrimSpace(r.URL.Query().Get("reason")),
+		Ticket:  strings.TrimSpace(r.URL.Query().Get("ticket")),
+		Created: time.Now(),
+		Status:  ReviewOpen,
+	}
+	recordReview := func(ctx context.Context) error {
+		if err := s.Store.PutReviewItem(ctx, item); err != nil {
+			return fmt.Errorf("cannot record review item: %w", err)
+		}
+		return nil
+	}
+
+	s.issueCredentials(w, r, user, role, nil, recordReview, AuditEvent{
+		ID:       item.EventID,
+		Type:     AuditBreakGlass,
+		Severity: AuditSeverityHigh,
+		Message:  fmt.Sprintf("review %s", item.ID),
+	})
+}
+
+// handleBreakGlassLogin lets a user designated for break-glass access log
+// in with their key alone, for when the identity provider is unavailable.
+// The user names themselves by ID or email address in the user parameter
+// and must then sign with one of their registered keys. The resulting
+// session is short-lived and good only for break-glass access; the other
+// parameters are passed on as for a break-glass request to /.
+func (s *Server) handleBreakGlassLogin(w http.ResponseWriter, r *http.Request) {
+	if s.Config.BreakGlassRole == "" {
+		http.Error(w, "break-glass access is not configured", http.StatusNotFound)
+		return
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("user"))
+	user, err := s.lookupUser(r.Context(), name)
+	if err != nil || !user.BreakGlass || !user.Active() || len(user.U2FDevices) == 0 {
+		s.audit(r.Context(), r, AuditEvent{
+			Type:    AuditLogin,
+			Actor:   name,
+			Message: "break-glass login refused",
+		})
+		http.Error(w, "break-glass login is not available for this user", http.StatusForbidden)
+		return
+	}
+
+	params := r.URL.Query()
+	params.Del("user")
+	params.Set("break_glass", "1")
+	session := Session{
+		ID:         newSessionID(),
+		UserID:     user.ID,
+		Params:     params,
+		BreakGlass: true,
+		Expires:    time.Now().Add(breakGlassSessionLifetime),
+	}
+	if err := s.Store.PutSession(r.Context(), session); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.setSessionCookie(w, session)
+
+	s.audit(r.Context(), r, AuditEvent{
+		Type:     AuditLogin,
+		Actor:    user.ID,
+		Severity: AuditSeverityHigh,
+		Message:  "break-glass login without the identity provider",
+	})
+	s.sendU2FChallenge(w, r, session, *user)
+}
+
+// handleCloseReview closes a break-glass review item.
+func (s *Server) handleCloseReview(w http.ResponseWriter, r *http.Request) {
+	admin := s.authorizedAdmin(r)
+	if admin == nil {
+		http.Redirect(w, r, "/?format=admin", http.StatusFound)
+		return
+	}
+
+	notes := strings.TrimSpace(r.FormValue("notes"))
+	if notes == "" {
+		http.Error(w, "closing a review requires notes", http.StatusBadRequest)
+		return
+	}
+
+	var closed ReviewItem
+	err := s.Store.UpdateReviewItem(r.Context(), pat.Param(r, "id"), func(item *ReviewItem) error {
+		if item.Status == ReviewClosed {
+			return errReviewClosed
+		}
+		item.Status = ReviewClosed
+		item.ClosedBy = admin.ID
+		item.Closed = time.Now()
+		item.Notes = notes
+		closed = *item
+		return nil
+	})
+	switch err {
+	case nil:
+	case ErrNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errReviewClosed:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.audit(r.Context(), r, AuditEvent{
+		Type:    AuditAdmin,
+		Actor:   admin.ID,
+		Subject: closed.UserID,
+		Op:      "close_review",
+		Role:    closed.Role,
+		Message: fmt.Sprintf("closed review %s: %s", closed.ID, notes),
+	})
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
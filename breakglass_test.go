@@ -0,0 +1,156 @@
+package tvm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestBreakGlass(t *testing.T) {
+	ctx := context.Background()
+	s, stsSvc := newTestServer(t, Config{
+		BreakGlassRole: "emergency",
+		Roles: map[string]RoleConfig{
+			"emergency": {RequireApproval: true},
+		},
+	})
+
+	alice := loginAs(t, s, User{ID: "alice", BreakGlass: true})
+	bob := loginAs(t, s, User{ID: "bob", Roles: []RoleGrant{{Role: "emergency"}}})
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+
+	// a reason is required
+	w := do(s, "GET", "/?break_glass=1&format=sh", nil, alice)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+	assert.Check(t, is.Len(stsSvc.inputs, 0))
+
+	// only designated users may break glass
+	w = do(s, "GET", "/?break_glass=1&format=sh&reason=outage", nil, bob)
+	assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+	assert.Check(t, is.Len(stsSvc.inputs, 0))
+
+	// no approval is needed
+	w = do(s, "GET", "/?break_glass=1&format=sh&reason=outage", nil, alice)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.Contains(w.Body.String(), "export AWS_ACCESS_KEY_ID=ASIAEXAMPLE"))
+	assert.Assert(t, is.Len(stsSvc.inputs, 1))
+	assert.Check(t, is.Equal("emergency", *stsSvc.inputs[0].RoleArn))
+
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditBreakGlass})
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(events, 1))
+	assert.Check(t, is.Equal(AuditSeverityHigh, events[0].Severity))
+	assert.Check(t, is.Equal("alice", events[0].Actor))
+	assert.Check(t, is.Equal("outage", events[0].Reason))
+
+	items, err := s.Store.ListReviewItems(ctx)
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(items, 1))
+	assert.Check(t, is.Equal(ReviewOpen, items[0].Status))
+	assert.Check(t, is.Equal(events[0].ID, items[0].EventID))
+	id := items[0].ID
+
+	// closing the review
+	w = do(s, "POST", "/admin/reviews/"+id, url.Values{"notes": {"ok"}}, alice)
+	assert.Check(t, is.Equal(http.StatusFound, w.Code)) // not an admin
+	w = do(s, "POST", "/admin/reviews/"+id, url.Values{}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+	w = do(s, "POST", "/admin/reviews/"+id, url.Values{"notes": {"database outage, INC-1"}}, admin)
+	assert.Check(t, is.Equal(http.StatusSeeOther, w.Code))
+	w = do(s, "POST", "/admin/reviews/"+id, url.Values{"notes": {"again"}}, admin)
+	assert.Check(t, is.Equal(http.StatusConflict, w.Code))
+
+	item, err := s.Store.GetReviewItem(ctx, id)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(ReviewClosed, item.Status))
+	assert.Check(t, is.Equal("admin", item.ClosedBy))
+	assert.Check(t, is.Equal("database outage, INC-1", item.Notes))
+}
+
+func TestBreakGlassNotConfigured(t *testing.T) {
+	s, stsSvc := newTestServer(t, Config{})
+	alice := loginAs(t, s, User{ID: "alice", BreakGlass: true})
+
+	w := do(s, "GET", "/?break_glass=1&format=sh&reason=outage", nil, alice)
+	assert.Check(t, is.Equal(http.StatusNotFound, w.Code))
+	assert.Check(t, is.Len(stsSvc.inputs, 0))
+}
+
+func TestBreakGlassLogin(t *testing.T) {
+	ctx := context.Background()
+	s, stsSvc := newTestServer(t, Config{BreakGlassRole: "emergency"})
+	device := []U2FDevice{{Counter: 1}}
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "alice", Email: "alice@example.com", BreakGlass: true, U2FDevices: device}))
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "bob", Email: "bob@example.com", U2FDevices: device}))
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "carol", Email: "carol@example.com", BreakGlass: true}))
+
+	// only designated users who have a key may log in this way
+	for _, user := range []string{"bob@example.com", "carol@example.com", "nobody@example.com"} {
+		w := do(s, "GET", "/break-glass?user="+url.QueryEscape(user), nil, "")
+		assert.Check(t, is.Equal(http.StatusForbidden, w.Code), user)
+	}
+
+	w := do(s, "GET", "/break-glass?user=alice%40example.com&format=sh&reason=idp+down", nil, "")
+	assert.Assert(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.Contains(w.Body.String(), "Press the button"))
+	var sessionID string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "session" {
+			sessionID = cookie.Value
+		}
+	}
+	session, err := s.Store.GetSession(ctx, sessionID)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("alice", session.UserID))
+	assert.Check(t, session.BreakGlass)
+	assert.Check(t, !session.U2F)
+	assert.Check(t, session.U2FChallenge != nil)
+	assert.Check(t, is.Equal("1", session.Params.Get("break_glass")))
+	assert.Check(t, is.Equal("idp down", session.Params.Get("reason")))
+
+	// the key cannot be swapped out before signing
+	w = do(s, "GET", "/u2f/register", nil, sessionID)
+	assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+
+	// once alice has signed with her key, she may break glass
+	err = s.Store.UpdateSession(ctx, sessionID, func(session *Session) error {
+		session.U2F = true
+		return nil
+	})
+	assert.NilError(t, err)
+
+	// a review item is recorded only for credentials that were issued
+	stsSvc.err = errors.New("throttled")
+	w = do(s, "GET", "/?"+session.Params.Encode(), nil, sessionID)
+	stsSvc.err = nil
+	assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+	items, err := s.Store.ListReviewItems(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(items, 0))
+
+	w = do(s, "GET", "/?"+session.Params.Encode(), nil, sessionID)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.Contains(w.Body.String(), "export AWS_ACCESS_KEY_ID=ASIAEXAMPLE"))
+	items, err = s.Store.ListReviewItems(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(items, 1))
+
+	// but do nothing else
+	w = do(s, "GET", "/requests", nil, sessionID)
+	assert.Check(t, is.Equal(http.StatusFound, w.Code))
+	w = do(s, "GET", "/u2f/register", nil, sessionID)
+	assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+	w = do(s, "GET", "/?format=sh&role=emergency", nil, sessionID)
+	assert.Check(t, is.Equal(http.StatusFound, w.Code))
+	_, err = s.Store.GetSession(ctx, sessionID)
+	assert.Check(t, is.Equal(ErrNotFound, err))
+
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditLogin})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(events, 4))
+}
@@ -0,0 +1,142 @@
+package tvm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+// A role with a chain is not assumed with TVM's own credentials. TVM
+// assumes each hub role in the chain in turn, each with the credentials of
+// the one before, and then the role itself with the credentials of the last
+// hub. The role then needs to trust only the last hub, and only the first
+// hub needs to trust TVM.
+//
+// STS limits sessions from a chained role to one hour, so credentials for
+// roles with a chain last at most that long.
+
+// RoleHop is a role that TVM assumes on the way to the role it issues
+// credentials for.
+type RoleHop struct {
+	Role string
+
+	// ExternalID, if set, is passed to STS when assuming the role, for trust
+	// policies that require sts:ExternalId.
+	ExternalID string
+
+	// SessionName is the role session name, in which {user} is replaced by
+	// the ID of the user. It defaults to tvm:{user}.
+	SessionName string
+}
+
+// sessionName returns the role session name for assuming the role for the
+// user with ID userID.
+func (h RoleHop) sessionName(userID string) string {
+	name := h.SessionName
+	if name == "" {
+		name = "tvm:{user}"
+	}
+	return strings.ReplaceAll(name, "{user}", userID)
+}
+
+// hubSessionSeconds is how long the credentials of hub roles last. They are
+// used only to assume the next role, so this is the least STS allows.
+const hubSessionSeconds = 900
+
+// maxChainedSessionSeconds is the longest session STS allows from a chained
+// role.
+const maxChainedSessionSeconds = 3600
+
+// hops returns the roles that TVM assumes, in order, to get credentials for
+// role: the hubs in its chain and then role itself.
+func (c Config) hops(role string) []RoleHop {
+	config := c.Roles[role]
+	hops := append([]RoleHop(nil), config.Chain...)
+	return append(hops, RoleHop{Role: role, ExternalID: config.ExternalID, SessionName: config.SessionName})
+}
+
+// sessionSeconds returns how long credentials for role last.
+func (c Config) sessionSeconds(role string) int {
+	if len(c.Roles[role].Chain) > 0 && c.CredentialLifetimeSeconds > maxChainedSessionSeconds {
+		return maxChainedSessionSeconds
+	}
+	return c.CredentialLifetimeSeconds
+}
+
+// lastHub returns the ARN of the last hub in role's chain, which role's trust
+// policy must allow in place of TVM, or "" if role has no chain.
+func (c Config) lastHub(role string) string {
+	if chain := c.Roles[role].Chain; len(chain) > 0 {
+		return chain[len(chain)-1].Role
+	}
+	return ""
+}
+
+// HopError says which role in a chain TVM could not assume.
+type HopError struct {
+	// Hop is the position of the role in the chain, from 1, of Hops.
+	Hop  int
+	Hops int
+	Role string
+	Err  error
+}
+
+func (e *HopError) Error() string {
+	if e.Hops == 1 {
+		return fmt.Sprintf("cannot assume %s: %v", e.Role, e.Err)
+	}
+	return fmt.Sprintf("cannot assume %s, hop %d of %d: %v", e.Role, e.Hop, e.Hops, e.Err)
+}
+
+func (e *HopError) Unwrap() error {
+	return e.Err
+}
+
+// assumeRole returns credentials for role on behalf of the user with ID
+// userID, following the role's chain if it has one. Session tags are passed
+// only to role itself. Errors are *HopError.
+func (s *Server) assumeRole(ctx context.Context, userID, role string, tags []*sts.Tag) (*sts.Credentials, error) {
+	hops := s.Config.hops(role)
+	client, err := s.baseSTS(hops[0].Role)
+	if err != nil {
+		return nil, &HopError{Hop: 1, Hops: len(hops), Role: hops[0].Role, Err: err}
+	}
+	var creds *sts.Credentials
+	for i, hop := range hops {
+		if i > 0 {
+			client = s.stsWithCredentials(hop.Role, creds)
+		}
+		input := &sts.AssumeRoleInput{
+			DurationSeconds: aws.Int64(hubSessionSeconds),
+			RoleArn:         aws.String(hop.Role),
+			RoleSessionName: aws.String(hop.sessionName(userID)),
+		}
+		if hop.ExternalID != "" {
+			input.ExternalId = aws.String(hop.ExternalID)
+		}
+		if i == len(hops)-1 {
+			input.DurationSeconds = aws.Int64(int64(s.Config.sessionSeconds(role)))
+			input.Tags = tags
+		}
+		output, err := client.AssumeRoleWithContext(ctx, input)
+		if err != nil {
+			return nil, &HopError{Hop: i + 1, Hops: len(hops), Role: hop.Role, Err: err}
+		}
+		creds = output.Credentials
+	}
+	return creds, nil
+}
+
+// stsWithCredentials returns an STS client that assumes role with creds.
+func (s *Server) stsWithCredentials(role string, creds *sts.Credentials) stsiface.STSAPI {
+	return sts.New(s.awsSession, s.Config.stsConfig(role).WithCredentials(credentials.NewStaticCredentials(
+		aws.StringValue(creds.AccessKeyId),
+		aws.StringValue(creds.SecretAccessKey),
+		aws.StringValue(creds.SessionToken),
+	)))
+}
@@ -0,0 +1,127 @@
+package tvm
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// fakeSTSEndpoint serves sts:AssumeRole for roles in Trust, which maps each
+// role to the access key it trusts. Credentials for a role have the access
+// key AKID<role name>. It records each request and the region it was signed
+// for.
+type fakeSTSEndpoint struct {
+	Trust    map[string]string
+	Requests []url.Values
+	Regions  []string
+}
+
+var signingRegionPattern = regexp.MustCompile(`Credential=[^/]+/[0-9]+/([^/]+)/sts/`)
+
+func (f *fakeSTSEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	accessKey := credentialPattern.FindStringSubmatch(r.Header.Get("Authorization"))[1]
+	f.Requests = append(f.Requests, r.Form)
+	f.Regions = append(f.Regions, signingRegionPattern.FindStringSubmatch(r.Header.Get("Authorization"))[1])
+	role := r.Form.Get("RoleArn")
+	if trusted, ok := f.Trust[role]; !ok || trusted != accessKey {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>AccessDenied</Code><Message>not authorized</Message></Error></ErrorResponse>`))
+		return
+	}
+
+	type credentials struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      string
+	}
+	type result struct {
+		Credentials credentials
+	}
+	buf, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"AssumeRoleResponse"`
+		Result  result   `xml:"AssumeRoleResult"`
+	}{Result: result{Credentials: credentials{
+		AccessKeyId:     "AKID" + role[strings.LastIndex(role, "/")+1:],
+		SecretAccessKey: "secret",
+		SessionToken:    "token",
+		Expiration:      "2030-01-01T00:00:00Z",
+	}}})
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(buf)
+}
+
+func TestRoleChain(t *testing.T) {
+	const (
+		hub   = "arn:aws:iam::2:role/hub"
+		spoke = "arn:aws:iam::3:role/spoke"
+		other = "arn:aws:iam::4:role/other"
+	)
+	endpoint := &fakeSTSEndpoint{Trust: map[string]string{spoke: "ASIAEXAMPLE"}}
+	httpServer := httptest.NewServer(endpoint)
+	defer httpServer.Close()
+
+	s, stsSvc := newTestServer(t, Config{
+		CredentialLifetimeSeconds: 7200,
+		Roles: map[string]RoleConfig{
+			spoke: {
+				Chain:         []RoleHop{{Role: hub, ExternalID: "hub-id", SessionName: "tvm-hub-{user}"}},
+				ExternalID:    "spoke-id",
+				SessionName:   "{user}",
+				RequireReason: true,
+			},
+			other: {Chain: []RoleHop{{Role: hub}}},
+		},
+	})
+	var err error
+	s.awsSession, err = awssession.NewSession(&aws.Config{
+		Endpoint:    aws.String(httpServer.URL),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("AKIDTVM", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	assert.NilError(t, err)
+	alice := loginAs(t, s, User{ID: "alice", Roles: []RoleGrant{{Role: spoke}, {Role: other}}})
+
+	w := do(s, "GET", "/?format=sh&reason=deploy&role="+url.QueryEscape(spoke), nil, alice)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.Contains(w.Body.String(), "AWS_ACCESS_KEY_ID=AKIDspoke"))
+
+	// the hub is assumed with TVM's credentials, briefly and without tags
+	assert.Assert(t, is.Len(stsSvc.inputs, 1))
+	assert.Check(t, is.Equal(hub, *stsSvc.inputs[0].RoleArn))
+	assert.Check(t, is.Equal("hub-id", aws.StringValue(stsSvc.inputs[0].ExternalId)))
+	assert.Check(t, is.Equal("tvm-hub-alice", *stsSvc.inputs[0].RoleSessionName))
+	assert.Check(t, is.Equal(int64(hubSessionSeconds), *stsSvc.inputs[0].DurationSeconds))
+	assert.Check(t, is.Len(stsSvc.inputs[0].Tags, 0))
+
+	// and the spoke with the hub's, for at most an hour
+	assert.Assert(t, is.Len(endpoint.Requests, 1))
+	assert.Check(t, is.Equal(spoke, endpoint.Requests[0].Get("RoleArn")))
+	assert.Check(t, is.Equal("spoke-id", endpoint.Requests[0].Get("ExternalId")))
+	assert.Check(t, is.Equal("alice", endpoint.Requests[0].Get("RoleSessionName")))
+	assert.Check(t, is.Equal("3600", endpoint.Requests[0].Get("DurationSeconds")))
+	assert.Check(t, is.Equal("tvm:reason", endpoint.Requests[0].Get("Tags.member.1.Key")))
+
+	// errors say which hop failed
+	w = do(s, "GET", "/?format=sh&role="+url.QueryEscape(other), nil, alice)
+	assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+	assert.Check(t, is.Equal("sts.AssumeRole failed for "+other+", hop 2 of 2\n", w.Body.String()))
+
+	// the spoke must trust the hub rather than TVM
+	out, err := runAdmin(t, s, "roles trust-policy "+spoke)
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(out, `"AWS": "`+hub+`"`))
+	assert.Check(t, is.Contains(out, `"sts:ExternalId": "spoke-id"`))
+}
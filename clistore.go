@@ -28,6 +28,9 @@ type Credential struct {
 	SecretAccessKey string
 	SessionToken    string
 	Expires         time.Time
+
+	// Region is the role's default region, if it has one.
+	Region string
 }
 
 var _ ClientStorage = FileClientStorage{}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
+	"os"
 
 	"github.com/akrylysov/algnhsa"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -10,7 +12,16 @@ import (
 )
 
 func main() {
-	svr, err := tvm.NewServer()
+	// TVM_CONFIG holds the server configuration as JSON, since a function
+	// has no command line.
+	var config tvm.Config
+	if configJSON := os.Getenv("TVM_CONFIG"); configJSON != "" {
+		if err := json.Unmarshal([]byte(configJSON), &config); err != nil {
+			log.Fatalf("cannot parse TVM_CONFIG: %s", err)
+		}
+	}
+
+	svr, err := tvm.NewServer(config)
 	if err != nil {
 		log.Fatalf("cannot initialize server: %s", err)
 	}
@@ -2,18 +2,33 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
+	"cloud.google.com/go/firestore"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/go-redis/redis/v8"
+
 	"github.com/nametaginc/tvm"
 )
 
@@ -21,6 +36,21 @@ func main() {
 	if len(os.Args) > 1 && os.Args[1] == "serve" {
 		serveMain()
 		return
+	} else if len(os.Args) > 1 && os.Args[1] == "admin" {
+		if err := adminMain(); err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR", err.Error())
+			os.Exit(1)
+		}
+	} else if len(os.Args) > 1 && os.Args[1] == "roles" {
+		if err := adminMain("roles"); err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR", err.Error())
+			os.Exit(1)
+		}
+	} else if len(os.Args) > 1 && os.Args[1] == "approve" {
+		if err := approveMain(); err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR", err.Error())
+			os.Exit(1)
+		}
 	} else {
 		if err := cliMain(); err != nil {
 			fmt.Fprintln(os.Stderr, "ERROR", err.Error())
@@ -31,29 +61,207 @@ func main() {
 
 func serveMain() {
 	os.Args = append([]string{os.Args[0]}, os.Args[2:]...)
+	configPath := flag.String("config", "", "Read the role catalog, webhooks and other settings from this JSON file")
 	listenPort := flag.String("listen", "", "Run the server, listening on the specified port")
 	rootURL := flag.String("url", "", "The URL of the server")
 	oauth2ClientID := flag.String("oauth2-client-id", "", "")
 	oauth2ClientSecret := flag.String("oauth2-client-secret", "", "")
 	sessionMaxAgeSeconds := flag.Int("session-max-age", 120, "Number of seconds that an authentication session lasts")
+	storeFlags := addStoreFlags()
+	accessFilePath := flag.String("access-file", "", "Apply this access file at startup and make it authoritative, so that roles, admins and groups cannot be changed in the admin UI")
+	syslogURL := flag.String("syslog", "", "Send audit events to this syslog server, e.g. tcp://siem:514, udp://siem:514 or tls://siem:6514")
+	eventsFile := flag.String("events-file", "", "Append audit events as JSON lines to this file")
+	eventsFileMaxBytes := flag.Int64("events-file-max-bytes", 100<<20, "Rotate the events file when it reaches this size")
+	eventsFileMaxFiles := flag.Int("events-file-max-files", 5, "Number of rotated events files to keep")
+	eventsStdout := flag.Bool("events-stdout", false, "Write audit events as JSON lines to standard output")
+	eventBufferSize := flag.Int("event-buffer", 1000, "Number of audit events to queue for each sink before dropping them")
+	sweepInterval := flag.Duration("sweep-interval", time.Minute, "How often to remove expired role grants")
+	migrate := flag.Bool("migrate", false, "Rewrite the stored data in the current format, rekeying users stored by email through the directory, then exit")
+	directoryCredentials := flag.String("directory-credentials", "", "Sync with Google Workspace using the service account key in this file")
+	directoryAdmin := flag.String("directory-admin", "", "The Google Workspace admin that the directory service account acts as")
+	directorySyncInterval := flag.Duration("directory-sync-interval", 15*time.Minute, "How often to sync with the directory")
+	checkRoles := flag.Bool("check-roles", true, "Check with IAM that TVM can assume roles when they are granted, and report granted roles that it cannot")
+	roleCheckInterval := flag.Duration("role-check-interval", 24*time.Hour, "How often to report granted roles that TVM cannot assume")
+	organizationRefreshInterval := flag.Duration("organization-refresh-interval", time.Hour, "How often to list the accounts in AWS Organizations")
 	flag.Parse()
 
+	if *migrate {
+		store, err := storeFlags.open(context.Background())
+		if err != nil {
+			log.Fatalf("cannot open store: %v", err)
+		}
+		srv := &tvm.Server{Store: store}
+		if *directoryCredentials != "" {
+			if srv.Directory, err = openDirectory(*directoryCredentials, *directoryAdmin); err != nil {
+				log.Fatalf("cannot connect to directory: %v", err)
+			}
+		}
+		count, err := srv.Migrate(context.Background())
+		if err != nil {
+			log.Fatalf("migration failed: %v", err)
+		}
+		log.Printf("migrated %d users", count)
+		return
+	}
+
 	if listenPort != nil && *listenPort != "" {
+		config, err := readConfig(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var accessFile *tvm.AccessFile
+		if *accessFilePath != "" {
+			if accessFile, err = tvm.ReadAccessFile(*accessFilePath); err != nil {
+				log.Fatalf("cannot read access file: %v", err)
+			}
+			if len(accessFile.Roles) > 0 {
+				config.Roles = accessFile.Roles
+			}
+			config.ManagedAccess = true
+		}
+
 		rootURL, err := url.Parse(*rootURL)
-		config := tvm.Config{
-			RootURL:              *rootURL,
-			OAuth2ClientID:      *oauth2ClientID,
-			OAuth2ClientSecret:   *oauth2ClientSecret,
-			SessionMaxAgeSeconds: *sessionMaxAgeSeconds,
+		if err != nil {
+			log.Fatalf("cannot parse URL: %v", err)
 		}
+		config.RootURL = *rootURL
+		config.OAuth2ClientID = *oauth2ClientID
+		config.OAuth2ClientSecret = *oauth2ClientSecret
+		config.SessionMaxAgeSeconds = *sessionMaxAgeSeconds
 		srv, err := tvm.NewServer(config)
 		if err != nil {
 			log.Fatalf("cannot start server: %v", err)
 		}
-		srv.Store = tvm.LocalStore{Path: "data"}
+		srv.Store, err = storeFlags.open(context.Background())
+		if err != nil {
+			log.Fatalf("cannot open store: %v", err)
+		}
+		if *checkRoles {
+			awsSession, err := awssession.NewSession()
+			if err != nil {
+				log.Fatalf("cannot connect to IAM: %v", err)
+			}
+			srv.IAM = iam.New(awsSession)
+		}
+		if config.Organization.Enabled() {
+			awsSession, err := awssession.NewSession()
+			if err != nil {
+				log.Fatalf("cannot connect to AWS Organizations: %v", err)
+			}
+			srv.Organizations = newOrganizations(awsSession, config.Organization)
+		}
+
+		if *syslogURL != "" {
+			u, err := url.Parse(*syslogURL)
+			if err != nil {
+				log.Fatalf("cannot parse syslog URL: %v", err)
+			}
+			srv.Sinks = append(srv.Sinks, tvm.NewAsyncSink(&tvm.SyslogSink{Network: u.Scheme, Addr: u.Host}, *eventBufferSize))
+		}
+		if *eventsFile != "" {
+			srv.Sinks = append(srv.Sinks, tvm.NewAsyncSink(&tvm.JSONLinesSink{
+				Path:     *eventsFile,
+				MaxBytes: *eventsFileMaxBytes,
+				MaxFiles: *eventsFileMaxFiles,
+			}, *eventBufferSize))
+		}
+		if *eventsStdout {
+			srv.Sinks = append(srv.Sinks, tvm.NewAsyncSink(&tvm.WriterSink{W: os.Stdout}, *eventBufferSize))
+		}
+
+		if *directoryCredentials != "" {
+			if srv.Directory, err = openDirectory(*directoryCredentials, *directoryAdmin); err != nil {
+				log.Fatalf("cannot connect to directory: %v", err)
+			}
+		}
+
+		if accessFile != nil {
+			changes, err := srv.ApplyAccess(context.Background(), "access-file", *accessFile)
+			if err != nil {
+				log.Fatalf("cannot apply access file: %v", err)
+			}
+			log.Printf("applied %d changes from the access file", len(changes))
+		}
+
+		// Background jobs audit what they do, so they are stopped before
+		// the event sinks are closed.
+		stopJobs := make(chan struct{})
+		var jobs sync.WaitGroup
+		every := func(interval time.Duration, job func()) {
+			jobs.Add(1)
+			go func() {
+				defer jobs.Done()
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-stopJobs:
+						return
+					case <-ticker.C:
+						job()
+					}
+				}
+			}()
+		}
+
+		every(*sweepInterval, func() {
+			if err := srv.SweepExpiredGrants(context.Background()); err != nil {
+				log.Printf("cannot sweep expired grants: %v", err)
+			}
+		})
+
+		if srv.IAM != nil {
+			every(*roleCheckInterval, func() {
+				problems, err := srv.CheckRoles(context.Background())
+				if err != nil {
+					log.Printf("cannot check roles: %v", err)
+				}
+				for _, problem := range problems {
+					log.Printf("%s; granted to users %v and groups %v", problem.Error(), problem.Users, problem.Groups)
+				}
+			})
+		}
+
+		if srv.Organizations != nil {
+			every(*organizationRefreshInterval, func() {
+				if err := srv.RefreshOrganization(context.Background()); err != nil {
+					log.Printf("cannot list accounts: %v", err)
+				}
+			})
+		}
+
+		if srv.Directory != nil {
+			every(*directorySyncInterval, func() {
+				if err := srv.SyncDirectory(context.Background()); err != nil {
+					log.Printf("cannot sync directory: %v", err)
+				}
+			})
+		}
+
+		// On SIGINT or SIGTERM, finish the requests in progress and the
+		// background jobs, and then deliver the audit events that the sinks
+		// have queued.
+		httpServer := &http.Server{Addr: *listenPort, Handler: srv}
+		go func() {
+			stop := make(chan os.Signal, 1)
+			signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+			<-stop
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := httpServer.Shutdown(ctx); err != nil {
+				log.Printf("cannot shut down: %v", err)
+			}
+		}()
 
 		log.Printf("listening on %s", *listenPort)
-		http.ListenAndServe(*listenPort, srv)
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Printf("cannot serve: %v", err)
+		}
+		close(stopJobs)
+		jobs.Wait()
+		if err := srv.Close(); err != nil {
+			log.Printf("cannot close event sinks: %v", err)
+		}
 		return
 	}
 
@@ -61,12 +269,172 @@ func serveMain() {
 	flag.Usage()
 }
 
+// storeFlags say where the server keeps its data.
+type storeFlags struct {
+	dataDir          *string
+	redisURL         *string
+	redisPrefix      *string
+	firestoreProject *string
+}
+
+func addStoreFlags() storeFlags {
+	return storeFlags{
+		dataDir:          flag.String("data", "data", "Store data in this directory"),
+		redisURL:         flag.String("redis", "", "Store data in the Redis server at this URL (e.g. redis://localhost:6379/0) rather than locally"),
+		redisPrefix:      flag.String("redis-prefix", "tvm:", "Prefix for all Redis keys"),
+		firestoreProject: flag.String("firestore-project", "", "Store data in Firestore in this Google Cloud project rather than locally"),
+	}
+}
+
+// openDirectory connects to Google Workspace using the service account key
+// in the file credentialsPath, acting as adminEmail.
+func openDirectory(credentialsPath, adminEmail string) (tvm.Directory, error) {
+	buf, err := ioutil.ReadFile(credentialsPath)
+	if err != nil {
+		return nil, err
+	}
+	return tvm.NewGoogleDirectory(context.Background(), buf, adminEmail)
+}
+
+func (f storeFlags) open(ctx context.Context) (tvm.Store, error) {
+	switch {
+	case *f.redisURL != "":
+		redisOptions, err := redis.ParseURL(*f.redisURL)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse redis URL: %v", err)
+		}
+		return tvm.RedisStore{
+			Client: redis.NewClient(redisOptions),
+			Prefix: *f.redisPrefix,
+		}, nil
+	case *f.firestoreProject != "":
+		client, err := firestore.NewClient(ctx, *f.firestoreProject)
+		if err != nil {
+			return nil, err
+		}
+		return tvm.NewFirestore(client), nil
+	default:
+		return tvm.LocalStore{Path: *f.dataDir}, nil
+	}
+}
+
+func readConfig(path string) (tvm.Config, error) {
+	var config tvm.Config
+	if path == "" {
+		return config, nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("cannot read config: %v", err)
+	}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return config, fmt.Errorf("cannot parse config: %v", err)
+	}
+	return config, nil
+}
+
+// adminMain administers the store directly, for example to create the
+// first admin. The command is prefix, if any, followed by the arguments.
+func adminMain(prefix ...string) error {
+	os.Args = append([]string{os.Args[0]}, os.Args[2:]...)
+	configPath := flag.String("config", "", "Read the role catalog and other settings from this JSON file")
+	rootURL := flag.String("url", "", "The URL of the server, for enrollment links")
+	storeFlags := addStoreFlags()
+	flag.Usage = func() {
+		if len(prefix) > 0 {
+			fmt.Fprintf(flag.CommandLine.Output(), "usage: %s %s [flags] <command> [args]\n", os.Args[0], prefix[0])
+		} else {
+			fmt.Fprintf(flag.CommandLine.Output(), "usage: %s admin [flags] <command> [args]\n", os.Args[0])
+		}
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	ctx := context.Background()
+	config, err := readConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(*rootURL)
+	if err != nil {
+		return fmt.Errorf("cannot parse URL: %v", err)
+	}
+	config.RootURL = *u
+	srv, err := tvm.NewServer(config)
+	if err != nil {
+		return err
+	}
+	if srv.Store, err = storeFlags.open(ctx); err != nil {
+		return err
+	}
+	awsSession, err := awssession.NewSession()
+	if err != nil {
+		return err
+	}
+	srv.IAM = iam.New(awsSession)
+	if config.Organization.Enabled() {
+		srv.Organizations = newOrganizations(awsSession, config.Organization)
+	}
+
+	actor := "cli"
+	if u, err := user.Current(); err == nil {
+		actor = "cli:" + u.Username
+	}
+	return srv.RunAdminCommand(ctx, os.Stdout, actor, append(prefix, flag.Args()...))
+}
+
+// approveMain opens the page where an approver can approve or deny an
+// access request.
+func approveMain() error {
+	os.Args = append([]string{os.Args[0]}, os.Args[2:]...)
+	server := flag.String("s", "", "The URL of the TVM server")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s approve [-s server] [request-id]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *server == "" {
+		store := tvm.FileClientStorage{
+			Path: filepath.Join(os.Getenv("HOME"), ".config", "tvm", "tvm.json"),
+		}
+		state, err := store.Get(context.Background())
+		if err != nil {
+			return err
+		}
+		if len(state.Servers) == 1 {
+			for s := range state.Servers {
+				*server = s
+			}
+		}
+	}
+	if *server == "" {
+		return fmt.Errorf("Cannot infer server, specify -s")
+	}
+
+	openURL, err := url.Parse(*server)
+	if err != nil {
+		return err
+	}
+	openURL.Path = "/requests"
+	if flag.NArg() > 0 {
+		openURL.Path += "/" + flag.Arg(0)
+	}
+
+	return exec.Command("open", openURL.String()).Run()
+}
+
 func cliMain() error {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 
 	server := flag.String("s", "", "The URL of the TVM server")
 	role := flag.String("r", "", "The role to use")
+	reason := flag.String("reason", "", "Why you need credentials, for roles that require a reason")
+	ticket := flag.String("ticket", "", "The ticket ID for this access, for roles that require one")
+	breakGlass := flag.Bool("break-glass", false, "Get emergency credentials for the break-glass role. Requires -reason")
+	breakGlassUser := flag.String("break-glass-user", "", "With -break-glass, log in as this user with your key alone, for when the identity provider is down")
+	flag.Parse()
 
 	store := tvm.FileClientStorage{
 		Path: filepath.Join(os.Getenv("HOME"), ".config", "tvm", "tvm.json"),
@@ -94,8 +462,10 @@ func cliMain() error {
 		}
 	}
 
+	// Break-glass credentials are never reused from the cache, since each use
+	// must be recorded and reviewed.
 	var credential tvm.Credential
-	{
+	if !*breakGlass {
 		if *role == "" && len(serverState.Roles) == 1 {
 			for r := range serverState.Roles {
 				*role = r
@@ -119,6 +489,7 @@ func cliMain() error {
 			credential.AccessKeyID,
 			credential.SecretAccessKey,
 			credential.SessionToken)
+		printRegion(credential.Region)
 		return nil
 	}
 
@@ -150,6 +521,7 @@ func cliMain() error {
 		credential.AccessKeyID = r.URL.Query().Get("access_key_id")
 		credential.SecretAccessKey = r.URL.Query().Get("secret_access_key")
 		credential.SessionToken = r.URL.Query().Get("session_token")
+		credential.Region = r.URL.Query().Get("region")
 		credential.Expires, err  = time.Parse(time.RFC3339, r.URL.Query().Get("expiration"))
 		if err != nil {
 			doneCh <- err
@@ -166,10 +538,24 @@ func cliMain() error {
 
 	query := openURL.Query()
 	query.Set("format", "cli")
-	query.Set("port", listener.Addr().String())
+	query.Set("port", strconv.Itoa(listener.Addr().(*net.TCPAddr).Port))
 	if *role != "" {
 		query.Set("role", *role)
 	}
+	if *reason != "" {
+		query.Set("reason", *reason)
+	}
+	if *ticket != "" {
+		query.Set("ticket", *ticket)
+	}
+	if *breakGlass {
+		query.Set("break_glass", "1")
+		if *breakGlassUser != "" {
+			openURL.Path = "/break-glass"
+			query.Set("user", *breakGlassUser)
+		}
+	}
+	openURL.RawQuery = query.Encode()
 
 	// TODO(ross): when I have internet access, find the library for this
 	exec.Command("open", openURL.String()).Run()
@@ -179,7 +565,13 @@ func cliMain() error {
 	}
 
 
+	if serverState.Roles == nil {
+		serverState.Roles = map[string]tvm.Credential{}
+	}
 	serverState.Roles[*role] = credential
+	if state.Servers == nil {
+		state.Servers = map[string]tvm.ServerState{}
+	}
 	state.Servers[*server] = serverState
 
 	if err := store.Put(ctx, *state); err != nil {
@@ -195,5 +587,28 @@ func cliMain() error {
 		credential.AccessKeyID,
 		credential.SecretAccessKey,
 		credential.SessionToken)
+	printRegion(credential.Region)
 	return nil
 }
+
+// printRegion prints the exports that make region, the role's default, the
+// region for AWS tools. It prints nothing if region is empty.
+func printRegion(region string) {
+	if region == "" {
+		return
+	}
+	fmt.Printf(
+		"export AWS_REGION=%s\n"+
+			"export AWS_DEFAULT_REGION=%s\n",
+		region,
+		region)
+}
+
+// newOrganizations returns a client for AWS Organizations, which assumes the
+// configured management role if there is one.
+func newOrganizations(awsSession *awssession.Session, config tvm.OrganizationConfig) *organizations.Organizations {
+	if config.ManagementRole == "" {
+		return organizations.New(awsSession)
+	}
+	return organizations.New(awsSession, aws.NewConfig().WithCredentials(stscreds.NewCredentials(awsSession, config.ManagementRole)))
+}
@@ -0,0 +1,424 @@
+package tvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Directory is a source of truth for who works here and which groups they
+// are in, such as Google Workspace.
+type Directory interface {
+	// GetUser returns the directory entry for the user with the given email
+	// address, or ErrNotFound if there is none.
+	GetUser(ctx context.Context, email string) (*DirectoryUser, error)
+
+	// ListUsers returns every user in the directory.
+	ListUsers(ctx context.Context) ([]DirectoryUser, error)
+
+	// ListGroupMembers returns the email addresses of the users in the
+	// group, including those in nested groups.
+	ListGroupMembers(ctx context.Context, groupEmail string) ([]string, error)
+
+	// HasMember returns true if the user is in the group, directly or
+	// through a nested group.
+	HasMember(ctx context.Context, groupEmail, email string) (bool, error)
+}
+
+// googleIssuer is the iss claim of Google ID tokens, whose sub claim is the
+// Google Workspace directory's ID for the user.
+const googleIssuer = "https://accounts.google.com"
+
+// DirectoryUser is a user as the directory sees them.
+type DirectoryUser struct {
+	// ID is the directory's own, stable identifier for the user. For
+	// Google Workspace it is the same as the sub claim of the user's ID
+	// token.
+	ID        string
+	Email     string
+	Suspended bool
+}
+
+// matches returns true if dirUser is the same person as user, whose email
+// address is the same. Once user has logged in, their subject must also
+// match, so that a former user is not mistaken for whoever now has their
+// address.
+func (dirUser DirectoryUser) matches(user User) bool {
+	return !user.Bound() || dirUser.ID == "" || dirUser.ID == user.Subject
+}
+
+// DirectoryConfig describes how TVM follows the directory.
+type DirectoryConfig struct {
+	// Mappings make TVM groups mirror directory groups.
+	Mappings []DirectoryMapping
+
+	// SyncAtLogin refreshes a user's status and group memberships from the
+	// directory each time they log in, in addition to the periodic sync.
+	SyncAtLogin bool
+
+	// Domains are the email domains that the directory is authoritative
+	// for. Only users with addresses in them are disabled for being missing
+	// from the directory. Empty means Enrollment.Domains or, if that is
+	// empty too, the domains of the users the directory lists.
+	Domains []string
+
+	// MaxDeletions is the most users that one sync may disable for being
+	// missing from the directory. A sync that would disable more changes
+	// nothing and fails, since a truncated listing is more likely than that
+	// many people leaving at once. Zero means a tenth of the active users
+	// in the directory's domains, and at least 5.
+	MaxDeletions int
+}
+
+// maxDeletions returns the most users that one sync may disable for being
+// missing from the directory, out of active users in its domains.
+func (c DirectoryConfig) maxDeletions(active int) int {
+	if c.MaxDeletions > 0 {
+		return c.MaxDeletions
+	}
+	if active/10 > 5 {
+		return active / 10
+	}
+	return 5
+}
+
+// directoryDomains returns the configured domains that the directory is
+// authoritative for, in lower case.
+func (c Config) directoryDomains() []string {
+	domains := c.Directory.Domains
+	if len(domains) == 0 {
+		domains = c.Enrollment.Domains
+	}
+	var rv []string
+	for _, domain := range domains {
+		rv = append(rv, strings.ToLower(domain))
+	}
+	return rv
+}
+
+// inDomains returns true if email is an address in one of domains.
+func inDomains(email string, domains []string) bool {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[i+1:])
+	for _, d := range domains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// DirectoryMapping makes the TVM group Group contain the members of the
+// directory group DirectoryGroup, and grant them Roles.
+type DirectoryMapping struct {
+	// DirectoryGroup is the email address of the directory group.
+	DirectoryGroup string
+
+	// Group is the ID of the TVM group to maintain. Changes made to the
+	// group in TVM are overwritten by the next sync.
+	Group string
+
+	// Roles are the roles that the group grants, either as ARNs or as
+	// aliases from the role catalog.
+	Roles []string
+}
+
+// errNoChange is returned from update functions to skip writing.
+var errNoChange = errors.New("no change")
+
+const (
+	// directoryStatusReasonSuspended and directoryStatusReasonDeleted
+	// are the reasons given for users disabled by the directory sync. Users
+	// disabled for other reasons are never re-enabled by the sync.
+	directoryStatusReasonSuspended = "suspended in the directory"
+	directoryStatusReasonDeleted   = "deleted from the directory"
+)
+
+// directoryGroupSource is the Group.Source of groups maintained by the
+// directory sync.
+func directoryGroupSource(mapping DirectoryMapping) string {
+	return "directory:" + mapping.DirectoryGroup
+}
+
+var errManagedMappings = errors.New("directory group mappings cannot be used when the access file manages access")
+
+// directoryMappings returns the configured mappings with the roles
+// resolved to ARNs.
+func (s *Server) directoryMappings() ([]DirectoryMapping, error) {
+	if s.Config.ManagedAccess && len(s.Config.Directory.Mappings) > 0 {
+		return nil, errManagedMappings
+	}
+	var rv []DirectoryMapping
+	for _, mapping := range s.Config.Directory.Mappings {
+		if !groupIDPattern.MatchString(mapping.Group) {
+			return nil, fmt.Errorf("directory mapping for %s: %w", mapping.DirectoryGroup, errBadGroupID)
+		}
+		resolved := mapping
+		resolved.Roles = nil
+		for _, name := range mapping.Roles {
+			role, ok := s.Config.resolveRole(name)
+			if !ok {
+				return nil, fmt.Errorf("directory mapping for %s: unknown role %q", mapping.DirectoryGroup, name)
+			}
+			resolved.Roles = append(resolved.Roles, role)
+		}
+		rv = append(rv, resolved)
+	}
+	return rv, nil
+}
+
+// SyncDirectory makes the mapped TVM groups match the directory, and
+// disables users who are suspended in or deleted from the directory. Users
+// outside the directory's domains are left alone. Mapped groups that are
+// missing from the directory are audited and left unchanged.
+func (s *Server) SyncDirectory(ctx context.Context) error {
+	mappings, err := s.directoryMappings()
+	if err != nil {
+		return err
+	}
+
+	dirUsers, err := s.Directory.ListUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot list directory users: %w", err)
+	}
+	byEmail := map[string]DirectoryUser{}
+	for _, dirUser := range dirUsers {
+		byEmail[strings.ToLower(dirUser.Email)] = dirUser
+	}
+	domains := s.Config.directoryDomains()
+	if len(domains) == 0 {
+		seen := map[string]bool{}
+		for email := range byEmail {
+			if i := strings.LastIndex(email, "@"); i >= 0 && !seen[email[i+1:]] {
+				seen[email[i+1:]] = true
+				domains = append(domains, email[i+1:])
+			}
+		}
+	}
+
+	users, err := s.Store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Check that the listing is plausible before changing anything.
+	active, missing := 0, 0
+	for _, user := range users {
+		if !user.Active() || !inDomains(user.PrimaryEmail(), domains) {
+			continue
+		}
+		active++
+		if dirUser, ok := byEmail[strings.ToLower(user.PrimaryEmail())]; !ok || !dirUser.matches(user) {
+			missing++
+		}
+	}
+	if limit := s.Config.Directory.maxDeletions(active); missing > limit || (len(dirUsers) == 0 && active > 0) {
+		return fmt.Errorf("directory lists %d users, which would disable %d of %d active users; "+
+			"not syncing in case the listing is incomplete (limit %d)", len(dirUsers), missing, active, limit)
+	}
+
+	// Group members are the IDs of the TVM users that the directory's
+	// members match, or their email addresses if they have no TVM user yet.
+	userIDs := map[string][]string{}
+	for _, user := range users {
+		email := strings.ToLower(user.PrimaryEmail())
+		if dirUser, ok := byEmail[email]; ok && dirUser.matches(user) {
+			userIDs[email] = append(userIDs[email], user.ID)
+		}
+	}
+
+	for _, mapping := range mappings {
+		emails, err := s.Directory.ListGroupMembers(ctx, mapping.DirectoryGroup)
+		if err == ErrNotFound {
+			log.Printf("directory sync: group %s not found, leaving %s unchanged", mapping.DirectoryGroup, mapping.Group)
+			s.audit(ctx, nil, AuditEvent{
+				Type:    AuditDirectorySync,
+				Group:   mapping.Group,
+				Message: fmt.Sprintf("directory group %s not found; group %s left unchanged", mapping.DirectoryGroup, mapping.Group),
+			})
+			continue
+		} else if err != nil {
+			return fmt.Errorf("cannot list members of %s: %w", mapping.DirectoryGroup, err)
+		}
+		var members []string
+		for _, email := range emails {
+			if ids, ok := userIDs[strings.ToLower(email)]; ok {
+				members = append(members, ids...)
+			} else {
+				members = append(members, email)
+			}
+		}
+		if err := s.syncDirectoryGroup(ctx, mapping, func(*Group) []string { return members }); err != nil {
+			return err
+		}
+	}
+
+	for _, user := range users {
+		var dirUser *DirectoryUser
+		if u, ok := byEmail[strings.ToLower(user.PrimaryEmail())]; ok && u.matches(user) {
+			dirUser = &u
+		} else if !inDomains(user.PrimaryEmail(), domains) {
+			continue
+		}
+		if err := s.syncDirectoryUserStatus(ctx, user.ID, dirUser); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncDirectoryUser refreshes one user's status and their membership of the
+// mapped groups from the directory. A user missing from the directory is
+// disabled only if their address is in one of the configured domains.
+func (s *Server) SyncDirectoryUser(ctx context.Context, userID string) error {
+	mappings, err := s.directoryMappings()
+	if err != nil {
+		return err
+	}
+
+	user, err := s.Store.GetUser(ctx, userID)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	email := user.PrimaryEmail()
+
+	dirUser, err := s.Directory.GetUser(ctx, email)
+	if err == ErrNotFound || (err == nil && !dirUser.matches(*user)) {
+		dirUser = nil
+	} else if err != nil {
+		return fmt.Errorf("cannot get directory user %s: %w", email, err)
+	}
+	if dirUser != nil || inDomains(email, s.Config.directoryDomains()) {
+		if err := s.syncDirectoryUserStatus(ctx, userID, dirUser); err != nil {
+			return err
+		}
+	}
+
+	for _, mapping := range mappings {
+		isMember := false
+		if dirUser != nil {
+			isMember, err = s.Directory.HasMember(ctx, mapping.DirectoryGroup, email)
+			if err != nil {
+				return fmt.Errorf("cannot check membership of %s: %w", mapping.DirectoryGroup, err)
+			}
+		}
+		err := s.syncDirectoryGroup(ctx, mapping, func(group *Group) []string {
+			members := removeMember(group.Members, userID)
+			if dirUser != nil {
+				// the user's entry from before they had a TVM user
+				members = removeMember(members, email)
+			}
+			if isMember {
+				members = append(members, userID)
+			}
+			return members
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDirectoryGroup creates or updates the group for mapping, setting its
+// roles from the mapping and its members to those returned by membersFn,
+// and audits any change.
+func (s *Server) syncDirectoryGroup(ctx context.Context, mapping DirectoryMapping, membersFn func(group *Group) []string) error {
+	var grants []RoleGrant
+	for _, role := range mapping.Roles {
+		grants = append(grants, RoleGrant{Role: role})
+	}
+
+	var before, after Group
+	update := func(group *Group) error {
+		before = *group
+		members := membersFn(group)
+		sort.Strings(members)
+		group.Members = members
+		group.Roles = grants
+		group.Source = directoryGroupSource(mapping)
+		after = *group
+		return nil
+	}
+	err := s.Store.UpdateGroup(ctx, mapping.Group, update)
+	if err == ErrNotFound {
+		group := Group{ID: mapping.Group}
+		update(&group)
+		err = s.Store.PutGroup(ctx, group)
+	}
+	if err != nil {
+		return err
+	}
+
+	before.Version, after.Version = 0, 0
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+	s.audit(ctx, nil, AuditEvent{
+		Type:    AuditDirectorySync,
+		Group:   mapping.Group,
+		Message: fmt.Sprintf("group %s now has members %v and roles %v from %s", mapping.Group, after.Members, mapping.Roles, mapping.DirectoryGroup),
+	})
+	return nil
+}
+
+// syncDirectoryUserStatus disables the user if they are suspended in or
+// missing from the directory (dirUser is nil), and re-enables them if the
+// directory disabled them and they are back. Users who do not exist in TVM
+// are ignored.
+func (s *Server) syncDirectoryUserStatus(ctx context.Context, userID string, dirUser *DirectoryUser) error {
+	reason := ""
+	switch {
+	case dirUser == nil:
+		reason = directoryStatusReasonDeleted
+	case dirUser.Suspended:
+		reason = directoryStatusReasonSuspended
+	}
+
+	var before, after *AuditUserState
+	var message string
+	err := s.Store.UpdateUser(ctx, userID, func(user *User) error {
+		before = newAuditUserState(*user)
+		switch {
+		case reason != "" && user.Status == UserActive:
+			user.Status = UserDisabled
+			user.StatusReason = reason
+			user.StatusTime = time.Now()
+			message = fmt.Sprintf("disabled %s: %s", user.ID, reason)
+		case reason == "" && user.Status == UserDisabled &&
+			(user.StatusReason == directoryStatusReasonSuspended || user.StatusReason == directoryStatusReasonDeleted):
+			user.Status = UserActive
+			user.StatusReason = ""
+			user.StatusTime = time.Now()
+			message = fmt.Sprintf("re-enabled %s: active in the directory", user.ID)
+		default:
+			return errNoChange
+		}
+		after = newAuditUserState(*user)
+		return nil
+	})
+	if err == ErrNotFound || err == errNoChange {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	s.audit(ctx, nil, AuditEvent{
+		Type:    AuditDirectorySync,
+		Subject: userID,
+		Before:  before,
+		After:   after,
+		Message: message,
+	})
+	return nil
+}
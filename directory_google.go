@@ -0,0 +1,102 @@
+package tvm
+
+import (
+	"context"
+	"net/http"
+
+	"golang.org/x/oauth2/google"
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// GoogleDirectory is a Directory backed by the Google Workspace Admin SDK
+// Directory API.
+type GoogleDirectory struct {
+	Service *admin.Service
+
+	// Customer is the ID of the Workspace account whose users are listed.
+	// Empty means "my_customer", the account of the calling admin.
+	Customer string
+}
+
+var _ Directory = GoogleDirectory{} // GoogleDirectory must implement Directory
+
+// NewGoogleDirectory returns a GoogleDirectory that authenticates as the
+// service account in credentialsJSON, using domain-wide delegation to act
+// as adminEmail. The service account needs the read-only user and group
+// member scopes.
+func NewGoogleDirectory(ctx context.Context, credentialsJSON []byte, adminEmail string) (*GoogleDirectory, error) {
+	jwtConfig, err := google.JWTConfigFromJSON(credentialsJSON,
+		admin.AdminDirectoryUserReadonlyScope,
+		admin.AdminDirectoryGroupMemberReadonlyScope)
+	if err != nil {
+		return nil, err
+	}
+	jwtConfig.Subject = adminEmail
+
+	service, err := admin.NewService(ctx, option.WithTokenSource(jwtConfig.TokenSource(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	return &GoogleDirectory{Service: service}, nil
+}
+
+func (d GoogleDirectory) customer() string {
+	if d.Customer == "" {
+		return "my_customer"
+	}
+	return d.Customer
+}
+
+func (d GoogleDirectory) GetUser(ctx context.Context, email string) (*DirectoryUser, error) {
+	user, err := d.Service.Users.Get(email).Context(ctx).Do()
+	if isGoogleNotFound(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &DirectoryUser{ID: user.Id, Email: user.PrimaryEmail, Suspended: user.Suspended}, nil
+}
+
+func (d GoogleDirectory) ListUsers(ctx context.Context) ([]DirectoryUser, error) {
+	var rv []DirectoryUser
+	err := d.Service.Users.List().Customer(d.customer()).Pages(ctx, func(users *admin.Users) error {
+		for _, user := range users.Users {
+			rv = append(rv, DirectoryUser{ID: user.Id, Email: user.PrimaryEmail, Suspended: user.Suspended})
+		}
+		return nil
+	})
+	return rv, err
+}
+
+func (d GoogleDirectory) ListGroupMembers(ctx context.Context, groupEmail string) ([]string, error) {
+	var rv []string
+	err := d.Service.Members.List(groupEmail).IncludeDerivedMembership(true).Pages(ctx, func(members *admin.Members) error {
+		for _, member := range members.Members {
+			if member.Type == "USER" {
+				rv = append(rv, member.Email)
+			}
+		}
+		return nil
+	})
+	if isGoogleNotFound(err) {
+		return nil, ErrNotFound
+	}
+	return rv, err
+}
+
+func (d GoogleDirectory) HasMember(ctx context.Context, groupEmail, email string) (bool, error) {
+	result, err := d.Service.Members.HasMember(groupEmail, email).Context(ctx).Do()
+	if isGoogleNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return result.IsMember, nil
+}
+
+func isGoogleNotFound(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusNotFound
+}
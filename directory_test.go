@@ -0,0 +1,313 @@
+package tvm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/option"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// fakeGoogleDirectory is a local fake of the parts of the Admin SDK
+// Directory API that GoogleDirectory uses. It returns one item per page to
+// exercise pagination.
+type fakeGoogleDirectory struct {
+	*httptest.Server
+	suspended map[string]bool     // by user email
+	ids       map[string]string   // directory ID by user email
+	groups    map[string][]string // members by group email
+}
+
+func newFakeGoogleDirectory(t *testing.T) *fakeGoogleDirectory {
+	f := &fakeGoogleDirectory{suspended: map[string]bool{}, ids: map[string]string{}, groups: map[string][]string{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeGoogleDirectory) directory(t *testing.T) GoogleDirectory {
+	service, err := admin.NewService(context.Background(),
+		option.WithEndpoint(f.URL+"/"),
+		option.WithoutAuthentication())
+	assert.NilError(t, err)
+	return GoogleDirectory{Service: service}
+}
+
+func (f *fakeGoogleDirectory) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/directory/v1/"), "/")
+	page := func(items []interface{}, key string) {
+		i, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+		rv := map[string]interface{}{}
+		if i < len(items) {
+			rv[key] = items[i : i+1]
+		}
+		if i+1 < len(items) {
+			rv["nextPageToken"] = strconv.Itoa(i + 1)
+		}
+		json.NewEncoder(w).Encode(rv)
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "users":
+		var emails []string
+		for email := range f.suspended {
+			emails = append(emails, email)
+		}
+		sort.Strings(emails)
+		var users []interface{}
+		for _, email := range emails {
+			users = append(users, admin.User{Id: f.ids[email], PrimaryEmail: email, Suspended: f.suspended[email]})
+		}
+		page(users, "users")
+
+	case len(parts) == 2 && parts[0] == "users":
+		suspended, ok := f.suspended[parts[1]]
+		if !ok {
+			http.Error(w, `{"error":{"code":404,"message":"Resource Not Found: userKey"}}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(admin.User{Id: f.ids[parts[1]], PrimaryEmail: parts[1], Suspended: suspended})
+
+	case len(parts) == 3 && parts[0] == "groups" && parts[2] == "members":
+		members, ok := f.groups[parts[1]]
+		if !ok {
+			http.Error(w, `{"error":{"code":404,"message":"Resource Not Found: groupKey"}}`, http.StatusNotFound)
+			return
+		}
+		items := []interface{}{admin.Member{Email: "nested@example.com", Type: "GROUP"}}
+		for _, member := range members {
+			items = append(items, admin.Member{Email: member, Type: "USER"})
+		}
+		page(items, "members")
+
+	case len(parts) == 4 && parts[0] == "groups" && parts[2] == "hasMember":
+		isMember := false
+		for _, member := range f.groups[parts[1]] {
+			isMember = isMember || member == parts[3]
+		}
+		json.NewEncoder(w).Encode(admin.MembersHasMember{IsMember: isMember})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestGoogleDirectory(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeGoogleDirectory(t)
+	fake.suspended["alice@example.com"] = false
+	fake.suspended["bob@example.com"] = true
+	fake.groups["sre@example.com"] = []string{"alice@example.com", "bob@example.com"}
+	dir := fake.directory(t)
+
+	users, err := dir.ListUsers(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]DirectoryUser{
+		{Email: "alice@example.com"},
+		{Email: "bob@example.com", Suspended: true},
+	}, users))
+
+	user, err := dir.GetUser(ctx, "bob@example.com")
+	assert.NilError(t, err)
+	assert.Check(t, user.Suspended)
+	_, err = dir.GetUser(ctx, "carol@example.com")
+	assert.Check(t, is.Equal(ErrNotFound, err))
+
+	members, err := dir.ListGroupMembers(ctx, "sre@example.com")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"alice@example.com", "bob@example.com"}, members))
+	_, err = dir.ListGroupMembers(ctx, "nosuch@example.com")
+	assert.Check(t, is.Equal(ErrNotFound, err))
+
+	isMember, err := dir.HasMember(ctx, "sre@example.com", "alice@example.com")
+	assert.NilError(t, err)
+	assert.Check(t, isMember)
+	isMember, err = dir.HasMember(ctx, "sre@example.com", "carol@example.com")
+	assert.NilError(t, err)
+	assert.Check(t, !isMember)
+}
+
+func TestSyncDirectory(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeGoogleDirectory(t)
+	fake.suspended["alice@example.com"] = false
+	fake.suspended["bob@example.com"] = false
+	fake.groups["sre@example.com"] = []string{"alice@example.com"}
+
+	s, _ := newTestServer(t, Config{
+		Roles: map[string]RoleConfig{
+			"arn:aws:iam::123456789012:role/prod-admin": {Alias: "prod-admin"},
+		},
+		Directory: DirectoryConfig{
+			Mappings: []DirectoryMapping{
+				{DirectoryGroup: "sre@example.com", Group: "sre", Roles: []string{"prod-admin"}},
+			},
+		},
+	})
+	s.Directory = fake.directory(t)
+	for _, id := range []string{"alice@example.com", "bob@example.com", "carol@example.com"} {
+		assert.NilError(t, s.Store.PutUser(ctx, User{ID: id}))
+	}
+
+	assert.NilError(t, s.SyncDirectory(ctx))
+
+	group, err := s.Store.GetGroup(ctx, "sre")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"alice@example.com"}, group.Members))
+	assert.Check(t, is.DeepEqual([]RoleGrant{{Role: "arn:aws:iam::123456789012:role/prod-admin"}}, group.Roles))
+	assert.Check(t, is.Equal("directory:sre@example.com", group.Source))
+
+	carol, err := s.Store.GetUser(ctx, "carol@example.com")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(UserDisabled, carol.Status))
+	assert.Check(t, is.Equal(directoryStatusReasonDeleted, carol.StatusReason))
+
+	// a second sync with no changes audits nothing
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditDirectorySync})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(events, 2))
+	assert.NilError(t, s.SyncDirectory(ctx))
+	events, err = s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditDirectorySync})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(events, 2))
+
+	// suspension and membership changes, picked up at login
+	fake.suspended["alice@example.com"] = true
+	fake.groups["sre@example.com"] = []string{"alice@example.com", "bob@example.com"}
+	assert.NilError(t, s.SyncDirectoryUser(ctx, "alice@example.com"))
+	assert.NilError(t, s.SyncDirectoryUser(ctx, "bob@example.com"))
+
+	alice, err := s.Store.GetUser(ctx, "alice@example.com")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(UserDisabled, alice.Status))
+	group, err = s.Store.GetGroup(ctx, "sre")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"alice@example.com", "bob@example.com"}, group.Members))
+
+	// users disabled by the directory come back when they are restored
+	fake.suspended["alice@example.com"] = false
+	fake.suspended["carol@example.com"] = false
+	assert.NilError(t, s.SyncDirectory(ctx))
+	for _, id := range []string{"alice@example.com", "carol@example.com"} {
+		user, err := s.Store.GetUser(ctx, id)
+		assert.NilError(t, err)
+		assert.Check(t, user.Active(), id)
+	}
+}
+
+func TestSyncDirectoryUnknownRole(t *testing.T) {
+	s, _ := newTestServer(t, Config{
+		Directory: DirectoryConfig{
+			Mappings: []DirectoryMapping{
+				{DirectoryGroup: "sre@example.com", Group: "sre", Roles: []string{"nosuch"}},
+			},
+		},
+	})
+	s.Directory = newFakeGoogleDirectory(t).directory(t)
+	err := s.SyncDirectory(context.Background())
+	assert.Check(t, is.ErrorContains(err, `unknown role "nosuch"`))
+}
+
+func TestSyncDirectoryManagedAccess(t *testing.T) {
+	config := Config{
+		ManagedAccess: true,
+		Directory: DirectoryConfig{
+			Mappings: []DirectoryMapping{{DirectoryGroup: "sre@example.com", Group: "sre"}},
+		},
+	}
+	_, err := NewServer(config)
+	assert.Check(t, is.Equal(errManagedMappings, err))
+
+	s := &Server{Config: config, Directory: newFakeGoogleDirectory(t).directory(t)}
+	assert.Check(t, is.Equal(errManagedMappings, s.SyncDirectory(context.Background())))
+}
+
+func TestDisabledUser(t *testing.T) {
+	s, stsSvc := newTestServer(t, Config{})
+	alice := loginAs(t, s, User{
+		ID:           "alice",
+		Roles:        []RoleGrant{{Role: "dev"}},
+		Admin:        true,
+		Status:       UserDisabled,
+		StatusReason: directoryStatusReasonSuspended,
+	})
+
+	w := do(s, "GET", "/?format=sh&role=dev", nil, alice)
+	assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+	assert.Check(t, is.Contains(w.Body.String(), "suspended in the directory"))
+	assert.Check(t, is.Len(stsSvc.inputs, 0))
+
+	alice = loginAs(t, s, User{ID: "alice"})
+	w = do(s, "POST", "/admin/groups", nil, alice)
+	assert.Check(t, is.Equal(http.StatusFound, w.Code)) // not treated as an admin
+}
+
+func TestSyncDirectorySafety(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeGoogleDirectory(t)
+	fake.suspended["alice@example.com"] = false
+	fake.groups["sre@example.com"] = []string{"alice@example.com"}
+
+	s, _ := newTestServer(t, Config{
+		Directory: DirectoryConfig{
+			Domains:      []string{"example.com"},
+			MaxDeletions: 2,
+			Mappings: []DirectoryMapping{
+				{DirectoryGroup: "gone@example.com", Group: "gone"},
+				{DirectoryGroup: "sre@example.com", Group: "sre"},
+			},
+		},
+	})
+	s.Directory = fake.directory(t)
+	for _, id := range []string{"alice@example.com", "bob@example.com", "carol@example.com", "contractor@partner.com"} {
+		assert.NilError(t, s.Store.PutUser(ctx, User{ID: id}))
+	}
+	status := func(id string) UserStatus {
+		user, err := s.Store.GetUser(ctx, id)
+		assert.NilError(t, err)
+		return user.Status
+	}
+
+	// a missing group is reported and skipped, and users outside the
+	// directory's domains are left alone
+	assert.NilError(t, s.SyncDirectory(ctx))
+	group, err := s.Store.GetGroup(ctx, "sre")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"alice@example.com"}, group.Members))
+	_, err = s.Store.GetGroup(ctx, "gone")
+	assert.Check(t, is.Equal(ErrNotFound, err))
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditDirectorySync})
+	assert.NilError(t, err)
+	var messages []string
+	for _, event := range events {
+		messages = append(messages, event.Message)
+	}
+	assert.Check(t, is.Contains(messages, "directory group gone@example.com not found; group gone left unchanged"))
+	assert.Check(t, is.Equal(UserDisabled, status("bob@example.com")))
+	assert.Check(t, is.Equal(UserActive, status("contractor@partner.com")))
+	assert.NilError(t, s.SyncDirectoryUser(ctx, "contractor@partner.com"))
+	assert.Check(t, is.Equal(UserActive, status("contractor@partner.com")))
+
+	// a listing that would disable too many users changes nothing
+	for _, id := range []string{"bob@example.com", "carol@example.com", "dave@example.com", "erin@example.com"} {
+		assert.NilError(t, s.Store.PutUser(ctx, User{ID: id}))
+		fake.suspended[id] = false
+	}
+	assert.NilError(t, s.SyncDirectory(ctx))
+	for id := range fake.suspended {
+		if id != "alice@example.com" {
+			delete(fake.suspended, id)
+		}
+	}
+	err = s.SyncDirectory(ctx)
+	assert.Check(t, is.ErrorContains(err, "would disable 4 of 5 active users"))
+	assert.Check(t, is.Equal(UserActive, status("bob@example.com")))
+}
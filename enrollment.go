@@ -0,0 +1,145 @@
+package tvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type EnrollmentPolicy string
+
+const (
+	// EnrollOpen creates a user for anyone who logs in. It is the default.
+	EnrollOpen EnrollmentPolicy = "open"
+
+	// EnrollDomain creates a user for anyone who logs in with an account in
+	// one of EnrollmentConfig.Domains.
+	EnrollDomain EnrollmentPolicy = "domain"
+
+	// EnrollInvite admits only users that an admin has invited.
+	EnrollInvite EnrollmentPolicy = "invite"
+
+	// EnrollApproval records anyone who logs in as pending, and admits them
+	// once an admin approves.
+	EnrollApproval EnrollmentPolicy = "approval"
+)
+
+// EnrollmentConfig says who may become a user by logging in.
+type EnrollmentConfig struct {
+	Policy EnrollmentPolicy
+
+	// Domains are the Google Workspace domains whose accounts may enroll
+	// under EnrollDomain. They are matched against the hosted domain claim
+	// of the ID token, which Google sets only for Workspace accounts.
+	Domains []string
+}
+
+var (
+	errNotInvited     = errors.New("you have not been invited to use TVM")
+	errWrongDomain    = errors.New("your account is not in a domain that may use TVM")
+	errNotProvisioned = errors.New("you have not been provisioned")
+	errNotPending     = errors.New("user is not pending approval")
+	errUserExists     = errors.New("user already exists")
+	errBadEmail       = errors.New("invalid email address")
+)
+
+// enrollUser returns the user for the account in idToken, creating it if
+// the enrollment policy allows. Users created under EnrollApproval are
+// pending. Users refused by the policy are not recorded, except for those
+// an admin has rejected, so repeated attempts do not fill the store.
+func (s *Server) enrollUser(ctx context.Context, r *http.Request, idToken IDToken) (*User, error) {
+	user, err := s.identifyUser(ctx, r, idToken)
+	if err != ErrNotFound {
+		return user, err
+	}
+
+	if s.Config.SCIMToken != "" {
+		return nil, errNotProvisioned
+	}
+
+	user = &User{
+		ID:      SubjectUserID(idToken.Iss, idToken.Sub),
+		Issuer:  idToken.Iss,
+		Subject: idToken.Sub,
+		Email:   idToken.Email,
+	}
+	switch s.Config.Enrollment.Policy {
+	case "", EnrollOpen:
+	case EnrollDomain:
+		allowed := false
+		for _, domain := range s.Config.Enrollment.Domains {
+			allowed = allowed || (idToken.Hd != "" && strings.EqualFold(idToken.Hd, domain))
+		}
+		if !allowed {
+			return nil, errWrongDomain
+		}
+	case EnrollInvite:
+		return nil, errNotInvited
+	case EnrollApproval:
+		user.Status = UserPending
+		user.StatusReason = "waiting for approval"
+		user.StatusTime = time.Now()
+	default:
+		return nil, fmt.Errorf("unknown enrollment policy %q", s.Config.Enrollment.Policy)
+	}
+
+	if err := s.Store.PutUser(ctx, *user); err != nil {
+		return nil, err
+	}
+	s.audit(ctx, r, AuditEvent{
+		Type:    AuditEnroll,
+		Actor:   user.ID,
+		Subject: user.ID,
+		After:   newAuditUserState(*user),
+		Message: fmt.Sprintf("enrolled under %s policy", s.enrollmentPolicy()),
+	})
+	return user, nil
+}
+
+func (s *Server) enrollmentPolicy() EnrollmentPolicy {
+	if s.Config.Enrollment.Policy == "" {
+		return EnrollOpen
+	}
+	return s.Config.Enrollment.Policy
+}
+
+var inactiveUserTemplate = template.Must(template.New("inactive").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <title>TVM</title>
+</head>
+<body>
+{{ if and .Pending .User.EnrollmentCode }}
+<h1>Enrollment code required</h1>
+<p>Log in again using the enrollment link you were given.</p>
+{{ else if .Pending }}
+<h1>Waiting for approval</h1>
+<p>An admin must approve your account ({{ .User.ID }}) before you can use TVM.
+Log in again once they have.</p>
+{{ else }}
+<h1>Your account is {{ .User.Status }}</h1>
+<p>{{ .User.StatusReason }}</p>
+{{ end }}
+</body>
+</html>
+`))
+
+// serveInactiveUser explains to a user who may not use TVM why not.
+func (s *Server) serveInactiveUser(w http.ResponseWriter, r *http.Request, user User) {
+	if r.URL.Query().Get("format") == "sh" {
+		http.Error(w, fmt.Sprintf("your account is %s: %s", user.Status, user.StatusReason), http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusForbidden)
+	inactiveUserTemplate.Execute(w, struct {
+		User    User
+		Pending bool
+	}{
+		User:    user,
+		Pending: user.Status == UserPending,
+	})
+}
@@ -0,0 +1,106 @@
+package tvm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestEnrollUser(t *testing.T) {
+	ctx := context.Background()
+	r := httptest.NewRequest("GET", "/oauth2/callback", nil)
+
+	for _, tc := range []struct {
+		config  Config
+		idToken IDToken
+		status  UserStatus
+		err     error
+	}{
+		{Config{}, IDToken{Iss: googleIssuer, Sub: "1", Email: "alice@example.com", EmailVerified: true}, UserActive, nil},
+		{Config{Enrollment: EnrollmentConfig{Policy: EnrollDomain, Domains: []string{"Example.com"}}},
+			IDToken{Iss: googleIssuer, Sub: "1", Email: "alice@example.com", Hd: "example.com"}, UserActive, nil},
+		{Config{Enrollment: EnrollmentConfig{Policy: EnrollDomain, Domains: []string{"example.com"}}},
+			IDToken{Iss: googleIssuer, Sub: "1", Email: "alice@example.com", EmailVerified: true}, "", errWrongDomain},
+		{Config{Enrollment: EnrollmentConfig{Policy: EnrollDomain, Domains: []string{"example.com"}}},
+			IDToken{Iss: googleIssuer, Sub: "1", Email: "alice@example.org", Hd: "example.org"}, "", errWrongDomain},
+		{Config{Enrollment: EnrollmentConfig{Policy: EnrollInvite}},
+			IDToken{Iss: googleIssuer, Sub: "1", Email: "alice@example.com", EmailVerified: true}, "", errNotInvited},
+		{Config{Enrollment: EnrollmentConfig{Policy: EnrollApproval}},
+			IDToken{Iss: googleIssuer, Sub: "1", Email: "alice@example.com", EmailVerified: true}, UserPending, nil},
+		{Config{SCIMToken: "sekrit"}, IDToken{Iss: googleIssuer, Sub: "1", Email: "alice@example.com", EmailVerified: true}, "", errNotProvisioned},
+	} {
+		s, _ := newTestServer(t, tc.config)
+		user, err := s.enrollUser(ctx, r, tc.idToken)
+		assert.Check(t, is.Equal(tc.err, err), tc.config.Enrollment.Policy)
+		if tc.err != nil {
+			// refused users are not recorded
+			users, err := s.Store.ListUsers(ctx)
+			assert.NilError(t, err)
+			assert.Check(t, is.Len(users, 0))
+			continue
+		}
+		assert.Check(t, is.Equal(tc.status, user.Status), tc.config.Enrollment.Policy)
+		events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditEnroll})
+		assert.NilError(t, err)
+		assert.Check(t, is.Len(events, 1))
+	}
+}
+
+func TestEnrollUserExisting(t *testing.T) {
+	ctx := context.Background()
+	r := httptest.NewRequest("GET", "/oauth2/callback", nil)
+	s, _ := newTestServer(t, Config{Enrollment: EnrollmentConfig{Policy: EnrollInvite}})
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "alice@example.com", Email: "alice@example.com"}))
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "bob@example.com", Email: "bob@example.com", Status: UserRejected}))
+
+	user, err := s.enrollUser(ctx, r, IDToken{Iss: googleIssuer, Sub: "1", Email: "alice@example.com", EmailVerified: true})
+	assert.NilError(t, err)
+	assert.Check(t, user.Active())
+
+	// a rejected user who logs in again stays rejected and is not re-audited
+	user, err = s.enrollUser(ctx, r, IDToken{Iss: googleIssuer, Sub: "2", Email: "bob@example.com", EmailVerified: true})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(UserRejected, user.Status))
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditEnroll})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(events, 0))
+}
+
+func TestPendingUser(t *testing.T) {
+	s, stsSvc := newTestServer(t, Config{})
+	alice := loginAs(t, s, User{ID: "alice", Roles: []RoleGrant{{Role: "dev"}}, Status: UserPending})
+
+	w := do(s, "GET", "/?role=dev", nil, alice)
+	assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+	assert.Check(t, is.Contains(w.Body.String(), "Waiting for approval"))
+	assert.Check(t, is.Len(stsSvc.inputs, 0))
+}
+
+func TestAdminInvite(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{})
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "bob@example.com"}))
+
+	w := do(s, "POST", "/admin/op", url.Values{"op": {"invite"}, "user": {" Alice@example.com "}}, admin)
+	assert.Check(t, is.Equal(http.StatusSeeOther, w.Code))
+	alice, err := s.Store.GetUser(ctx, "alice@example.com")
+	assert.NilError(t, err)
+	assert.Check(t, alice.Active())
+
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"invite"}, "user": {"bob@example.com"}}, admin)
+	assert.Check(t, is.Equal(http.StatusConflict, w.Code))
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"invite"}, "user": {"../admin"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+
+	// only pending users can be approved or rejected
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"approve_user"}, "user": {"bob@example.com"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"reject_user"}, "user": {"bob@example.com"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+}
@@ -0,0 +1,176 @@
+package tvm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// RoleGrant allows a user to get credentials for a role, optionally only
+// within a window of time.
+type RoleGrant struct {
+	Role string
+
+	// NotBefore and NotAfter bound the time during which the grant is
+	// active. The zero value means unbounded.
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Active returns true if the grant may be used at time now.
+func (g RoleGrant) Active(now time.Time) bool {
+	if !g.NotBefore.IsZero() && now.Before(g.NotBefore) {
+		return false
+	}
+	return !g.Expired(now)
+}
+
+// Expired returns true if the grant can never be used again after now.
+func (g RoleGrant) Expired(now time.Time) bool {
+	return !g.NotAfter.IsZero() && !now.Before(g.NotAfter)
+}
+
+func (g RoleGrant) String() string {
+	switch {
+	case !g.NotBefore.IsZero() && !g.NotAfter.IsZero():
+		return fmt.Sprintf("%s (%s to %s)", g.Role, g.NotBefore.Format(time.RFC3339), g.NotAfter.Format(time.RFC3339))
+	case !g.NotAfter.IsZero():
+		return fmt.Sprintf("%s (until %s)", g.Role, g.NotAfter.Format(time.RFC3339))
+	case !g.NotBefore.IsZero():
+		return fmt.Sprintf("%s (from %s)", g.Role, g.NotBefore.Format(time.RFC3339))
+	default:
+		return g.Role
+	}
+}
+
+// UnmarshalJSON accepts either a RoleGrant object or, for data written
+// before grants could be time-bounded, a bare role string.
+func (g *RoleGrant) UnmarshalJSON(buf []byte) error {
+	var role string
+	if err := json.Unmarshal(buf, &role); err == nil {
+		*g = RoleGrant{Role: role}
+		return nil
+	}
+	type roleGrant RoleGrant // without the UnmarshalJSON method
+	return json.Unmarshal(buf, (*roleGrant)(g))
+}
+
+// ActiveRoles returns the roles the user may get credentials for at time
+// now.
+func (u User) ActiveRoles(now time.Time) []string {
+	var roles []string
+	for _, grant := range u.Roles {
+		if grant.Active(now) {
+			roles = append(roles, grant.Role)
+		}
+	}
+	return roles
+}
+
+// SweepExpiredGrants removes expired role grants from every user and group,
+// recording each removal in the audit log.
+func (s *Server) SweepExpiredGrants(ctx context.Context) error {
+	if err := s.sweepExpiredUserGrants(ctx); err != nil {
+		return err
+	}
+	return s.sweepExpiredGroupGrants(ctx)
+}
+
+// hasExpired returns true if any of grants has expired at time now.
+func hasExpired(grants []RoleGrant, now time.Time) bool {
+	for _, grant := range grants {
+		if grant.Expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeExpired returns the grants that have not expired at time now, and
+// those that have.
+func removeExpired(grants []RoleGrant, now time.Time) (kept, expired []RoleGrant) {
+	for _, grant := range grants {
+		if grant.Expired(now) {
+			expired = append(expired, grant)
+			continue
+		}
+		kept = append(kept, grant)
+	}
+	return kept, expired
+}
+
+func (s *Server) sweepExpiredUserGrants(ctx context.Context) error {
+	users, err := s.Store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, user := range users {
+		if !hasExpired(user.Roles, now) {
+			continue
+		}
+
+		var expired []RoleGrant
+		var before, after *AuditUserState
+		err := s.Store.UpdateUser(ctx, user.ID, func(user *User) error {
+			before = newAuditUserState(*user)
+			user.Roles, expired = removeExpired(user.Roles, now)
+			after = newAuditUserState(*user)
+			return nil
+		})
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for _, grant := range expired {
+			s.audit(ctx, nil, AuditEvent{
+				Type:    AuditGrantExpired,
+				Subject: user.ID,
+				Role:    grant.Role,
+				Before:  before,
+				After:   after,
+				Message: fmt.Sprintf("grant of %s expired", grant),
+			})
+		}
+	}
+	return nil
+}
+
+func (s *Server) sweepExpiredGroupGrants(ctx context.Context) error {
+	groups, err := s.Store.ListGroups(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, group := range groups {
+		if !hasExpired(group.Roles, now) {
+			continue
+		}
+
+		var expired []RoleGrant
+		err := s.Store.UpdateGroup(ctx, group.ID, func(group *Group) error {
+			group.Roles, expired = removeExpired(group.Roles, now)
+			return nil
+		})
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for _, grant := range expired {
+			s.audit(ctx, nil, AuditEvent{
+				Type:    AuditGrantExpired,
+				Group:   group.ID,
+				Role:    grant.Role,
+				Message: fmt.Sprintf("grant of %s to group %s expired", grant, group.ID),
+			})
+		}
+	}
+	return nil
+}
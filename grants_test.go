@@ -0,0 +1,96 @@
+package tvm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestRoleGrantLegacyJSON(t *testing.T) {
+	var user User
+	err := json.Unmarshal([]byte(`{"ID":"alice","Roles":["a",{"Role":"b","NotAfter":"2021-01-01T00:00:00Z"}]}`), &user)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]RoleGrant{
+		{Role: "a"},
+		{Role: "b", NotAfter: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}, user.Roles))
+}
+
+func TestRoleGrantWindow(t *testing.T) {
+	now := time.Now()
+	s, stsSvc := newTestServer(t, Config{})
+	alice := loginAs(t, s, User{ID: "alice", Roles: []RoleGrant{
+		{Role: "current", NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour)},
+		{Role: "future", NotBefore: now.Add(time.Hour)},
+		{Role: "expired", NotAfter: now.Add(-time.Hour)},
+	}})
+
+	for role, code := range map[string]int{
+		"current": http.StatusOK,
+		"future":  http.StatusForbidden,
+		"expired": http.StatusForbidden,
+	} {
+		w := do(s, "GET", "/?format=sh&role="+role, nil, alice)
+		assert.Check(t, is.Equal(code, w.Code), role)
+	}
+	assert.Check(t, is.Len(stsSvc.inputs, 1))
+
+	// with only one active grant, the role can be omitted
+	w := do(s, "GET", "/?format=sh", nil, alice)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.Equal("current", *stsSvc.inputs[1].RoleArn))
+}
+
+func TestSweepExpiredGrants(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	s, _ := newTestServer(t, Config{})
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "alice", Roles: []RoleGrant{
+		{Role: "permanent"},
+		{Role: "expired", NotAfter: now.Add(-time.Minute)},
+		{Role: "later", NotAfter: now.Add(time.Hour)},
+	}}))
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "bob", Roles: []RoleGrant{{Role: "permanent"}}}))
+	assert.NilError(t, s.Store.PutGroup(ctx, Group{ID: "oncall", Roles: []RoleGrant{
+		{Role: "permanent"},
+		{Role: "expired", NotAfter: now.Add(-time.Minute)},
+	}}))
+
+	assert.NilError(t, s.SweepExpiredGrants(ctx))
+
+	alice, err := s.Store.GetUser(ctx, "alice")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"permanent", "later"}, alice.ActiveRoles(now)))
+	assert.Check(t, is.Len(alice.Roles, 2))
+
+	bob, err := s.Store.GetUser(ctx, "bob")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(int64(0), bob.Version)) // untouched
+
+	oncall, err := s.Store.GetGroup(ctx, "oncall")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]RoleGrant{{Role: "permanent"}}, oncall.Roles))
+
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditGrantExpired, Subject: "alice"})
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(events, 1))
+	assert.Check(t, is.Equal("expired", events[0].Role))
+	assert.Check(t, is.Len(events[0].Before.Roles, 3))
+	assert.Check(t, is.Len(events[0].After.Roles, 2))
+
+	events, err = s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditGrantExpired})
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(events, 2))
+	var groups []string
+	for _, event := range events {
+		if event.Group != "" {
+			groups = append(groups, event.Group+" "+event.Role)
+		}
+	}
+	assert.Check(t, is.DeepEqual([]string{"oncall expired"}, groups))
+}
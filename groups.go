@@ -0,0 +1,241 @@
+package tvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Group grants roles to each of its members.
+type Group struct {
+	ID string
+
+	// DisplayName is a human readable name for groups whose ID is not.
+	DisplayName string
+
+	// ExternalID is the identifier that a provisioning client, such as an
+	// identity provider using SCIM, knows the group by.
+	ExternalID string
+
+	// Members are the IDs of the users in the group.
+	Members []string
+
+	Roles []RoleGrant
+
+	// Source is empty for groups managed in TVM. Otherwise it says where
+	// the group is synchronized from, and changes made in TVM will be
+	// overwritten.
+	Source string
+
+	// Version is incremented by each call to Store.UpdateGroup.
+	Version int64
+}
+
+// HasMember returns true if the user with the given ID is in the group.
+func (g Group) HasMember(userID string) bool {
+	for _, member := range g.Members {
+		if member == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// EffectiveRole is a role that a user may get credentials for, along with
+// where the grant came from.
+type EffectiveRole struct {
+	Role string
+
+	// Direct means that the role is granted to the user themselves.
+	Direct bool
+
+	// Groups are the IDs of the groups through which the user has the role.
+	Groups []string
+}
+
+func (e EffectiveRole) String() string {
+	var sources []string
+	if e.Direct {
+		sources = append(sources, "direct")
+	}
+	for _, group := range e.Groups {
+		sources = append(sources, "group "+group)
+	}
+	return fmt.Sprintf("%s (%s)", e.Role, strings.Join(sources, ", "))
+}
+
+// EffectiveRoles returns the roles that user may get credentials for at
+// time now: the union of their own active grants and those of the groups
+// they are in, sorted by role.
+func EffectiveRoles(user User, groups []Group, now time.Time) []EffectiveRole {
+	byRole := map[string]*EffectiveRole{}
+	get := func(role string) *EffectiveRole {
+		if byRole[role] == nil {
+			byRole[role] = &EffectiveRole{Role: role}
+		}
+		return byRole[role]
+	}
+
+	for _, role := range user.ActiveRoles(now) {
+		get(role).Direct = true
+	}
+	for _, group := range groups {
+		if !group.HasMember(user.ID) {
+			continue
+		}
+		for _, grant := range group.Roles {
+			if grant.Active(now) {
+				e := get(grant.Role)
+				e.Groups = append(e.Groups, group.ID)
+			}
+		}
+	}
+
+	var rv []EffectiveRole
+	for _, e := range byRole {
+		rv = append(rv, *e)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Role < rv[j].Role })
+	return rv
+}
+
+// effectiveRoles returns the ARNs of the roles that user may get
+// credentials for now, with organization roles expanded. Organization roles
+// that cannot be expanded, because the organization cannot be listed, are
+// logged and skipped, so that the user's other roles still work.
+func (s *Server) effectiveRoles(ctx context.Context, user User) ([]string, error) {
+	groups, err := s.Store.ListGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var roles []string
+	seen := map[string]bool{}
+	for _, e := range EffectiveRoles(user, groups, time.Now()) {
+		expanded, err := s.expandRole(ctx, e.Role)
+		if err != nil {
+			log.Printf("cannot expand %s for %s: %v", e.Role, user.ID, err)
+			continue
+		}
+		for _, role := range expanded {
+			if !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles, nil
+}
+
+// removeFromGroups removes the user from every group they are in.
+func (s *Server) removeFromGroups(ctx context.Context, userID string) error {
+	groups, err := s.Store.ListGroups(ctx)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if !group.HasMember(userID) {
+			continue
+		}
+		err := s.Store.UpdateGroup(ctx, group.ID, func(group *Group) error {
+			group.Members = removeMember(group.Members, userID)
+			return nil
+		})
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeMember returns members without userID.
+func removeMember(members []string, userID string) []string {
+	var rv []string
+	for _, member := range members {
+		if member != userID {
+			rv = append(rv, member)
+		}
+	}
+	return rv
+}
+
+// addGrant returns grants with grant added, replacing any existing grant
+// of the same role.
+func addGrant(grants []RoleGrant, grant RoleGrant) []RoleGrant {
+	rv := []RoleGrant{grant}
+	for _, existing := range grants {
+		if existing.Role != grant.Role {
+			rv = append(rv, existing)
+		}
+	}
+	return rv
+}
+
+// removeGrant returns grants without any grant of role.
+func removeGrant(grants []RoleGrant, role string) []RoleGrant {
+	var rv []RoleGrant
+	for _, existing := range grants {
+		if existing.Role != role {
+			rv = append(rv, existing)
+		}
+	}
+	return rv
+}
+
+// grantFromForm returns the grant described by the role and optional
+// duration fields of an admin form.
+func grantFromForm(r *http.Request) (RoleGrant, error) {
+	grant := RoleGrant{Role: r.FormValue("role")}
+	if d := r.FormValue("duration"); d != "" {
+		duration, err := time.ParseDuration(d)
+		if err != nil || duration <= 0 {
+			return grant, errBadDuration
+		}
+		grant.NotAfter = time.Now().Add(duration)
+	}
+	return grant, nil
+}
+
+var (
+	errBadGroupID  = errors.New("group IDs may contain only letters, numbers, '.', '_' and '-'")
+	errGroupExists = errors.New("group already exists")
+)
+
+var groupIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// handleAdminGroupOp creates, deletes and changes groups.
+func (s *Server) handleAdminGroupOp(w http.ResponseWriter, r *http.Request) {
+	admin := s.authorizedAdmin(r)
+	if admin == nil {
+		http.Redirect(w, r, "/?format=admin", http.StatusFound)
+		return
+	}
+
+	op := r.FormValue("op")
+	change := groupChange{
+		Op:     op,
+		UserID: r.FormValue("user"),
+		Role:   r.FormValue("role"),
+	}
+	var err error
+	switch op {
+	case "add_member":
+		change.UserID, err = s.formUserID(r)
+	case "add_role":
+		change.Grant, err = grantFromForm(r)
+	}
+	if err == nil {
+		_, err = s.changeGroup(r.Context(), r, adminActor{UserID: admin.ID}, r.FormValue("group"), change)
+	}
+	if err != nil {
+		adminFormError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,83 @@
+package tvm
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestEffectiveRoles(t *testing.T) {
+	now := time.Now()
+	user := User{ID: "alice", Roles: []RoleGrant{{Role: "dev"}, {Role: "old", NotAfter: now.Add(-time.Hour)}}}
+	groups := []Group{
+		{ID: "eng", Members: []string{"alice", "bob"}, Roles: []RoleGrant{{Role: "dev"}, {Role: "staging"}}},
+		{ID: "oncall", Members: []string{"alice"}, Roles: []RoleGrant{{Role: "prod", NotAfter: now.Add(time.Hour)}}},
+		{ID: "expired", Members: []string{"alice"}, Roles: []RoleGrant{{Role: "legacy", NotAfter: now.Add(-time.Hour)}}},
+		{ID: "sales", Members: []string{"carol"}, Roles: []RoleGrant{{Role: "crm"}}},
+	}
+
+	assert.Check(t, is.DeepEqual([]EffectiveRole{
+		{Role: "dev", Direct: true, Groups: []string{"eng"}},
+		{Role: "prod", Groups: []string{"oncall"}},
+		{Role: "staging", Groups: []string{"eng"}},
+	}, EffectiveRoles(user, groups, now)))
+	assert.Check(t, is.Equal("dev (direct, group eng)", EffectiveRoles(user, groups, now)[0].String()))
+}
+
+func TestGroupRoles(t *testing.T) {
+	ctx := context.Background()
+	s, stsSvc := newTestServer(t, Config{})
+	alice := loginAs(t, s, User{ID: "alice"})
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+
+	w := do(s, "GET", "/?format=sh&role=prod", nil, alice)
+	assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+
+	for _, form := range []url.Values{
+		{"op": {"create_group"}, "group": {"oncall"}},
+		{"op": {"add_member"}, "group": {"oncall"}, "user": {"alice"}},
+		{"op": {"add_role"}, "group": {"oncall"}, "role": {"prod"}, "duration": {"1h"}},
+	} {
+		w := do(s, "POST", "/admin/groups", form, admin)
+		assert.Check(t, is.Equal(http.StatusSeeOther, w.Code), form.Get("op"))
+	}
+
+	w = do(s, "GET", "/?format=sh&role=prod", nil, alice)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.Len(stsSvc.inputs, 1))
+
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditAdmin})
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(events, 3))
+	assert.Check(t, is.Equal("group.add_role", events[0].Op))
+	assert.Check(t, is.Equal("oncall", events[0].Group))
+
+	// errors
+	w = do(s, "POST", "/admin/groups", url.Values{"op": {"create_group"}, "group": {"oncall"}}, admin)
+	assert.Check(t, is.Equal(http.StatusConflict, w.Code))
+	w = do(s, "POST", "/admin/groups", url.Values{"op": {"create_group"}, "group": {"../users/admin"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+	w = do(s, "POST", "/admin/groups", url.Values{"op": {"add_member"}, "group": {"nosuch"}, "user": {"alice"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+	for _, duration := range []string{"0s", "-1h"} {
+		w = do(s, "POST", "/admin/groups", url.Values{"op": {"add_role"}, "group": {"oncall"}, "role": {"dev"}, "duration": {duration}}, admin)
+		assert.Check(t, is.Equal(http.StatusBadRequest, w.Code), duration)
+	}
+	w = do(s, "POST", "/admin/groups", url.Values{"op": {"create_group"}, "group": {"eng"}}, alice)
+	assert.Check(t, is.Equal(http.StatusFound, w.Code)) // not an admin
+
+	w = do(s, "POST", "/admin/groups", url.Values{"op": {"remove_member"}, "group": {"oncall"}, "user": {"alice"}}, admin)
+	assert.Check(t, is.Equal(http.StatusSeeOther, w.Code))
+	w = do(s, "GET", "/?format=sh&role=prod", nil, alice)
+	assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+
+	w = do(s, "POST", "/admin/groups", url.Values{"op": {"delete_group"}, "group": {"oncall"}}, admin)
+	assert.Check(t, is.Equal(http.StatusSeeOther, w.Code))
+	_, err = s.Store.GetGroup(ctx, "oncall")
+	assert.Check(t, is.Equal(ErrNotFound, err))
+}
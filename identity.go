@@ -0,0 +1,302 @@
+package tvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Users are keyed by the issuer and subject of their ID token, which never
+// change, rather than by their email address, which can be renamed or
+// recycled. Users created before their first login, and users from
+// versions that keyed everyone by email, are keyed by email until that
+// login binds them; see identifyUser. Migrate binds the latter ahead of
+// time through the directory, if there is one.
+
+var (
+	errNoSubject      = errors.New("your ID token does not say who you are")
+	errAmbiguousEmail = errors.New("more than one user has that email address")
+)
+
+var userIDReplacer = strings.NewReplacer("/", "_", "\\", "_")
+
+// SubjectUserID returns the ID of the user identified by the iss and sub
+// claims of an ID token, e.g. "accounts.google.com:1234567890".
+func SubjectUserID(issuer, subject string) string {
+	issuer = strings.TrimPrefix(strings.TrimPrefix(issuer, "https://"), "http://")
+	return userIDReplacer.Replace(issuer) + ":" + userIDReplacer.Replace(subject)
+}
+
+// identifyUser returns the user identified by idToken, updating their email
+// address if it has changed. If there is no such user but there is an
+// unbound user with the token's verified email address, it binds that user
+// to the token's identity. Otherwise it returns ErrNotFound.
+func (s *Server) identifyUser(ctx context.Context, r *http.Request, idToken IDToken) (*User, error) {
+	if idToken.Sub == "" {
+		return nil, errNoSubject
+	}
+
+	user, err := s.Store.GetUser(ctx, SubjectUserID(idToken.Iss, idToken.Sub))
+	if err == ErrNotFound {
+		return s.bindUser(ctx, r, idToken)
+	} else if err != nil {
+		return nil, err
+	}
+	if idToken.Email == "" || idToken.Email == user.Email {
+		return user, nil
+	}
+
+	var before, after *AuditUserState
+	err = s.Store.UpdateUser(ctx, user.ID, func(user *User) error {
+		before = newAuditUserState(*user)
+		user.Email = idToken.Email
+		after = newAuditUserState(*user)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.audit(ctx, r, AuditEvent{
+		Type:    AuditIdentity,
+		Actor:   user.ID,
+		Subject: user.ID,
+		Before:  before,
+		After:   after,
+		Message: fmt.Sprintf("email address changed from %s to %s", user.Email, idToken.Email),
+	})
+	return s.Store.GetUser(ctx, user.ID)
+}
+
+// bindUser rekeys the unbound user with idToken's email address by
+// idToken's identity, carrying over their roles, devices and group
+// memberships. Users from versions that keyed users by email have no Email
+// and were created by Google logins, so they are bound only by Google ID
+// tokens. If there is a directory, it must agree that the address belongs
+// to idToken's subject.
+func (s *Server) bindUser(ctx context.Context, r *http.Request, idToken IDToken) (*User, error) {
+	if !idToken.EmailVerified || idToken.Email == "" {
+		return nil, ErrNotFound
+	}
+	users, err := s.usersByEmail(ctx, idToken.Email)
+	if err != nil {
+		return nil, err
+	}
+	var unbound []User
+	for _, user := range users {
+		if !user.Bound() && (user.Email != "" || idToken.Iss == googleIssuer) {
+			unbound = append(unbound, user)
+		}
+	}
+	switch {
+	case len(unbound) == 0:
+		return nil, ErrNotFound
+	case len(unbound) > 1:
+		return nil, errAmbiguousEmail
+	}
+
+	if s.Directory != nil && idToken.Iss == googleIssuer {
+		dirUser, err := s.Directory.GetUser(ctx, idToken.Email)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		if err == nil && dirUser.ID != "" && dirUser.ID != idToken.Sub {
+			return nil, ErrNotFound
+		}
+	}
+
+	newID := SubjectUserID(idToken.Iss, idToken.Sub)
+	user, err := s.rekeyUser(ctx, r, newID, unbound[0].ID, idToken.Iss, idToken.Sub, idToken.Email)
+	if err == ErrNotFound || err == errAlreadyBound {
+		// a concurrent login bound the user first
+		return s.Store.GetUser(ctx, newID)
+	}
+	return user, err
+}
+
+var errAlreadyBound = errors.New("user is already bound to an identity")
+
+// rekeyUser rekeys the unbound user oldID by the identity of issuer and
+// subject, and updates the groups, access requests, review items and API
+// tokens that refer to them. Sessions for the old ID are revoked. actor is
+// who is responsible, for the audit log.
+func (s *Server) rekeyUser(ctx context.Context, r *http.Request, actor, oldID, issuer, subject, email string) (*User, error) {
+	newID := SubjectUserID(issuer, subject)
+	var before, after *AuditUserState
+	err := s.Store.RenameUser(ctx, oldID, newID, func(user *User) error {
+		if user.Bound() {
+			return errAlreadyBound
+		}
+		before = newAuditUserState(*user)
+		user.ID = newID
+		user.Issuer = issuer
+		user.Subject = subject
+		user.Email = email
+		after = newAuditUserState(*user)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.renameUserReferences(ctx, oldID, newID); err != nil {
+		return nil, err
+	}
+	if err := s.revokeSessions(ctx, oldID); err != nil {
+		return nil, err
+	}
+
+	s.audit(ctx, r, AuditEvent{
+		Type:    AuditIdentity,
+		Actor:   actor,
+		Subject: newID,
+		Before:  before,
+		After:   after,
+		Message: fmt.Sprintf("%s is now keyed as %s", oldID, newID),
+	})
+	return s.Store.GetUser(ctx, newID)
+}
+
+// renameUserReferences replaces oldID with newID wherever a record refers
+// to a user by ID.
+func (s *Server) renameUserReferences(ctx context.Context, oldID, newID string) error {
+	if err := s.renameGroupMember(ctx, oldID, newID); err != nil {
+		return err
+	}
+
+	requests, err := s.Store.ListAccessRequests(ctx)
+	if err != nil {
+		return err
+	}
+	for _, request := range requests {
+		if request.UserID != oldID && request.DecidedBy != oldID {
+			continue
+		}
+		err := s.Store.UpdateAccessRequest(ctx, request.ID, func(request *AccessRequest) error {
+			if request.UserID == oldID {
+				request.UserID = newID
+			}
+			if request.DecidedBy == oldID {
+				request.DecidedBy = newID
+			}
+			return nil
+		})
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+
+	items, err := s.Store.ListReviewItems(ctx)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item.UserID != oldID && item.ClosedBy != oldID {
+			continue
+		}
+		err := s.Store.UpdateReviewItem(ctx, item.ID, func(item *ReviewItem) error {
+			if item.UserID == oldID {
+				item.UserID = newID
+			}
+			if item.ClosedBy == oldID {
+				item.ClosedBy = newID
+			}
+			return nil
+		})
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+
+	tokens, err := s.Store.ListAPITokens(ctx)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if token.CreatedBy != oldID {
+			continue
+		}
+		token.CreatedBy = newID
+		if err := s.Store.PutAPIToken(ctx, token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameGroupMember replaces oldID with newID in every group.
+func (s *Server) renameGroupMember(ctx context.Context, oldID, newID string) error {
+	groups, err := s.Store.ListGroups(ctx)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if !group.HasMember(oldID) {
+			continue
+		}
+		err := s.Store.UpdateGroup(ctx, group.ID, func(group *Group) error {
+			group.Members = removeMember(group.Members, oldID)
+			if !group.HasMember(newID) {
+				group.Members = append(group.Members, newID)
+			}
+			return nil
+		})
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// usersByEmail returns the users with the given email address. There can be
+// more than one if an address has been reused.
+func (s *Server) usersByEmail(ctx context.Context, email string) ([]User, error) {
+	users, err := s.Store.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var rv []User
+	for _, user := range users {
+		if strings.EqualFold(user.PrimaryEmail(), email) {
+			rv = append(rv, user)
+		}
+	}
+	return rv, nil
+}
+
+// formUserID returns the ID of the user named by the "user" form value of
+// r, which may be their ID or their email address. Unknown users are
+// returned as given, for the caller to report.
+func (s *Server) formUserID(r *http.Request) (string, error) {
+	idOrEmail := r.FormValue("user")
+	user, err := s.lookupUser(r.Context(), idOrEmail)
+	switch err {
+	case nil:
+		return user.ID, nil
+	case ErrNotFound:
+		return idOrEmail, nil
+	default:
+		return "", err
+	}
+}
+
+// lookupUser returns the user with the given ID or, failing that, the only
+// user with the given email address.
+func (s *Server) lookupUser(ctx context.Context, idOrEmail string) (*User, error) {
+	user, err := s.Store.GetUser(ctx, idOrEmail)
+	if err != ErrNotFound || !strings.Contains(idOrEmail, "@") {
+		return user, err
+	}
+	users, err := s.usersByEmail(ctx, idOrEmail)
+	if err != nil {
+		return nil, err
+	}
+	switch len(users) {
+	case 0:
+		return nil, ErrNotFound
+	case 1:
+		return &users[0], nil
+	default:
+		return nil, errAmbiguousEmail
+	}
+}
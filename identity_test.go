@@ -0,0 +1,239 @@
+package tvm
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestSubjectUserID(t *testing.T) {
+	assert.Check(t, is.Equal("accounts.google.com:1234", SubjectUserID("https://accounts.google.com", "1234")))
+	assert.Check(t, is.Equal("login.example.com_tenant:a_b", SubjectUserID("https://login.example.com/tenant", "a/b")))
+}
+
+func TestBindUser(t *testing.T) {
+	ctx := context.Background()
+	r := httptest.NewRequest("GET", "/oauth2/callback", nil)
+	s, _ := newTestServer(t, Config{Enrollment: EnrollmentConfig{Policy: EnrollInvite}})
+	oldSession := loginAs(t, s, User{ID: "alice@example.com", Email: "alice@example.com", Roles: []RoleGrant{{Role: "dev"}}})
+	assert.NilError(t, s.Store.PutGroup(ctx, Group{ID: "eng", Members: []string{"alice@example.com"}}))
+	assert.NilError(t, s.Store.PutAccessRequest(ctx, AccessRequest{ID: "req", UserID: "alice@example.com", Role: "prod"}))
+
+	// an unverified email address cannot claim a user
+	idToken := IDToken{Iss: googleIssuer, Sub: "1", Email: "alice@example.com"}
+	_, err := s.enrollUser(ctx, r, idToken)
+	assert.Check(t, is.Equal(errNotInvited, err))
+
+	idToken.EmailVerified = true
+	user, err := s.enrollUser(ctx, r, idToken)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("accounts.google.com:1", user.ID))
+	assert.Check(t, is.Equal("alice@example.com", user.Email))
+	assert.Check(t, is.DeepEqual([]RoleGrant{{Role: "dev"}}, user.Roles))
+
+	_, err = s.Store.GetUser(ctx, "alice@example.com")
+	assert.Check(t, is.Equal(ErrNotFound, err))
+	_, err = s.Store.GetSession(ctx, oldSession)
+	assert.Check(t, is.Equal(ErrNotFound, err))
+	group, err := s.Store.GetGroup(ctx, "eng")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"accounts.google.com:1"}, group.Members))
+	request, err := s.Store.GetAccessRequest(ctx, "req")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("accounts.google.com:1", request.UserID))
+
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditIdentity})
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(events, 1))
+	assert.Check(t, is.Equal("alice@example.com", events[0].Before.ID))
+	assert.Check(t, is.Equal("accounts.google.com:1", events[0].After.ID))
+
+	// the user keeps their roles when their address changes
+	idToken.Email = "alice.smith@example.com"
+	user, err = s.enrollUser(ctx, r, idToken)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("accounts.google.com:1", user.ID))
+	assert.Check(t, is.Equal("alice.smith@example.com", user.Email))
+	assert.Check(t, is.Len(user.Roles, 1))
+	events, err = s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditIdentity})
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(events, 2))
+	assert.Check(t, is.Equal("alice.smith@example.com", events[0].After.Email))
+}
+
+func TestRecycledEmail(t *testing.T) {
+	ctx := context.Background()
+	r := httptest.NewRequest("GET", "/oauth2/callback", nil)
+	s, _ := newTestServer(t, Config{})
+	assert.NilError(t, s.Store.PutUser(ctx, User{
+		ID:      "accounts.google.com:1",
+		Issuer:  googleIssuer,
+		Subject: "1",
+		Email:   "alice@example.com",
+		Roles:   []RoleGrant{{Role: "prod-admin"}},
+	}))
+
+	// someone new with the same address is a different user
+	user, err := s.enrollUser(ctx, r, IDToken{Iss: googleIssuer, Sub: "2", Email: "alice@example.com", EmailVerified: true})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("accounts.google.com:2", user.ID))
+	assert.Check(t, is.Len(user.Roles, 0))
+
+	_, err = s.lookupUser(ctx, "alice@example.com")
+	assert.Check(t, is.Equal(errAmbiguousEmail, err))
+	found, err := s.lookupUser(ctx, "accounts.google.com:1")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(found.Roles, 1))
+
+	// the directory does not mistake one for the other
+	dirUser := DirectoryUser{ID: "2", Email: "alice@example.com"}
+	assert.Check(t, !dirUser.matches(User{Subject: "1", Email: "alice@example.com"}))
+	assert.Check(t, dirUser.matches(*user))
+	assert.Check(t, dirUser.matches(User{ID: "alice@example.com"}))
+}
+
+func TestBindUserLegacy(t *testing.T) {
+	ctx := context.Background()
+	r := httptest.NewRequest("GET", "/oauth2/callback", nil)
+	fake := newFakeGoogleDirectory(t)
+	fake.suspended["bob@example.com"] = false
+	fake.ids["bob@example.com"] = "2"
+	fake.suspended["alice@example.com"] = false
+	fake.ids["alice@example.com"] = "9"
+	s, _ := newTestServer(t, Config{Enrollment: EnrollmentConfig{Policy: EnrollInvite}})
+	s.Directory = fake.directory(t)
+
+	// a user keyed by email by an older version is not bound to someone
+	// the directory says is not them, since the address may have been
+	// recycled
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "alice@example.com", Admin: true}))
+	_, err := s.enrollUser(ctx, r, IDToken{Iss: googleIssuer, Sub: "1", Email: "alice@example.com", EmailVerified: true})
+	assert.Check(t, is.Equal(errNotInvited, err))
+	user, err := s.enrollUser(ctx, r, IDToken{Iss: googleIssuer, Sub: "9", Email: "alice@example.com", EmailVerified: true})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("accounts.google.com:9", user.ID))
+	assert.Check(t, user.Admin)
+
+	// nor is an invited user bound to someone the directory says is not them
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "bob@example.com", Email: "bob@example.com"}))
+	_, err = s.enrollUser(ctx, r, IDToken{Iss: googleIssuer, Sub: "3", Email: "bob@example.com", EmailVerified: true})
+	assert.Check(t, is.Equal(errNotInvited, err))
+	user, err = s.enrollUser(ctx, r, IDToken{Iss: googleIssuer, Sub: "2", Email: "bob@example.com", EmailVerified: true})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("accounts.google.com:2", user.ID))
+}
+
+func TestUpgradeWithoutDirectory(t *testing.T) {
+	ctx := context.Background()
+	r := httptest.NewRequest("GET", "/oauth2/callback", nil)
+	s, _ := newTestServer(t, Config{Enrollment: EnrollmentConfig{Policy: EnrollInvite}})
+
+	// users stored by an older version, keyed by email
+	assert.NilError(t, s.Store.PutUser(ctx, User{
+		ID:         "alice@example.com",
+		Admin:      true,
+		Roles:      []RoleGrant{{Role: "dev"}},
+		U2FDevices: []U2FDevice{{Counter: 1}},
+	}))
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "bob@example.com"}))
+	assert.NilError(t, s.Store.PutGroup(ctx, Group{ID: "eng", Members: []string{"alice@example.com"}}))
+
+	// migrating without a directory leaves them keyed by email
+	count, err := s.Migrate(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(2, count))
+	_, err = s.Store.GetUser(ctx, "alice@example.com")
+	assert.NilError(t, err)
+
+	// only a Google login binds them
+	_, err = s.enrollUser(ctx, r, IDToken{Iss: "https://idp.example.com", Sub: "1", Email: "bob@example.com", EmailVerified: true})
+	assert.Check(t, is.Equal(errNotInvited, err))
+
+	// and keeps what they had
+	user, err := s.enrollUser(ctx, r, IDToken{Iss: googleIssuer, Sub: "1", Email: "alice@example.com", EmailVerified: true})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("accounts.google.com:1", user.ID))
+	assert.Check(t, is.Equal("alice@example.com", user.Email))
+	assert.Check(t, user.Admin)
+	assert.Check(t, is.Len(user.Roles, 1))
+	assert.Check(t, is.Len(user.U2FDevices, 1))
+	_, err = s.Store.GetUser(ctx, "alice@example.com")
+	assert.Check(t, is.Equal(ErrNotFound, err))
+	group, err := s.Store.GetGroup(ctx, "eng")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"accounts.google.com:1"}, group.Members))
+
+	// no orphaned record is left behind
+	users, err := s.Store.ListUsers(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(users, 2))
+}
+
+func TestMigrateIdentity(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeGoogleDirectory(t)
+	fake.suspended["alice@example.com"] = false
+	fake.ids["alice@example.com"] = "1"
+	s, _ := newTestServer(t, Config{})
+	s.Directory = fake.directory(t)
+
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "alice@example.com", Admin: true, Roles: []RoleGrant{{Role: "dev"}}}))
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "bob@example.com"}))
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "carol@example.com", Email: "carol@example.com"}))
+	assert.NilError(t, s.Store.PutGroup(ctx, Group{ID: "eng", Members: []string{"alice@example.com", "bob@example.com"}}))
+	assert.NilError(t, s.Store.PutAccessRequest(ctx, AccessRequest{ID: "req", UserID: "bob@example.com", DecidedBy: "alice@example.com"}))
+	assert.NilError(t, s.Store.PutReviewItem(ctx, ReviewItem{ID: "item", UserID: "alice@example.com"}))
+	assert.NilError(t, s.Store.PutAPIToken(ctx, APIToken{ID: "token", CreatedBy: "alice@example.com"}))
+	aliceSession := loginAs(t, s, User{ID: "alice@example.com"})
+
+	count, err := s.Migrate(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(3, count))
+
+	// alice is rekeyed by the identity the directory gives
+	_, err = s.Store.GetUser(ctx, "alice@example.com")
+	assert.Check(t, is.Equal(ErrNotFound, err))
+	user, err := s.Store.GetUser(ctx, "accounts.google.com:1")
+	assert.NilError(t, err)
+	assert.Check(t, user.Bound())
+	assert.Check(t, is.Equal("alice@example.com", user.Email))
+	assert.Check(t, user.Admin)
+	assert.Check(t, is.Len(user.Roles, 1))
+	group, err := s.Store.GetGroup(ctx, "eng")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"bob@example.com", "accounts.google.com:1"}, group.Members))
+	request, err := s.Store.GetAccessRequest(ctx, "req")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("bob@example.com", request.UserID))
+	assert.Check(t, is.Equal("accounts.google.com:1", request.DecidedBy))
+	item, err := s.Store.GetReviewItem(ctx, "item")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("accounts.google.com:1", item.UserID))
+	token, err := s.Store.GetAPIToken(ctx, "token")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("accounts.google.com:1", token.CreatedBy))
+	_, err = s.Store.GetSession(ctx, aliceSession)
+	assert.Check(t, is.Equal(ErrNotFound, err))
+
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditIdentity})
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(events, 1))
+	assert.Check(t, is.Equal("migrate", events[0].Actor))
+	assert.Check(t, is.Equal("alice@example.com", events[0].Before.ID))
+	assert.Check(t, is.Equal("accounts.google.com:1", events[0].After.ID))
+
+	// bob is not in the directory, so stays keyed by email and unbindable
+	user, err = s.Store.GetUser(ctx, "bob@example.com")
+	assert.NilError(t, err)
+	assert.Check(t, !user.Bound())
+	assert.Check(t, is.Equal("", user.Email))
+	assert.Check(t, is.Equal("bob@example.com", user.PrimaryEmail()))
+
+	// carol was invited and binds when she logs in
+	user, err = s.Store.GetUser(ctx, "carol@example.com")
+	assert.NilError(t, err)
+	assert.Check(t, !user.Bound())
+}
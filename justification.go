@@ -0,0 +1,110 @@
+package tvm
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// justificationTemplate asks the user for the reason and ticket that a role
+// requires, then repeats the original request with them added.
+var justificationTemplate = template.Must(template.New("justification").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <title>Why do you need access?</title>
+</head>
+<body>
+<h1>Why do you need access to {{ .Role }}?</h1>
+{{ if .Error }}<p>{{ .Error }}</p>{{ end }}
+<form action="/" method="GET">
+  {{ range $name, $values := .Params }}{{ range $values }}
+  <input type="hidden" name="{{ $name }}" value="{{ . }}" />
+  {{ end }}{{ end }}
+  {{ if .RequireReason }}
+  <p><label>Reason <input type="text" name="reason" value="{{ .Reason }}" size="60" /></label></p>
+  {{ end }}
+  {{ if .TicketPattern }}
+  <p><label>Ticket <input type="text" name="ticket" value="{{ .Ticket }}" /></label></p>
+  {{ end }}
+  <button>Continue</button>
+</form>
+</body>
+</html>
+`))
+
+// checkJustification makes sure that the request carries the reason and
+// ticket that roleConfig requires. If not, it prompts for them and returns
+// false.
+func (s *Server) checkJustification(w http.ResponseWriter, r *http.Request, role string, roleConfig RoleConfig) bool {
+	reason := strings.TrimSpace(r.URL.Query().Get("reason"))
+	ticket := strings.TrimSpace(r.URL.Query().Get("ticket"))
+
+	var problem string
+	switch {
+	case roleConfig.RequireReason && reason == "":
+		problem = fmt.Sprintf("role %s requires a reason", role)
+	case roleConfig.TicketPattern != "" && ticket == "":
+		problem = fmt.Sprintf("role %s requires a ticket", role)
+	case roleConfig.TicketPattern != "":
+		re, err := regexp.Compile("^(?:" + roleConfig.TicketPattern + ")$")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad ticket pattern for %s: %s", role, err), http.StatusInternalServerError)
+			return false
+		}
+		if !re.MatchString(ticket) {
+			problem = fmt.Sprintf("ticket %q does not match %s", ticket, roleConfig.TicketPattern)
+		}
+	}
+	if problem == "" {
+		return true
+	}
+
+	if r.URL.Query().Get("format") == "sh" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return false
+	}
+
+	params := r.URL.Query()
+	params.Del("reason")
+	params.Del("ticket")
+	justificationTemplate.Execute(w, struct {
+		Role          string
+		Error         string
+		Params        map[string][]string
+		RequireReason bool
+		TicketPattern string
+		Reason        string
+		Ticket        string
+	}{
+		Role:          role,
+		Error:         problem,
+		Params:        params,
+		RequireReason: roleConfig.RequireReason,
+		TicketPattern: roleConfig.TicketPattern,
+		Reason:        reason,
+		Ticket:        ticket,
+	})
+	return false
+}
+
+// sessionTagValue returns s modified to fit the rules for STS session tag
+// values: at most 256 characters drawn from letters, numbers, spaces and
+// _.:/=+-@.
+func sessionTagValue(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsSpace(r) || strings.ContainsRune("_.:/=+-@", r) {
+			if unicode.IsSpace(r) {
+				return ' '
+			}
+			return r
+		}
+		return '_'
+	}, s)
+	if runes := []rune(s); len(runes) > 256 {
+		s = string(runes[:256])
+	}
+	return s
+}
@@ -0,0 +1,85 @@
+package tvm
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestJustification(t *testing.T) {
+	s, stsSvc := newTestServer(t, Config{
+		Roles: map[string]RoleConfig{
+			"prod": {RequireReason: true, TicketPattern: `OPS-\d+`},
+		},
+	})
+	alice := loginAs(t, s, User{ID: "alice", Roles: []RoleGrant{{Role: "prod"}, {Role: "dev"}}})
+
+	t.Run("prompts in browser", func(t *testing.T) {
+		w := do(s, "GET", "/?role=prod&format=cli&port=1234", nil, alice)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+		assert.Check(t, is.Contains(w.Body.String(), "role prod requires a reason"))
+		assert.Check(t, is.Contains(w.Body.String(), `<input type="hidden" name="port" value="1234" />`))
+		assert.Check(t, is.Contains(w.Body.String(), `name="ticket"`))
+		assert.Check(t, is.Len(stsSvc.inputs, 0))
+	})
+
+	t.Run("rejects missing reason", func(t *testing.T) {
+		w := do(s, "GET", "/?role=prod&format=sh&ticket=OPS-1", nil, alice)
+		assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+		assert.Check(t, is.Contains(w.Body.String(), "requires a reason"))
+	})
+
+	t.Run("rejects bad ticket", func(t *testing.T) {
+		w := do(s, "GET", "/?role=prod&format=sh&reason=deploy&ticket=OPS-1x", nil, alice)
+		assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+		assert.Check(t, is.Contains(w.Body.String(), "does not match"))
+		assert.Check(t, is.Len(stsSvc.inputs, 0))
+	})
+
+	t.Run("issues with tags", func(t *testing.T) {
+		w := do(s, "GET", "/?role=prod&format=sh&reason=deploy+%22v2%22&ticket=OPS-42", nil, alice)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+		assert.Assert(t, is.Len(stsSvc.inputs, 1))
+
+		var tags []string
+		for _, tag := range stsSvc.inputs[0].Tags {
+			tags = append(tags, *tag.Key+"="+*tag.Value)
+		}
+		assert.Check(t, is.DeepEqual([]string{"tvm:reason=deploy _v2_", "tvm:ticket=OPS-42"}, tags))
+
+		events, err := s.Store.ListAuditEvents(context.Background(), AuditFilter{Type: AuditCredentialsIssue})
+		assert.NilError(t, err)
+		assert.Assert(t, is.Len(events, 1))
+		assert.Check(t, is.Equal(`deploy "v2"`, events[0].Reason))
+		assert.Check(t, is.Equal("OPS-42", events[0].Ticket))
+	})
+
+	t.Run("not required", func(t *testing.T) {
+		w := do(s, "GET", "/?role=dev&format=sh", nil, alice)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+		assert.Assert(t, is.Len(stsSvc.inputs, 2))
+		assert.Check(t, is.Len(stsSvc.inputs[1].Tags, 0))
+	})
+
+	t.Run("volunteered", func(t *testing.T) {
+		// a reason for a role that does not require one is audited but not
+		// sent as a tag, which the role may not allow
+		w := do(s, "GET", "/?role=dev&format=sh&reason=debug", nil, alice)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+		assert.Assert(t, is.Len(stsSvc.inputs, 3))
+		assert.Check(t, is.Len(stsSvc.inputs[2].Tags, 0))
+
+		events, err := s.Store.ListAuditEvents(context.Background(), AuditFilter{Type: AuditCredentialsIssue, Role: "dev"})
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal("debug", events[0].Reason))
+	})
+}
+
+func TestSessionTagValue(t *testing.T) {
+	assert.Check(t, is.Equal("fix prod: see https://x/y_z=1 _tab_", sessionTagValue("fix prod: see https://x/y?z=1\t(tab)")))
+	assert.Check(t, is.Equal(256, len(sessionTagValue(strings.Repeat("a", 300)))))
+}
@@ -0,0 +1,80 @@
+package tvm
+
+import (
+	"context"
+	"log"
+)
+
+// Migrate rewrites every user in s.Store in the current format. Stores read
+// data written by older versions, so migrating is not required for
+// correctness, but afterwards the stored data no longer depends on the
+// compatibility code. It returns the number of users rewritten.
+//
+// Changes so far:
+//
+//   - User.Roles changed from a list of role ARNs to a list of RoleGrants.
+//   - Users gained an identity separate from their email address. Users
+//     keyed by email are looked up in s.Directory and rekeyed by the
+//     identity it gives. Those it cannot resolve, or all of them if there
+//     is no directory, are left keyed by email and bound when they next
+//     log in.
+func (s *Server) Migrate(ctx context.Context) (int, error) {
+	users, err := s.Store.ListUsers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, user := range users {
+		if !user.Bound() && user.Email == "" {
+			bound, err := s.migrateIdentity(ctx, user)
+			if err != nil {
+				return count, err
+			}
+			if bound {
+				count++
+				continue
+			}
+		}
+
+		err := s.Store.UpdateUser(ctx, user.ID, func(user *User) error {
+			return nil
+		})
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// migrateIdentity rekeys user, who is keyed by email, by the identity that
+// the directory has for that address. It returns false if there is none.
+func (s *Server) migrateIdentity(ctx context.Context, user User) (bool, error) {
+	if s.Directory == nil {
+		log.Printf("migrate: %s is keyed by email and will be bound when they next log in", user.ID)
+		return false, nil
+	}
+	dirUser, err := s.Directory.GetUser(ctx, user.ID)
+	if err == ErrNotFound || (err == nil && dirUser.ID == "") {
+		log.Printf("migrate: %s is not in the directory and will be bound if they log in", user.ID)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	newID := SubjectUserID(googleIssuer, dirUser.ID)
+	if _, err := s.Store.GetUser(ctx, newID); err == nil {
+		log.Printf("migrate: %s is in the directory as %s, who already has a user; delete one of them", user.ID, newID)
+		return false, nil
+	} else if err != ErrNotFound {
+		return false, err
+	}
+
+	_, err = s.rekeyUser(ctx, nil, "migrate", user.ID, googleIssuer, dirUser.ID, dirUser.Email)
+	if err == ErrNotFound || err == errAlreadyBound {
+		return false, nil
+	}
+	return err == nil, err
+}
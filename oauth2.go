@@ -41,27 +41,66 @@ func (s *Server) handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	session.OAuth2State = ""
-	session.UserID = idToken.Email
-	if err := s.Store.PutSession(r.Context(), *session); err != nil {
-		panic(fmt.Errorf("cannot store session: %s", err))
+	user, err := s.enrollUser(r.Context(), r, idToken)
+	switch err {
+	case nil:
+	case errNotProvisioned, errNotInvited, errWrongDomain, errNoSubject, errAmbiguousEmail:
+		s.audit(r.Context(), r, AuditEvent{
+			Type:    AuditLogin,
+			Actor:   idToken.Email,
+			Message: err.Error(),
+		})
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	default:
+		fmt.Fprintf(w, "cannot fetch user: %s\n", err)
+		return
+	}
+
+	s.audit(r.Context(), r, AuditEvent{
+		Type:    AuditLogin,
+		Actor:   user.ID,
+		Message: fmt.Sprintf("logged in as %s", idToken.Email),
+	})
+
+	if code := session.Params.Get("enroll"); code != "" {
+		user, err = s.redeemEnrollmentCode(r.Context(), r, user, code)
+		if err == errBadEnrollmentCode {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			fmt.Fprintf(w, "cannot fetch user: %s\n", err)
+			return
+		}
 	}
 
-	user, err := s.Store.GetUser(r.Context(), session.UserID)
+	err = s.Store.UpdateSession(r.Context(), session.ID, func(session *Session) error {
+		session.OAuth2State = ""
+		session.UserID = user.ID
+		return nil
+	})
 	if err != nil {
-		fmt.Fprintln(w, "cannot fetch user: %w", err)
-		return
+		panic(fmt.Errorf("cannot store session: %s", err))
 	}
-	if user == nil {
-		user = &User{
-			ID: session.UserID,
+	session.OAuth2State = ""
+	session.UserID = user.ID
+
+	if s.Directory != nil && s.Config.Directory.SyncAtLogin {
+		if err := s.SyncDirectoryUser(r.Context(), user.ID); err != nil {
+			http.Error(w, fmt.Sprintf("cannot check directory: %s", err), http.StatusInternalServerError)
+			return
 		}
-		if err := s.Store.PutUser(r.Context(), *user); err != nil {
-			fmt.Fprintln(w, "cannot create user: %w", err)
+		if user, err = s.Store.GetUser(r.Context(), user.ID); err != nil {
+			fmt.Fprintf(w, "cannot fetch user: %s\n", err)
 			return
 		}
 	}
 
+	if !user.Active() {
+		s.serveInactiveUser(w, r, *user)
+		return
+	}
+
 	if len(user.U2FDevices) == 0 {
 		http.Redirect(w,r,"/u2f/register", http.StatusFound)
 		return
@@ -75,6 +114,7 @@ func (s *Server) handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 // token endpoint.
 type IDToken struct {
 	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
 	Aud               string `json:"aud"`
 	Iss               string `json:"iss"`
 	Iat               int    `json:"iat"`
@@ -0,0 +1,302 @@
+package tvm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/organizations"
+)
+
+// When every account has the same standard roles, such as Admin, ReadOnly
+// and Deploy, TVM lists the accounts in AWS Organizations to offer each
+// standard role in each account. A single grant of an organization role,
+//
+//	organization:<root or OU ID>:role/<name>
+//
+// allows the named role in every active account under that root or
+// organizational unit, including accounts added after the grant.
+
+// OrganizationConfig describes how TVM uses AWS Organizations, if
+// Server.Organizations is set.
+type OrganizationConfig struct {
+	// StandardRoles are the names of the roles that exist in every account.
+	StandardRoles []string
+
+	// ManagementRole, if set, is the ARN of a role in the management
+	// account that TVM assumes to list accounts. It needs only
+	// organizations:ListRoots, organizations:ListAccountsForParent and
+	// organizations:ListOrganizationalUnitsForParent.
+	ManagementRole string
+}
+
+// Enabled returns true if TVM should list accounts.
+func (c OrganizationConfig) Enabled() bool {
+	return len(c.StandardRoles) > 0
+}
+
+const organizationRolePrefix = "organization:"
+
+// OrganizationRole returns the role that grants the role named name in every
+// account under parent, which is the ID of a root or organizational unit.
+func OrganizationRole(parent, name string) string {
+	return organizationRolePrefix + parent + ":role/" + name
+}
+
+// parseOrganizationRole returns the parent and role name of an organization
+// role, and false if role is not one.
+func parseOrganizationRole(role string) (parent, name string, ok bool) {
+	if !strings.HasPrefix(role, organizationRolePrefix) {
+		return "", "", false
+	}
+	rest := strings.TrimPrefix(role, organizationRolePrefix)
+	i := strings.Index(rest, ":role/")
+	if i <= 0 || i+len(":role/") == len(rest) {
+		return "", "", false
+	}
+	return rest[:i], rest[i+len(":role/"):], true
+}
+
+// Organization is the accounts and organizational units of an AWS
+// organization, as of Time.
+type Organization struct {
+	// Accounts are the active accounts, sorted by name.
+	Accounts []OrganizationAccount
+
+	// Units are the roots and organizational units, sorted by path.
+	Units []OrganizationalUnit
+
+	Time time.Time
+}
+
+// OrganizationAccount is an active account in an organization.
+type OrganizationAccount struct {
+	ID   string
+	Name string
+	ARN  string
+
+	// Parents are the IDs of the root and organizational units that the
+	// account is in, outermost first.
+	Parents []string
+
+	// Path is the path of the organizational unit that the account is
+	// directly in.
+	Path string
+}
+
+// RoleARN returns the ARN of the role named name in the account.
+func (a OrganizationAccount) RoleARN(name string) string {
+	partition := "aws"
+	if accountARN, err := arn.Parse(a.ARN); err == nil {
+		partition = accountARN.Partition
+	}
+	return arn.ARN{Partition: partition, Service: "iam", AccountID: a.ID, Resource: "role/" + name}.String()
+}
+
+// OrganizationalUnit is a root or organizational unit.
+type OrganizationalUnit struct {
+	ID string
+
+	// Path is the names of the unit and those it is in, separated by
+	// slashes, e.g. Root/Production/EU.
+	Path string
+}
+
+// Role returns the organization role that grants the role named name in
+// every account under the unit.
+func (u OrganizationalUnit) Role(name string) string {
+	return OrganizationRole(u.ID, name)
+}
+
+// AccountsUnder returns the accounts under the root or organizational unit
+// with ID parent.
+func (o *Organization) AccountsUnder(parent string) []OrganizationAccount {
+	var rv []OrganizationAccount
+	for _, account := range o.Accounts {
+		for _, p := range account.Parents {
+			if p == parent {
+				rv = append(rv, account)
+				break
+			}
+		}
+	}
+	return rv
+}
+
+func (o *Organization) unit(id string) (OrganizationalUnit, bool) {
+	for _, unit := range o.Units {
+		if unit.ID == id {
+			return unit, true
+		}
+	}
+	return OrganizationalUnit{}, false
+}
+
+// organizationRetryInterval is how long Organization waits after failing to
+// list the organization before it tries again.
+const organizationRetryInterval = time.Minute
+
+// organizationCache holds the organization, which is listed on first use
+// and refreshed by RefreshOrganization. If listing fails, the error is kept
+// for organizationRetryInterval, so that every request does not walk the
+// organization again while it is unavailable.
+type organizationCache struct {
+	mu           sync.Mutex
+	organization *Organization
+	err          error
+	failed       time.Time
+}
+
+// Organization returns the organization, listing it if it has not been. It
+// returns nil if s.Organizations is not set. The lock is not held while
+// listing, so concurrent first calls may each list; the first to finish is
+// kept.
+func (s *Server) Organization(ctx context.Context) (*Organization, error) {
+	if s.Organizations == nil {
+		return nil, nil
+	}
+	s.organization.mu.Lock()
+	cached, err, failed := s.organization.organization, s.organization.err, s.organization.failed
+	s.organization.mu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+	if err != nil && time.Since(failed) < organizationRetryInterval {
+		return nil, err
+	}
+
+	organization, err := s.listOrganization(ctx)
+	s.organization.mu.Lock()
+	defer s.organization.mu.Unlock()
+	if s.organization.organization != nil {
+		return s.organization.organization, nil
+	}
+	if err != nil {
+		s.organization.err, s.organization.failed = err, time.Now()
+		return nil, err
+	}
+	s.organization.organization, s.organization.err = organization, nil
+	return organization, nil
+}
+
+// RefreshOrganization lists the organization again, so that grants of
+// organization roles cover accounts that have been added since.
+func (s *Server) RefreshOrganization(ctx context.Context) error {
+	if s.Organizations == nil {
+		return nil
+	}
+	organization, err := s.listOrganization(ctx)
+	if err != nil {
+		return err
+	}
+	s.organization.mu.Lock()
+	defer s.organization.mu.Unlock()
+	s.organization.organization, s.organization.err = organization, nil
+	return nil
+}
+
+func (s *Server) listOrganization(ctx context.Context) (*Organization, error) {
+	var roots []*organizations.Root
+	err := s.Organizations.ListRootsPagesWithContext(ctx, &organizations.ListRootsInput{}, func(output *organizations.ListRootsOutput, lastPage bool) bool {
+		roots = append(roots, output.Roots...)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list organization roots: %w", err)
+	}
+
+	rv := &Organization{Time: time.Now()}
+	var walk func(id, path string, parents []string) error
+	walk = func(id, path string, parents []string) error {
+		rv.Units = append(rv.Units, OrganizationalUnit{ID: id, Path: path})
+		parents = append(parents[:len(parents):len(parents)], id)
+
+		err := s.Organizations.ListAccountsForParentPagesWithContext(ctx, &organizations.ListAccountsForParentInput{ParentId: aws.String(id)}, func(output *organizations.ListAccountsForParentOutput, lastPage bool) bool {
+			for _, account := range output.Accounts {
+				if aws.StringValue(account.Status) != organizations.AccountStatusActive {
+					continue
+				}
+				rv.Accounts = append(rv.Accounts, OrganizationAccount{
+					ID:      aws.StringValue(account.Id),
+					Name:    aws.StringValue(account.Name),
+					ARN:     aws.StringValue(account.Arn),
+					Parents: parents,
+					Path:    path,
+				})
+			}
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("cannot list accounts in %s: %w", path, err)
+		}
+
+		var units []*organizations.OrganizationalUnit
+		err = s.Organizations.ListOrganizationalUnitsForParentPagesWithContext(ctx, &organizations.ListOrganizationalUnitsForParentInput{ParentId: aws.String(id)}, func(output *organizations.ListOrganizationalUnitsForParentOutput, lastPage bool) bool {
+			units = append(units, output.OrganizationalUnits...)
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("cannot list organizational units in %s: %w", path, err)
+		}
+		for _, unit := range units {
+			if err := walk(aws.StringValue(unit.Id), path+"/"+aws.StringValue(unit.Name), parents); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, root := range roots {
+		if err := walk(aws.StringValue(root.Id), aws.StringValue(root.Name), nil); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(rv.Accounts, func(i, j int) bool { return rv.Accounts[i].Name < rv.Accounts[j].Name })
+	sort.Slice(rv.Units, func(i, j int) bool { return rv.Units[i].Path < rv.Units[j].Path })
+	return rv, nil
+}
+
+// expandRole returns the ARNs of the roles that role allows: role itself,
+// or for an organization role, the role in each account it covers.
+func (s *Server) expandRole(ctx context.Context, role string) ([]string, error) {
+	parent, name, ok := parseOrganizationRole(role)
+	if !ok {
+		return []string{role}, nil
+	}
+	organization, err := s.Organization(ctx)
+	if err != nil || organization == nil {
+		return nil, err
+	}
+	var rv []string
+	for _, account := range organization.AccountsUnder(parent) {
+		rv = append(rv, account.RoleARN(name))
+	}
+	return rv, nil
+}
+
+// checkOrganizationRole returns a *RoleProblem if role, an organization
+// role, does not name a known root or organizational unit and a standard
+// role.
+func (s *Server) checkOrganizationRole(ctx context.Context, role, parent, name string) error {
+	organization, err := s.Organization(ctx)
+	if err != nil {
+		return err
+	}
+	if organization == nil {
+		return &RoleProblem{Role: role, Problem: "needs AWS Organizations, which is not configured"}
+	}
+	if _, ok := organization.unit(parent); !ok {
+		return &RoleProblem{Role: role, Problem: fmt.Sprintf("names %s, which is not a root or organizational unit", parent)}
+	}
+	for _, standard := range s.Config.Organization.StandardRoles {
+		if standard == name {
+			return nil
+		}
+	}
+	return &RoleProblem{Role: role, Problem: fmt.Sprintf("names %s, which is not a standard role", name)}
+}
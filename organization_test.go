@@ -0,0 +1,167 @@
+package tvm
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// fakeOrganizations serves an organization with one root, r-root, whose
+// units and accounts are keyed by the ID of their parent. If err is set,
+// listing roots fails with it.
+type fakeOrganizations struct {
+	organizationsiface.OrganizationsAPI
+	units    map[string][]*organizations.OrganizationalUnit
+	accounts map[string][]*organizations.Account
+	err      error
+	calls    int
+}
+
+func (f *fakeOrganizations) ListRootsPagesWithContext(ctx aws.Context, input *organizations.ListRootsInput, fn func(*organizations.ListRootsOutput, bool) bool, opts ...request.Option) error {
+	f.calls++
+	if f.err != nil {
+		return f.err
+	}
+	fn(&organizations.ListRootsOutput{Roots: []*organizations.Root{{Id: aws.String("r-root"), Name: aws.String("Root")}}}, true)
+	return nil
+}
+
+func (f *fakeOrganizations) ListAccountsForParentPagesWithContext(ctx aws.Context, input *organizations.ListAccountsForParentInput, fn func(*organizations.ListAccountsForParentOutput, bool) bool, opts ...request.Option) error {
+	fn(&organizations.ListAccountsForParentOutput{Accounts: f.accounts[*input.ParentId]}, true)
+	return nil
+}
+
+func (f *fakeOrganizations) ListOrganizationalUnitsForParentPagesWithContext(ctx aws.Context, input *organizations.ListOrganizationalUnitsForParentInput, fn func(*organizations.ListOrganizationalUnitsForParentOutput, bool) bool, opts ...request.Option) error {
+	fn(&organizations.ListOrganizationalUnitsForParentOutput{OrganizationalUnits: f.units[*input.ParentId]}, true)
+	return nil
+}
+
+func fakeAccount(id, name, status string) *organizations.Account {
+	return &organizations.Account{
+		Id:     aws.String(id),
+		Name:   aws.String(name),
+		Arn:    aws.String("arn:aws:organizations::111111111111:account/o-example/" + id),
+		Status: aws.String(status),
+	}
+}
+
+func newFakeOrganizations() *fakeOrganizations {
+	return &fakeOrganizations{
+		units: map[string][]*organizations.OrganizationalUnit{
+			"r-root":  {{Id: aws.String("ou-prod"), Name: aws.String("Production")}},
+			"ou-prod": {{Id: aws.String("ou-prod-eu"), Name: aws.String("EU")}},
+		},
+		accounts: map[string][]*organizations.Account{
+			"r-root":     {fakeAccount("111111111111", "management", organizations.AccountStatusActive)},
+			"ou-prod":    {fakeAccount("222222222222", "prod-us", organizations.AccountStatusActive)},
+			"ou-prod-eu": {fakeAccount("333333333333", "prod-eu", organizations.AccountStatusActive), fakeAccount("444444444444", "closed", organizations.AccountStatusSuspended)},
+		},
+	}
+}
+
+func TestOrganizationRoles(t *testing.T) {
+	ctx := context.Background()
+	s, stsSvc := newTestServer(t, Config{Organization: OrganizationConfig{StandardRoles: []string{"Admin", "ReadOnly"}}})
+	fake := newFakeOrganizations()
+	s.Organizations = fake
+
+	organization, err := s.Organization(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]OrganizationalUnit{
+		{ID: "r-root", Path: "Root"},
+		{ID: "ou-prod", Path: "Root/Production"},
+		{ID: "ou-prod-eu", Path: "Root/Production/EU"},
+	}, organization.Units))
+	assert.Check(t, is.Len(organization.Accounts, 3))
+	assert.Check(t, is.Len(organization.AccountsUnder("ou-prod"), 2))
+
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+	alice := loginAs(t, s, User{ID: "alice"})
+	grant := func(role string) int {
+		return do(s, "POST", "/admin/op", url.Values{"op": {"add_role"}, "user": {"alice"}, "role": {role}}, admin).Code
+	}
+	assert.Check(t, is.Equal(http.StatusBadRequest, grant(OrganizationRole("ou-missing", "Admin"))))
+	assert.Check(t, is.Equal(http.StatusBadRequest, grant(OrganizationRole("ou-prod", "Billing"))))
+	assert.Check(t, is.Equal(http.StatusOK, grant(OrganizationRole("ou-prod", "ReadOnly"))))
+
+	// the grant covers each account under the unit, and no others
+	w := do(s, "GET", "/?format=sh&role="+url.QueryEscape("arn:aws:iam::333333333333:role/ReadOnly"), nil, alice)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.Equal("arn:aws:iam::333333333333:role/ReadOnly", *stsSvc.inputs[len(stsSvc.inputs)-1].RoleArn))
+	w = do(s, "GET", "/?format=sh&role="+url.QueryEscape("arn:aws:iam::111111111111:role/ReadOnly"), nil, alice)
+	assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+	w = do(s, "GET", "/?format=sh&role="+url.QueryEscape("arn:aws:iam::444444444444:role/ReadOnly"), nil, alice)
+	assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+
+	// and accounts added to the unit, once the organization is listed again
+	fake.accounts["ou-prod-eu"] = append(fake.accounts["ou-prod-eu"], fakeAccount("555555555555", "prod-eu-2", organizations.AccountStatusActive))
+	w = do(s, "GET", "/?format=sh&role="+url.QueryEscape("arn:aws:iam::555555555555:role/ReadOnly"), nil, alice)
+	assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+	w = do(s, "POST", "/admin/accounts/refresh", nil, admin)
+	assert.Check(t, is.Equal(http.StatusSeeOther, w.Code))
+	w = do(s, "GET", "/?format=sh&role="+url.QueryEscape("arn:aws:iam::555555555555:role/ReadOnly"), nil, alice)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+
+	// standard roles are offered when granting roles
+	w = do(s, "GET", "/admin/users/alice", nil, admin)
+	assert.Check(t, is.Contains(w.Body.String(), `<option value="arn:aws:iam::222222222222:role/Admin">Admin in prod-us</option>`))
+	assert.Check(t, is.Contains(w.Body.String(), `<option value="organization:ou-prod-eu:role/Admin">Admin in every account under Root/Production/EU</option>`))
+
+	w = do(s, "GET", "/admin/accounts", nil, admin)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.Contains(w.Body.String(), "<td>arn:aws:iam::555555555555:role/ReadOnly</td>"))
+	assert.Check(t, is.Contains(w.Body.String(), "<td>organization:ou-prod:role/Admin</td>"))
+
+	out, err := runAdmin(t, s, "roles accounts")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(out, "organization:ou-prod-eu:role/Admin organization:ou-prod-eu:role/ReadOnly"))
+	assert.Check(t, is.Contains(out, "arn:aws:iam::555555555555:role/Admin arn:aws:iam::555555555555:role/ReadOnly"))
+}
+
+func TestOrganizationUnavailable(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{})
+	fake := newFakeOrganizations()
+	fake.err = awserr.New(organizations.ErrCodeServiceException, "unavailable", nil)
+	s.Organizations = fake
+
+	user := User{ID: "alice", Roles: []RoleGrant{{Role: "arn:aws:iam::1:role/dev"}, {Role: OrganizationRole("ou-prod", "Admin")}}}
+	roles, err := s.effectiveRoles(ctx, user)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"arn:aws:iam::1:role/dev"}, roles))
+
+	// failures are not retried right away
+	_, err = s.effectiveRoles(ctx, user)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(1, fake.calls))
+
+	fake.err = nil
+	assert.NilError(t, s.RefreshOrganization(ctx))
+	roles, err = s.effectiveRoles(ctx, user)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"arn:aws:iam::1:role/dev", "arn:aws:iam::333333333333:role/Admin", "arn:aws:iam::222222222222:role/Admin"}, roles))
+}
+
+func TestOrganizationNotConfigured(t *testing.T) {
+	s, _ := newTestServer(t, Config{})
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+	loginAs(t, s, User{ID: "alice"})
+
+	w := do(s, "GET", "/admin/accounts", nil, admin)
+	assert.Check(t, is.Contains(w.Body.String(), "AWS Organizations is not configured"))
+
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"add_role"}, "user": {"alice"}, "role": {OrganizationRole("ou-prod", "Admin")}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+
+	_, err := runAdmin(t, s, "roles accounts")
+	assert.Check(t, is.ErrorContains(err, "not configured"))
+}
@@ -0,0 +1,133 @@
+package tvm
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+// Each role is assumed through STS in the partition of its ARN, such as aws
+// or aws-us-gov. Credentials are valid in only one partition, so TVM needs
+// base credentials of its own in each partition it has roles in. Only the
+// aws partition has a global STS endpoint; roles elsewhere need a region,
+// from the role catalog or the partition, and NewServer rejects a
+// configuration in which they have none.
+
+// PartitionConfig describes how TVM reaches STS in a partition.
+type PartitionConfig struct {
+	// Profile names the profile in the shared AWS config files whose
+	// credentials TVM uses as its base credentials in the partition. Empty
+	// means TVM's default credentials.
+	Profile string
+
+	// Region is the default region of roles in the partition. Roles with a
+	// region are assumed through the STS endpoint in that region.
+	Region string
+}
+
+// rolePartition returns the partition that role is in.
+func rolePartition(role string) string {
+	if roleARN, err := arn.Parse(role); err == nil {
+		return roleARN.Partition
+	}
+	return endpoints.AwsPartitionID
+}
+
+// roleRegion returns the default region of role, which is its own or that
+// of its partition, or "" if it has none.
+func (c Config) roleRegion(role string) string {
+	if region := c.Roles[role].Region; region != "" {
+		return region
+	}
+	return c.Partitions[rolePartition(role)].Region
+}
+
+// checkPartitions returns an error if a partition other than aws, or a
+// role in one, has no region, since only the aws partition has a global STS
+// endpoint.
+func (c Config) checkPartitions() error {
+	for partition, config := range c.Partitions {
+		if partition != endpoints.AwsPartitionID && config.Region == "" {
+			return fmt.Errorf("partition %s needs a region, since it has no global STS endpoint", partition)
+		}
+	}
+	for role, config := range c.Roles {
+		partition := rolePartition(role)
+		if partition != endpoints.AwsPartitionID && c.roleRegion(role) == "" && config.STSEndpoint == "" {
+			return fmt.Errorf("role %s needs a region, since partition %s has no global STS endpoint", role, partition)
+		}
+	}
+	return nil
+}
+
+// stsConfig returns the configuration of the STS client that assumes role.
+func (c Config) stsConfig(role string) *aws.Config {
+	config := aws.NewConfig()
+	if region := c.roleRegion(role); region != "" {
+		config = config.WithRegion(region).WithSTSRegionalEndpoint(endpoints.RegionalSTSEndpoint)
+	}
+	if endpoint := c.Roles[role].STSEndpoint; endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	return config
+}
+
+// partitionSessions holds the sessions with TVM's base credentials in each
+// partition that has a profile, which are loaded on first use.
+type partitionSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*awssession.Session
+}
+
+// partitionSession returns the session with TVM's base credentials in
+// partition.
+func (s *Server) partitionSession(partition string) (*awssession.Session, error) {
+	profile := s.Config.Partitions[partition].Profile
+	if profile == "" {
+		return s.awsSession, nil
+	}
+	s.partitions.mu.Lock()
+	defer s.partitions.mu.Unlock()
+	if session, ok := s.partitions.sessions[partition]; ok {
+		return session, nil
+	}
+	session, err := awssession.NewSessionWithOptions(awssession.Options{
+		Profile:           profile,
+		SharedConfigState: awssession.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot load profile %s for partition %s: %w", profile, partition, err)
+	}
+	if s.partitions.sessions == nil {
+		s.partitions.sessions = map[string]*awssession.Session{}
+	}
+	s.partitions.sessions[partition] = session
+	return session, nil
+}
+
+// baseSTS returns the STS client that assumes role with TVM's base
+// credentials in role's partition. It is s.STS unless the partition or role
+// is configured otherwise. Roles outside the aws partition must have a
+// region.
+func (s *Server) baseSTS(role string) (stsiface.STSAPI, error) {
+	partition := rolePartition(role)
+	if s.Config.roleRegion(role) == "" && s.Config.Roles[role].STSEndpoint == "" {
+		if partition != endpoints.AwsPartitionID {
+			return nil, fmt.Errorf("role %s needs a region, since partition %s has no global STS endpoint", role, partition)
+		}
+		if s.Config.Partitions[partition].Profile == "" {
+			return s.STS, nil
+		}
+	}
+	session, err := s.partitionSession(partition)
+	if err != nil {
+		return nil, err
+	}
+	return sts.New(session, s.Config.stsConfig(role)), nil
+}
@@ -0,0 +1,87 @@
+package tvm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestRoleRegion(t *testing.T) {
+	config := Config{
+		Roles: map[string]RoleConfig{
+			"arn:aws:iam::1:role/eu":              {Region: "eu-west-1"},
+			"arn:aws-us-gov:iam::2:role/gov-east": {Region: "us-gov-east-1"},
+		},
+		Partitions: map[string]PartitionConfig{"aws-us-gov": {Region: "us-gov-west-1"}},
+	}
+	assert.Check(t, is.Equal("eu-west-1", config.roleRegion("arn:aws:iam::1:role/eu")))
+	assert.Check(t, is.Equal("", config.roleRegion("arn:aws:iam::1:role/dev")))
+	assert.Check(t, is.Equal("us-gov-east-1", config.roleRegion("arn:aws-us-gov:iam::2:role/gov-east")))
+	assert.Check(t, is.Equal("us-gov-west-1", config.roleRegion("arn:aws-us-gov:iam::2:role/gov")))
+
+	s, stsSvc := newTestServer(t, config)
+	client, err := s.baseSTS("arn:aws:iam::1:role/dev")
+	assert.NilError(t, err)
+	assert.Check(t, client == stsSvc)
+	client, err = s.baseSTS("arn:aws:iam::1:role/eu")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("https://sts.eu-west-1.amazonaws.com", client.(*sts.STS).Endpoint))
+	client, err = s.baseSTS("arn:aws-us-gov:iam::2:role/gov")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("https://sts.us-gov-west-1.amazonaws.com", client.(*sts.STS).Endpoint))
+	_, err = s.baseSTS("arn:aws-cn:iam::3:role/china")
+	assert.Check(t, is.ErrorContains(err, "needs a region"))
+}
+
+func TestPartitionNeedsRegion(t *testing.T) {
+	_, err := NewServer(Config{Partitions: map[string]PartitionConfig{"aws-us-gov": {Profile: "gov"}}})
+	assert.Check(t, is.Error(err, "partition aws-us-gov needs a region, since it has no global STS endpoint"))
+	_, err = NewServer(Config{Roles: map[string]RoleConfig{"arn:aws-cn:iam::3:role/china": {}}})
+	assert.Check(t, is.Error(err, "role arn:aws-cn:iam::3:role/china needs a region, since partition aws-cn has no global STS endpoint"))
+	_, err = NewServer(Config{Roles: map[string]RoleConfig{"arn:aws-cn:iam::3:role/china": {Region: "cn-north-1"}}})
+	assert.Check(t, err)
+}
+
+func TestPartitionCredentials(t *testing.T) {
+	const gov = "arn:aws-us-gov:iam::2:role/gov"
+	endpoint := &fakeSTSEndpoint{Trust: map[string]string{gov: "AKIDGOV"}}
+	httpServer := httptest.NewServer(endpoint)
+	defer httpServer.Close()
+
+	// the partition's base credentials come from a profile
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config")
+	assert.NilError(t, os.WriteFile(configFile, []byte("[profile gov]\naws_access_key_id = AKIDGOV\naws_secret_access_key = secret\n"), 0600))
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+
+	s, stsSvc := newTestServer(t, Config{
+		CredentialLifetimeSeconds: 3600,
+		Roles:                     map[string]RoleConfig{gov: {STSEndpoint: httpServer.URL}},
+		Partitions:                map[string]PartitionConfig{"aws-us-gov": {Profile: "gov", Region: "us-gov-west-1"}},
+	})
+	alice := loginAs(t, s, User{ID: "alice", Roles: []RoleGrant{{Role: gov}}})
+
+	w := do(s, "GET", "/?format=sh&role="+url.QueryEscape(gov), nil, alice)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.Equal("export AWS_ACCESS_KEY_ID=AKIDgov\n"+
+		"export AWS_SECRET_ACCESS_KEY=secret\n"+
+		"export AWS_SESSION_TOKEN=token\n"+
+		"export AWS_REGION=us-gov-west-1\n"+
+		"export AWS_DEFAULT_REGION=us-gov-west-1\n", w.Body.String()))
+	assert.Check(t, is.Len(stsSvc.inputs, 0))
+	assert.Check(t, is.DeepEqual([]string{"us-gov-west-1"}, endpoint.Regions))
+
+	w = do(s, "GET", "/?format=cli&port=1234&role="+url.QueryEscape(gov), nil, alice)
+	assert.Check(t, is.Equal(http.StatusFound, w.Code))
+	next, err := url.Parse(w.Header().Get("Location"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("us-gov-west-1", next.Query().Get("region")))
+}
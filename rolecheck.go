@@ -0,0 +1,410 @@
+package tvm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Granting a role that TVM cannot assume fails only when the user asks for
+// credentials. When Server.IAM is set, roles are checked with iam.GetRole
+// as they are granted, and CheckRoles reports roles that have since been
+// deleted or stopped trusting TVM.
+//
+// Trust policies are checked for a statement that allows TVM's principal,
+// or its account, to assume the role. Conditions are not evaluated: an
+// Allow with conditions counts, so a role whose conditions TVM does not
+// meet still passes, and a Deny with conditions is ignored.
+//
+// Roles in other accounts are read as the discovery role for their
+// account, or failing that a hub role there, which then needs iam:GetRole.
+// Roles in accounts with neither are not checked.
+
+// RoleProblem says why TVM cannot assume a role.
+type RoleProblem struct {
+	Role    string
+	Problem string
+
+	// Users and Groups are the IDs of those who are granted the role.
+	Users  []string
+	Groups []string
+}
+
+func (p *RoleProblem) Error() string {
+	return fmt.Sprintf("role %s %s", p.Role, p.Problem)
+}
+
+// principal returns the ARN of the IAM role or user that TVM assumes roles
+// as, which is Config.Principal or else the identity of TVM's credentials.
+func (s *Server) principal(ctx context.Context) (string, error) {
+	if s.Config.Principal != "" {
+		return s.Config.Principal, nil
+	}
+	output, err := s.STS.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("cannot get TVM's identity: %w", err)
+	}
+	return principalARN(aws.StringValue(output.Arn))
+}
+
+// principalARN returns the IAM ARN that trust policies name for the
+// identity callerARN. Credentials from an assumed role have an STS ARN,
+// arn:aws:sts::<account>:assumed-role/<role>/<session>, but trust policies
+// name the role itself.
+func principalARN(callerARN string) (string, error) {
+	a, err := arn.Parse(callerARN)
+	if err != nil {
+		return "", err
+	}
+	if a.Service == "sts" && strings.HasPrefix(a.Resource, "assumed-role/") {
+		parts := strings.Split(a.Resource, "/")
+		a.Service = "iam"
+		a.Resource = "role/" + parts[1]
+	}
+	return a.String(), nil
+}
+
+// requiredActions returns the actions that role's trust policy must allow.
+// Roles that are passed session tags need sts:TagSession.
+func (c Config) requiredActions(role string) []string {
+	if c.Roles[role].tagsSession() {
+		return []string{"sts:AssumeRole", "sts:TagSession"}
+	}
+	return []string{"sts:AssumeRole"}
+}
+
+// TrustStatement returns the trust policy statement that role needs so that
+// principal may assume it for TVM.
+func (c Config) TrustStatement(role, principal string) ([]byte, error) {
+	var condition map[string]map[string]string
+	if externalID := c.Roles[role].ExternalID; externalID != "" {
+		condition = map[string]map[string]string{"StringEquals": {"sts:ExternalId": externalID}}
+	}
+	return json.MarshalIndent(struct {
+		Effect    string
+		Principal map[string]string
+		Action    []string
+		Condition map[string]map[string]string `json:",omitempty"`
+	}{
+		Effect:    "Allow",
+		Principal: map[string]string{"AWS": principal},
+		Action:    c.requiredActions(role),
+		Condition: condition,
+	}, "", "  ")
+}
+
+// checkRole returns a *RoleProblem if TVM cannot assume role. It does nothing
+// if s.IAM is not set. Organization roles are checked against the
+// organization, and roles with a chain by their first hub.
+func (s *Server) checkRole(ctx context.Context, role string) error {
+	if parent, name, ok := parseOrganizationRole(role); ok {
+		return s.checkOrganizationRole(ctx, role, parent, name)
+	}
+	if s.IAM == nil {
+		return nil
+	}
+	principal, err := s.principal(ctx)
+	if err != nil {
+		return err
+	}
+	return s.checkChainTrust(ctx, role, principal)
+}
+
+// checkChainTrust checks the first role that TVM assumes to reach role,
+// which is role itself or the first hub in its chain.
+func (s *Server) checkChainTrust(ctx context.Context, role, principal string) error {
+	chain := s.Config.Roles[role].Chain
+	if len(chain) == 0 {
+		return s.checkRoleTrust(ctx, role, principal)
+	}
+	err := s.checkRoleTrust(ctx, chain[0].Role, principal)
+	var problem *RoleProblem
+	if errors.As(err, &problem) {
+		return &RoleProblem{Role: role, Problem: fmt.Sprintf("is reached through hub role %s, which %s", chain[0].Role, problem.Problem)}
+	}
+	return err
+}
+
+func (s *Server) checkRoleTrust(ctx context.Context, role, principal string) error {
+	roleARN, err := arn.Parse(role)
+	if err != nil || roleARN.Service != "iam" || !strings.HasPrefix(roleARN.Resource, "role/") {
+		return &RoleProblem{Role: role, Problem: "is not an IAM role ARN"}
+	}
+	principalARN, err := arn.Parse(principal)
+	if err != nil {
+		return fmt.Errorf("cannot parse principal %q: %w", principal, err)
+	}
+	client := s.IAM
+	if roleARN.AccountID != principalARN.AccountID {
+		if client = s.accountIAM(roleARN.AccountID); client == nil {
+			return nil
+		}
+	}
+
+	name := roleARN.Resource[strings.LastIndex(roleARN.Resource, "/")+1:]
+	output, err := client.GetRoleWithContext(ctx, &iam.GetRoleInput{RoleName: aws.String(name)})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == iam.ErrCodeNoSuchEntityException {
+		return &RoleProblem{Role: role, Problem: "does not exist"}
+	} else if err != nil {
+		return fmt.Errorf("cannot get role %s: %w", role, err)
+	}
+	if actual := aws.StringValue(output.Role.Arn); actual != role {
+		return &RoleProblem{Role: role, Problem: fmt.Sprintf("does not exist; the role named %s is %s", name, actual)}
+	}
+
+	doc, err := url.QueryUnescape(aws.StringValue(output.Role.AssumeRolePolicyDocument))
+	if err != nil {
+		return fmt.Errorf("cannot decode trust policy of %s: %w", role, err)
+	}
+	var policy trustPolicy
+	if err := json.Unmarshal([]byte(doc), &policy); err != nil {
+		return fmt.Errorf("cannot parse trust policy of %s: %w", role, err)
+	}
+	for _, action := range s.Config.requiredActions(role) {
+		if !policy.allows(principalARN, action) {
+			return &RoleProblem{Role: role, Problem: fmt.Sprintf("does not allow %s to %s in its trust policy", principal, action)}
+		}
+	}
+	return nil
+}
+
+// accountIAM returns an IAM client for reading roles in account, which is
+// not TVM's own, or nil if TVM has no role there to read them as.
+func (s *Server) accountIAM(account string) iamiface.IAMAPI {
+	inAccount := func(role string) bool {
+		a, err := arn.Parse(role)
+		return err == nil && a.AccountID == account
+	}
+	for _, role := range s.Config.RoleDiscovery.AccountRoles {
+		if inAccount(role) {
+			return s.roleIAM(role)
+		}
+	}
+	var hubs []string
+	for _, config := range s.Config.Roles {
+		if len(config.Chain) > 0 && inAccount(config.Chain[0].Role) {
+			hubs = append(hubs, config.Chain[0].Role)
+		}
+	}
+	if len(hubs) == 0 {
+		return nil
+	}
+	sort.Strings(hubs)
+	return s.roleIAM(hubs[0])
+}
+
+// roleIAM returns an IAM client that acts as role.
+func (s *Server) roleIAM(role string) iamiface.IAMAPI {
+	return iam.New(s.awsSession, aws.NewConfig().WithCredentials(stscreds.NewCredentialsWithClient(s.STS, role)))
+}
+
+// trustPolicy is the part of an IAM role trust policy that checkRoleTrust
+// reads.
+type trustPolicy struct {
+	Statement policyStatements
+}
+
+type policyStatement struct {
+	Effect       string
+	Principal    policyPrincipal
+	NotPrincipal json.RawMessage
+	Action       policyStrings
+	NotAction    policyStrings
+	Condition    json.RawMessage
+}
+
+// policyStatements is one statement or a list of them.
+type policyStatements []policyStatement
+
+func (s *policyStatements) UnmarshalJSON(buf []byte) error {
+	var one policyStatement
+	if err := json.Unmarshal(buf, &one); err == nil {
+		*s = policyStatements{one}
+		return nil
+	}
+	return json.Unmarshal(buf, (*[]policyStatement)(s))
+}
+
+// policyStrings is one string or a list of them.
+type policyStrings []string
+
+func (s *policyStrings) UnmarshalJSON(buf []byte) error {
+	var one string
+	if err := json.Unmarshal(buf, &one); err == nil {
+		*s = policyStrings{one}
+		return nil
+	}
+	return json.Unmarshal(buf, (*[]string)(s))
+}
+
+// policyPrincipal holds the AWS principals of a statement. "*" is
+// represented as an AWS principal of "*".
+type policyPrincipal struct {
+	AWS policyStrings
+}
+
+func (p *policyPrincipal) UnmarshalJSON(buf []byte) error {
+	var wildcard string
+	if err := json.Unmarshal(buf, &wildcard); err == nil {
+		p.AWS = policyStrings{wildcard}
+		return nil
+	}
+	var principals struct{ AWS policyStrings }
+	if err := json.Unmarshal(buf, &principals); err != nil {
+		return err
+	}
+	p.AWS = principals.AWS
+	return nil
+}
+
+// allows returns true if the policy lets principal perform action.
+func (p trustPolicy) allows(principal arn.ARN, action string) bool {
+	allowed := false
+	for _, statement := range p.Statement {
+		if !statement.matches(principal, action) {
+			continue
+		}
+		switch statement.Effect {
+		case "Deny":
+			if statement.Condition != nil {
+				// Conditions are not evaluated, so a conditional Deny
+				// might not apply to TVM; assume that it does not.
+				continue
+			}
+			return false
+		case "Allow":
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+func (s policyStatement) matches(principal arn.ARN, action string) bool {
+	if s.NotPrincipal != nil || s.NotAction != nil {
+		// Too subtle to check; assume that the statement does not apply.
+		return false
+	}
+	principalMatches := false
+	root := arn.ARN{Partition: principal.Partition, Service: "iam", AccountID: principal.AccountID, Resource: "root"}
+	for _, p := range s.Principal.AWS {
+		if p == "*" || p == principal.String() || p == root.String() || p == principal.AccountID {
+			principalMatches = true
+		}
+	}
+	if !principalMatches {
+		return false
+	}
+	for _, pattern := range s.Action {
+		if actionMatches(pattern, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// actionMatches returns true if the action pattern, which may end with a
+// wildcard, matches action. Actions are not case sensitive.
+func actionMatches(pattern, action string) bool {
+	pattern, action = strings.ToLower(pattern), strings.ToLower(action)
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(action, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == action
+}
+
+// CheckRoles checks every role that is granted to a user or group, and the
+// break-glass role, and returns those that TVM cannot assume. Each problem
+// is audited with high severity so that webhooks can report it. It does
+// nothing if s.IAM is not set.
+func (s *Server) CheckRoles(ctx context.Context) ([]RoleProblem, error) {
+	if s.IAM == nil {
+		return nil, nil
+	}
+	principal, err := s.principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := s.Store.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.Store.ListGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	granted := map[string]*RoleProblem{}
+	grantedTo := func(role string) *RoleProblem {
+		if granted[role] == nil {
+			granted[role] = &RoleProblem{Role: role}
+		}
+		return granted[role]
+	}
+	for _, user := range users {
+		for _, grant := range user.Roles {
+			if !grant.Expired(now) {
+				grantedTo(grant.Role).Users = append(grantedTo(grant.Role).Users, user.ID)
+			}
+		}
+	}
+	for _, group := range groups {
+		for _, grant := range group.Roles {
+			if !grant.Expired(now) {
+				grantedTo(grant.Role).Groups = append(grantedTo(grant.Role).Groups, group.ID)
+			}
+		}
+	}
+	if s.Config.BreakGlassRole != "" {
+		grantedTo(s.Config.BreakGlassRole)
+	}
+
+	var roles []string
+	for role := range granted {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	var problems []RoleProblem
+	for _, role := range roles {
+		var err error
+		if parent, name, ok := parseOrganizationRole(role); ok {
+			err = s.checkOrganizationRole(ctx, role, parent, name)
+		} else {
+			err = s.checkChainTrust(ctx, role, principal)
+		}
+		var problem *RoleProblem
+		if !errors.As(err, &problem) {
+			if err != nil {
+				return problems, err
+			}
+			continue
+		}
+		problem.Users = granted[role].Users
+		problem.Groups = granted[role].Groups
+		problems = append(problems, *problem)
+
+		s.audit(ctx, nil, AuditEvent{
+			Type:     AuditRoleCheck,
+			Role:     role,
+			Severity: AuditSeverityHigh,
+			Message:  fmt.Sprintf("%s; granted to %d users and %d groups", problem.Error(), len(problem.Users), len(problem.Groups)),
+		})
+	}
+	return problems, nil
+}
@@ -0,0 +1,210 @@
+package tvm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// fakeIAM has roles with the given trust policies, keyed by ARN.
+type fakeIAM struct {
+	iamiface.IAMAPI
+	trustPolicies map[string]string
+}
+
+func (f *fakeIAM) GetRoleWithContext(ctx aws.Context, input *iam.GetRoleInput, opts ...request.Option) (*iam.GetRoleOutput, error) {
+	for roleARN, policy := range f.trustPolicies {
+		if strings.HasSuffix(roleARN, "/"+*input.RoleName) {
+			return &iam.GetRoleOutput{Role: &iam.Role{
+				Arn:                      aws.String(roleARN),
+				RoleName:                 input.RoleName,
+				AssumeRolePolicyDocument: aws.String(url.QueryEscape(policy)),
+			}}, nil
+		}
+	}
+	return nil, awserr.New(iam.ErrCodeNoSuchEntityException, "no such role", nil)
+}
+
+const tvmTrustPolicy = `{
+	"Version": "2012-10-17",
+	"Statement": [{
+		"Effect": "Allow",
+		"Principal": {"AWS": "arn:aws:iam::1:role/tvm"},
+		"Action": "sts:AssumeRole"
+	}]
+}`
+
+func TestTrustPolicy(t *testing.T) {
+	principal, err := arn.Parse("arn:aws:iam::1:role/tvm")
+	assert.NilError(t, err)
+	for _, tc := range []struct {
+		Policy   string
+		Action   string
+		Expected bool
+	}{
+		{tvmTrustPolicy, "sts:AssumeRole", true},
+		{tvmTrustPolicy, "sts:TagSession", false},
+		{`{"Statement": {"Effect": "Allow", "Principal": {"AWS": ["arn:aws:iam::2:root", "arn:aws:iam::1:root"]}, "Action": ["sts:*"]}}`, "sts:TagSession", true},
+		{`{"Statement": {"Effect": "Allow", "Principal": {"AWS": "1"}, "Action": "STS:AssumeRole"}}`, "sts:AssumeRole", true},
+		{`{"Statement": {"Effect": "Allow", "Principal": "*", "Action": "*"}}`, "sts:AssumeRole", true},
+		{`{"Statement": {"Effect": "Allow", "Principal": {"AWS": "arn:aws:iam::1:role/other"}, "Action": "sts:AssumeRole"}}`, "sts:AssumeRole", false},
+		{`{"Statement": {"Effect": "Allow", "Principal": {"Service": "ec2.amazonaws.com"}, "Action": "sts:AssumeRole"}}`, "sts:AssumeRole", false},
+		{`{"Statement": [
+			{"Effect": "Allow", "Principal": {"AWS": "1"}, "Action": "sts:AssumeRole"},
+			{"Effect": "Deny", "Principal": {"AWS": "arn:aws:iam::1:role/tvm"}, "Action": "sts:AssumeRole"}
+		]}`, "sts:AssumeRole", false},
+		{`{"Statement": [
+			{"Effect": "Allow", "Principal": {"AWS": "1"}, "Action": "sts:AssumeRole"},
+			{"Effect": "Deny", "Principal": "*", "Action": "sts:AssumeRole", "Condition": {"Bool": {"aws:SecureTransport": "false"}}}
+		]}`, "sts:AssumeRole", true},
+	} {
+		var policy trustPolicy
+		assert.NilError(t, json.Unmarshal([]byte(tc.Policy), &policy))
+		assert.Check(t, is.Equal(tc.Expected, policy.allows(principal, tc.Action)), tc.Policy)
+	}
+}
+
+func TestPrincipalARN(t *testing.T) {
+	principal, err := principalARN("arn:aws:sts::1:assumed-role/tvm/i-0123")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("arn:aws:iam::1:role/tvm", principal))
+	principal, err = principalARN("arn:aws:iam::1:user/tvm")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("arn:aws:iam::1:user/tvm", principal))
+}
+
+func TestCheckRoleAtGrant(t *testing.T) {
+	s, _ := newTestServer(t, Config{
+		Principal: "arn:aws:iam::1:role/tvm",
+		Roles: map[string]RoleConfig{
+			"arn:aws:iam::1:role/sensitive": {RequireReason: true},
+			"arn:aws:iam::1:role/ticketed":  {TicketPattern: `^OPS-\d+$`},
+			"arn:aws:iam::3:role/spoke":     {Chain: []RoleHop{{Role: "arn:aws:iam::1:role/hub"}}},
+		},
+	})
+	s.IAM = &fakeIAM{trustPolicies: map[string]string{
+		"arn:aws:iam::1:role/dev":       tvmTrustPolicy,
+		"arn:aws:iam::1:role/sensitive": tvmTrustPolicy,
+		"arn:aws:iam::1:role/ticketed":  tvmTrustPolicy,
+		"arn:aws:iam::1:role/ec2":       `{"Statement": {"Effect": "Allow", "Principal": {"Service": "ec2.amazonaws.com"}, "Action": "sts:AssumeRole"}}`,
+	}}
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+	loginAs(t, s, User{ID: "bob"})
+
+	for role, expected := range map[string]string{
+		"arn:aws:iam::1:role/dev":       "",
+		"arn:aws:iam::2:role/elsewhere": "",
+		"arn:aws:iam::1:role/deleted":   "role arn:aws:iam::1:role/deleted does not exist",
+		"arn:aws:iam::1:role/ec2":       "role arn:aws:iam::1:role/ec2 does not allow arn:aws:iam::1:role/tvm to sts:AssumeRole in its trust policy",
+		"arn:aws:iam::1:role/sensitive": "role arn:aws:iam::1:role/sensitive does not allow arn:aws:iam::1:role/tvm to sts:TagSession in its trust policy",
+		"arn:aws:iam::1:role/ticketed":  "role arn:aws:iam::1:role/ticketed does not allow arn:aws:iam::1:role/tvm to sts:TagSession in its trust policy",
+		"dev":                           "role dev is not an IAM role ARN",
+		"arn:aws:iam::3:role/spoke":     "role arn:aws:iam::3:role/spoke is reached through hub role arn:aws:iam::1:role/hub, which does not exist",
+	} {
+		w := do(s, "POST", "/admin/op", url.Values{"op": {"add_role"}, "user": {"bob"}, "role": {role}}, admin)
+		if expected == "" {
+			assert.Check(t, is.Equal(http.StatusOK, w.Code), role)
+		} else {
+			assert.Check(t, is.Equal(http.StatusBadRequest, w.Code), role)
+			assert.Check(t, is.Contains(w.Body.String(), expected))
+		}
+	}
+
+	w := do(s, "POST", "/admin/groups", url.Values{"op": {"create_group"}, "group": {"eng"}}, admin)
+	assert.Check(t, is.Equal(http.StatusSeeOther, w.Code))
+	w = do(s, "POST", "/admin/groups", url.Values{"op": {"add_role"}, "group": {"eng"}, "role": {"arn:aws:iam::1:role/deleted"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+}
+
+func TestCheckRoleOtherAccount(t *testing.T) {
+	ctx := context.Background()
+	s := newDiscoveryTestServer(t, RoleDiscoveryConfig{AccountRoles: []string{"arn:aws:iam::2:role/tvm-discovery"}}, &fakeIAMEndpoint{Accounts: map[string][]fakeIAMRole{
+		"2": {
+			{Path: "/", Name: "app", Trust: tvmTrustPolicy},
+			{Path: "/", Name: "ec2", Trust: `{"Statement": {"Effect": "Allow", "Principal": {"Service": "ec2.amazonaws.com"}, "Action": "sts:AssumeRole"}}`},
+		},
+	}})
+	s.Config.Principal = "arn:aws:iam::1:role/tvm"
+	s.IAM = &fakeIAM{}
+
+	assert.Check(t, s.checkRole(ctx, "arn:aws:iam::2:role/app"))
+	assert.Check(t, is.Error(s.checkRole(ctx, "arn:aws:iam::2:role/ec2"),
+		"role arn:aws:iam::2:role/ec2 does not allow arn:aws:iam::1:role/tvm to sts:AssumeRole in its trust policy"))
+	assert.Check(t, is.Error(s.checkRole(ctx, "arn:aws:iam::2:role/deleted"), "role arn:aws:iam::2:role/deleted does not exist"))
+	assert.Check(t, s.checkRole(ctx, "arn:aws:iam::3:role/unreadable"))
+}
+
+func TestCheckRoles(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{Principal: "arn:aws:iam::1:role/tvm"})
+	fake := &fakeIAM{trustPolicies: map[string]string{
+		"arn:aws:iam::1:role/dev":  tvmTrustPolicy,
+		"arn:aws:iam::1:role/prod": tvmTrustPolicy,
+	}}
+	s.IAM = fake
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "bob", Roles: []RoleGrant{{Role: "arn:aws:iam::1:role/dev"}, {Role: "arn:aws:iam::1:role/prod"}}}))
+	assert.NilError(t, s.Store.PutGroup(ctx, Group{ID: "eng", Roles: []RoleGrant{{Role: "arn:aws:iam::1:role/prod"}}}))
+
+	problems, err := s.CheckRoles(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(problems, 0))
+
+	delete(fake.trustPolicies, "arn:aws:iam::1:role/prod")
+	problems, err = s.CheckRoles(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]RoleProblem{{
+		Role:    "arn:aws:iam::1:role/prod",
+		Problem: "does not exist",
+		Users:   []string{"bob"},
+		Groups:  []string{"eng"},
+	}}, problems))
+
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditRoleCheck})
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(events, 1))
+	assert.Check(t, is.Equal(AuditSeverityHigh, events[0].Severity))
+	assert.Check(t, is.Equal("arn:aws:iam::1:role/prod", events[0].Role))
+
+	out, err := runAdmin(t, s, "roles check")
+	assert.Check(t, is.Equal(errBrokenRoles, err))
+	assert.Check(t, is.Equal("role arn:aws:iam::1:role/prod does not exist\n  granted to user bob\n  granted to group eng\n", out))
+}
+
+func TestTrustPolicyCommand(t *testing.T) {
+	s, _ := newTestServer(t, Config{
+		Principal: "arn:aws:iam::1:role/tvm",
+		Roles:     map[string]RoleConfig{"arn:aws:iam::1:role/prod": {Alias: "prod", RequireReason: true}},
+	})
+	out, err := runAdmin(t, s, "roles trust-policy prod")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(`Add this statement to the trust policy of arn:aws:iam::1:role/prod:
+
+{
+  "Effect": "Allow",
+  "Principal": {
+    "AWS": "arn:aws:iam::1:role/tvm"
+  },
+  "Action": [
+    "sts:AssumeRole",
+    "sts:TagSession"
+  ]
+}
+`, out))
+
+	out, err = runAdmin(t, s, "roles trust-policy -principal arn:aws:iam::1:user/ops arn:aws:iam::1:role/dev")
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(out, `"AWS": "arn:aws:iam::1:user/ops"`))
+	assert.Check(t, !strings.Contains(out, "sts:TagSession"))
+}
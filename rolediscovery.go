@@ -0,0 +1,180 @@
+package tvm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+)
+
+// RoleDiscoveryConfig describes how TVM finds roles in IAM to offer when
+// admins grant roles, in addition to the role catalog. Only roles with Tag
+// or under PathPrefix are offered, so that service-linked and other
+// internal roles are not. Discovery is disabled unless one of them is set.
+type RoleDiscoveryConfig struct {
+	// Tag, as key=value, marks roles that may be granted, e.g.
+	// tvm:enabled=true. A key alone matches the tag with any value.
+	Tag string
+
+	// PathPrefix selects roles whose IAM path begins with it, e.g. /tvm/.
+	PathPrefix string
+
+	// AccountRoles are the ARNs of a role in each account to search, which
+	// TVM assumes to list roles. They need only iam:ListRoles,
+	// iam:ListRoleTags and, to check the trust policies of roles in their
+	// account, iam:GetRole. Empty means to search TVM's own account with
+	// its own credentials.
+	AccountRoles []string
+}
+
+// Enabled returns true if roles should be discovered.
+func (c RoleDiscoveryConfig) Enabled() bool {
+	return c.Tag != "" || c.PathPrefix != ""
+}
+
+// DiscoveredRole is a role found in IAM.
+type DiscoveredRole struct {
+	ARN  string
+	Path string
+	Name string
+}
+
+// RoleDiscovery is the result of searching for roles.
+type RoleDiscovery struct {
+	Roles []DiscoveredRole
+
+	// Problems say which accounts could not be searched, and why.
+	Problems []string
+
+	Time time.Time
+}
+
+// roleDiscoveryCache holds the last RoleDiscovery. Discovery calls IAM in
+// every account, so it happens only on first use and when an admin asks.
+type roleDiscoveryCache struct {
+	mu        sync.Mutex
+	discovery *RoleDiscovery
+}
+
+// DiscoveredRoles returns the roles found by the last discovery, discovering
+// them first if they have not been. The lock is not held while discovering,
+// so concurrent first calls may each discover; the first to finish is kept.
+func (s *Server) DiscoveredRoles(ctx context.Context) RoleDiscovery {
+	s.roleDiscovery.mu.Lock()
+	cached := s.roleDiscovery.discovery
+	s.roleDiscovery.mu.Unlock()
+	if cached != nil {
+		return *cached
+	}
+
+	discovery := s.discoverRoles(ctx)
+	s.roleDiscovery.mu.Lock()
+	defer s.roleDiscovery.mu.Unlock()
+	if s.roleDiscovery.discovery == nil {
+		s.roleDiscovery.discovery = &discovery
+	}
+	return *s.roleDiscovery.discovery
+}
+
+// RefreshDiscoveredRoles discovers roles again.
+func (s *Server) RefreshDiscoveredRoles(ctx context.Context) RoleDiscovery {
+	discovery := s.discoverRoles(ctx)
+	s.roleDiscovery.mu.Lock()
+	defer s.roleDiscovery.mu.Unlock()
+	s.roleDiscovery.discovery = &discovery
+	return discovery
+}
+
+func (s *Server) discoverRoles(ctx context.Context) RoleDiscovery {
+	config := s.Config.RoleDiscovery
+	discovery := RoleDiscovery{Time: time.Now()}
+	if !config.Enabled() {
+		return discovery
+	}
+
+	accountRoles := config.AccountRoles
+	if len(accountRoles) == 0 {
+		accountRoles = []string{""}
+	}
+	for _, accountRole := range accountRoles {
+		var client iamiface.IAMAPI
+		if accountRole == "" {
+			client = iam.New(s.awsSession)
+		} else {
+			client = s.roleIAM(accountRole)
+		}
+		roles, err := config.discoverAccountRoles(ctx, client)
+		if err != nil {
+			account := accountRole
+			if account == "" {
+				account = "TVM's account"
+			}
+			discovery.Problems = append(discovery.Problems, fmt.Sprintf("cannot search %s: %s", account, err))
+		}
+		discovery.Roles = append(discovery.Roles, roles...)
+	}
+	sort.Slice(discovery.Roles, func(i, j int) bool { return discovery.Roles[i].ARN < discovery.Roles[j].ARN })
+	return discovery
+}
+
+// discoverAccountRoles returns the roles that client can see that match c.
+func (c RoleDiscoveryConfig) discoverAccountRoles(ctx context.Context, client iamiface.IAMAPI) ([]DiscoveredRole, error) {
+	tagKey, tagValue, anyValue := c.Tag, "", true
+	if i := strings.Index(c.Tag, "="); i >= 0 {
+		tagKey, tagValue, anyValue = c.Tag[:i], c.Tag[i+1:], false
+	}
+
+	input := &iam.ListRolesInput{}
+	if c.Tag == "" {
+		input.PathPrefix = aws.String(c.PathPrefix)
+	}
+	var candidates []*iam.Role
+	err := client.ListRolesPagesWithContext(ctx, input, func(output *iam.ListRolesOutput, lastPage bool) bool {
+		candidates = append(candidates, output.Roles...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var roles []DiscoveredRole
+	for _, role := range candidates {
+		path := aws.StringValue(role.Path)
+		if strings.HasPrefix(path, "/aws-service-role/") {
+			continue
+		}
+		matches := c.PathPrefix != "" && strings.HasPrefix(path, c.PathPrefix)
+		if !matches && c.Tag != "" {
+			input := &iam.ListRoleTagsInput{RoleName: role.RoleName}
+			for {
+				output, err := client.ListRoleTagsWithContext(ctx, input)
+				if err != nil {
+					return roles, err
+				}
+				for _, tag := range output.Tags {
+					if aws.StringValue(tag.Key) == tagKey && (anyValue || aws.StringValue(tag.Value) == tagValue) {
+						matches = true
+					}
+				}
+				if matches || !aws.BoolValue(output.IsTruncated) {
+					break
+				}
+				input.Marker = output.Marker
+			}
+		}
+		if matches {
+			roles = append(roles, DiscoveredRole{
+				ARN:  aws.StringValue(role.Arn),
+				Path: path,
+				Name: aws.StringValue(role.RoleName),
+			})
+		}
+	}
+	return roles, nil
+}
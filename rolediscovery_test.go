@@ -0,0 +1,228 @@
+package tvm
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// fakeIAMRole is a role served by fakeIAMEndpoint.
+type fakeIAMRole struct {
+	Path  string
+	Name  string
+	Tags  map[string]string
+	Trust string
+}
+
+// fakeIAMEndpoint serves iam:ListRoles, iam:ListRoleTags and iam:GetRole for the
+// accounts in Accounts, telling them apart by the access key that signed
+// the request. It returns one role per page, to exercise paging.
+type fakeIAMEndpoint struct {
+	Accounts map[string][]fakeIAMRole
+}
+
+var credentialPattern = regexp.MustCompile(`Credential=([^/]+)/`)
+
+func (f *fakeIAMEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	accessKey := credentialPattern.FindStringSubmatch(r.Header.Get("Authorization"))[1]
+	account := strings.TrimPrefix(accessKey, "AKID")
+	roles, ok := f.Accounts[account]
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>AccessDenied</Code><Message>denied</Message></Error></ErrorResponse>`))
+		return
+	}
+
+	type member struct {
+		Path       string `xml:",omitempty"`
+		RoleName   string `xml:",omitempty"`
+		RoleId     string `xml:",omitempty"`
+		Arn        string `xml:",omitempty"`
+		CreateDate string `xml:",omitempty"`
+		Key        string `xml:",omitempty"`
+		Value      string `xml:",omitempty"`
+
+		AssumeRolePolicyDocument string `xml:",omitempty"`
+	}
+	type result struct {
+		XMLName     xml.Name
+		Roles       *[]member `xml:"Roles>member"`
+		Tags        *[]member `xml:"Tags>member"`
+		Role        *member   `xml:",omitempty"`
+		IsTruncated bool
+		Marker      string `xml:",omitempty"`
+	}
+	action := r.Form.Get("Action")
+	rv := result{XMLName: xml.Name{Local: action + "Result"}}
+	switch action {
+	case "ListRoles":
+		i, _ := strconv.Atoi(r.Form.Get("Marker"))
+		var page []member
+		for ; i < len(roles); i++ {
+			role := roles[i]
+			if !strings.HasPrefix(role.Path, r.Form.Get("PathPrefix")) {
+				continue
+			}
+			page = append(page, member{
+				Path:       role.Path,
+				RoleName:   role.Name,
+				RoleId:     "AROA" + role.Name,
+				Arn:        "arn:aws:iam::" + account + ":role" + role.Path + role.Name,
+				CreateDate: "2021-01-01T00:00:00Z",
+			})
+			break
+		}
+		rv.Roles = &page
+		if i+1 < len(roles) {
+			rv.IsTruncated = true
+			rv.Marker = strconv.Itoa(i + 1)
+		}
+	case "ListRoleTags":
+		var tags []member
+		for _, role := range roles {
+			if role.Name == r.Form.Get("RoleName") {
+				for key, value := range role.Tags {
+					tags = append(tags, member{Key: key, Value: value})
+				}
+			}
+		}
+		rv.Tags = &tags
+	case "GetRole":
+		for _, role := range roles {
+			if role.Name == r.Form.Get("RoleName") {
+				rv.Role = &member{
+					Path:                     role.Path,
+					RoleName:                 role.Name,
+					RoleId:                   "AROA" + role.Name,
+					Arn:                      "arn:aws:iam::" + account + ":role" + role.Path + role.Name,
+					CreateDate:               "2021-01-01T00:00:00Z",
+					AssumeRolePolicyDocument: url.QueryEscape(role.Trust),
+				}
+			}
+		}
+		if rv.Role == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>NoSuchEntity</Code><Message>no such role</Message></Error></ErrorResponse>`))
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	buf, _ := xml.Marshal(struct {
+		XMLName xml.Name
+		Result  result
+	}{XMLName: xml.Name{Local: action + "Response"}, Result: rv})
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(buf)
+}
+
+// discoverySTS issues credentials for a discovery role whose access key
+// names the role's account.
+type discoverySTS struct {
+	stsiface.STSAPI
+}
+
+func (discoverySTS) AssumeRoleWithContext(ctx aws.Context, input *sts.AssumeRoleInput, opts ...request.Option) (*sts.AssumeRoleOutput, error) {
+	account := strings.Split(*input.RoleArn, ":")[4]
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("AKID" + account),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}}, nil
+}
+
+func newDiscoveryTestServer(t *testing.T, config RoleDiscoveryConfig, endpoint *fakeIAMEndpoint) *Server {
+	httpServer := httptest.NewServer(endpoint)
+	t.Cleanup(httpServer.Close)
+
+	s, _ := newTestServer(t, Config{RoleDiscovery: config})
+	s.STS = discoverySTS{}
+	var err error
+	s.awsSession, err = awssession.NewSession(&aws.Config{
+		Endpoint:    aws.String(httpServer.URL),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("AKID1", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	assert.NilError(t, err)
+	return s
+}
+
+func TestDiscoverRoles(t *testing.T) {
+	ctx := context.Background()
+	endpoint := &fakeIAMEndpoint{Accounts: map[string][]fakeIAMRole{
+		"1": {
+			{Path: "/", Name: "admin"},
+			{Path: "/", Name: "dev", Tags: map[string]string{"tvm:enabled": "true", "team": "eng"}},
+			{Path: "/", Name: "disabled", Tags: map[string]string{"tvm:enabled": "false"}},
+			{Path: "/aws-service-role/", Name: "AWSServiceRoleForSupport", Tags: map[string]string{"tvm:enabled": "true"}},
+			{Path: "/tvm/", Name: "ops"},
+		},
+		"2": {
+			{Path: "/", Name: "prod", Tags: map[string]string{"tvm:enabled": "true"}},
+		},
+	}}
+
+	s := newDiscoveryTestServer(t, RoleDiscoveryConfig{Tag: "tvm:enabled=true"}, endpoint)
+	discovery := s.DiscoveredRoles(ctx)
+	assert.Check(t, is.Len(discovery.Problems, 0))
+	assert.Check(t, is.DeepEqual([]DiscoveredRole{{ARN: "arn:aws:iam::1:role/dev", Path: "/", Name: "dev"}}, discovery.Roles))
+
+	s = newDiscoveryTestServer(t, RoleDiscoveryConfig{Tag: "tvm:enabled"}, endpoint)
+	discovery = s.DiscoveredRoles(ctx)
+	assert.Check(t, is.DeepEqual([]DiscoveredRole{
+		{ARN: "arn:aws:iam::1:role/dev", Path: "/", Name: "dev"},
+		{ARN: "arn:aws:iam::1:role/disabled", Path: "/", Name: "disabled"},
+	}, discovery.Roles))
+
+	s = newDiscoveryTestServer(t, RoleDiscoveryConfig{PathPrefix: "/tvm/"}, endpoint)
+	discovery = s.DiscoveredRoles(ctx)
+	assert.Check(t, is.DeepEqual([]DiscoveredRole{{ARN: "arn:aws:iam::1:role/tvm/ops", Path: "/tvm/", Name: "ops"}}, discovery.Roles))
+
+	s = newDiscoveryTestServer(t, RoleDiscoveryConfig{
+		Tag:          "tvm:enabled=true",
+		PathPrefix:   "/tvm/",
+		AccountRoles: []string{"arn:aws:iam::1:role/discovery", "arn:aws:iam::2:role/discovery", "arn:aws:iam::3:role/discovery"},
+	}, endpoint)
+	discovery = s.DiscoveredRoles(ctx)
+	var arns []string
+	for _, role := range discovery.Roles {
+		arns = append(arns, role.ARN)
+	}
+	assert.Check(t, is.DeepEqual([]string{"arn:aws:iam::1:role/dev", "arn:aws:iam::1:role/tvm/ops", "arn:aws:iam::2:role/prod"}, arns))
+	assert.Assert(t, is.Len(discovery.Problems, 1))
+	assert.Check(t, is.Contains(discovery.Problems[0], "cannot search arn:aws:iam::3:role/discovery: AccessDenied"))
+
+	// results are cached until refreshed
+	endpoint.Accounts["2"] = append(endpoint.Accounts["2"], fakeIAMRole{Path: "/", Name: "staging", Tags: map[string]string{"tvm:enabled": "true"}})
+	assert.Check(t, is.Len(s.DiscoveredRoles(ctx).Roles, 3))
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+	w := do(s, "POST", "/admin/roles/refresh", nil, admin)
+	assert.Check(t, is.Equal(http.StatusSeeOther, w.Code))
+	assert.Check(t, is.Len(s.DiscoveredRoles(ctx).Roles, 4))
+
+	// discovered roles are offered when granting roles
+	w = do(s, "GET", "/admin", nil, admin)
+	assert.Check(t, is.Contains(w.Body.String(), `<option value="arn:aws:iam::2:role/staging">`))
+	assert.Check(t, is.Contains(w.Body.String(), "cannot search arn:aws:iam::3:role/discovery"))
+}
@@ -0,0 +1,76 @@
+package tvm
+
+import "sort"
+
+// RoleConfig describes how TVM treats a role. Roles that are not in
+// Config.Roles get the zero RoleConfig.
+type RoleConfig struct {
+	// Alias is a short name for the role that may be used in place of the
+	// ARN in configuration.
+	Alias string
+
+	// Sensitivity ranks how dangerous the role is, higher being more
+	// dangerous. Webhooks can fire when sensitive roles are issued.
+	Sensitivity int
+
+	// RequireApproval means that each request for credentials must be
+	// approved by another user who is an approver for the role.
+	RequireApproval bool
+
+	// RequireReason means that users must say why they need credentials.
+	RequireReason bool
+
+	// TicketPattern, if set, is a regular expression that a ticket ID must
+	// match. Users must supply a matching ticket to get credentials.
+	TicketPattern string
+
+	// Chain lists the hub roles that TVM assumes, in order, before assuming
+	// this role with the credentials of the last of them.
+	Chain []RoleHop
+
+	// ExternalID and SessionName are as in RoleHop, for assuming this role.
+	ExternalID  string
+	SessionName string
+
+	// Region is the role's default region, which is given to users with
+	// their credentials. The role is assumed through the STS endpoint in
+	// that region. Empty means the default region of the role's partition.
+	Region string
+
+	// STSEndpoint, if set, is the URL of the STS endpoint to assume the role
+	// through, such as a VPC endpoint.
+	STSEndpoint string
+}
+
+// tagsSession returns true if credentials for the role are issued with the
+// reason and ticket as session tags. Only roles that require them get them,
+// so that other roles need not allow sts:TagSession.
+func (c RoleConfig) tagsSession() bool {
+	return c.RequireReason || c.TicketPattern != ""
+}
+
+// resolveRole returns the ARN of the role with the given ARN or alias.
+func (c Config) resolveRole(name string) (string, bool) {
+	if _, ok := c.Roles[name]; ok {
+		return name, true
+	}
+	for arn, role := range c.Roles {
+		if role.Alias != "" && role.Alias == name {
+			return arn, true
+		}
+	}
+	return "", false
+}
+
+// approvalRoles returns the ARNs of the roles that require approval, in
+// order.
+func (c Config) approvalRoles() []string {
+	var rv []string
+	for arn, role := range c.Roles {
+		if role.RequireApproval {
+			rv = append(rv, arn)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
@@ -0,0 +1,824 @@
+package tvm
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"goji.io/pat"
+)
+
+// SCIM 2.0 (RFC 7643 and 7644) lets an identity provider create, update and
+// deprovision users and groups. A user's SCIM userName is their email
+// address. Their id is their TVM user ID, which changes when their first
+// login binds them to an identity, so users may also be addressed by the
+// email address they were created with. SCIM can see and manage only the
+// groups that it created, leaving the rest to the admin UI and directory
+// sync.
+
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+	// scimGroupSource is the Group.Source of groups created by SCIM.
+	scimGroupSource = "scim"
+
+	// scimDeprovisionedReason is the StatusReason of users deactivated by
+	// SCIM. Only those users are reactivated by SCIM.
+	scimDeprovisionedReason = "deprovisioned by SCIM"
+
+	scimMaxCount = 100
+)
+
+type scimUser struct {
+	Schemas    []string    `json:"schemas"`
+	ID         string      `json:"id,omitempty"`
+	ExternalID string      `json:"externalId,omitempty"`
+	UserName   string      `json:"userName"`
+	Active     *scimBool   `json:"active,omitempty"`
+	Emails     []scimEmail `json:"emails,omitempty"`
+	Meta       *scimMeta   `json:"meta,omitempty"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimGroup struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id,omitempty"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members"`
+	Meta        *scimMeta    `json:"meta,omitempty"`
+}
+
+type scimMember struct {
+	Value string `json:"value"`
+	Ref   string `json:"$ref,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+	Version      string `json:"version,omitempty"`
+}
+
+type scimListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+type scimPatchRequest struct {
+	Operations []scimPatchOp `json:"Operations"`
+}
+
+type scimPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// scimBool is a boolean that also accepts the strings "true" and "false",
+// which some identity providers send.
+type scimBool bool
+
+func (b *scimBool) UnmarshalJSON(buf []byte) error {
+	var s string
+	if err := json.Unmarshal(buf, &s); err == nil {
+		v, err := strconv.ParseBool(s)
+		*b = scimBool(v)
+		return err
+	}
+	return json.Unmarshal(buf, (*bool)(b))
+}
+
+// scimError is an error with the HTTP status and SCIM error type to report
+// to the client.
+type scimError struct {
+	Status   int
+	ScimType string
+	Detail   string
+}
+
+func (e *scimError) Error() string {
+	return e.Detail
+}
+
+func scimErrorf(status int, scimType string, format string, args ...interface{}) *scimError {
+	return &scimError{Status: status, ScimType: scimType, Detail: fmt.Sprintf(format, args...)}
+}
+
+var (
+	errSCIMUserExists  = scimErrorf(http.StatusConflict, "uniqueness", "user already exists")
+	errSCIMBadUserName = scimErrorf(http.StatusBadRequest, "invalidValue", "userName must be an email address")
+	errSCIMRename      = scimErrorf(http.StatusBadRequest, "mutability", "userName cannot be changed")
+)
+
+// scimID returns the resource ID from the request path. IDs become store
+// keys, so anything that could name another path is refused.
+func scimID(r *http.Request) (string, error) {
+	id, err := url.PathUnescape(pat.Param(r, "id"))
+	if err != nil || id == "" || strings.ContainsAny(id, `/\`) || strings.Contains(id, "..") {
+		return "", scimErrorf(http.StatusBadRequest, "invalidValue", "invalid id")
+	}
+	return id, nil
+}
+
+var scimUserNamePattern = regexp.MustCompile(`^[A-Za-z0-9._%+'-]+@[A-Za-z0-9.-]+$`)
+
+func (s *Server) writeSCIM(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) writeSCIMError(w http.ResponseWriter, err error) {
+	var scimErr *scimError
+	switch {
+	case errors.As(err, &scimErr):
+	case err == ErrNotFound:
+		scimErr = scimErrorf(http.StatusNotFound, "", "not found")
+	default:
+		scimErr = scimErrorf(http.StatusInternalServerError, "", "%s", err)
+	}
+	s.writeSCIM(w, scimErr.Status, struct {
+		Schemas  []string `json:"schemas"`
+		Status   string   `json:"status"`
+		ScimType string   `json:"scimType,omitempty"`
+		Detail   string   `json:"detail"`
+	}{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(scimErr.Status),
+		ScimType: scimErr.ScimType,
+		Detail:   scimErr.Detail,
+	})
+}
+
+// scimAuthorized checks the bearer token on a SCIM request, writing an
+// error and returning false if it is wrong.
+func (s *Server) scimAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if s.Config.SCIMToken == "" {
+		s.writeSCIMError(w, scimErrorf(http.StatusNotFound, "", "SCIM is not enabled"))
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.Config.SCIMToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="tvm"`)
+		s.writeSCIMError(w, scimErrorf(http.StatusUnauthorized, "", "bad bearer token"))
+		return false
+	}
+	return true
+}
+
+func (s *Server) scimLocation(kind, id string) string {
+	u := s.Config.RootURL
+	u.Path = "/scim/v2/" + kind + "/" + id
+	return u.String()
+}
+
+func (s *Server) toSCIMUser(user User) scimUser {
+	active := scimBool(user.Active())
+	return scimUser{
+		Schemas:    []string{scimUserSchema},
+		ID:         user.ID,
+		ExternalID: user.ExternalID,
+		UserName:   user.PrimaryEmail(),
+		Active:     &active,
+		Emails:     []scimEmail{{Value: user.PrimaryEmail(), Primary: true}},
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Location:     s.scimLocation("Users", user.ID),
+			Version:      fmt.Sprintf(`W/"%d"`, user.Version),
+		},
+	}
+}
+
+func (s *Server) toSCIMGroup(group Group) scimGroup {
+	rv := scimGroup{
+		Schemas:     []string{scimGroupSchema},
+		ID:          group.ID,
+		ExternalID:  group.ExternalID,
+		DisplayName: group.DisplayName,
+		Members:     []scimMember{},
+		Meta: &scimMeta{
+			ResourceType: "Group",
+			Location:     s.scimLocation("Groups", group.ID),
+			Version:      fmt.Sprintf(`W/"%d"`, group.Version),
+		},
+	}
+	for _, member := range group.Members {
+		rv.Members = append(rv.Members, scimMember{Value: member, Ref: s.scimLocation("Users", member)})
+	}
+	return rv
+}
+
+// scimFilter is a parsed SCIM filter. We support only conjunctions of
+// equality tests, which is what identity providers use in practice.
+type scimFilter map[string]string
+
+var (
+	scimFilterAndPattern  = regexp.MustCompile(`\s+(?i:and)\s+`)
+	scimFilterTermPattern = regexp.MustCompile(`^\s*([A-Za-z.]+)\s+(?i:eq)\s+("(?:[^"\\]|\\.)*"|true|false)\s*$`)
+)
+
+func parseSCIMFilter(s string) (scimFilter, error) {
+	filter := scimFilter{}
+	if strings.TrimSpace(s) == "" {
+		return filter, nil
+	}
+	for _, term := range scimFilterAndPattern.Split(s, -1) {
+		m := scimFilterTermPattern.FindStringSubmatch(term)
+		if m == nil {
+			return nil, scimErrorf(http.StatusBadRequest, "invalidFilter", "unsupported filter %q", term)
+		}
+		value := m[2]
+		if strings.HasPrefix(value, `"`) {
+			if err := json.Unmarshal([]byte(value), &value); err != nil {
+				return nil, scimErrorf(http.StatusBadRequest, "invalidFilter", "bad value in %q", term)
+			}
+		}
+		filter[strings.ToLower(m[1])] = value
+	}
+	return filter, nil
+}
+
+// match returns true if every term of the filter matches attrs, which maps
+// lower-cased attribute names to values. Attributes not in attrs never
+// match.
+func (f scimFilter) match(attrs map[string]string) bool {
+	for name, want := range f {
+		got, ok := attrs[name]
+		if !ok || !strings.EqualFold(got, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// scimPage returns the page of resources that r asks for.
+func scimPage(r *http.Request, resources []interface{}) scimListResponse {
+	startIndex, err := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count > scimMaxCount {
+		count = scimMaxCount
+	}
+	if count < 0 {
+		count = 0
+	}
+
+	page := []interface{}{}
+	if start := startIndex - 1; start < len(resources) {
+		end := start + count
+		if end > len(resources) {
+			end = len(resources)
+		}
+		page = resources[start:end]
+	}
+	return scimListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(resources),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	}
+}
+
+func (s *Server) auditSCIM(ctx context.Context, r *http.Request, event AuditEvent) {
+	event.Type = AuditSCIM
+	event.Actor = "scim"
+	s.audit(ctx, r, event)
+}
+
+// handleSCIMUsers lists and creates users.
+func (s *Server) handleSCIMUsers(w http.ResponseWriter, r *http.Request) {
+	if !s.scimAuthorized(w, r) {
+		return
+	}
+	ctx := r.Context()
+
+	switch r.Method {
+	case "GET":
+		filter, err := parseSCIMFilter(r.URL.Query().Get("filter"))
+		if err != nil {
+			s.writeSCIMError(w, err)
+			return
+		}
+		users, err := s.Store.ListUsers(ctx)
+		if err != nil {
+			s.writeSCIMError(w, err)
+			return
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+		var resources []interface{}
+		for _, user := range users {
+			if filter.match(map[string]string{
+				"id":           user.ID,
+				"username":     user.PrimaryEmail(),
+				"emails.value": user.PrimaryEmail(),
+				"externalid":   user.ExternalID,
+				"active":       strconv.FormatBool(user.Active()),
+			}) {
+				resources = append(resources, s.toSCIMUser(user))
+			}
+		}
+		s.writeSCIM(w, http.StatusOK, scimPage(r, resources))
+
+	case "POST":
+		var req scimUser
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.writeSCIMError(w, scimErrorf(http.StatusBadRequest, "invalidSyntax", "%s", err))
+			return
+		}
+		userID := strings.ToLower(req.UserName)
+		if !scimUserNamePattern.MatchString(userID) {
+			s.writeSCIMError(w, errSCIMBadUserName)
+			return
+		}
+		if existing, err := s.usersByEmail(ctx, userID); err != nil {
+			s.writeSCIMError(w, err)
+			return
+		} else if len(existing) > 0 {
+			s.writeSCIMError(w, errSCIMUserExists)
+			return
+		}
+
+		user := User{ID: userID, Email: userID, ExternalID: req.ExternalID}
+		if req.Active != nil && !*req.Active {
+			user.Status = UserDisabled
+			user.StatusReason = scimDeprovisionedReason
+			user.StatusTime = time.Now()
+		}
+		if err := s.Store.PutUser(ctx, user); err != nil {
+			s.writeSCIMError(w, err)
+			return
+		}
+		s.auditSCIM(ctx, r, AuditEvent{
+			Op:      "create_user",
+			Subject: user.ID,
+			After:   newAuditUserState(user),
+			Message: fmt.Sprintf("provisioned %s", user.ID),
+		})
+		w.Header().Set("Location", s.scimLocation("Users", user.ID))
+		s.writeSCIM(w, http.StatusCreated, s.toSCIMUser(user))
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		s.writeSCIMError(w, scimErrorf(http.StatusMethodNotAllowed, "", "method not allowed"))
+	}
+}
+
+// handleSCIMUser reads, replaces, patches and deletes a user.
+func (s *Server) handleSCIMUser(w http.ResponseWriter, r *http.Request) {
+	if !s.scimAuthorized(w, r) {
+		return
+	}
+	ctx := r.Context()
+	userID, err := scimID(r)
+	if err != nil {
+		s.writeSCIMError(w, err)
+		return
+	}
+	if user, err := s.lookupUser(ctx, userID); err == nil {
+		userID = user.ID
+	}
+
+	switch r.Method {
+	case "GET":
+		user, err := s.Store.GetUser(ctx, userID)
+		if err != nil {
+			s.writeSCIMError(w, err)
+			return
+		}
+		s.writeSCIM(w, http.StatusOK, s.toSCIMUser(*user))
+
+	case "PUT", "PATCH":
+		var apply func(user *User) error
+		if r.Method == "PUT" {
+			var req scimUser
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				s.writeSCIMError(w, scimErrorf(http.StatusBadRequest, "invalidSyntax", "%s", err))
+				return
+			}
+			apply = func(user *User) error {
+				if req.UserName != "" && !strings.EqualFold(req.UserName, user.PrimaryEmail()) {
+					return errSCIMRename
+				}
+				user.ExternalID = req.ExternalID
+				setSCIMActive(user, req.Active == nil || bool(*req.Active))
+				return nil
+			}
+		} else {
+			var req scimPatchRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				s.writeSCIMError(w, scimErrorf(http.StatusBadRequest, "invalidSyntax", "%s", err))
+				return
+			}
+			apply = func(user *User) error {
+				for _, op := range req.Operations {
+					if err := patchSCIMUser(user, op); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		}
+
+		var before, after *AuditUserState
+		err := s.Store.UpdateUser(ctx, userID, func(user *User) error {
+			before = newAuditUserState(*user)
+			if err := apply(user); err != nil {
+				return err
+			}
+			after = newAuditUserState(*user)
+			return nil
+		})
+		if err != nil {
+			s.writeSCIMError(w, err)
+			return
+		}
+		updated, err := s.Store.GetUser(ctx, userID)
+		if err != nil {
+			s.writeSCIMError(w, err)
+			return
+		}
+		if !updated.Active() {
+			if err := s.deprovision(ctx, userID); err != nil {
+				s.writeSCIMError(w, err)
+				return
+			}
+		}
+		s.auditSCIM(ctx, r, AuditEvent{
+			Op:      strings.ToLower(r.Method) + "_user",
+			Subject: userID,
+			Before:  before,
+			After:   after,
+		})
+		s.writeSCIM(w, http.StatusOK, s.toSCIMUser(*updated))
+
+	case "DELETE":
+		user, err := s.Store.GetUser(ctx, userID)
+		if err != nil {
+			s.writeSCIMError(w, err)
+			return
+		}
+		if err := s.Store.DeleteUser(ctx, userID); err != nil {
+			s.writeSCIMError(w, err)
+			return
+		}
+		if err := s.deprovision(ctx, userID); err != nil {
+			s.writeSCIMError(w, err)
+			return
+		}
+		s.auditSCIM(ctx, r, AuditEvent{
+			Op:      "delete_user",
+			Subject: userID,
+			Before:  newAuditUserState(*user),
+			Message: fmt.Sprintf("deleted %s", userID),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
+		s.writeSCIMError(w, scimErrorf(http.StatusMethodNotAllowed, "", "method not allowed"))
+	}
+}
+
+// setSCIMActive activates or deactivates user. Deactivation removes the
+// user's roles, admin and break-glass access and approver roles, so
+// reactivating a user does not restore their access.
+func setSCIMActive(user *User, active bool) {
+	switch {
+	case !active && user.Active():
+		user.Status = UserDisabled
+		user.StatusReason = scimDeprovisionedReason
+		user.StatusTime = time.Now()
+		user.Roles = nil
+		user.Admin = false
+		user.BreakGlass = false
+		user.ApproverFor = nil
+	case active && user.Status == UserDisabled && user.StatusReason == scimDeprovisionedReason:
+		user.Status = UserActive
+		user.StatusReason = ""
+		user.StatusTime = time.Now()
+	}
+}
+
+func patchSCIMUser(user *User, op scimPatchOp) error {
+	switch strings.ToLower(op.Op) {
+	case "add", "replace":
+	default:
+		return scimErrorf(http.StatusBadRequest, "invalidValue", "unsupported operation %q", op.Op)
+	}
+
+	// Without a path, the value is an object of attributes to set.
+	values := map[string]json.RawMessage{}
+	if op.Path == "" {
+		if err := json.Unmarshal(op.Value, &values); err != nil {
+			return scimErrorf(http.StatusBadRequest, "invalidSyntax", "%s", err)
+		}
+	} else {
+		values[op.Path] = op.Value
+	}
+
+	for path, value := range values {
+		switch strings.ToLower(path) {
+		case "active":
+			var active scimBool
+			if err := json.Unmarshal(value, &active); err != nil {
+				return scimErrorf(http.StatusBadRequest, "invalidValue", "bad active: %s", err)
+			}
+			setSCIMActive(user, bool(active))
+		case "externalid":
+			if err := json.Unmarshal(value, &user.ExternalID); err != nil {
+				return scimErrorf(http.StatusBadRequest, "invalidValue", "bad externalId: %s", err)
+			}
+		case "username":
+			var userName string
+			json.Unmarshal(value, &userName)
+			if !strings.EqualFold(userName, user.PrimaryEmail()) {
+				return errSCIMRename
+			}
+		default:
+			// Ignore attributes that TVM does not store, such as name and
+			// title, which identity providers send regardless.
+		}
+	}
+	return nil
+}
+
+// deprovision removes a user who has been deactivated or deleted from
+// their groups and ends their sessions.
+func (s *Server) deprovision(ctx context.Context, userID string) error {
+	if err := s.removeFromGroups(ctx, userID); err != nil {
+		return err
+	}
+	return s.revokeSessions(ctx, userID)
+}
+
+// handleSCIMGroups lists and creates groups.
+func (s *Server) handleSCIMGroups(w http.ResponseWriter, r *http.Request) {
+	if !s.scimAuthorized(w, r) {
+		return
+	}
+	ctx := r.Context()
+
+	switch r.Method {
+	case "GET":
+		filter, err := parseSCIMFilter(r.URL.Query().Get("filter"))
+		if err != nil {
+			s.writeSCIMError(w, err)
+			return
+		}
+		groups, err := s.Store.ListGroups(ctx)
+		if err != nil {
+			s.writeSCIMError(w, err)
+			return
+		}
+		sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+		var resources []interface{}
+		for _, group := range groups {
+			if group.Source == scimGroupSource && filter.match(map[string]string{
+				"id":          group.ID,
+				"displayname": group.DisplayName,
+				"externalid":  group.ExternalID,
+			}) {
+				resources = append(resources, s.toSCIMGroup(group))
+			}
+		}
+		s.writeSCIM(w, http.StatusOK, scimPage(r, resources))
+
+	case "POST":
+		if s.Config.ManagedAccess {
+			s.writeSCIMError(w, scimErrorf(http.StatusForbidden, "", "%s", errManagedAccess))
+			return
+		}
+		var req scimGroup
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.writeSCIMError(w, scimErrorf(http.StatusBadRequest, "invalidSyntax", "%s", err))
+			return
+		}
+		if req.DisplayName == "" {
+			s.writeSCIMError(w, scimErrorf(http.StatusBadRequest, "invalidValue", "displayName is required"))
+			return
+		}
+		group := Group{
+			ID:          newID(),
+			DisplayName: req.DisplayName,
+			ExternalID:  req.ExternalID,
+			Source:      scimGroupSource,
+		}
+		for _, member := range req.Members {
+			group.Members = append(group.Members, member.Value)
+		}
+		if err := s.Store.PutGroup(ctx, group); err != nil {
+			s.writeSCIMError(w, err)
+			return
+		}
+		s.auditSCIM(ctx, r, AuditEvent{
+			Op:      "create_group",
+			Group:   group.ID,
+			Message: fmt.Sprintf("created group %q with members %v", group.DisplayName, group.Members),
+		})
+		w.Header().Set("Location", s.scimLocation("Groups", group.ID))
+		s.writeSCIM(w, http.StatusCreated, s.toSCIMGroup(group))
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		s.writeSCIMError(w, scimErrorf(http.StatusMethodNotAllowed, "", "method not allowed"))
+	}
+}
+
+// handleSCIMGroup reads, replaces, patches and deletes a group.
+func (s *Server) handleSCIMGroup(w http.ResponseWriter, r *http.Request) {
+	if !s.scimAuthorized(w, r) {
+		return
+	}
+	ctx := r.Context()
+	groupID, err := scimID(r)
+	if err != nil {
+		s.writeSCIMError(w, err)
+		return
+	}
+
+	// SCIM may only touch the groups it created.
+	group, err := s.Store.GetGroup(ctx, groupID)
+	if err == nil && group.Source != scimGroupSource {
+		err = ErrNotFound
+	}
+	if err != nil {
+		s.writeSCIMError(w, err)
+		return
+	}
+
+	if s.Config.ManagedAccess && (r.Method == "PUT" || r.Method == "PATCH" || r.Method == "DELETE") {
+		s.writeSCIMError(w, scimErrorf(http.StatusForbidden, "", "%s", errManagedAccess))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		s.writeSCIM(w, http.StatusOK, s.toSCIMGroup(*group))
+
+	case "PUT", "PATCH":
+		var apply func(group *Group) error
+		if r.Method == "PUT" {
+			var req scimGroup
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				s.writeSCIMError(w, scimErrorf(http.StatusBadRequest, "invalidSyntax", "%s", err))
+				return
+			}
+			apply = func(group *Group) error {
+				group.DisplayName = req.DisplayName
+				group.ExternalID = req.ExternalID
+				group.Members = nil
+				for _, member := range req.Members {
+					group.Members = append(group.Members, member.Value)
+				}
+				return nil
+			}
+		} else {
+			var req scimPatchRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				s.writeSCIMError(w, scimErrorf(http.StatusBadRequest, "invalidSyntax", "%s", err))
+				return
+			}
+			apply = func(group *Group) error {
+				for _, op := range req.Operations {
+					if err := patchSCIMGroup(group, op); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		}
+
+		err := s.Store.UpdateGroup(ctx, groupID, apply)
+		if err != nil {
+			s.writeSCIMError(w, err)
+			return
+		}
+		updated, err := s.Store.GetGroup(ctx, groupID)
+		if err != nil {
+			s.writeSCIMError(w, err)
+			return
+		}
+		s.auditSCIM(ctx, r, AuditEvent{
+			Op:      strings.ToLower(r.Method) + "_group",
+			Group:   groupID,
+			Message: fmt.Sprintf("group %q now has members %v", updated.DisplayName, updated.Members),
+		})
+		s.writeSCIM(w, http.StatusOK, s.toSCIMGroup(*updated))
+
+	case "DELETE":
+		if err := s.Store.DeleteGroup(ctx, groupID); err != nil {
+			s.writeSCIMError(w, err)
+			return
+		}
+		s.auditSCIM(ctx, r, AuditEvent{
+			Op:      "delete_group",
+			Group:   groupID,
+			Message: fmt.Sprintf("deleted group %q", group.DisplayName),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
+		s.writeSCIMError(w, scimErrorf(http.StatusMethodNotAllowed, "", "method not allowed"))
+	}
+}
+
+// scimMemberPathPattern matches the path of a patch operation on one
+// member, e.g. members[value eq "alice@example.com"].
+var scimMemberPathPattern = regexp.MustCompile(`^(?i:members)\[\s*(?i:value)\s+(?i:eq)\s+"([^"]*)"\s*\]$`)
+
+func patchSCIMGroup(group *Group, op scimPatchOp) error {
+	opName := strings.ToLower(op.Op)
+	path := op.Path
+
+	// members[value eq "x"] names a single member to remove.
+	if m := scimMemberPathPattern.FindStringSubmatch(path); m != nil {
+		if opName != "remove" {
+			return scimErrorf(http.StatusBadRequest, "invalidPath", "unsupported path %q for %s", path, op.Op)
+		}
+		group.Members = removeMember(group.Members, m[1])
+		return nil
+	}
+
+	values := map[string]json.RawMessage{}
+	if path == "" {
+		if err := json.Unmarshal(op.Value, &values); err != nil {
+			return scimErrorf(http.StatusBadRequest, "invalidSyntax", "%s", err)
+		}
+	} else {
+		values[path] = op.Value
+	}
+
+	for path, value := range values {
+		switch strings.ToLower(path) {
+		case "members":
+			var members []scimMember
+			if len(value) > 0 {
+				if err := json.Unmarshal(value, &members); err != nil {
+					return scimErrorf(http.StatusBadRequest, "invalidValue", "bad members: %s", err)
+				}
+			}
+			switch opName {
+			case "add":
+				for _, member := range members {
+					if !group.HasMember(member.Value) {
+						group.Members = append(group.Members, member.Value)
+					}
+				}
+			case "replace":
+				group.Members = nil
+				for _, member := range members {
+					group.Members = append(group.Members, member.Value)
+				}
+			case "remove":
+				if len(members) == 0 {
+					group.Members = nil
+				}
+				for _, member := range members {
+					group.Members = removeMember(group.Members, member.Value)
+				}
+			default:
+				return scimErrorf(http.StatusBadRequest, "invalidValue", "unsupported operation %q", op.Op)
+			}
+		case "displayname", "externalid":
+			if opName != "add" && opName != "replace" {
+				return scimErrorf(http.StatusBadRequest, "invalidValue", "unsupported operation %q on %s", op.Op, path)
+			}
+			var v string
+			if err := json.Unmarshal(value, &v); err != nil {
+				return scimErrorf(http.StatusBadRequest, "invalidValue", "bad %s: %s", path, err)
+			}
+			if strings.ToLower(path) == "displayname" {
+				group.DisplayName = v
+			} else {
+				group.ExternalID = v
+			}
+		default:
+			return scimErrorf(http.StatusBadRequest, "invalidPath", "unsupported path %q", path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package tvm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// scimDo makes a SCIM request to s with the given bearer token.
+func scimDo(s *Server, method, path, body, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/scim+json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestSCIMAuth(t *testing.T) {
+	s, _ := newTestServer(t, Config{})
+	w := scimDo(s, "GET", "/scim/v2/Users", "", "")
+	assert.Check(t, is.Equal(http.StatusNotFound, w.Code))
+
+	s.Config.SCIMToken = "sekrit"
+	w = scimDo(s, "GET", "/scim/v2/Users", "", "")
+	assert.Check(t, is.Equal(http.StatusUnauthorized, w.Code))
+	w = scimDo(s, "GET", "/scim/v2/Users", "", "wrong")
+	assert.Check(t, is.Equal(http.StatusUnauthorized, w.Code))
+	w = scimDo(s, "GET", "/scim/v2/Users", "", "sekrit")
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.Equal("application/scim+json", w.Header().Get("Content-Type")))
+}
+
+func TestSCIMUsers(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{SCIMToken: "sekrit"})
+	scim := func(method, path, body string) (int, map[string]interface{}) {
+		w := scimDo(s, method, path, body, "sekrit")
+		var rv map[string]interface{}
+		if w.Body.Len() > 0 {
+			assert.Check(t, json.Unmarshal(w.Body.Bytes(), &rv), w.Body.String())
+		}
+		return w.Code, rv
+	}
+
+	for _, name := range []string{"Carol@example.com", "alice@example.com", "bob@example.com"} {
+		code, user := scim("POST", "/scim/v2/Users", `{"schemas":["urn:ietf:params:scim:schemas:core:2.0:User"],"userName":"`+name+`","externalId":"ext-`+name+`","active":true}`)
+		assert.Check(t, is.Equal(http.StatusCreated, code))
+		assert.Check(t, is.Equal(strings.ToLower(name), user["id"]))
+	}
+	code, body := scim("POST", "/scim/v2/Users", `{"userName":"alice@example.com"}`)
+	assert.Check(t, is.Equal(http.StatusConflict, code))
+	assert.Check(t, is.Equal("uniqueness", body["scimType"]))
+	code, _ = scim("POST", "/scim/v2/Users", `{"userName":"../admin"}`)
+	assert.Check(t, is.Equal(http.StatusBadRequest, code))
+
+	// filtering and pagination
+	code, list := scim("GET", `/scim/v2/Users?filter=userName+eq+"BOB@example.com"`, "")
+	assert.Check(t, is.Equal(http.StatusOK, code))
+	assert.Check(t, is.Equal(float64(1), list["totalResults"]))
+	assert.Check(t, is.Equal("bob@example.com", list["Resources"].([]interface{})[0].(map[string]interface{})["userName"]))
+
+	code, list = scim("GET", `/scim/v2/Users?filter=externalId+eq+"ext-alice@example.com"+and+active+eq+true`, "")
+	assert.Check(t, is.Equal(http.StatusOK, code))
+	assert.Check(t, is.Equal(float64(1), list["totalResults"]))
+
+	code, _ = scim("GET", `/scim/v2/Users?filter=userName+sw+"a"`, "")
+	assert.Check(t, is.Equal(http.StatusBadRequest, code))
+
+	code, list = scim("GET", "/scim/v2/Users?startIndex=2&count=1", "")
+	assert.Check(t, is.Equal(http.StatusOK, code))
+	assert.Check(t, is.Equal(float64(3), list["totalResults"]))
+	assert.Check(t, is.Equal(float64(2), list["startIndex"]))
+	assert.Check(t, is.Equal(float64(1), list["itemsPerPage"]))
+	assert.Check(t, is.Equal("bob@example.com", list["Resources"].([]interface{})[0].(map[string]interface{})["id"]))
+
+	// deprovisioning with PATCH removes roles, admin and break-glass
+	// access, approver roles, group memberships and sessions
+	assert.NilError(t, s.Store.UpdateUser(ctx, "alice@example.com", func(user *User) error {
+		user.Roles = []RoleGrant{{Role: "dev"}}
+		user.Admin = true
+		user.BreakGlass = true
+		user.ApproverFor = []string{"prod"}
+		return nil
+	}))
+	assert.NilError(t, s.Store.PutGroup(ctx, Group{ID: "eng", Members: []string{"alice@example.com", "bob@example.com"}}))
+	loginAs(t, s, User{ID: "alice@example.com"})
+
+	code, user := scim("PATCH", "/scim/v2/Users/alice@example.com", `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"Replace","path":"active","value":"False"}]}`)
+	assert.Check(t, is.Equal(http.StatusOK, code))
+	assert.Check(t, is.Equal(false, user["active"]))
+
+	alice, err := s.Store.GetUser(ctx, "alice@example.com")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(UserDisabled, alice.Status))
+	assert.Check(t, is.Len(alice.Roles, 0))
+	assert.Check(t, !alice.Admin)
+	assert.Check(t, !alice.BreakGlass)
+	assert.Check(t, is.Len(alice.ApproverFor, 0))
+	group, err := s.Store.GetGroup(ctx, "eng")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"bob@example.com"}, group.Members))
+	_, err = s.Store.GetSession(ctx, "session-alice@example.com")
+	assert.Check(t, is.Equal(ErrNotFound, err))
+
+	// reactivation with PUT
+	code, user = scim("PUT", "/scim/v2/Users/alice@example.com", `{"userName":"alice@example.com","active":true,"externalId":"new"}`)
+	assert.Check(t, is.Equal(http.StatusOK, code))
+	assert.Check(t, is.Equal(true, user["active"]))
+	assert.Check(t, is.Equal("new", user["externalId"]))
+	alice, err = s.Store.GetUser(ctx, "alice@example.com")
+	assert.NilError(t, err)
+	assert.Check(t, !alice.Admin)
+	assert.Check(t, !alice.BreakGlass)
+
+	code, _ = scim("PUT", "/scim/v2/Users/alice@example.com", `{"userName":"alice2@example.com"}`)
+	assert.Check(t, is.Equal(http.StatusBadRequest, code))
+
+	// deletion
+	loginAs(t, s, User{ID: "bob@example.com"})
+	code, _ = scim("DELETE", "/scim/v2/Users/bob@example.com", "")
+	assert.Check(t, is.Equal(http.StatusNoContent, code))
+	code, _ = scim("GET", "/scim/v2/Users/bob@example.com", "")
+	assert.Check(t, is.Equal(http.StatusNotFound, code))
+	_, err = s.Store.GetSession(ctx, "session-bob@example.com")
+	assert.Check(t, is.Equal(ErrNotFound, err))
+	group, err = s.Store.GetGroup(ctx, "eng")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(group.Members, 0))
+
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditSCIM})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(events, 6))
+	assert.Check(t, is.Equal("delete_user", events[0].Op))
+}
+
+func TestSCIMGroups(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{SCIMToken: "sekrit"})
+	assert.NilError(t, s.Store.PutGroup(ctx, Group{ID: "admin-managed"}))
+	scim := func(method, path, body string) (int, map[string]interface{}) {
+		w := scimDo(s, method, path, body, "sekrit")
+		var rv map[string]interface{}
+		if w.Body.Len() > 0 {
+			assert.Check(t, json.Unmarshal(w.Body.Bytes(), &rv), w.Body.String())
+		}
+		return w.Code, rv
+	}
+	members := func(id string) []string {
+		group, err := s.Store.GetGroup(ctx, id)
+		assert.NilError(t, err)
+		return group.Members
+	}
+
+	code, group := scim("POST", "/scim/v2/Groups", `{"displayName":"Site Reliability","members":[{"value":"alice@example.com"}]}`)
+	assert.Assert(t, is.Equal(http.StatusCreated, code))
+	id := group["id"].(string)
+	assert.Check(t, is.DeepEqual([]string{"alice@example.com"}, members(id)))
+
+	// only groups created by SCIM are visible
+	code, list := scim("GET", "/scim/v2/Groups", "")
+	assert.Check(t, is.Equal(http.StatusOK, code))
+	assert.Check(t, is.Equal(float64(1), list["totalResults"]))
+	code, _ = scim("GET", "/scim/v2/Groups/admin-managed", "")
+	assert.Check(t, is.Equal(http.StatusNotFound, code))
+
+	code, list = scim("GET", `/scim/v2/Groups?filter=displayName+eq+"Site+Reliability"`, "")
+	assert.Check(t, is.Equal(http.StatusOK, code))
+	assert.Check(t, is.Equal(float64(1), list["totalResults"]))
+
+	for _, tc := range []struct {
+		patch string
+		want  []string
+	}{
+		{`{"op":"add","path":"members","value":[{"value":"bob@example.com"},{"value":"carol@example.com"}]}`,
+			[]string{"alice@example.com", "bob@example.com", "carol@example.com"}},
+		{`{"op":"remove","path":"members[value eq \"bob@example.com\"]"}`,
+			[]string{"alice@example.com", "carol@example.com"}},
+		{`{"op":"remove","path":"members","value":[{"value":"alice@example.com"}]}`,
+			[]string{"carol@example.com"}},
+		{`{"op":"replace","value":{"displayName":"SRE","members":[{"value":"dave@example.com"}]}}`,
+			[]string{"dave@example.com"}},
+	} {
+		code, _ := scim("PATCH", "/scim/v2/Groups/"+id, `{"Operations":[`+tc.patch+`]}`)
+		assert.Check(t, is.Equal(http.StatusOK, code), tc.patch)
+		assert.Check(t, is.DeepEqual(tc.want, members(id)), tc.patch)
+	}
+
+	code, group = scim("GET", "/scim/v2/Groups/"+id, "")
+	assert.Check(t, is.Equal(http.StatusOK, code))
+	assert.Check(t, is.Equal("SRE", group["displayName"]))
+
+	code, _ = scim("PATCH", "/scim/v2/Groups/"+id, `{"Operations":[{"op":"replace","path":"owner","value":"x"}]}`)
+	assert.Check(t, is.Equal(http.StatusBadRequest, code))
+
+	code, _ = scim("PUT", "/scim/v2/Groups/"+id, `{"displayName":"SRE","members":[]}`)
+	assert.Check(t, is.Equal(http.StatusOK, code))
+	assert.Check(t, is.Len(members(id), 0))
+
+	code, _ = scim("DELETE", "/scim/v2/Groups/"+id, "")
+	assert.Check(t, is.Equal(http.StatusNoContent, code))
+	code, _ = scim("DELETE", "/scim/v2/Groups/admin-managed", "")
+	assert.Check(t, is.Equal(http.StatusNotFound, code))
+}
+
+func TestSCIMGroupsManagedAccess(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{SCIMToken: "sekrit", ManagedAccess: true})
+	assert.NilError(t, s.Store.PutGroup(ctx, Group{ID: "sre", Source: scimGroupSource, Members: []string{"alice@example.com"}}))
+
+	// groups can be read but not changed
+	w := scimDo(s, "GET", "/scim/v2/Groups/sre", "", "sekrit")
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	for _, tc := range []struct{ method, path, body string }{
+		{"POST", "/scim/v2/Groups", `{"displayName":"Ops"}`},
+		{"PUT", "/scim/v2/Groups/sre", `{"displayName":"SRE","members":[]}`},
+		{"PATCH", "/scim/v2/Groups/sre", `{"Operations":[{"op":"add","path":"members","value":[{"value":"bob@example.com"}]}]}`},
+		{"DELETE", "/scim/v2/Groups/sre", ""},
+	} {
+		w := scimDo(s, tc.method, tc.path, tc.body, "sekrit")
+		assert.Check(t, is.Equal(http.StatusForbidden, w.Code), tc.method)
+	}
+	group, err := s.Store.GetGroup(ctx, "sre")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"alice@example.com"}, group.Members))
+	groups, err := s.Store.ListGroups(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(groups, 1))
+}
+
+func TestSCIMBadID(t *testing.T) {
+	s, _ := newTestServer(t, Config{SCIMToken: "sekrit"})
+	for _, path := range []string{
+		"/scim/v2/Users/..%2F..%2Fsessions%2Fx",
+		"/scim/v2/Users/..%5Cx",
+		"/scim/v2/Users/..",
+		"/scim/v2/Groups/..%2Fusers%2Falice@example.com",
+	} {
+		for _, method := range []string{"GET", "PUT", "DELETE"} {
+			w := scimDo(s, method, path, `{"userName":"alice@example.com","displayName":"x"}`, "sekrit")
+			assert.Check(t, is.Equal(http.StatusBadRequest, w.Code), "%s %s", method, path)
+		}
+	}
+}
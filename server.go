@@ -1,15 +1,24 @@
 package tvm
 
 import (
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	"goji.io"
 	"goji.io/pat"
 	"golang.org/x/oauth2"
@@ -22,11 +31,95 @@ type Config struct {
 	OAuth2ClientSecret   string
 	SessionMaxAgeSeconds int
 	CredentialLifetimeSeconds int
+
+	// ApprovalLifetimeSeconds is how long after a request for a role with
+	// RequireApproval is approved that it may be used to get credentials.
+	// Zero means one hour.
+	ApprovalLifetimeSeconds int
+
+	// Roles describes the roles TVM issues credentials for, keyed by ARN.
+	Roles map[string]RoleConfig
+
+	// Webhooks are notified of security-relevant events.
+	Webhooks []WebhookConfig
+
+	// Directory describes how to follow the directory, if Server.Directory
+	// is set.
+	Directory DirectoryConfig
+
+	// Enrollment says who may become a user by logging in.
+	Enrollment EnrollmentConfig
+
+	// SCIMToken is the bearer token that identity providers use to
+	// provision users and groups through /scim/v2. Empty disables SCIM.
+	// When SCIM is enabled, users are no longer created when they first
+	// log in.
+	SCIMToken string
+
+	// BreakGlassRole is the role that users with User.BreakGlass may get in
+	// an emergency. Empty disables break-glass access.
+	BreakGlassRole string
+
+	// ManagedAccess means that an AccessFile is authoritative for role
+	// grants, admins and groups. The admin UI, the API and SCIM cannot
+	// change them, and directory group mappings are not allowed. SCIM can
+	// still deprovision users, which removes their access at once.
+	ManagedAccess bool
+
+	// Principal is the ARN of the IAM role or user that TVM assumes roles
+	// as, which role trust policies must allow. Empty means the identity of
+	// TVM's AWS credentials.
+	Principal string
+
+	// RoleDiscovery describes how to find roles in IAM to offer admins.
+	RoleDiscovery RoleDiscoveryConfig
+
+	// Organization describes the standard roles in each account of the AWS
+	// organization, if Server.Organizations is set.
+	Organization OrganizationConfig
+
+	// Partitions describes how TVM reaches STS in each AWS partition, keyed
+	// by partition ID, e.g. aws-us-gov.
+	Partitions map[string]PartitionConfig
+
+	// TrustedProxies are the addresses or CIDR blocks of the load balancers
+	// in front of TVM. X-Forwarded-For is believed only when a request comes
+	// from one of them.
+	TrustedProxies []string
 }
 
 func NewServer(config Config) (*Server, error) {
 	s := Server{Mux: goji.NewMux(), Config: config}
 
+	if err := config.checkPartitions(); err != nil {
+		return nil, err
+	}
+	if config.ManagedAccess && len(config.Directory.Mappings) > 0 {
+		return nil, errManagedMappings
+	}
+
+	for _, proxy := range config.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse trusted proxy %q: %w", proxy, err)
+		}
+		s.trustedProxies = append(s.trustedProxies, network)
+	}
+
+	awsSession, err := awssession.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	s.STS = sts.New(awsSession)
+	s.awsSession = awsSession
+
 	redirectURL := config.RootURL
 	redirectURL.Path = "/oauth2/callback"
 	s.OAuth2 = oauth2.Config{
@@ -37,14 +130,50 @@ func NewServer(config Config) (*Server, error) {
 		Scopes:       []string{"openid", "email"},
 	}
 
+	for _, webhook := range config.Webhooks {
+		sink := &WebhookSink{
+			Config: webhook,
+			Roles:  config.Roles,
+			OnFailure: func(event AuditEvent, err error) {
+				s.audit(context.Background(), nil, AuditEvent{
+					Type:    AuditWebhookFailed,
+					Actor:   event.Actor,
+					Message: fmt.Sprintf("cannot deliver %s %s: %s", event.Type, event.ID, err),
+				})
+			},
+		}
+		s.Sinks = append(s.Sinks, NewAsyncSink(sink, webhook.queueSize()))
+	}
+
 	s.Mux.HandleFunc(pat.Get("/"), s.handleGetToken)
 
 	s.Mux.HandleFunc(pat.Get("/oauth2/callback"), s.handleOAuth2Callback)
 	s.Mux.HandleFunc(pat.Get("/u2f/sign"), s.handleU2FSigned)
 	s.Mux.HandleFunc(pat.Get("/u2f/register"), s.handleU2FRegister)
+	s.Mux.HandleFunc(pat.Get("/break-glass"), s.handleBreakGlassLogin)
+
+	s.Mux.HandleFunc(pat.Get("/requests"), s.handleAccessRequests)
+	s.Mux.HandleFunc(pat.Get("/requests/:id"), s.handleAccessRequest)
+	s.Mux.HandleFunc(pat.Post("/requests/:id"), s.handleAccessRequestOp)
 
 	s.Mux.HandleFunc(pat.Get("/admin"), s.handleAdminRoot)
-	s.Mux.HandleFunc(pat.Post("/admin"), s.handleAdminOp)
+	s.Mux.HandleFunc(pat.Post("/admin/op"), s.handleAdminOp)
+	s.Mux.HandleFunc(pat.Get("/admin/users/:id"), s.handleAdminUser)
+	s.Mux.HandleFunc(pat.Get("/admin/audit"), s.handleAdminAudit)
+	s.Mux.HandleFunc(pat.Post("/admin/reviews/:id"), s.handleCloseReview)
+	s.Mux.HandleFunc(pat.Post("/admin/groups"), s.handleAdminGroupOp)
+	s.Mux.HandleFunc(pat.Post("/admin/tokens"), s.handleAdminCreateAPIToken)
+	s.Mux.HandleFunc(pat.Post("/admin/tokens/:id/revoke"), s.handleAdminRevokeAPIToken)
+	s.Mux.HandleFunc(pat.Post("/admin/roles/refresh"), s.handleAdminRefreshRoles)
+	s.Mux.HandleFunc(pat.Get("/admin/accounts"), s.handleAdminAccounts)
+	s.Mux.HandleFunc(pat.Post("/admin/accounts/refresh"), s.handleAdminRefreshAccounts)
+
+	s.registerAPI()
+
+	s.Mux.HandleFunc(pat.New("/scim/v2/Users"), s.handleSCIMUsers)
+	s.Mux.HandleFunc(pat.New("/scim/v2/Users/:id"), s.handleSCIMUser)
+	s.Mux.HandleFunc(pat.New("/scim/v2/Groups"), s.handleSCIMGroups)
+	s.Mux.HandleFunc(pat.New("/scim/v2/Groups/:id"), s.handleSCIMGroup)
 
 	s.Mux.HandleFunc(pat.Get("/u2f-api.js"), handleU2FApiJS)
 
@@ -63,6 +192,35 @@ type Server struct {
 	OAuth2 oauth2.Config
 	Store  Store
 	Config Config
+
+	// STS is used to assume roles.
+	STS stsiface.STSAPI
+
+	// IAM, if set, is used to check that TVM can assume roles when they
+	// are granted, and by CheckRoles.
+	IAM iamiface.IAMAPI
+
+	// Organizations, if set, lists the accounts in the AWS organization, to
+	// offer their standard roles and expand grants of organization roles.
+	Organizations organizationsiface.OrganizationsAPI
+
+	// awsSession configures the IAM clients used for role discovery and the
+	// STS clients for roles with their own region or endpoint.
+	awsSession    *awssession.Session
+	roleDiscovery roleDiscoveryCache
+	organization  organizationCache
+	partitions    partitionSessions
+
+	// trustedProxies are the networks in Config.TrustedProxies.
+	trustedProxies []*net.IPNet
+
+	// Directory, if set, is synchronized with by SyncDirectory and, if
+	// configured, at login.
+	Directory Directory
+
+	// Sinks receive a copy of every audit event. Sinks that may be slow
+	// should be wrapped with NewAsyncSink.
+	Sinks []EventSink
 }
 
 func (s *Server) handleGetToken(w http.ResponseWriter, r *http.Request) {
@@ -90,6 +248,12 @@ func (s *Server) handleGetToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if session.BreakGlass && r.URL.Query().Get("break_glass") == "" {
+		s.Store.DeleteSession(r.Context(), session.ID)
+		s.newSession(w, r)
+		return
+	}
+
 	user, err := s.Store.GetUser(r.Context(), session.UserID)
 	if err != nil {
 		s.Store.DeleteSession(r.Context(), session.ID)
@@ -97,6 +261,12 @@ func (s *Server) handleGetToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !user.Active() {
+		s.Store.DeleteSession(r.Context(), session.ID)
+		s.serveInactiveUser(w, r, *user)
+		return
+	}
+
 	if r.URL.Query().Get("format") == "admin" {
 		if !user.Admin {
 			http.Error(w, "Forbidden", http.StatusForbidden)
@@ -106,13 +276,32 @@ func (s *Server) handleGetToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Query().Get("format") == "approve" {
+		requestURL := "/requests"
+		if id := r.URL.Query().Get("request"); id != "" {
+			requestURL += "/" + url.PathEscape(id)
+		}
+		http.Redirect(w, r, requestURL, http.StatusFound)
+		return
+	}
+
+	if r.URL.Query().Get("break_glass") != "" {
+		s.breakGlass(w, r, user)
+		return
+	}
+
+	activeRoles, err := s.effectiveRoles(r.Context(), *user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	desiredRole := r.URL.Query().Get("role")
-	if desiredRole == "" && len(user.Roles) == 1 {
-		desiredRole = user.Roles[0]
+	if desiredRole == "" && len(activeRoles) == 1 {
+		desiredRole = activeRoles[0]
 	}
 
 	roleIsOK := false
-	for _, role := range user.Roles {
+	for _, role := range activeRoles {
 		if role == desiredRole {
 			roleIsOK = true
 		}
@@ -123,25 +312,101 @@ func (s *Server) handleGetToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stsSvc := sts.New(nil)
-	assumeRoleOutput, err := stsSvc.AssumeRoleWithContext(r.Context(), &sts.AssumeRoleInput{
-		DurationSeconds:   aws.Int64(int64(s.Config.CredentialLifetimeSeconds)),
-		RoleArn:           &desiredRole,
-		RoleSessionName:   aws.String(fmt.Sprintf("tvm:%s", user.ID)),
-	})
+	if !s.checkJustification(w, r, desiredRole, s.Config.Roles[desiredRole]) {
+		return
+	}
+
+	var request *AccessRequest
+	if s.Config.Roles[desiredRole].RequireApproval {
+		if request = s.checkAccessRequest(w, r, user, desiredRole); request == nil {
+			return
+		}
+	}
+
+	s.issueCredentials(w, r, user, desiredRole, request, nil, AuditEvent{Type: AuditCredentialsIssue})
+}
+
+// issueCredentials assumes role on behalf of user, through the role's chain
+// of hub roles if it has one, and sends the credentials in the format the
+// request asks for. For roles that require a reason or ticket, they are
+// passed to STS as session tags, so those roles must allow sts:TagSession
+// in their trust policy.
+//
+// If request is not nil, it is the approved access request that allows the
+// issuance, which is used up once STS has issued the credentials. The
+// reason and ticket are then the ones the approver saw, not those in the
+// URL.
+//
+// If onIssue is not nil, it is called once STS has issued the credentials,
+// to record the issuance. If it fails, the credentials are not sent.
+//
+// The issuance is audited as event, with the details of the credentials
+// filled in.
+func (s *Server) issueCredentials(w http.ResponseWriter, r *http.Request, user *User, desiredRole string, request *AccessRequest, onIssue func(ctx context.Context) error, event AuditEvent) {
+	reason := strings.TrimSpace(r.URL.Query().Get("reason"))
+	ticket := strings.TrimSpace(r.URL.Query().Get("ticket"))
+	if request != nil {
+		reason = request.Justification
+		ticket = request.Ticket
+	}
+
+	var tags []*sts.Tag
+	if s.Config.Roles[desiredRole].tagsSession() {
+		if reason != "" {
+			tags = append(tags, &sts.Tag{Key: aws.String("tvm:reason"), Value: aws.String(sessionTagValue(reason))})
+		}
+		if ticket != "" {
+			tags = append(tags, &sts.Tag{Key: aws.String("tvm:ticket"), Value: aws.String(sessionTagValue(ticket))})
+		}
+	}
+
+	creds, err := s.assumeRole(r.Context(), user.ID, desiredRole, tags)
 	if err != nil {
+		log.Printf("cannot issue credentials to %s: %v", user.ID, err)
 		w.WriteHeader(http.StatusForbidden)
+		var hopErr *HopError
+		if errors.As(err, &hopErr) && hopErr.Hops > 1 {
+			fmt.Fprintf(w, "sts.AssumeRole failed for %s, hop %d of %d\n", hopErr.Role, hopErr.Hop, hopErr.Hops)
+			return
+		}
 		fmt.Fprintln(w, "sts.AssumeRole failed")
 		return
 	}
 
+	if request != nil {
+		if err := s.useAccessRequest(r.Context(), request.ID, user.ID, desiredRole); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if onIssue != nil {
+		if err := onIssue(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	event.Actor = user.ID
+	event.Role = desiredRole
+	event.DurationSeconds = s.Config.sessionSeconds(desiredRole)
+	event.AccessKeyID = *creds.AccessKeyId
+	event.Reason = reason
+	event.Ticket = ticket
+	if err := s.audit(r.Context(), r, event); err != nil {
+		http.Error(w, "cannot write audit log", http.StatusInternalServerError)
+		return
+	}
+
 	if r.URL.Query().Get("format") == "cli" {
 		query := url.Values{
 			"role":              {desiredRole },
-			"access_key_id":     {*assumeRoleOutput.Credentials.AccessKeyId},
-			"secret_access_key": {*assumeRoleOutput.Credentials.SecretAccessKey},
-			"session_token":     {*assumeRoleOutput.Credentials.SessionToken},
-			"expiration":        {assumeRoleOutput.Credentials.Expiration.Format(time.RFC3339)},
+			"access_key_id":     {*creds.AccessKeyId},
+			"secret_access_key": {*creds.SecretAccessKey},
+			"session_token":     {*creds.SessionToken},
+			"expiration":        {creds.Expiration.Format(time.RFC3339)},
+		}
+		if region := s.Config.roleRegion(desiredRole); region != "" {
+			query.Set("region", region)
 		}
 
 		port, err := strconv.Atoi(r.URL.Query().Get("port"))
@@ -158,9 +423,13 @@ func (s *Server) handleGetToken(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Query().Get("format") == "sh" {
 		fmt.Fprintf(w, "export AWS_ACCESS_KEY_ID=%s\n"+
 			"export AWS_SECRET_ACCESS_KEY=%s\n"+
-			"export AWS_SESSION_TOKEN=%s\n", *assumeRoleOutput.Credentials.AccessKeyId,
-			*assumeRoleOutput.Credentials.SecretAccessKey,
-			*assumeRoleOutput.Credentials.SessionToken)
+			"export AWS_SESSION_TOKEN=%s\n", *creds.AccessKeyId,
+			*creds.SecretAccessKey,
+			*creds.SessionToken)
+		if region := s.Config.roleRegion(desiredRole); region != "" {
+			fmt.Fprintf(w, "export AWS_REGION=%s\n"+
+				"export AWS_DEFAULT_REGION=%s\n", region, region)
+		}
 		return
 	}
 
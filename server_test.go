@@ -0,0 +1,107 @@
+package tvm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// fakeSTS records calls to AssumeRole and returns made-up credentials.
+type fakeSTS struct {
+	stsiface.STSAPI
+	inputs []*sts.AssumeRoleInput
+	err    error // returned by AssumeRole, if set
+}
+
+func (f *fakeSTS) AssumeRoleWithContext(ctx aws.Context, input *sts.AssumeRoleInput, opts ...request.Option) (*sts.AssumeRoleOutput, error) {
+	f.inputs = append(f.inputs, input)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &sts.AssumeRoleOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String("ASIAEXAMPLE"),
+			SecretAccessKey: aws.String("secret"),
+			SessionToken:    aws.String("token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+// newTestServer returns a server backed by a temporary LocalStore and a
+// fake STS.
+func newTestServer(t *testing.T, config Config) (*Server, *fakeSTS) {
+	tempdir, err := os.MkdirTemp("", "")
+	assert.NilError(t, err)
+	t.Cleanup(func() { os.RemoveAll(tempdir) })
+
+	s, err := NewServer(config)
+	assert.NilError(t, err)
+	s.Store = LocalStore{Path: tempdir}
+
+	stsSvc := &fakeSTS{}
+	s.STS = stsSvc
+	return s, stsSvc
+}
+
+// loginAs creates a user and a session for them that has completed the
+// second factor, and returns the session ID.
+func loginAs(t *testing.T, s *Server, user User) string {
+	ctx := context.Background()
+	if _, err := s.Store.GetUser(ctx, user.ID); err == ErrNotFound {
+		assert.NilError(t, s.Store.PutUser(ctx, user))
+	}
+	sessionID := "session-" + user.ID
+	assert.NilError(t, s.Store.PutSession(ctx, Session{ID: sessionID, UserID: user.ID, U2F: true}))
+	return sessionID
+}
+
+// do makes a request to s with the given session cookie.
+func do(s *Server, method, path string, form url.Values, sessionID string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r.PostForm = form
+	if sessionID != "" {
+		r.AddCookie(&http.Cookie{Name: "session", Value: sessionID})
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestSourceIP(t *testing.T) {
+	s, err := NewServer(Config{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"}})
+	assert.NilError(t, err)
+	for _, tc := range []struct {
+		RemoteAddr string
+		XFF        string
+		Expected   string
+	}{
+		{"198.51.100.7:1234", "", "198.51.100.7"},
+		{"198.51.100.7:1234", "203.0.113.9", "198.51.100.7"},
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+		{"10.1.2.3:1234", "203.0.113.9", "203.0.113.9"},
+		{"10.1.2.3:1234", "1.1.1.1, 203.0.113.9", "203.0.113.9"},
+		{"10.1.2.3:1234", "203.0.113.9, 192.0.2.1", "203.0.113.9"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.RemoteAddr
+		if tc.XFF != "" {
+			r.Header.Set("X-Forwarded-For", tc.XFF)
+		}
+		assert.Check(t, is.Equal(tc.Expected, s.sourceIP(r)), "%s %s", tc.RemoteAddr, tc.XFF)
+	}
+
+	_, err = NewServer(Config{TrustedProxies: []string{"load-balancer"}})
+	assert.Check(t, is.ErrorContains(err, "cannot parse trusted proxy"))
+}
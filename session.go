@@ -1,34 +1,52 @@
 package tvm
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"io"
 	"net/http"
+	"time"
 )
 
-func (s *Server) newSession(w http.ResponseWriter, r *http.Request)  {
+// newSessionID returns a new random session ID.
+func newSessionID() string {
 	id := make([]byte, 32)
-	_, err := io.ReadFull(rand.Reader, id)
-	if err != nil {
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
 		panic(err)
 	}
+	return base64.RawURLEncoding.EncodeToString(id)
+}
 
+func (s *Server) newSession(w http.ResponseWriter, r *http.Request)  {
 	oauth2state := make([]byte, 32)
-	_, err = io.ReadFull(rand.Reader, oauth2state)
+	_, err := io.ReadFull(rand.Reader, oauth2state)
 	if err != nil {
 		panic(err)
 	}
 
 	session := Session{
-		ID: base64.RawURLEncoding.EncodeToString(id),
+		ID: newSessionID(),
 		OAuth2State: base64.RawURLEncoding.EncodeToString(oauth2state),
 		Params: r.URL.Query(),
 	}
+	if s.Config.SessionMaxAgeSeconds > 0 {
+		session.Expires = time.Now().Add(time.Duration(s.Config.SessionMaxAgeSeconds) * time.Second)
+	}
 	if err := s.Store.PutSession(r.Context(), session); err != nil {
 		panic(err)
 	}
+	s.setSessionCookie(w, session)
+
+	redirectURL := s.OAuth2.AuthCodeURL(session.OAuth2State)
+	http.Redirect(w,r, redirectURL, http.StatusFound)
+}
 
+
+// setSessionCookie sends the cookie that identifies session.
+func (s *Server) setSessionCookie(w http.ResponseWriter, session Session) {
 	cookie := http.Cookie{
 		Name:     "session",
 		Value:    session.ID,
@@ -38,9 +56,51 @@ func (s *Server) newSession(w http.ResponseWriter, r *http.Request)  {
 		//SameSite: http.SameSiteStrictMode,  // TODO(ross): confirm this
 		//Path:     "/",
 	}
+	if !session.Expires.IsZero() {
+		cookie.MaxAge = int(time.Until(session.Expires).Seconds())
+	}
 	http.SetCookie(w, &cookie)
+}
 
-	redirectURL := s.OAuth2.AuthCodeURL(session.OAuth2State)
-	http.Redirect(w,r, redirectURL, http.StatusFound)
+// currentUser returns the user who made r, provided that they have logged
+// in and signed with their key, or nil otherwise.
+func (s *Server) currentUser(r *http.Request) *User {
+	cookie, err := r.Cookie("session")
+	if err != nil {
+		return nil
+	}
+	session, err := s.Store.GetSession(r.Context(), cookie.Value)
+	if err != nil || session.UserID == "" || !session.U2F || session.BreakGlass {
+		return nil
+	}
+	user, err := s.Store.GetUser(r.Context(), session.UserID)
+	if err != nil || !user.Active() {
+		return nil
+	}
+	return user
 }
 
+// sessionHandle returns a name for the session with ID id that can be shown
+// to admins. The ID itself is a bearer credential.
+func sessionHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// revokeSessions deletes every session belonging to the user, so that they
+// must log in again.
+func (s *Server) revokeSessions(ctx context.Context, userID string) error {
+	sessions, err := s.Store.ListSessions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.UserID != userID {
+			continue
+		}
+		if err := s.Store.DeleteSession(ctx, session.ID); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package tvm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+)
+
+// EventSink receives audit events as they happen, for example to forward
+// them to a SIEM.
+type EventSink interface {
+	Send(ctx context.Context, event AuditEvent) error
+}
+
+// AsyncSink delivers events to another sink in the background so that a
+// slow or unavailable sink does not hold up requests. At most a fixed
+// number of events are queued; when the queue is full, further events are
+// dropped and logged. Events sent after Close are dropped too, since sinks
+// can audit their own failures while Close delivers the queue.
+type AsyncSink struct {
+	sink   EventSink
+	events chan AuditEvent
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+var _ EventSink = &AsyncSink{}
+
+// NewAsyncSink returns an AsyncSink that queues up to bufferSize events for
+// sink.
+func NewAsyncSink(sink EventSink, bufferSize int) *AsyncSink {
+	a := &AsyncSink{
+		sink:   sink,
+		events: make(chan AuditEvent, bufferSize),
+		done:   make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *AsyncSink) run() {
+	defer close(a.done)
+	for event := range a.events {
+		if err := a.sink.Send(context.Background(), event); err != nil {
+			log.Printf("event sink: cannot send %s %s: %v", event.Type, event.ID, err)
+		}
+	}
+}
+
+// Send queues event for delivery. It never blocks.
+func (a *AsyncSink) Send(ctx context.Context, event AuditEvent) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		log.Printf("event sink: closed, dropping %s %s", event.Type, event.ID)
+		return nil
+	}
+	select {
+	case a.events <- event:
+	default:
+		log.Printf("event sink: buffer full, dropping %s %s", event.Type, event.ID)
+	}
+	return nil
+}
+
+// Close stops accepting events, waits for queued events to be delivered and
+// then closes the sink they are delivered to, if it is an io.Closer.
+func (a *AsyncSink) Close() error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.events)
+	}
+	a.mu.Unlock()
+	<-a.done
+	if closer, ok := a.sink.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Close closes those of s.Sinks that are io.Closers, so that events they
+// have buffered are delivered. Call it when shutting down, after the last
+// request.
+func (s *Server) Close() error {
+	var rv error
+	for _, sink := range s.Sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			if err := closer.Close(); err != nil && rv == nil {
+				rv = err
+			}
+		}
+	}
+	return rv
+}
+
+// WriterSink writes each event as a line of JSON to W. Use it with
+// os.Stdout to send events to a log collector that reads standard output.
+type WriterSink struct {
+	W io.Writer
+
+	mu sync.Mutex
+}
+
+var _ EventSink = &WriterSink{}
+
+func (s *WriterSink) Send(ctx context.Context, event AuditEvent) error {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.W.Write(append(buf, '\n'))
+	return err
+}
@@ -0,0 +1,99 @@
+package tvm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// JSONLinesSink appends each event as a line of JSON to the file at Path.
+// When the file grows beyond MaxBytes it is rotated: Path is renamed to
+// Path.1, Path.1 to Path.2 and so on, keeping at most MaxFiles old files.
+type JSONLinesSink struct {
+	Path string
+
+	// MaxBytes is the size at which the file is rotated. Zero means never
+	// rotate.
+	MaxBytes int64
+
+	// MaxFiles is the number of rotated files to keep.
+	MaxFiles int
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+var _ EventSink = &JSONLinesSink{}
+
+func (s *JSONLinesSink) Send(ctx context.Context, event AuditEvent) error {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		if s.f, err = os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			return err
+		}
+	}
+
+	if s.MaxBytes > 0 {
+		fi, err := s.f.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Size() > 0 && fi.Size()+int64(len(buf)) > s.MaxBytes {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = s.f.Write(buf)
+	return err
+}
+
+// rotate must be called with s.mu held.
+func (s *JSONLinesSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.f = nil
+
+	os.Remove(fmt.Sprintf("%s.%d", s.Path, s.MaxFiles))
+	for i := s.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.Path, i), fmt.Sprintf("%s.%d", s.Path, i+1))
+	}
+	if s.MaxFiles > 0 {
+		if err := os.Rename(s.Path, s.Path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.Path); err != nil {
+		return err
+	}
+
+	var err error
+	s.f, err = os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// Close flushes the underlying file to disk and closes it.
+func (s *JSONLinesSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Sync()
+	if closeErr := s.f.Close(); err == nil {
+		err = closeErr
+	}
+	s.f = nil
+	return err
+}
@@ -0,0 +1,123 @@
+package tvm
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+var syslogHeaderRE = regexp.MustCompile(`^<(\d+)>1 (\S+) (\S+) tvm (\d+) (\S+) (\[.*\]) (.*)$`)
+
+func TestSyslogSinkTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer listener.Close()
+
+	received := make(chan string)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// read octet-counted frames: "LEN SP MSG"
+		r := bufio.NewReader(conn)
+		for {
+			lenStr, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, err := strconv.Atoi(strings.TrimSuffix(lenStr, " "))
+			if err != nil {
+				received <- "bad frame: " + lenStr
+				return
+			}
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			received <- string(buf)
+		}
+	}()
+
+	sink := &SyslogSink{Network: "tcp", Addr: listener.Addr().String(), Hostname: "tvm.example.com"}
+	defer sink.Close()
+
+	ctx := context.Background()
+	err = sink.Send(ctx, AuditEvent{
+		ID:              "event1",
+		Time:            time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC),
+		Type:            AuditCredentialsIssue,
+		Actor:           "alice@example.com",
+		Role:            "arn:aws:iam::123456789012:role/admin",
+		DurationSeconds: 3600,
+		AccessKeyID:     "ASIAEXAMPLE",
+		SourceIP:        "192.0.2.1",
+		UserAgent:       `curl/7.0 "quoted" [bracket]`,
+	})
+	assert.NilError(t, err)
+	err = sink.Send(ctx, AuditEvent{
+		ID:    "event2",
+		Time:  time.Date(2021, 8, 1, 12, 0, 1, 0, time.UTC),
+		Type:  AuditKeySignFailed,
+		Actor: "bob@example.com",
+	})
+	assert.NilError(t, err)
+
+	msg := <-received
+	m := syslogHeaderRE.FindStringSubmatch(msg)
+	assert.Assert(t, m != nil, "cannot parse %q", msg)
+	assert.Check(t, is.Equal("85", m[1])) // authpriv.notice
+	assert.Check(t, is.Equal("2021-08-01T12:00:00.000000Z", m[2]))
+	assert.Check(t, is.Equal("tvm.example.com", m[3]))
+	assert.Check(t, is.Equal("credentials.issue", m[5]))
+	assert.Check(t, is.Contains(m[6], `[tvm@32473 id="event1" type="credentials.issue" actor="alice@example.com"`))
+	assert.Check(t, is.Contains(m[6], ` role="arn:aws:iam::123456789012:role/admin" duration="3600" accessKeyId="ASIAEXAMPLE" srcIp="192.0.2.1"`))
+	assert.Check(t, is.Contains(m[6], ` userAgent="curl/7.0 \"quoted\" [bracket\]"`))
+	assert.Check(t, is.Equal("credentials.issue", m[7]))
+
+	msg = <-received
+	m = syslogHeaderRE.FindStringSubmatch(msg)
+	assert.Assert(t, m != nil, "cannot parse %q", msg)
+	assert.Check(t, is.Equal("84", m[1])) // authpriv.warning
+	assert.Check(t, is.Equal("key.sign_failed", m[5]))
+	assert.Check(t, is.Contains(m[6], `actor="bob@example.com"`))
+}
+
+func TestSyslogSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer conn.Close()
+
+	sink := &SyslogSink{Network: "udp", Addr: conn.LocalAddr().String(), Hostname: "tvm.example.com"}
+	defer sink.Close()
+
+	err = sink.Send(context.Background(), AuditEvent{
+		ID:    "event1",
+		Time:  time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC),
+		Type:  AuditLogin,
+		Actor: "alice@example.com",
+	})
+	assert.NilError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	assert.NilError(t, err)
+
+	// no octet count over UDP
+	m := syslogHeaderRE.FindStringSubmatch(string(buf[:n]))
+	assert.Assert(t, m != nil, "cannot parse %q", string(buf[:n]))
+	assert.Check(t, is.Equal("login", m[5]))
+	assert.Check(t, is.Equal(`[tvm@32473 id="event1" type="login" actor="alice@example.com"]`, m[6]))
+}
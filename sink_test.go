@@ -0,0 +1,99 @@
+package tvm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestJSONLinesSink(t *testing.T) {
+	tempdir, err := os.MkdirTemp("", "")
+	assert.Check(t, err)
+	defer os.RemoveAll(tempdir)
+
+	path := filepath.Join(tempdir, "events.jsonl")
+	sink := &JSONLinesSink{Path: path, MaxBytes: 1000, MaxFiles: 2}
+
+	ctx := context.Background()
+	for i := 0; i < 30; i++ {
+		err := sink.Send(ctx, AuditEvent{ID: fmt.Sprintf("event%02d", i), Type: AuditLogin})
+		assert.Check(t, err)
+	}
+	assert.Check(t, sink.Close())
+
+	var ids []string
+	for _, name := range []string{path + ".2", path + ".1", path} {
+		buf, err := os.ReadFile(name)
+		assert.NilError(t, err)
+		assert.Check(t, len(buf) <= 1000)
+		for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+			var event AuditEvent
+			assert.NilError(t, json.Unmarshal([]byte(line), &event))
+			ids = append(ids, event.ID)
+		}
+	}
+	_, err = os.Stat(path + ".3")
+	assert.Check(t, os.IsNotExist(err))
+
+	// the oldest events have been rotated away, the rest are in order
+	assert.Check(t, len(ids) < 30)
+	assert.Check(t, is.Equal("event29", ids[len(ids)-1]))
+	for i := 1; i < len(ids); i++ {
+		assert.Check(t, ids[i-1] < ids[i])
+	}
+}
+
+type blockingSink struct {
+	release chan struct{}
+	mu      sync.Mutex
+	events  []AuditEvent
+	closed  bool
+}
+
+func (s *blockingSink) Send(ctx context.Context, event AuditEvent) error {
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestAsyncSink(t *testing.T) {
+	inner := &blockingSink{release: make(chan struct{})}
+	sink := NewAsyncSink(inner, 2)
+
+	// The first event is taken by the delivery goroutine (which blocks),
+	// the next two fill the buffer and the rest are dropped. Send must not
+	// block in any case.
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		assert.Check(t, sink.Send(ctx, AuditEvent{ID: fmt.Sprint(i)}))
+	}
+
+	// closing the server delivers the queued events and closes the sink
+	// they were queued for
+	close(inner.release)
+	s := &Server{Sinks: []EventSink{sink}}
+	assert.Check(t, s.Close())
+	assert.Check(t, len(inner.events) >= 2 && len(inner.events) <= 3, "got %d events", len(inner.events))
+	assert.Check(t, is.Equal("0", inner.events[0].ID))
+	assert.Check(t, inner.closed)
+
+	// events sent after closing are dropped
+	n := len(inner.events)
+	assert.Check(t, sink.Send(ctx, AuditEvent{ID: "late"}))
+	assert.Check(t, is.Len(inner.events, n))
+}
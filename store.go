@@ -2,9 +2,12 @@ package tvm
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"github.com/tstranex/u2f"
 	"net/url"
+	"time"
 )
 
 type Session struct {
@@ -14,13 +17,121 @@ type Session struct {
 	U2F bool
 	OAuth2State string
 	U2FChallenge *u2f.Challenge
+
+	// BreakGlass means that the user named themselves, rather than being
+	// identified by the identity provider, to get break-glass access while
+	// it is unavailable. Once they have signed with their key, the session
+	// is good only for break-glass access.
+	BreakGlass bool
+
+	// Expires is when the session stops being valid. The zero value means
+	// that the session does not expire.
+	Expires time.Time
+
+	// Version is incremented by each call to Store.UpdateSession.
+	Version int64
+}
+
+func (s Session) expired() bool {
+	return !s.Expires.IsZero() && time.Now().After(s.Expires)
 }
 
 type User struct {
+	// ID is SubjectUserID(Issuer, Subject) for users who have logged in.
+	// Users created ahead of their first login, by an invite, SCIM or a
+	// version of TVM that keyed users by email, have their email address as
+	// their ID until that login binds them to an identity.
 	ID string
-	Roles []string
+	Roles []RoleGrant
 	U2FDevices []U2FDevice
 	Admin bool
+
+	// Issuer and Subject are the iss and sub claims of the ID token that
+	// identifies the user. They are empty until the user first logs in.
+	Issuer  string
+	Subject string
+
+	// Email is the user's email address as of their last login. Unlike ID,
+	// it may change, and may later belong to someone else.
+	Email string
+
+	// ExternalID is the identifier that a provisioning client, such as an
+	// identity provider using SCIM, knows the user by.
+	ExternalID string
+
+	// Status says whether the user may use TVM. StatusReason and StatusTime
+	// say why and when it last changed.
+	Status       UserStatus
+	StatusReason string
+	StatusTime   time.Time
+
+	// ApproverFor lists the roles for which this user may approve other
+	// users' access requests.
+	ApproverFor []string
+
+	// BreakGlass means that the user may get Config.BreakGlassRole in an
+	// emergency without holding the role or getting approval.
+	BreakGlass bool
+
+	// EnrollmentCode is the hex SHA-256 of a one-time code that activates
+	// the user when they log in with it, and EnrollmentCodeExpires is when
+	// it stops working. See Bootstrap.
+	EnrollmentCode        string
+	EnrollmentCodeExpires time.Time
+
+	// Version is incremented by each call to Store.UpdateUser.
+	Version int64
+}
+
+type UserStatus string
+
+const (
+	UserActive UserStatus = ""
+
+	// UserDisabled means that the user is no longer in the directory, or
+	// is suspended there.
+	UserDisabled UserStatus = "disabled"
+
+	// UserPending means that the user has logged in but an admin has not
+	// yet approved them.
+	UserPending UserStatus = "pending"
+
+	// UserRejected means that an admin refused the user's enrollment.
+	UserRejected UserStatus = "rejected"
+
+	// UserSuspended means that an admin has blocked the user for now, for
+	// example during an investigation. Their roles and keys are kept.
+	UserSuspended UserStatus = "suspended"
+)
+
+// PrimaryEmail returns the user's email address. Users stored before TVM
+// recorded email separately have it only as their ID.
+func (u User) PrimaryEmail() string {
+	if u.Email == "" && u.Subject == "" {
+		return u.ID
+	}
+	return u.Email
+}
+
+// Bound returns true if the user has logged in and is keyed by their
+// identity rather than their email address.
+func (u User) Bound() bool {
+	return u.Subject != ""
+}
+
+// Active returns true if the user may use TVM.
+func (u User) Active() bool {
+	return u.Status == UserActive
+}
+
+// IsApproverFor returns true if the user may approve requests for role.
+func (u User) IsApproverFor(role string) bool {
+	for _, r := range u.ApproverFor {
+		if r == role {
+			return true
+		}
+	}
+	return false
 }
 
 func (u User) U2FRegistrations() []u2f.Registration {
@@ -36,14 +147,86 @@ type U2FDevice struct {
 	Counter uint32
 }
 
+// ID returns a short identifier for the device, derived from its key
+// handle.
+func (d U2FDevice) ID() string {
+	sum := sha256.Sum256(d.Registration.KeyHandle)
+	return hex.EncodeToString(sum[:8])
+}
+
 type Store interface {
 	GetSession(ctx context.Context, id string) (*Session, error)
 	PutSession(ctx context.Context, session Session) (error)
 	DeleteSession(ctx context.Context, id string) (error)
+
+	// UpdateSession reads the session, calls fn to modify it and writes it
+	// back, all without interference from concurrent updates. fn may be
+	// called more than once. If fn returns an error, nothing is written and
+	// the error is returned. If the session does not exist, UpdateSession
+	// returns ErrNotFound.
+	UpdateSession(ctx context.Context, id string, fn func(session *Session) error) error
+
+	// ListSessions returns every session that has not expired.
+	ListSessions(ctx context.Context) ([]Session, error)
+
 	GetUser(ctx context.Context, id string) (*User, error)
 	PutUser(ctx context.Context, user User) error
 	DeleteUser(ctx context.Context, id string) (error)
+
+	// UpdateUser reads the user, calls fn to modify it and writes it back,
+	// all without interference from concurrent updates. fn may be called
+	// more than once. If fn returns an error, nothing is written and the
+	// error is returned. If the user does not exist, UpdateUser returns
+	// ErrNotFound.
+	UpdateUser(ctx context.Context, id string, fn func(user *User) error) error
+
+	// RenameUser reads the user with oldID, calls fn to modify it and
+	// stores it as newID, removing oldID, as a single change: the user is
+	// never stored under both IDs or neither. A user already stored as
+	// newID is replaced. fn and errors behave as for UpdateUser.
+	RenameUser(ctx context.Context, oldID, newID string, fn func(user *User) error) error
+
 	ListUsers(ctx context.Context) ([]User, error)
+
+	GetGroup(ctx context.Context, id string) (*Group, error)
+	PutGroup(ctx context.Context, group Group) error
+	DeleteGroup(ctx context.Context, id string) error
+
+	// UpdateGroup reads the group, calls fn to modify it and writes it back
+	// in the same way as UpdateUser.
+	UpdateGroup(ctx context.Context, id string, fn func(group *Group) error) error
+
+	ListGroups(ctx context.Context) ([]Group, error)
+
+	GetAccessRequest(ctx context.Context, id string) (*AccessRequest, error)
+	PutAccessRequest(ctx context.Context, request AccessRequest) error
+
+	// UpdateAccessRequest reads the request, calls fn to modify it and
+	// writes it back in the same way as UpdateUser.
+	UpdateAccessRequest(ctx context.Context, id string, fn func(request *AccessRequest) error) error
+
+	ListAccessRequests(ctx context.Context) ([]AccessRequest, error)
+
+	GetReviewItem(ctx context.Context, id string) (*ReviewItem, error)
+	PutReviewItem(ctx context.Context, item ReviewItem) error
+
+	// UpdateReviewItem reads the review item, calls fn to modify it and
+	// writes it back in the same way as UpdateUser.
+	UpdateReviewItem(ctx context.Context, id string, fn func(item *ReviewItem) error) error
+
+	ListReviewItems(ctx context.Context) ([]ReviewItem, error)
+
+	GetAPIToken(ctx context.Context, id string) (*APIToken, error)
+	PutAPIToken(ctx context.Context, token APIToken) error
+	DeleteAPIToken(ctx context.Context, id string) error
+	ListAPITokens(ctx context.Context) ([]APIToken, error)
+
+	// PutAuditEvent appends event to the audit log.
+	PutAuditEvent(ctx context.Context, event AuditEvent) error
+
+	// ListAuditEvents returns the audit events that match filter, newest
+	// first.
+	ListAuditEvents(ctx context.Context, filter AuditFilter) ([]AuditEvent, error)
 }
 
 var ErrNotFound = errors.New("not found")
@@ -3,6 +3,8 @@ package tvm
 import (
 	"cloud.google.com/go/firestore"
 	"context"
+	"encoding/json"
+	"google.golang.org/api/iterator"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 )
@@ -13,11 +15,17 @@ type Firestore struct {
 
 var _ Store = Firestore{}  // Firestore must implement Store
 
+// NewFirestore returns a Store that keeps its data in the Firestore database
+// client refers to.
+func NewFirestore(client *firestore.Client) Firestore {
+	return Firestore{fs: client}
+}
+
 
 func (s Firestore) GetSession(ctx context.Context, id string) (*Session, error) {
 	dsnap, err := s.fs.Collection("sessions").Doc(id).Get(ctx)
 	if grpc.Code(err) == codes.NotFound {
-		return nil, nil
+		return nil, ErrNotFound
 	} else if err != nil {
 		return nil, err
 	}
@@ -25,28 +33,79 @@ func (s Firestore) GetSession(ctx context.Context, id string) (*Session, error)
 	if err := dsnap.DataTo(&rv); err != nil {
 		return nil, err
 	}
+	if rv.expired() {
+		return nil, ErrNotFound
+	}
 	return &rv, nil
 }
 
+func (s Firestore) ListSessions(ctx context.Context) ([]Session, error) {
+	docs, err := s.fs.Collection("sessions").Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var sessions []Session
+	for _, dsnap := range docs {
+		var session Session
+		if err := dsnap.DataTo(&session); err != nil {
+			return nil, err
+		}
+		if session.expired() {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
 func (s Firestore) PutSession(ctx context.Context, session Session) (error) {
 	_, err := s.fs.Collection("sessions").Doc(session.ID).Set(ctx, &session)
 	return err
 }
 
 func (s Firestore) DeleteSession(ctx context.Context, id string) (error) {
-	_, err := s.fs.Collection("sessions").Doc(id).Delete(ctx)
+	_, err := s.fs.Collection("sessions").Doc(id).Delete(ctx, firestore.Exists)
+	if grpc.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
 	return err
 }
 
+func (s Firestore) UpdateSession(ctx context.Context, id string, fn func(session *Session) error) error {
+	ref := s.fs.Collection("sessions").Doc(id)
+	return s.fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		dsnap, err := tx.Get(ref)
+		if grpc.Code(err) == codes.NotFound {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		var session Session
+		if err := dsnap.DataTo(&session); err != nil {
+			return err
+		}
+		if session.expired() {
+			return ErrNotFound
+		}
+		version := session.Version
+		if err := fn(&session); err != nil {
+			return err
+		}
+		session.ID = id
+		session.Version = version + 1
+		return tx.Set(ref, &session)
+	})
+}
+
 func (s Firestore) GetUser(ctx context.Context, id string) (*User, error) {
 	dsnap, err := s.fs.Collection("users").Doc(id).Get(ctx)
 	if grpc.Code(err) == codes.NotFound {
-		return nil, nil
+		return nil, ErrNotFound
 	} else if err != nil {
 		return nil, err
 	}
 	var rv User
-	if err := dsnap.DataTo(&rv); err != nil {
+	if err := dataToUser(dsnap, &rv); err != nil {
 		return nil, err
 	}
 	return &rv, nil
@@ -58,10 +117,63 @@ func (s Firestore) PutUser(ctx context.Context, user User) error {
 }
 
 func (s Firestore) DeleteUser(ctx context.Context, id string) (error) {
-	_, err := s.fs.Collection("users").Doc(id).Delete(ctx)
+	_, err := s.fs.Collection("users").Doc(id).Delete(ctx, firestore.Exists)
+	if grpc.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
 	return err
 }
 
+func (s Firestore) UpdateUser(ctx context.Context, id string, fn func(user *User) error) error {
+	ref := s.fs.Collection("users").Doc(id)
+	return s.fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		dsnap, err := tx.Get(ref)
+		if grpc.Code(err) == codes.NotFound {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		var user User
+		if err := dataToUser(dsnap, &user); err != nil {
+			return err
+		}
+		version := user.Version
+		if err := fn(&user); err != nil {
+			return err
+		}
+		user.ID = id
+		user.Version = version + 1
+		return tx.Set(ref, &user)
+	})
+}
+
+func (s Firestore) RenameUser(ctx context.Context, oldID, newID string, fn func(user *User) error) error {
+	oldRef := s.fs.Collection("users").Doc(oldID)
+	newRef := s.fs.Collection("users").Doc(newID)
+	return s.fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		dsnap, err := tx.Get(oldRef)
+		if grpc.Code(err) == codes.NotFound {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		var user User
+		if err := dataToUser(dsnap, &user); err != nil {
+			return err
+		}
+		version := user.Version
+		if err := fn(&user); err != nil {
+			return err
+		}
+		user.ID = newID
+		user.Version = version + 1
+		if err := tx.Set(newRef, &user); err != nil {
+			return err
+		}
+		return tx.Delete(oldRef)
+	})
+}
+
 func (s Firestore) ListUsers(ctx context.Context) ([]User, error) {
 	docs, err := s.fs.Collection("users").Documents(ctx).GetAll()
 	if err != nil {
@@ -71,7 +183,7 @@ func (s Firestore) ListUsers(ctx context.Context) ([]User, error) {
 	var users []User
 	for _, dsnap := range docs {
 		var user User
-		if err := dsnap.DataTo(&user); err != nil {
+		if err := dataToUser(dsnap, &user); err != nil {
 			return nil, err
 		}
 		users = append(users, user)
@@ -79,3 +191,276 @@ func (s Firestore) ListUsers(ctx context.Context) ([]User, error) {
 
 	return users, nil
 }
+
+func (s Firestore) PutAuditEvent(ctx context.Context, event AuditEvent) error {
+	_, err := s.fs.Collection("audit").Doc(event.ID).Create(ctx, event)
+	return err
+}
+
+func (s Firestore) ListAuditEvents(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	query := s.fs.Collection("audit").OrderBy("Time", firestore.Desc)
+	if !filter.Since.IsZero() {
+		query = query.Where("Time", ">=", filter.Since)
+	}
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	var events []AuditEvent
+	for {
+		dsnap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var event AuditEvent
+		if err := dsnap.DataTo(&event); err != nil {
+			return nil, err
+		}
+		if !filter.Match(event) {
+			continue
+		}
+		events = append(events, event)
+		if filter.Limit > 0 && len(events) >= filter.Limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+// updateDoc reads the document at ref into out, calls fn and writes out
+// back in a transaction.
+func (s Firestore) updateDoc(ctx context.Context, ref *firestore.DocumentRef, out interface{}, fn func() error) error {
+	return s.fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		dsnap, err := tx.Get(ref)
+		if grpc.Code(err) == codes.NotFound {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if err := dsnap.DataTo(out); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		return tx.Set(ref, out)
+	})
+}
+
+func (s Firestore) GetAccessRequest(ctx context.Context, id string) (*AccessRequest, error) {
+	dsnap, err := s.fs.Collection("requests").Doc(id).Get(ctx)
+	if grpc.Code(err) == codes.NotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var rv AccessRequest
+	if err := dsnap.DataTo(&rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+func (s Firestore) PutAccessRequest(ctx context.Context, request AccessRequest) error {
+	_, err := s.fs.Collection("requests").Doc(request.ID).Set(ctx, request)
+	return err
+}
+
+func (s Firestore) UpdateAccessRequest(ctx context.Context, id string, fn func(request *AccessRequest) error) error {
+	var request AccessRequest
+	return s.updateDoc(ctx, s.fs.Collection("requests").Doc(id), &request, func() error {
+		version := request.Version
+		if err := fn(&request); err != nil {
+			return err
+		}
+		request.ID = id
+		request.Version = version + 1
+		return nil
+	})
+}
+
+func (s Firestore) ListAccessRequests(ctx context.Context) ([]AccessRequest, error) {
+	docs, err := s.fs.Collection("requests").Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var requests []AccessRequest
+	for _, dsnap := range docs {
+		var request AccessRequest
+		if err := dsnap.DataTo(&request); err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, nil
+}
+
+func (s Firestore) GetGroup(ctx context.Context, id string) (*Group, error) {
+	dsnap, err := s.fs.Collection("groups").Doc(id).Get(ctx)
+	if grpc.Code(err) == codes.NotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var rv Group
+	if err := dsnap.DataTo(&rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+func (s Firestore) PutGroup(ctx context.Context, group Group) error {
+	_, err := s.fs.Collection("groups").Doc(group.ID).Set(ctx, group)
+	return err
+}
+
+func (s Firestore) DeleteGroup(ctx context.Context, id string) error {
+	_, err := s.fs.Collection("groups").Doc(id).Delete(ctx, firestore.Exists)
+	if grpc.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s Firestore) UpdateGroup(ctx context.Context, id string, fn func(group *Group) error) error {
+	var group Group
+	return s.updateDoc(ctx, s.fs.Collection("groups").Doc(id), &group, func() error {
+		version := group.Version
+		if err := fn(&group); err != nil {
+			return err
+		}
+		group.ID = id
+		group.Version = version + 1
+		return nil
+	})
+}
+
+func (s Firestore) ListGroups(ctx context.Context) ([]Group, error) {
+	docs, err := s.fs.Collection("groups").Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var groups []Group
+	for _, dsnap := range docs {
+		var group Group
+		if err := dsnap.DataTo(&group); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func (s Firestore) GetReviewItem(ctx context.Context, id string) (*ReviewItem, error) {
+	dsnap, err := s.fs.Collection("reviews").Doc(id).Get(ctx)
+	if grpc.Code(err) == codes.NotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var rv ReviewItem
+	if err := dsnap.DataTo(&rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+func (s Firestore) PutReviewItem(ctx context.Context, item ReviewItem) error {
+	_, err := s.fs.Collection("reviews").Doc(item.ID).Set(ctx, item)
+	return err
+}
+
+func (s Firestore) UpdateReviewItem(ctx context.Context, id string, fn func(item *ReviewItem) error) error {
+	var item ReviewItem
+	return s.updateDoc(ctx, s.fs.Collection("reviews").Doc(id), &item, func() error {
+		version := item.Version
+		if err := fn(&item); err != nil {
+			return err
+		}
+		item.ID = id
+		item.Version = version + 1
+		return nil
+	})
+}
+
+func (s Firestore) ListReviewItems(ctx context.Context) ([]ReviewItem, error) {
+	docs, err := s.fs.Collection("reviews").Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var items []ReviewItem
+	for _, dsnap := range docs {
+		var item ReviewItem
+		if err := dsnap.DataTo(&item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// dataToUser decodes a user document. Documents written before role grants
+// could be time-bounded hold each grant as a bare string, which DataTo
+// cannot decode, so for those we go via JSON and RoleGrant.UnmarshalJSON.
+func dataToUser(dsnap *firestore.DocumentSnapshot, user *User) error {
+	err := dsnap.DataTo(user)
+	if err == nil {
+		return nil
+	}
+	if _, ok := dsnap.Data()["Roles"].([]interface{}); !ok {
+		return err
+	}
+	buf, jsonErr := json.Marshal(dsnap.Data())
+	if jsonErr != nil {
+		return err
+	}
+	*user = User{}
+	if jsonErr := json.Unmarshal(buf, user); jsonErr != nil {
+		return err
+	}
+	return nil
+}
+
+func (s Firestore) GetAPIToken(ctx context.Context, id string) (*APIToken, error) {
+	dsnap, err := s.fs.Collection("apitokens").Doc(id).Get(ctx)
+	if grpc.Code(err) == codes.NotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var rv APIToken
+	if err := dsnap.DataTo(&rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+func (s Firestore) PutAPIToken(ctx context.Context, token APIToken) error {
+	_, err := s.fs.Collection("apitokens").Doc(token.ID).Set(ctx, token)
+	return err
+}
+
+func (s Firestore) DeleteAPIToken(ctx context.Context, id string) error {
+	_, err := s.fs.Collection("apitokens").Doc(id).Delete(ctx, firestore.Exists)
+	if grpc.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s Firestore) ListAPITokens(ctx context.Context) ([]APIToken, error) {
+	docs, err := s.fs.Collection("apitokens").Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var tokens []APIToken
+	for _, dsnap := range docs {
+		var token APIToken
+		if err := dsnap.DataTo(&token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
@@ -0,0 +1,34 @@
+package tvm_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"gotest.tools/assert"
+
+	"github.com/nametaginc/tvm"
+	"github.com/nametaginc/tvm/storetest"
+)
+
+// TestFirestore runs against the Firestore emulator, e.g.:
+//
+//	gcloud beta emulators firestore start --host-port=localhost:8080
+//	FIRESTORE_EMULATOR_HOST=localhost:8080 go test ./...
+func TestFirestore(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+
+	// The emulator keeps each project separate, so a fresh project ID gives
+	// us an empty database.
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, fmt.Sprintf("tvm-test-%d", time.Now().UnixNano()))
+	assert.NilError(t, err)
+	defer client.Close()
+
+	storetest.Run(t, tvm.NewFirestore(client))
+}
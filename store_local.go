@@ -1,8 +1,11 @@
 package tvm
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -16,8 +19,14 @@ type LocalStore struct {
 
 var _ Store = LocalStore{}  // LocalStore must implement Store
 
+// errBadLocalID is returned when an ID cannot be used as a file name.
+var errBadLocalID = errors.New("invalid ID")
+
 func (s LocalStore) GetSession(ctx context.Context, id string) (*Session, error) {
-	path := filepath.Join(s.Path, "sessions", id+".json")
+	path, err := s.file("sessions", id)
+	if err != nil {
+		return nil, err
+	}
 	buf, err := ioutil.ReadFile(path)
 	if os.IsNotExist(err) {
 		return nil, ErrNotFound
@@ -28,32 +37,103 @@ func (s LocalStore) GetSession(ctx context.Context, id string) (*Session, error)
 	if err := json.Unmarshal(buf, &rv); err != nil {
 		return nil, err
 	}
+	if rv.expired() {
+		return nil, ErrNotFound
+	}
 	return &rv, nil
 }
 
+func (s LocalStore) ListSessions(ctx context.Context) ([]Session, error) {
+	ids, err := s.listIDs("sessions")
+	if err != nil {
+		return nil, err
+	}
+	var sessions []Session
+	for _, id := range ids {
+		var session Session
+		if err := s.readJSON("sessions", id, &session); err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if session.expired() {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
 func (s LocalStore) PutSession(ctx context.Context, session Session) (error) {
-	path := filepath.Join(s.Path, "sessions", session.ID+".json")
+	path, err := s.file("sessions", session.ID)
+	if err != nil {
+		return err
+	}
 	buf, err := json.Marshal(session)
 	if err != nil {
 		return err
 	}
 	log.Printf("PutSession: %s", string(buf))
 
-	os.MkdirAll(filepath.Dir(path), 0700)
-	return ioutil.WriteFile(path, buf, 0600)
+	unlock, err := s.lock(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeFileAtomic(path, buf)
 }
 
 func (s LocalStore) DeleteSession(ctx context.Context, id string) (error) {
-	path := filepath.Join(s.Path, "sessions", id+".json")
-	err := os.Remove(path)
+	path, err := s.file("sessions", id)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lock(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = os.Remove(path)
 	if os.IsNotExist(err) {
 		return ErrNotFound
 	}
 	return err
 }
 
+func (s LocalStore) UpdateSession(ctx context.Context, id string, fn func(session *Session) error) error {
+	path, err := s.file("sessions", id)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lock(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	session, err := s.GetSession(ctx, id)
+	if err != nil {
+		return err
+	}
+	version := session.Version
+	if err := fn(session); err != nil {
+		return err
+	}
+	session.ID = id
+	session.Version = version + 1
+
+	buf, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf)
+}
+
 func (s LocalStore) GetUser(ctx context.Context, id string) (*User, error) {
-	path := filepath.Join(s.Path, "users", id+".json")
+	path, err := s.file("users", id)
+	if err != nil {
+		return nil, err
+	}
 	buf, err := ioutil.ReadFile(path)
 	if os.IsNotExist(err) {
 		return nil, ErrNotFound
@@ -66,24 +146,107 @@ func (s LocalStore) GetUser(ctx context.Context, id string) (*User, error) {
 }
 
 func (s LocalStore) PutUser(ctx context.Context, user User) error {
-	path := filepath.Join(s.Path, "users", user.ID+".json")
+	path, err := s.file("users", user.ID)
+	if err != nil {
+		return err
+	}
 	buf, err := json.Marshal(user)
 	if err != nil {
 		return err
 	}
-	os.MkdirAll(filepath.Dir(path), 0700)
-	return ioutil.WriteFile(path, buf, 0600)
+	unlock, err := s.lock(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeFileAtomic(path, buf)
 }
 
 func (s LocalStore) DeleteUser(ctx context.Context, id string) error {
-	path := filepath.Join(s.Path, "users", id+".json")
-	err := os.Remove(path)
+	path, err := s.file("users", id)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lock(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = os.Remove(path)
 	if os.IsNotExist(err) {
 		return ErrNotFound
 	}
 	return err
 }
 
+func (s LocalStore) UpdateUser(ctx context.Context, id string, fn func(user *User) error) error {
+	path, err := s.file("users", id)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lock(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	user, err := s.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	version := user.Version
+	if err := fn(user); err != nil {
+		return err
+	}
+	user.ID = id
+	user.Version = version + 1
+
+	buf, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf)
+}
+
+// RenameUser writes the new file before removing the old one, holding the
+// lock throughout. A crash between the two leaves both, which a retry
+// resolves.
+func (s LocalStore) RenameUser(ctx context.Context, oldID, newID string, fn func(user *User) error) error {
+	oldPath, err := s.file("users", oldID)
+	if err != nil {
+		return err
+	}
+	newPath, err := s.file("users", newID)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lock(filepath.Dir(oldPath))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	user, err := s.GetUser(ctx, oldID)
+	if err != nil {
+		return err
+	}
+	version := user.Version
+	if err := fn(user); err != nil {
+		return err
+	}
+	user.ID = newID
+	user.Version = version + 1
+
+	buf, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(newPath, buf); err != nil {
+		return err
+	}
+	return os.Remove(oldPath)
+}
+
 func (s LocalStore) ListUsers(ctx context.Context) ([]User, error) {
 	var users []User
 	files, err := os.ReadDir(filepath.Join(s.Path, "users"))
@@ -104,3 +267,371 @@ func (s LocalStore) ListUsers(ctx context.Context) ([]User, error) {
 	}
 	return users, nil
 }
+
+// lock takes an exclusive lock on dir, which serializes writers across
+// processes sharing the same data directory. The returned function releases
+// the lock.
+func (s LocalStore) lock(dir string) (func(), error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// writeFileAtomic writes buf to path such that readers see either the old
+// or the new contents, never a partial write.
+func writeFileAtomic(path string, buf []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s LocalStore) PutAuditEvent(ctx context.Context, event AuditEvent) error {
+	path := filepath.Join(s.Path, "audit", "events.jsonl")
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lock(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s LocalStore) ListAuditEvents(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	path := filepath.Join(s.Path, "audit", "events.jsonl")
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(buf), []byte("\n"))
+	var events []AuditEvent
+	for i := len(lines) - 1; i >= 0; i-- {
+		if len(lines[i]) == 0 {
+			continue
+		}
+		var event AuditEvent
+		if err := json.Unmarshal(lines[i], &event); err != nil {
+			return nil, err
+		}
+		if !filter.Match(event) {
+			continue
+		}
+		events = append(events, event)
+		if filter.Limit > 0 && len(events) >= filter.Limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+// file returns the path of the file holding the object of the given kind
+// and id. It refuses IDs that would name a file outside the kind's
+// directory.
+func (s LocalStore) file(kind, id string) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`+"\x00") {
+		return "", fmt.Errorf("%w: %q", errBadLocalID, id)
+	}
+	dir := filepath.Join(s.Path, kind)
+	path := filepath.Join(dir, id+".json")
+	if filepath.Dir(path) != dir {
+		return "", fmt.Errorf("%w: %q", errBadLocalID, id)
+	}
+	return path, nil
+}
+
+// readJSON reads the object of the given kind and id into out.
+func (s LocalStore) readJSON(kind, id string, out interface{}) error {
+	path, err := s.file(kind, id)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, out)
+}
+
+// writeJSON stores v as the object of the given kind and id.
+func (s LocalStore) writeJSON(kind, id string, v interface{}) error {
+	path, err := s.file(kind, id)
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lock(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeFileAtomic(path, buf)
+}
+
+// updateJSON reads the object of the given kind and id into out, calls fn
+// and writes out back, holding the lock throughout.
+func (s LocalStore) updateJSON(kind, id string, out interface{}, fn func() error) error {
+	path, err := s.file(kind, id)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lock(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.readJSON(kind, id, out); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf)
+}
+
+// deleteJSON removes the object of the given kind and id.
+func (s LocalStore) deleteJSON(kind, id string) error {
+	path, err := s.file(kind, id)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lock(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// listIDs returns the IDs of all the objects of the given kind.
+func (s LocalStore) listIDs(kind string) ([]string, error) {
+	files, err := os.ReadDir(filepath.Join(s.Path, kind))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json") && !strings.HasPrefix(file.Name(), ".") {
+			ids = append(ids, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	return ids, nil
+}
+
+func (s LocalStore) GetAccessRequest(ctx context.Context, id string) (*AccessRequest, error) {
+	var rv AccessRequest
+	if err := s.readJSON("requests", id, &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+func (s LocalStore) PutAccessRequest(ctx context.Context, request AccessRequest) error {
+	return s.writeJSON("requests", request.ID, request)
+}
+
+func (s LocalStore) UpdateAccessRequest(ctx context.Context, id string, fn func(request *AccessRequest) error) error {
+	var request AccessRequest
+	return s.updateJSON("requests", id, &request, func() error {
+		version := request.Version
+		if err := fn(&request); err != nil {
+			return err
+		}
+		request.ID = id
+		request.Version = version + 1
+		return nil
+	})
+}
+
+func (s LocalStore) ListAccessRequests(ctx context.Context) ([]AccessRequest, error) {
+	ids, err := s.listIDs("requests")
+	if err != nil {
+		return nil, err
+	}
+	var requests []AccessRequest
+	for _, id := range ids {
+		request, err := s.GetAccessRequest(ctx, id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		requests = append(requests, *request)
+	}
+	return requests, nil
+}
+
+func (s LocalStore) GetReviewItem(ctx context.Context, id string) (*ReviewItem, error) {
+	var rv ReviewItem
+	if err := s.readJSON("reviews", id, &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+func (s LocalStore) PutReviewItem(ctx context.Context, item ReviewItem) error {
+	return s.writeJSON("reviews", item.ID, item)
+}
+
+func (s LocalStore) UpdateReviewItem(ctx context.Context, id string, fn func(item *ReviewItem) error) error {
+	var item ReviewItem
+	return s.updateJSON("reviews", id, &item, func() error {
+		version := item.Version
+		if err := fn(&item); err != nil {
+			return err
+		}
+		item.ID = id
+		item.Version = version + 1
+		return nil
+	})
+}
+
+func (s LocalStore) ListReviewItems(ctx context.Context) ([]ReviewItem, error) {
+	ids, err := s.listIDs("reviews")
+	if err != nil {
+		return nil, err
+	}
+	var items []ReviewItem
+	for _, id := range ids {
+		item, err := s.GetReviewItem(ctx, id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		items = append(items, *item)
+	}
+	return items, nil
+}
+
+func (s LocalStore) GetGroup(ctx context.Context, id string) (*Group, error) {
+	var rv Group
+	if err := s.readJSON("groups", id, &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+func (s LocalStore) PutGroup(ctx context.Context, group Group) error {
+	return s.writeJSON("groups", group.ID, group)
+}
+
+func (s LocalStore) DeleteGroup(ctx context.Context, id string) error {
+	return s.deleteJSON("groups", id)
+}
+
+func (s LocalStore) UpdateGroup(ctx context.Context, id string, fn func(group *Group) error) error {
+	var group Group
+	return s.updateJSON("groups", id, &group, func() error {
+		version := group.Version
+		if err := fn(&group); err != nil {
+			return err
+		}
+		group.ID = id
+		group.Version = version + 1
+		return nil
+	})
+}
+
+func (s LocalStore) ListGroups(ctx context.Context) ([]Group, error) {
+	ids, err := s.listIDs("groups")
+	if err != nil {
+		return nil, err
+	}
+	var groups []Group
+	for _, id := range ids {
+		group, err := s.GetGroup(ctx, id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		groups = append(groups, *group)
+	}
+	return groups, nil
+}
+
+func (s LocalStore) GetAPIToken(ctx context.Context, id string) (*APIToken, error) {
+	var rv APIToken
+	if err := s.readJSON("apitokens", id, &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+func (s LocalStore) PutAPIToken(ctx context.Context, token APIToken) error {
+	return s.writeJSON("apitokens", token.ID, token)
+}
+
+func (s LocalStore) DeleteAPIToken(ctx context.Context, id string) error {
+	return s.deleteJSON("apitokens", id)
+}
+
+func (s LocalStore) ListAPITokens(ctx context.Context) ([]APIToken, error) {
+	ids, err := s.listIDs("apitokens")
+	if err != nil {
+		return nil, err
+	}
+	var tokens []APIToken
+	for _, id := range ids {
+		token, err := s.GetAPIToken(ctx, id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+	return tokens, nil
+}
@@ -0,0 +1,609 @@
+package tvm
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisStore is a Store backed by Redis. It is suitable for running several
+// servers behind a load balancer.
+//
+// Sessions are stored with a key TTL that matches Session.Expires. Users
+// are stored as JSON, and an index set records the IDs of every user so
+// that ListUsers does not need to scan the keyspace.
+type RedisStore struct {
+	Client redis.UniversalClient
+
+	// Prefix is prepended to every key, which allows several TVM instances
+	// to share one Redis. With Redis Cluster, the prefix should contain a
+	// hash tag such as "{tvm}:" so that all keys land in the same slot.
+	Prefix string
+}
+
+var _ Store = RedisStore{} // RedisStore must implement Store
+
+func (s RedisStore) sessionKey(id string) string {
+	return s.Prefix + "session:" + id
+}
+
+func (s RedisStore) userKey(id string) string {
+	return s.Prefix + "user:" + id
+}
+
+func (s RedisStore) usersKey() string {
+	return s.Prefix + "users"
+}
+
+func (s RedisStore) auditKey() string {
+	return s.Prefix + "audit"
+}
+
+func (s RedisStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	buf, err := s.Client.Get(ctx, s.sessionKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var rv Session
+	if err := json.Unmarshal(buf, &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+// ListSessions scans the keyspace for sessions, since an index would
+// outlive the sessions that expire from it.
+func (s RedisStore) ListSessions(ctx context.Context) ([]Session, error) {
+	var sessions []Session
+	iter := s.Client.Scan(ctx, 0, s.sessionKey("*"), 0).Iterator()
+	for iter.Next(ctx) {
+		buf, err := s.Client.Get(ctx, iter.Val()).Bytes()
+		if err == redis.Nil {
+			continue // expired since the scan
+		} else if err != nil {
+			return nil, err
+		}
+		var session Session
+		if err := json.Unmarshal(buf, &session); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, iter.Err()
+}
+
+func (s RedisStore) PutSession(ctx context.Context, session Session) error {
+	buf, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	var ttl time.Duration
+	if !session.Expires.IsZero() {
+		ttl = time.Until(session.Expires)
+		if ttl <= 0 {
+			return s.Client.Del(ctx, s.sessionKey(session.ID)).Err()
+		}
+	}
+	return s.Client.Set(ctx, s.sessionKey(session.ID), buf, ttl).Err()
+}
+
+func (s RedisStore) DeleteSession(ctx context.Context, id string) error {
+	n, err := s.Client.Del(ctx, s.sessionKey(id)).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s RedisStore) UpdateSession(ctx context.Context, id string, fn func(session *Session) error) error {
+	key := s.sessionKey(id)
+	return s.update(ctx, key, func(tx *redis.Tx) error {
+		buf, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		var session Session
+		if err := json.Unmarshal(buf, &session); err != nil {
+			return err
+		}
+		version := session.Version
+		if err := fn(&session); err != nil {
+			return err
+		}
+		session.ID = id
+		session.Version = version + 1
+		if buf, err = json.Marshal(session); err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SetArgs(ctx, key, buf, redis.SetArgs{KeepTTL: true})
+			return nil
+		})
+		return err
+	})
+}
+
+func (s RedisStore) GetUser(ctx context.Context, id string) (*User, error) {
+	buf, err := s.Client.Get(ctx, s.userKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var rv User
+	if err := json.Unmarshal(buf, &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+func (s RedisStore) PutUser(ctx context.Context, user User) error {
+	buf, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.userKey(user.ID), buf, 0)
+		pipe.SAdd(ctx, s.usersKey(), user.ID)
+		return nil
+	})
+	return err
+}
+
+func (s RedisStore) DeleteUser(ctx context.Context, id string) error {
+	key := s.userKey(id)
+	return s.Client.Watch(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.SRem(ctx, s.usersKey(), id)
+			return nil
+		})
+		return err
+	}, key)
+}
+
+func (s RedisStore) UpdateUser(ctx context.Context, id string, fn func(user *User) error) error {
+	key := s.userKey(id)
+	return s.update(ctx, key, func(tx *redis.Tx) error {
+		buf, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		var user User
+		if err := json.Unmarshal(buf, &user); err != nil {
+			return err
+		}
+		version := user.Version
+		if err := fn(&user); err != nil {
+			return err
+		}
+		user.ID = id
+		user.Version = version + 1
+		if buf, err = json.Marshal(user); err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, buf, 0)
+			return nil
+		})
+		return err
+	})
+}
+
+func (s RedisStore) RenameUser(ctx context.Context, oldID, newID string, fn func(user *User) error) error {
+	key := s.userKey(oldID)
+	return s.update(ctx, key, func(tx *redis.Tx) error {
+		buf, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		var user User
+		if err := json.Unmarshal(buf, &user); err != nil {
+			return err
+		}
+		version := user.Version
+		if err := fn(&user); err != nil {
+			return err
+		}
+		user.ID = newID
+		user.Version = version + 1
+		if buf, err = json.Marshal(user); err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, s.userKey(newID), buf, 0)
+			pipe.SAdd(ctx, s.usersKey(), newID)
+			pipe.Del(ctx, key)
+			pipe.SRem(ctx, s.usersKey(), oldID)
+			return nil
+		})
+		return err
+	})
+}
+
+// update runs fn in a WATCH/MULTI transaction on key, retrying if another
+// client modifies key before the transaction commits.
+func (s RedisStore) update(ctx context.Context, key string, fn func(tx *redis.Tx) error) error {
+	for {
+		err := s.Client.Watch(ctx, fn, key)
+		if err == redis.TxFailedErr && ctx.Err() == nil {
+			continue
+		}
+		return err
+	}
+}
+
+func (s RedisStore) ListUsers(ctx context.Context) ([]User, error) {
+	ids, err := s.Client.SMembers(ctx, s.usersKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.userKey(id)
+	}
+	values, err := s.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	for _, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			continue // deleted since we read the index
+		}
+		var user User
+		if err := json.Unmarshal([]byte(str), &user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (s RedisStore) PutAuditEvent(ctx context.Context, event AuditEvent) error {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.Client.RPush(ctx, s.auditKey(), buf).Err()
+}
+
+func (s RedisStore) ListAuditEvents(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	values, err := s.Client.LRange(ctx, s.auditKey(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var events []AuditEvent
+	for i := len(values) - 1; i >= 0; i-- {
+		var event AuditEvent
+		if err := json.Unmarshal([]byte(values[i]), &event); err != nil {
+			return nil, err
+		}
+		if !filter.Match(event) {
+			continue
+		}
+		events = append(events, event)
+		if filter.Limit > 0 && len(events) >= filter.Limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+// getJSON reads the JSON value at key into out.
+func (s RedisStore) getJSON(ctx context.Context, key string, out interface{}) error {
+	buf, err := s.Client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, out)
+}
+
+// putIndexedJSON stores v as JSON at key and adds id to the set at indexKey.
+func (s RedisStore) putIndexedJSON(ctx context.Context, key, indexKey, id string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, buf, 0)
+		pipe.SAdd(ctx, indexKey, id)
+		return nil
+	})
+	return err
+}
+
+// deleteIndexedJSON removes the value at key and id from the set at
+// indexKey. It returns ErrNotFound if there is no value at key.
+func (s RedisStore) deleteIndexedJSON(ctx context.Context, key, indexKey, id string) error {
+	return s.Client.Watch(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.SRem(ctx, indexKey, id)
+			return nil
+		})
+		return err
+	}, key)
+}
+
+// updateJSON reads the JSON value at key into out, calls fn and writes out
+// back, retrying if key changes in the meantime.
+func (s RedisStore) updateJSON(ctx context.Context, key string, out interface{}, fn func() error) error {
+	return s.update(ctx, key, func(tx *redis.Tx) error {
+		buf, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(buf, out); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		if buf, err = json.Marshal(out); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SetArgs(ctx, key, buf, redis.SetArgs{KeepTTL: true})
+			return nil
+		})
+		return err
+	})
+}
+
+// listIndexedJSON reads the JSON values for each ID in the set at indexKey,
+// calling fn with each.
+func (s RedisStore) listIndexedJSON(ctx context.Context, indexKey string, keyFn func(id string) string, fn func(buf []byte) error) error {
+	ids, err := s.Client.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = keyFn(id)
+	}
+	values, err := s.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			continue // deleted since we read the index
+		}
+		if err := fn([]byte(str)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s RedisStore) requestKey(id string) string {
+	return s.Prefix + "request:" + id
+}
+
+func (s RedisStore) requestsKey() string {
+	return s.Prefix + "requests"
+}
+
+func (s RedisStore) GetAccessRequest(ctx context.Context, id string) (*AccessRequest, error) {
+	var rv AccessRequest
+	if err := s.getJSON(ctx, s.requestKey(id), &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+func (s RedisStore) PutAccessRequest(ctx context.Context, request AccessRequest) error {
+	return s.putIndexedJSON(ctx, s.requestKey(request.ID), s.requestsKey(), request.ID, request)
+}
+
+func (s RedisStore) UpdateAccessRequest(ctx context.Context, id string, fn func(request *AccessRequest) error) error {
+	var request AccessRequest
+	return s.updateJSON(ctx, s.requestKey(id), &request, func() error {
+		version := request.Version
+		if err := fn(&request); err != nil {
+			return err
+		}
+		request.ID = id
+		request.Version = version + 1
+		return nil
+	})
+}
+
+func (s RedisStore) ListAccessRequests(ctx context.Context) ([]AccessRequest, error) {
+	var requests []AccessRequest
+	err := s.listIndexedJSON(ctx, s.requestsKey(), s.requestKey, func(buf []byte) error {
+		var request AccessRequest
+		if err := json.Unmarshal(buf, &request); err != nil {
+			return err
+		}
+		requests = append(requests, request)
+		return nil
+	})
+	return requests, err
+}
+
+func (s RedisStore) reviewKey(id string) string {
+	return s.Prefix + "review:" + id
+}
+
+func (s RedisStore) reviewsKey() string {
+	return s.Prefix + "reviews"
+}
+
+func (s RedisStore) GetReviewItem(ctx context.Context, id string) (*ReviewItem, error) {
+	var rv ReviewItem
+	if err := s.getJSON(ctx, s.reviewKey(id), &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+func (s RedisStore) PutReviewItem(ctx context.Context, item ReviewItem) error {
+	return s.putIndexedJSON(ctx, s.reviewKey(item.ID), s.reviewsKey(), item.ID, item)
+}
+
+func (s RedisStore) UpdateReviewItem(ctx context.Context, id string, fn func(item *ReviewItem) error) error {
+	var item ReviewItem
+	return s.updateJSON(ctx, s.reviewKey(id), &item, func() error {
+		version := item.Version
+		if err := fn(&item); err != nil {
+			return err
+		}
+		item.ID = id
+		item.Version = version + 1
+		return nil
+	})
+}
+
+func (s RedisStore) ListReviewItems(ctx context.Context) ([]ReviewItem, error) {
+	var items []ReviewItem
+	err := s.listIndexedJSON(ctx, s.reviewsKey(), s.reviewKey, func(buf []byte) error {
+		var item ReviewItem
+		if err := json.Unmarshal(buf, &item); err != nil {
+			return err
+		}
+		items = append(items, item)
+		return nil
+	})
+	return items, err
+}
+
+func (s RedisStore) groupKey(id string) string {
+	return s.Prefix + "group:" + id
+}
+
+func (s RedisStore) groupsKey() string {
+	return s.Prefix + "groups"
+}
+
+func (s RedisStore) GetGroup(ctx context.Context, id string) (*Group, error) {
+	var rv Group
+	if err := s.getJSON(ctx, s.groupKey(id), &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+func (s RedisStore) PutGroup(ctx context.Context, group Group) error {
+	return s.putIndexedJSON(ctx, s.groupKey(group.ID), s.groupsKey(), group.ID, group)
+}
+
+func (s RedisStore) DeleteGroup(ctx context.Context, id string) error {
+	return s.deleteIndexedJSON(ctx, s.groupKey(id), s.groupsKey(), id)
+}
+
+func (s RedisStore) UpdateGroup(ctx context.Context, id string, fn func(group *Group) error) error {
+	var group Group
+	return s.updateJSON(ctx, s.groupKey(id), &group, func() error {
+		version := group.Version
+		if err := fn(&group); err != nil {
+			return err
+		}
+		group.ID = id
+		group.Version = version + 1
+		return nil
+	})
+}
+
+func (s RedisStore) ListGroups(ctx context.Context) ([]Group, error) {
+	var groups []Group
+	err := s.listIndexedJSON(ctx, s.groupsKey(), s.groupKey, func(buf []byte) error {
+		var group Group
+		if err := json.Unmarshal(buf, &group); err != nil {
+			return err
+		}
+		groups = append(groups, group)
+		return nil
+	})
+	return groups, err
+}
+
+func (s RedisStore) apiTokenKey(id string) string {
+	return s.Prefix + "apitoken:" + id
+}
+
+func (s RedisStore) apiTokensKey() string {
+	return s.Prefix + "apitokens"
+}
+
+func (s RedisStore) GetAPIToken(ctx context.Context, id string) (*APIToken, error) {
+	var rv APIToken
+	if err := s.getJSON(ctx, s.apiTokenKey(id), &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+func (s RedisStore) PutAPIToken(ctx context.Context, token APIToken) error {
+	return s.putIndexedJSON(ctx, s.apiTokenKey(token.ID), s.apiTokensKey(), token.ID, token)
+}
+
+func (s RedisStore) DeleteAPIToken(ctx context.Context, id string) error {
+	return s.deleteIndexedJSON(ctx, s.apiTokenKey(id), s.apiTokensKey(), id)
+}
+
+func (s RedisStore) ListAPITokens(ctx context.Context) ([]APIToken, error) {
+	var tokens []APIToken
+	err := s.listIndexedJSON(ctx, s.apiTokensKey(), s.apiTokenKey, func(buf []byte) error {
+		var token APIToken
+		if err := json.Unmarshal(buf, &token); err != nil {
+			return err
+		}
+		tokens = append(tokens, token)
+		return nil
+	})
+	return tokens, err
+}
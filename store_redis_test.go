@@ -0,0 +1,50 @@
+package tvm_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	"github.com/nametaginc/tvm"
+	"github.com/nametaginc/tvm/storetest"
+)
+
+func TestRedisStore(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Check(t, err)
+	defer mr.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	store := tvm.RedisStore{Client: client, Prefix: "tvm:"}
+	storetest.Run(t, store)
+
+	t.Run("session ttl", func(t *testing.T) {
+		ctx := context.Background()
+		err := store.PutSession(ctx, tvm.Session{ID: "sessionid", Expires: time.Now().Add(time.Minute)})
+		assert.Check(t, err)
+		assert.Check(t, mr.TTL("tvm:session:sessionid") > 0)
+
+		mr.FastForward(2 * time.Minute)
+		session, err := store.GetSession(ctx, "sessionid")
+		assert.Error(t, err, "not found")
+		assert.Check(t, is.Nil(session))
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		ctx := context.Background()
+		other := tvm.RedisStore{Client: client, Prefix: "other:"}
+		err := other.PutUser(ctx, tvm.User{ID: "otheruser"})
+		assert.Check(t, err)
+
+		users, err := store.ListUsers(ctx)
+		assert.Check(t, err)
+		assert.Check(t, is.Len(users, 0))
+	})
+}
@@ -1,11 +1,16 @@
-package tvm
+package tvm_test
 
 import (
 	"context"
-	"gotest.tools/assert"
-	is "gotest.tools/assert/cmp"
 	"os"
+	"path/filepath"
 	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	"github.com/nametaginc/tvm"
+	"github.com/nametaginc/tvm/storetest"
 )
 
 func TestLocalStore(t *testing.T) {
@@ -13,65 +18,28 @@ func TestLocalStore(t *testing.T) {
 	assert.Check(t, err)
 	defer os.RemoveAll(tempdir)
 
-	store := LocalStore{Path: tempdir}
-	testStore(t, store)
+	store := tvm.LocalStore{Path: tempdir}
+	storetest.Run(t, store)
 }
 
-func testStore(t *testing.T, store Store) {
+func TestLocalStoreEscape(t *testing.T) {
 	ctx := context.Background()
+	tempdir, err := os.MkdirTemp("", "")
+	assert.Check(t, err)
+	defer os.RemoveAll(tempdir)
 
-	t.Run("session", func(t *testing.T) {
-		session, err := store.GetSession(ctx, "sessionid")
-		assert.Error(t, err, "not found")
-		assert.Check(t, is.Nil(session))
-
-		err = store.PutSession(ctx, Session{ID: "sessionid", UserID: "userid"})
-		assert.Check(t, err)
-
-		session, err = store.GetSession(ctx, "sessionid")
-		assert.Check(t, err)
-		assert.Equal(t, "userid", session.UserID)
-
-		err = store.DeleteSession(ctx, "sessionid")
-		assert.Check(t, err)
-		session, _ = store.GetSession(ctx, "sessionid")
-		assert.Check(t, is.Nil(session))
-
-		err = store.DeleteSession(ctx, "sessionid")
-		assert.Error(t, err, "not found")
-	})
-
-	t.Run("user", func(t *testing.T) {
-		user, err := store.GetUser(ctx, "userid")
-		assert.Error(t, err, "not found")
-		assert.Check(t, is.Nil(user))
-
-		users, err := store.ListUsers(ctx)
-		assert.Check(t, err)
-		assert.Check(t, is.Len(users, 0))
-
-		err = store.PutUser(ctx, User{ID: "userid", Admin: true})
-		assert.Check(t, err)
-
-		user, err = store.GetUser(ctx, "userid")
-		assert.Check(t, err)
-		assert.Equal(t, true, user.Admin)
-
-		users, err = store.ListUsers(ctx)
-		assert.Check(t, err)
-		assert.Check(t, is.Len(users, 1))
-		assert.Equal(t, "userid", users[0].ID)
-
-		err = store.DeleteUser(ctx, "userid")
-		assert.Check(t, err)
-		user, _ = store.GetUser(ctx, "userid")
-		assert.Check(t, is.Nil(user))
-
-		users, err = store.ListUsers(ctx)
-		assert.Check(t, err)
-		assert.Check(t, is.Len(users, 0))
-
-		err = store.DeleteUser(ctx, "userid")
-		assert.Error(t, err, "not found")
-	})
+	store := tvm.LocalStore{Path: filepath.Join(tempdir, "store")}
+	for _, id := range []string{"../../x", `..\x`, "a/b", ".", ".."} {
+		assert.Check(t, store.PutUser(ctx, tvm.User{ID: id}) != nil, id)
+		assert.Check(t, store.PutSession(ctx, tvm.Session{ID: id}) != nil, id)
+		assert.Check(t, store.PutGroup(ctx, tvm.Group{ID: id}) != nil, id)
+		_, err := store.GetUser(ctx, id)
+		assert.Check(t, err != nil, id)
+		assert.Check(t, store.DeleteUser(ctx, id) != nil, id)
+	}
+	files, err := os.ReadDir(tempdir)
+	assert.NilError(t, err)
+	for _, file := range files {
+		assert.Check(t, is.Equal("store", file.Name()))
+	}
 }
@@ -0,0 +1,488 @@
+// Package storetest provides a conformance test suite for implementations of
+// tvm.Store.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	"github.com/nametaginc/tvm"
+)
+
+// Run tests that store behaves as described by the tvm.Store interface. The
+// store must be empty when Run is called. If the tests pass, it is left
+// without users or sessions, but records that the interface provides no way
+// to delete, such as audit events, remain.
+func Run(t *testing.T, store tvm.Store) {
+	ctx := context.Background()
+
+	t.Run("session", func(t *testing.T) {
+		session, err := store.GetSession(ctx, "sessionid")
+		assert.Error(t, err, "not found")
+		assert.Check(t, is.Nil(session))
+
+		err = store.PutSession(ctx, tvm.Session{ID: "sessionid", UserID: "userid"})
+		assert.Check(t, err)
+
+		session, err = store.GetSession(ctx, "sessionid")
+		assert.Check(t, err)
+		assert.Equal(t, "userid", session.UserID)
+
+		err = store.DeleteSession(ctx, "sessionid")
+		assert.Check(t, err)
+		session, _ = store.GetSession(ctx, "sessionid")
+		assert.Check(t, is.Nil(session))
+
+		err = store.DeleteSession(ctx, "sessionid")
+		assert.Error(t, err, "not found")
+	})
+
+	t.Run("user", func(t *testing.T) {
+		user, err := store.GetUser(ctx, "userid")
+		assert.Error(t, err, "not found")
+		assert.Check(t, is.Nil(user))
+
+		users, err := store.ListUsers(ctx)
+		assert.Check(t, err)
+		assert.Check(t, is.Len(users, 0))
+
+		err = store.PutUser(ctx, tvm.User{ID: "userid", Admin: true})
+		assert.Check(t, err)
+
+		user, err = store.GetUser(ctx, "userid")
+		assert.Check(t, err)
+		assert.Equal(t, true, user.Admin)
+
+		users, err = store.ListUsers(ctx)
+		assert.Check(t, err)
+		assert.Check(t, is.Len(users, 1))
+		assert.Equal(t, "userid", users[0].ID)
+
+		err = store.DeleteUser(ctx, "userid")
+		assert.Check(t, err)
+		user, _ = store.GetUser(ctx, "userid")
+		assert.Check(t, is.Nil(user))
+
+		users, err = store.ListUsers(ctx)
+		assert.Check(t, err)
+		assert.Check(t, is.Len(users, 0))
+
+		err = store.DeleteUser(ctx, "userid")
+		assert.Error(t, err, "not found")
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := store.GetSession(ctx, "nosuchsession")
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "GetSession: %v", err)
+		err = store.DeleteSession(ctx, "nosuchsession")
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "DeleteSession: %v", err)
+		err = store.UpdateSession(ctx, "nosuchsession", func(session *tvm.Session) error {
+			t.Error("UpdateSession called fn for a missing session")
+			return nil
+		})
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "UpdateSession: %v", err)
+
+		_, err = store.GetUser(ctx, "nosuchuser")
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "GetUser: %v", err)
+		err = store.DeleteUser(ctx, "nosuchuser")
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "DeleteUser: %v", err)
+		err = store.UpdateUser(ctx, "nosuchuser", func(user *tvm.User) error {
+			t.Error("UpdateUser called fn for a missing user")
+			return nil
+		})
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "UpdateUser: %v", err)
+	})
+
+	t.Run("list users", func(t *testing.T) {
+		const count = 150
+		want := map[string]bool{}
+		for i := 0; i < count; i++ {
+			id := fmt.Sprintf("user%03d", i)
+			want[id] = true
+			err := store.PutUser(ctx, tvm.User{ID: id, Roles: []tvm.RoleGrant{{Role: "role-" + id}}})
+			assert.Check(t, err)
+		}
+
+		users, err := store.ListUsers(ctx)
+		assert.Check(t, err)
+		assert.Check(t, is.Len(users, count))
+		for _, user := range users {
+			assert.Check(t, want[user.ID], "unexpected user %q", user.ID)
+			assert.Check(t, is.DeepEqual([]tvm.RoleGrant{{Role: "role-" + user.ID}}, user.Roles))
+			delete(want, user.ID)
+		}
+		assert.Check(t, is.Len(want, 0))
+
+		for i := 0; i < count; i++ {
+			err := store.DeleteUser(ctx, fmt.Sprintf("user%03d", i))
+			assert.Check(t, err)
+		}
+	})
+
+	t.Run("update user", func(t *testing.T) {
+		err := store.PutUser(ctx, tvm.User{ID: "userid"})
+		assert.Check(t, err)
+
+		const writers = 10
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := store.UpdateUser(ctx, "userid", func(user *tvm.User) error {
+					user.U2FDevices = append(user.U2FDevices, tvm.U2FDevice{})
+					return nil
+				})
+				assert.Check(t, err)
+			}()
+		}
+		wg.Wait()
+
+		user, err := store.GetUser(ctx, "userid")
+		assert.Check(t, err)
+		assert.Check(t, is.Len(user.U2FDevices, writers))
+		assert.Equal(t, int64(writers), user.Version)
+
+		err = store.UpdateUser(ctx, "userid", func(user *tvm.User) error {
+			user.Admin = true
+			return errors.New("oops")
+		})
+		assert.Error(t, err, "oops")
+		user, err = store.GetUser(ctx, "userid")
+		assert.Check(t, err)
+		assert.Equal(t, false, user.Admin)
+
+		err = store.DeleteUser(ctx, "userid")
+		assert.Check(t, err)
+	})
+
+	t.Run("rename user", func(t *testing.T) {
+		err := store.PutUser(ctx, tvm.User{ID: "oldid", Admin: true})
+		assert.Check(t, err)
+
+		err = store.RenameUser(ctx, "oldid", "newid", func(user *tvm.User) error {
+			user.Subject = "1"
+			return errors.New("oops")
+		})
+		assert.Error(t, err, "oops")
+		_, err = store.GetUser(ctx, "newid")
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "GetUser: %v", err)
+
+		err = store.RenameUser(ctx, "oldid", "newid", func(user *tvm.User) error {
+			user.Subject = "1"
+			return nil
+		})
+		assert.Check(t, err)
+		_, err = store.GetUser(ctx, "oldid")
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "GetUser: %v", err)
+		user, err := store.GetUser(ctx, "newid")
+		assert.Assert(t, err)
+		assert.Check(t, is.Equal("newid", user.ID))
+		assert.Check(t, is.Equal("1", user.Subject))
+		assert.Check(t, user.Admin)
+		users, err := store.ListUsers(ctx)
+		assert.Check(t, err)
+		assert.Check(t, is.Len(users, 1))
+
+		err = store.RenameUser(ctx, "oldid", "newid", func(user *tvm.User) error {
+			t.Error("RenameUser called fn for a missing user")
+			return nil
+		})
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "RenameUser: %v", err)
+
+		err = store.DeleteUser(ctx, "newid")
+		assert.Check(t, err)
+	})
+
+	t.Run("update session", func(t *testing.T) {
+		err := store.PutSession(ctx, tvm.Session{ID: "sessionid"})
+		assert.Check(t, err)
+
+		const writers = 10
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := store.UpdateSession(ctx, "sessionid", func(session *tvm.Session) error {
+					session.UserID += "x"
+					return nil
+				})
+				assert.Check(t, err)
+			}()
+		}
+		wg.Wait()
+
+		session, err := store.GetSession(ctx, "sessionid")
+		assert.Check(t, err)
+		assert.Equal(t, "xxxxxxxxxx", session.UserID)
+		assert.Equal(t, int64(writers), session.Version)
+
+		err = store.DeleteSession(ctx, "sessionid")
+		assert.Check(t, err)
+	})
+
+	t.Run("large device list", func(t *testing.T) {
+		user := tvm.User{ID: "userid"}
+		for i := 0; i < 500; i++ {
+			user.U2FDevices = append(user.U2FDevices, tvm.U2FDevice{Counter: uint32(i)})
+		}
+		err := store.PutUser(ctx, user)
+		assert.Check(t, err)
+
+		err = store.UpdateUser(ctx, "userid", func(user *tvm.User) error {
+			user.U2FDevices[499].Counter++
+			return nil
+		})
+		assert.Check(t, err)
+
+		got, err := store.GetUser(ctx, "userid")
+		assert.Check(t, err)
+		assert.Assert(t, is.Len(got.U2FDevices, 500))
+		for i, device := range got.U2FDevices[:499] {
+			assert.Check(t, is.Equal(uint32(i), device.Counter))
+		}
+		assert.Check(t, is.Equal(uint32(500), got.U2FDevices[499].Counter))
+
+		err = store.DeleteUser(ctx, "userid")
+		assert.Check(t, err)
+	})
+
+	t.Run("session expiry", func(t *testing.T) {
+		err := store.PutSession(ctx, tvm.Session{ID: "live", Expires: time.Now().Add(time.Hour)})
+		assert.Check(t, err)
+		err = store.PutSession(ctx, tvm.Session{ID: "expired", Expires: time.Now().Add(-time.Second)})
+		assert.Check(t, err)
+
+		session, err := store.GetSession(ctx, "live")
+		assert.Check(t, err)
+		assert.Check(t, session != nil && session.Expires.After(time.Now()))
+
+		session, err = store.GetSession(ctx, "expired")
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "GetSession: %v", err)
+		assert.Check(t, is.Nil(session))
+
+		err = store.UpdateSession(ctx, "expired", func(session *tvm.Session) error {
+			t.Error("UpdateSession called fn for an expired session")
+			return nil
+		})
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "UpdateSession: %v", err)
+
+		sessions, err := store.ListSessions(ctx)
+		assert.Check(t, err)
+		ids := map[string]bool{}
+		for _, session := range sessions {
+			ids[session.ID] = true
+		}
+		assert.Check(t, ids["live"], "ListSessions: %v", ids)
+		assert.Check(t, !ids["expired"], "ListSessions: %v", ids)
+
+		err = store.DeleteSession(ctx, "live")
+		assert.Check(t, err)
+		store.DeleteSession(ctx, "expired")
+	})
+	t.Run("audit", func(t *testing.T) {
+		events, err := store.ListAuditEvents(ctx, tvm.AuditFilter{})
+		assert.Check(t, err)
+		assert.Check(t, is.Len(events, 0))
+
+		start := time.Now().Truncate(time.Second)
+		for i := 0; i < 10; i++ {
+			event := tvm.AuditEvent{
+				ID:    fmt.Sprintf("event%d", i),
+				Time:  start.Add(time.Duration(i) * time.Minute),
+				Type:  tvm.AuditLogin,
+				Actor: fmt.Sprintf("user%d", i%2),
+			}
+			if i == 9 {
+				event.Type = tvm.AuditAdmin
+				event.Subject = "user1"
+				event.Before = &tvm.AuditUserState{Roles: []tvm.RoleGrant{{Role: "role"}}}
+				event.After = &tvm.AuditUserState{Admin: true}
+			}
+			err := store.PutAuditEvent(ctx, event)
+			assert.Check(t, err)
+		}
+
+		events, err = store.ListAuditEvents(ctx, tvm.AuditFilter{})
+		assert.Check(t, err)
+		assert.Assert(t, is.Len(events, 10))
+		for i, event := range events {
+			assert.Check(t, is.Equal(fmt.Sprintf("event%d", 9-i), event.ID))
+		}
+		assert.Check(t, is.DeepEqual([]tvm.RoleGrant{{Role: "role"}}, events[0].Before.Roles))
+		assert.Check(t, events[0].After.Admin)
+
+		events, err = store.ListAuditEvents(ctx, tvm.AuditFilter{Actor: "user0", Limit: 2})
+		assert.Check(t, err)
+		assert.Assert(t, is.Len(events, 2))
+		assert.Check(t, is.Equal("event8", events[0].ID))
+		assert.Check(t, is.Equal("event6", events[1].ID))
+
+		events, err = store.ListAuditEvents(ctx, tvm.AuditFilter{
+			Type:  tvm.AuditLogin,
+			Since: start.Add(3 * time.Minute),
+			Until: start.Add(5 * time.Minute),
+		})
+		assert.Check(t, err)
+		assert.Assert(t, is.Len(events, 2))
+		assert.Check(t, is.Equal("event4", events[0].ID))
+		assert.Check(t, is.Equal("event3", events[1].ID))
+	})
+	t.Run("access requests", func(t *testing.T) {
+		request, err := store.GetAccessRequest(ctx, "requestid")
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "GetAccessRequest: %v", err)
+		assert.Check(t, is.Nil(request))
+
+		requests, err := store.ListAccessRequests(ctx)
+		assert.Check(t, err)
+		assert.Check(t, is.Len(requests, 0))
+
+		err = store.PutAccessRequest(ctx, tvm.AccessRequest{
+			ID:     "requestid",
+			UserID: "userid",
+			Role:   "role",
+			Status: tvm.AccessRequestPending,
+		})
+		assert.Check(t, err)
+
+		err = store.UpdateAccessRequest(ctx, "requestid", func(request *tvm.AccessRequest) error {
+			request.Status = tvm.AccessRequestApproved
+			request.DecidedBy = "approver"
+			return nil
+		})
+		assert.Check(t, err)
+
+		request, err = store.GetAccessRequest(ctx, "requestid")
+		assert.Check(t, err)
+		assert.Check(t, is.Equal(tvm.AccessRequestApproved, request.Status))
+		assert.Check(t, is.Equal("approver", request.DecidedBy))
+		assert.Check(t, is.Equal(int64(1), request.Version))
+
+		requests, err = store.ListAccessRequests(ctx)
+		assert.Check(t, err)
+		assert.Assert(t, is.Len(requests, 1))
+		assert.Check(t, is.Equal("requestid", requests[0].ID))
+
+		err = store.UpdateAccessRequest(ctx, "nosuchrequest", func(request *tvm.AccessRequest) error {
+			return nil
+		})
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "UpdateAccessRequest: %v", err)
+	})
+
+	t.Run("groups", func(t *testing.T) {
+		group, err := store.GetGroup(ctx, "groupid")
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "GetGroup: %v", err)
+		assert.Check(t, is.Nil(group))
+
+		err = store.PutGroup(ctx, tvm.Group{
+			ID:      "groupid",
+			Members: []string{"alice"},
+			Roles:   []tvm.RoleGrant{{Role: "role"}},
+		})
+		assert.Check(t, err)
+
+		err = store.UpdateGroup(ctx, "groupid", func(group *tvm.Group) error {
+			group.Members = append(group.Members, "bob")
+			return nil
+		})
+		assert.Check(t, err)
+
+		group, err = store.GetGroup(ctx, "groupid")
+		assert.Check(t, err)
+		assert.Check(t, is.DeepEqual([]string{"alice", "bob"}, group.Members))
+		assert.Check(t, is.DeepEqual([]tvm.RoleGrant{{Role: "role"}}, group.Roles))
+		assert.Check(t, is.Equal(int64(1), group.Version))
+
+		groups, err := store.ListGroups(ctx)
+		assert.Check(t, err)
+		assert.Assert(t, is.Len(groups, 1))
+		assert.Check(t, is.Equal("groupid", groups[0].ID))
+
+		err = store.UpdateGroup(ctx, "nosuchgroup", func(group *tvm.Group) error {
+			return nil
+		})
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "UpdateGroup: %v", err)
+
+		assert.Check(t, store.DeleteGroup(ctx, "groupid"))
+		err = store.DeleteGroup(ctx, "groupid")
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "DeleteGroup: %v", err)
+		groups, err = store.ListGroups(ctx)
+		assert.Check(t, err)
+		assert.Check(t, is.Len(groups, 0))
+	})
+
+	t.Run("api tokens", func(t *testing.T) {
+		token, err := store.GetAPIToken(ctx, "tokenid")
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "GetAPIToken: %v", err)
+		assert.Check(t, is.Nil(token))
+
+		err = store.PutAPIToken(ctx, tvm.APIToken{
+			ID:     "tokenid",
+			Hash:   "hash",
+			Scopes: []tvm.APIScope{tvm.ScopeUsersRead},
+		})
+		assert.Check(t, err)
+
+		token, err = store.GetAPIToken(ctx, "tokenid")
+		assert.Check(t, err)
+		assert.Check(t, is.Equal("hash", token.Hash))
+		assert.Check(t, is.DeepEqual([]tvm.APIScope{tvm.ScopeUsersRead}, token.Scopes))
+
+		tokens, err := store.ListAPITokens(ctx)
+		assert.Check(t, err)
+		assert.Assert(t, is.Len(tokens, 1))
+		assert.Check(t, is.Equal("tokenid", tokens[0].ID))
+
+		assert.Check(t, store.DeleteAPIToken(ctx, "tokenid"))
+		err = store.DeleteAPIToken(ctx, "tokenid")
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "DeleteAPIToken: %v", err)
+		tokens, err = store.ListAPITokens(ctx)
+		assert.Check(t, err)
+		assert.Check(t, is.Len(tokens, 0))
+	})
+
+	t.Run("review items", func(t *testing.T) {
+		item, err := store.GetReviewItem(ctx, "reviewid")
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "GetReviewItem: %v", err)
+		assert.Check(t, is.Nil(item))
+
+		err = store.PutReviewItem(ctx, tvm.ReviewItem{
+			ID:     "reviewid",
+			UserID: "userid",
+			Role:   "role",
+			Status: tvm.ReviewOpen,
+		})
+		assert.Check(t, err)
+
+		err = store.UpdateReviewItem(ctx, "reviewid", func(item *tvm.ReviewItem) error {
+			item.Status = tvm.ReviewClosed
+			item.ClosedBy = "admin"
+			return nil
+		})
+		assert.Check(t, err)
+
+		item, err = store.GetReviewItem(ctx, "reviewid")
+		assert.Check(t, err)
+		assert.Check(t, is.Equal(tvm.ReviewClosed, item.Status))
+		assert.Check(t, is.Equal("admin", item.ClosedBy))
+		assert.Check(t, is.Equal(int64(1), item.Version))
+
+		items, err := store.ListReviewItems(ctx)
+		assert.Check(t, err)
+		assert.Assert(t, is.Len(items, 1))
+		assert.Check(t, is.Equal("reviewid", items[0].ID))
+
+		err = store.UpdateReviewItem(ctx, "nosuchreview", func(item *tvm.ReviewItem) error {
+			return nil
+		})
+		assert.Check(t, errors.Is(err, tvm.ErrNotFound), "UpdateReviewItem: %v", err)
+	})
+}
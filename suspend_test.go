@@ -0,0 +1,96 @@
+package tvm
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestSuspendUser(t *testing.T) {
+	ctx := context.Background()
+	s, stsSvc := newTestServer(t, Config{})
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+	bob := loginAs(t, s, User{ID: "bob", Roles: []RoleGrant{{Role: "dev"}}, Admin: true})
+
+	w := do(s, "POST", "/admin/op", url.Values{"op": {"suspend_user"}, "user": {"bob"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"suspend_user"}, "user": {"admin"}, "reason": {"oops"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"suspend_user"}, "user": {"bob"}, "reason": {"investigation"}}, admin)
+	assert.Check(t, is.Equal(http.StatusSeeOther, w.Code))
+
+	user, err := s.Store.GetUser(ctx, "bob")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(UserSuspended, user.Status))
+	assert.Check(t, is.Equal("investigation (suspended by admin)", user.StatusReason))
+	assert.Check(t, is.Len(user.Roles, 1)) // kept for when bob returns
+	_, err = s.Store.GetSession(ctx, bob)
+	assert.Check(t, is.Equal(ErrNotFound, err))
+
+	// even with a fresh session, bob can neither get credentials nor
+	// administer
+	bob = loginAs(t, s, User{ID: "bob"})
+	w = do(s, "GET", "/?format=sh&role=dev", nil, bob)
+	assert.Check(t, is.Equal(http.StatusForbidden, w.Code))
+	assert.Check(t, is.Contains(w.Body.String(), "investigation"))
+	assert.Check(t, is.Len(stsSvc.inputs, 0))
+	bob = loginAs(t, s, User{ID: "bob"})
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"unsuspend_user"}, "user": {"bob"}}, bob)
+	assert.Check(t, is.Equal(http.StatusFound, w.Code))
+
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"unsuspend_user"}, "user": {"bob"}}, admin)
+	assert.Check(t, is.Equal(http.StatusSeeOther, w.Code))
+	user, err = s.Store.GetUser(ctx, "bob")
+	assert.NilError(t, err)
+	assert.Check(t, user.Active())
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"unsuspend_user"}, "user": {"bob"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+
+	events, err := s.Store.ListAuditEvents(ctx, AuditFilter{Type: AuditAdmin})
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(events, 2))
+	assert.Check(t, is.Equal("unsuspend_user", events[0].Op))
+	assert.Check(t, is.Equal(UserSuspended, events[1].After.Status))
+
+	// only active users can be suspended, so unsuspending never reactivates
+	// a disabled user
+	assert.NilError(t, s.Store.PutUser(ctx, User{ID: "carol", Status: UserDisabled}))
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"suspend_user"}, "user": {"carol"}, "reason": {"investigation"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+	user, err = s.Store.GetUser(ctx, "carol")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(UserDisabled, user.Status))
+}
+
+func TestDeleteUser(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, Config{})
+	admin := loginAs(t, s, User{ID: "admin", Admin: true})
+	bob := loginAs(t, s, User{ID: "bob"})
+	assert.NilError(t, s.Store.PutGroup(ctx, Group{ID: "eng", Members: []string{"bob"}}))
+
+	w := do(s, "POST", "/admin/op", url.Values{"op": {"delete_user"}, "user": {"bob"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"delete_user"}, "user": {"bob"}, "confirm": {"bo"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+	_, err := s.Store.GetUser(ctx, "bob")
+	assert.NilError(t, err)
+
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"delete_user"}, "user": {"bob"}, "confirm": {"bob"}}, admin)
+	assert.Check(t, is.Equal(http.StatusSeeOther, w.Code))
+	_, err = s.Store.GetUser(ctx, "bob")
+	assert.Check(t, is.Equal(ErrNotFound, err))
+	_, err = s.Store.GetSession(ctx, bob)
+	assert.Check(t, is.Equal(ErrNotFound, err))
+	group, err := s.Store.GetGroup(ctx, "eng")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(group.Members, 0))
+
+	w = do(s, "POST", "/admin/op", url.Values{"op": {"delete_user"}, "user": {"admin"}, "confirm": {"admin"}}, admin)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+}
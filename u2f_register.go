@@ -2,12 +2,15 @@ package tvm
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/tstranex/u2f"
 	"log"
 	"net/http"
 )
 
+var errNeedU2F = errors.New("need u2f")
+
 func (s *Server) handleU2FRegister(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Query().Get("resp") != "" {
 		s.handleU2FRegisterSigned(w, r)
@@ -31,6 +34,10 @@ func (s *Server) handleU2FRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if session.BreakGlass {
+		http.Error(w, "cannot register a key during break-glass access", http.StatusForbidden)
+		return
+	}
 	if len(user.U2FDevices) > 0 && !session.U2F {
 		fmt.Fprintln(w, "need u2f")
 		return
@@ -43,7 +50,13 @@ func (s *Server) handleU2FRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session.U2FChallenge = c
+	err = s.Store.UpdateSession(r.Context(), session.ID, func(session *Session) error {
+		session.U2FChallenge = c
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
 
 	req := u2f.NewWebRegisterRequest(c, user.U2FRegistrations())
 	reqJSON, err := json.Marshal(req)
@@ -98,9 +111,12 @@ func (s *Server) handleU2FRegisterSigned(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	user, err := s.Store.GetUser(r.Context(), session.UserID)
-	if err != nil {
-		fmt.Fprintln(w, "bad user")
+	if session.U2FChallenge == nil {
+		http.Error(w, "challenge missing", http.StatusBadRequest)
+		return
+	}
+	if session.BreakGlass {
+		http.Error(w, "cannot register a key during break-glass access", http.StatusForbidden)
 		return
 	}
 
@@ -117,16 +133,38 @@ func (s *Server) handleU2FRegisterSigned(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	user.U2FDevices = append(user.U2FDevices, U2FDevice{
-		Registration: *reg,
-		Counter:      0,
+	err = s.Store.UpdateUser(r.Context(), session.UserID, func(user *User) error {
+		// As on the registration page, adding a key requires one of the
+		// user's existing keys.
+		if len(user.U2FDevices) > 0 && !session.U2F {
+			return errNeedU2F
+		}
+		user.U2FDevices = append(user.U2FDevices, U2FDevice{
+			Registration: *reg,
+			Counter:      0,
+		})
+		return nil
 	})
-	if err := s.Store.PutUser(r.Context(), *user); err != nil {
+	if err == ErrNotFound {
+		fmt.Fprintln(w, "bad user")
+		return
+	} else if err == errNeedU2F {
+		http.Error(w, "need u2f", http.StatusForbidden)
+		return
+	} else if err != nil {
 		panic(err)
 	}
 
-	session.U2FChallenge = nil
-	if err := s.Store.PutSession(r.Context(), *session); err != nil {
+	s.audit(r.Context(), r, AuditEvent{
+		Type:  AuditKeyRegister,
+		Actor: session.UserID,
+	})
+
+	err = s.Store.UpdateSession(r.Context(), session.ID, func(session *Session) error {
+		session.U2FChallenge = nil
+		return nil
+	})
+	if err != nil {
 		panic(err)
 	}
 
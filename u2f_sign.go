@@ -2,12 +2,15 @@ package tvm
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/tstranex/u2f"
 	"log"
 	"net/http"
 )
 
+var errU2FSignFailed = errors.New("u2f sign failed")
+
 func (s *Server) u2fAppID() string {
 	u := s.Config.RootURL
 	return fmt.Sprintf("%s://%s", u.Scheme, u.Host)
@@ -20,8 +23,11 @@ func (s *Server) sendU2FChallenge(w http.ResponseWriter, r *http.Request, sessio
 		panic(err)
 	}
 
-	session.U2FChallenge = c
-	if err := s.Store.PutSession(r.Context(), session); err != nil {
+	err = s.Store.UpdateSession(r.Context(), session.ID, func(session *Session) error {
+		session.U2FChallenge = c
+		return nil
+	})
+	if err != nil {
 		panic(err)
 	}
 
@@ -81,39 +87,46 @@ func (s *Server) handleU2FSigned(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := s.Store.GetUser(r.Context(), session.UserID)
-	if err != nil {
+	// The counter check and update happen inside UpdateUser so that a
+	// concurrent write cannot roll the counter back.
+	err = s.Store.UpdateUser(r.Context(), session.UserID, func(user *User) error {
+		for i, device := range user.U2FDevices {
+			newCounter, authErr := device.Registration.Authenticate(signResp, *session.U2FChallenge, device.Counter)
+			if authErr != nil {
+				log.Printf("u2f: authenticate: %s", authErr)
+				continue
+			}
+
+			log.Printf("newCounter: %d", newCounter)
+			user.U2FDevices[i].Counter = newCounter
+			return nil
+		}
+		return errU2FSignFailed
+	})
+	if err == errU2FSignFailed {
+		s.audit(r.Context(), r, AuditEvent{
+			Type:  AuditKeySignFailed,
+			Actor: session.UserID,
+		})
+		fmt.Fprintln(w, "u2f sign failed")
+		return
+	} else if err != nil {
 		fmt.Fprintln(w, "bad session")
 		return
 	}
 
-	for i, device := range user.U2FDevices {
-		newCounter, authErr := device.Registration.Authenticate(signResp, *session.U2FChallenge, device.Counter)
-		if authErr != nil {
-			log.Printf("u2f: authenticate: %s", authErr)
-			continue
-		}
-
-		log.Printf("newCounter: %d", newCounter)
-		device.Counter = newCounter
-
-		user.U2FDevices[i].Counter = newCounter
-		if err := s.Store.PutUser(r.Context(), *user); err != nil {
-			panic(err)
-		}
+	s.audit(r.Context(), r, AuditEvent{
+		Type:  AuditKeySign,
+		Actor: session.UserID,
+	})
 
+	err = s.Store.UpdateSession(r.Context(), session.ID, func(session *Session) error {
 		session.U2FChallenge = nil
 		session.U2F = true
-		if err := s.Store.PutSession(r.Context(), *session); err != nil {
-			panic(err)
-		}
-
-		break
-	}
-
-	if !session.U2F {
-		fmt.Fprintln(w, "u2f sign failed")
-		return
+		return nil
+	})
+	if err != nil {
+		panic(err)
 	}
 
 	http.Redirect(w, r, "/?" + session.Params.Encode(), http.StatusFound)
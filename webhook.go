@@ -0,0 +1,304 @@
+package tvm
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// WebhookConfig describes an outbound webhook that is notified of
+// security-relevant events. Break-glass access is always notified,
+// whatever triggers are configured.
+type WebhookConfig struct {
+	URL string
+
+	// Secret is used to sign each payload. The signature is sent in the
+	// X-TVM-Signature header as the hex-encoded HMAC-SHA256 of the
+	// X-TVM-Timestamp header, a period, and the body.
+	Secret string
+
+	// Format is "generic" (the default) to send the event as JSON, or
+	// "slack" to send a message suitable for a Slack incoming webhook.
+	Format string
+
+	// Template, if set, is a text/template that produces the request body.
+	// It is executed with a WebhookPayload.
+	Template string
+
+	// MinSensitivity triggers the webhook when credentials are issued for a
+	// role whose sensitivity is at least this. Zero disables the trigger.
+	MinSensitivity int
+
+	// DeviceRegistration triggers the webhook when a user registers a key.
+	DeviceRegistration bool
+
+	// AdminPromotion triggers the webhook when a user is made an admin.
+	AdminPromotion bool
+
+	// FailedSignThreshold triggers the webhook when a user fails to sign
+	// with their key this many times within FailedSignWindowSeconds. Zero
+	// disables the trigger.
+	FailedSignThreshold     int
+	FailedSignWindowSeconds int
+
+	// QueueSize is the number of events queued for delivery to the webhook.
+	// Events are dropped while the queue is full. Zero means 100.
+	QueueSize int
+}
+
+// queueSize returns the number of events queued for delivery to the
+// webhook.
+func (c WebhookConfig) queueSize() int {
+	if c.QueueSize > 0 {
+		return c.QueueSize
+	}
+	return 100
+}
+
+// defaultWebhookClient is used to deliver webhooks when WebhookSink.Client is
+// nil. It has a timeout so that a webhook that never responds cannot stall
+// delivery to it.
+var defaultWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// WebhookPayload is the data sent to a webhook.
+type WebhookPayload struct {
+	// Trigger says why the webhook fired, e.g. "sensitive_role".
+	Trigger string
+
+	// Text is a human readable description of the event.
+	Text string
+
+	Event AuditEvent
+}
+
+// WebhookSink is an EventSink that delivers the events selected by its
+// configuration to a webhook, retrying with exponential backoff.
+type WebhookSink struct {
+	Config WebhookConfig
+
+	// Roles is the role catalog, used to look up role sensitivity.
+	Roles map[string]RoleConfig
+
+	// OnFailure, if set, is called when an event cannot be delivered.
+	OnFailure func(event AuditEvent, err error)
+
+	// Client is used to make requests. If nil, a client with a ten second
+	// timeout is used.
+	Client *http.Client
+
+	// MaxAttempts is the number of times to try delivery. Zero means 5.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry, doubling after each
+	// attempt. Zero means one second.
+	Backoff time.Duration
+
+	mu          sync.Mutex
+	failedSigns map[string][]time.Time
+}
+
+var _ EventSink = &WebhookSink{}
+
+func (s *WebhookSink) Send(ctx context.Context, event AuditEvent) error {
+	trigger := s.trigger(event)
+	if trigger == "" {
+		return nil
+	}
+
+	payload := WebhookPayload{
+		Trigger: trigger,
+		Text:    webhookText(trigger, event),
+		Event:   event,
+	}
+	body, err := s.body(payload)
+	if err != nil {
+		return err
+	}
+
+	if err := s.deliver(ctx, body); err != nil {
+		if s.OnFailure != nil {
+			s.OnFailure(event, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// trigger returns the reason event should be delivered, or "" if it should
+// not be.
+func (s *WebhookSink) trigger(event AuditEvent) string {
+	switch event.Type {
+	case AuditBreakGlass:
+		return "break_glass"
+	case AuditCredentialsIssue:
+		if s.Config.MinSensitivity > 0 && s.Roles[event.Role].Sensitivity >= s.Config.MinSensitivity {
+			return "sensitive_role"
+		}
+	case AuditKeyRegister:
+		if s.Config.DeviceRegistration {
+			return "device_registration"
+		}
+	case AuditAdmin:
+		if s.Config.AdminPromotion && event.Op == "add_admin" {
+			return "admin_promotion"
+		}
+	case AuditKeySignFailed:
+		if s.Config.FailedSignThreshold > 0 && s.countFailedSign(event) {
+			return "failed_signs"
+		}
+	}
+	return ""
+}
+
+// countFailedSign records a failed sign by event.Actor and returns true if
+// that takes the user to the threshold.
+func (s *WebhookSink) countFailedSign(event AuditEvent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failedSigns == nil {
+		s.failedSigns = map[string][]time.Time{}
+	}
+
+	window := time.Duration(s.Config.FailedSignWindowSeconds) * time.Second
+	var recent []time.Time
+	for _, t := range s.failedSigns[event.Actor] {
+		if window == 0 || event.Time.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, event.Time)
+
+	if len(recent) >= s.Config.FailedSignThreshold {
+		delete(s.failedSigns, event.Actor)
+		return true
+	}
+	s.failedSigns[event.Actor] = recent
+	return false
+}
+
+func webhookText(trigger string, event AuditEvent) string {
+	switch trigger {
+	case "sensitive_role":
+		text := fmt.Sprintf("%s was issued credentials for %s from %s", event.Actor, event.Role, event.SourceIP)
+		if event.Reason != "" {
+			text += fmt.Sprintf(" because %q", event.Reason)
+		}
+		if event.Ticket != "" {
+			text += fmt.Sprintf(" (ticket %s)", event.Ticket)
+		}
+		return text
+	case "break_glass":
+		return fmt.Sprintf("BREAK-GLASS: %s was issued emergency credentials for %s from %s because %q",
+			event.Actor, event.Role, event.SourceIP, event.Reason)
+	case "device_registration":
+		return fmt.Sprintf("%s registered a new key from %s", event.Actor, event.SourceIP)
+	case "admin_promotion":
+		return fmt.Sprintf("%s made %s an admin", event.Actor, event.Subject)
+	case "failed_signs":
+		return fmt.Sprintf("%s repeatedly failed to sign with their key, most recently from %s", event.Actor, event.SourceIP)
+	default:
+		return fmt.Sprintf("%s: %s", event.Type, event.Actor)
+	}
+}
+
+func (s *WebhookSink) body(payload WebhookPayload) ([]byte, error) {
+	if s.Config.Template != "" {
+		tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				buf, err := json.Marshal(v)
+				return string(buf), err
+			},
+		}).Parse(s.Config.Template)
+		if err != nil {
+			return nil, err
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := tmpl.Execute(buf, payload); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	switch s.Config.Format {
+	case "", "generic":
+		return json.Marshal(payload)
+	case "slack":
+		return json.Marshal(struct {
+			Text string `json:"text"`
+		}{Text: ":rotating_light: " + payload.Text})
+	default:
+		return nil, fmt.Errorf("unknown webhook format %q", s.Config.Format)
+	}
+}
+
+func (s *WebhookSink) deliver(ctx context.Context, body []byte) error {
+	maxAttempts := s.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = 5
+	}
+	backoff := s.Backoff
+	if backoff == 0 {
+		backoff = time.Second
+	}
+
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+		}
+		if err = s.post(ctx, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *WebhookSink) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.Config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-TVM-Timestamp", timestamp)
+	req.Header.Set("X-TVM-Signature", signWebhook(s.Config.Secret, timestamp, body))
+
+	client := s.Client
+	if client == nil {
+		client = defaultWebhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: %s", s.Config.URL, resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the signature of a webhook body.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, timestamp+".")
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,226 @@
+package tvm
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	bodies   []string
+	failures int // respond with an error to this many requests first
+}
+
+func newWebhookReceiver(t *testing.T, secret string) *webhookReceiver {
+	recv := &webhookReceiver{}
+	recv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Check(t, is.Equal(signWebhook(secret, r.Header.Get("X-TVM-Timestamp"), body),
+			r.Header.Get("X-TVM-Signature")))
+
+		recv.mu.Lock()
+		defer recv.mu.Unlock()
+		if recv.failures > 0 {
+			recv.failures--
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		recv.bodies = append(recv.bodies, string(body))
+	}))
+	return recv
+}
+
+func TestWebhookTriggers(t *testing.T) {
+	recv := newWebhookReceiver(t, "sekrit")
+	defer recv.Close()
+
+	sink := &WebhookSink{
+		Config: WebhookConfig{
+			URL:                     recv.URL,
+			Secret:                  "sekrit",
+			MinSensitivity:          2,
+			DeviceRegistration:      true,
+			AdminPromotion:          true,
+			FailedSignThreshold:     3,
+			FailedSignWindowSeconds: 60,
+		},
+		Roles: map[string]RoleConfig{
+			"prod-admin": {Sensitivity: 3},
+			"dev":        {Sensitivity: 1},
+		},
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	for _, event := range []AuditEvent{
+		{Type: AuditCredentialsIssue, Actor: "alice", Role: "dev"},
+		{Type: AuditCredentialsIssue, Actor: "alice", Role: "prod-admin"},
+		{Type: AuditKeyRegister, Actor: "bob"},
+		{Type: AuditAdmin, Actor: "alice", Subject: "bob", Op: "add_role"},
+		{Type: AuditAdmin, Actor: "alice", Subject: "bob", Op: "add_admin"},
+		{Type: AuditKeySignFailed, Actor: "carol", Time: now},
+		{Type: AuditKeySignFailed, Actor: "carol", Time: now.Add(2 * time.Minute)},
+		{Type: AuditKeySignFailed, Actor: "carol", Time: now.Add(2*time.Minute + time.Second)},
+		{Type: AuditKeySignFailed, Actor: "carol", Time: now.Add(2*time.Minute + 2*time.Second)},
+		{Type: AuditLogin, Actor: "alice"},
+	} {
+		assert.Check(t, sink.Send(ctx, event))
+	}
+
+	var triggers []string
+	for _, body := range recv.bodies {
+		var payload WebhookPayload
+		assert.Check(t, json.Unmarshal([]byte(body), &payload))
+		triggers = append(triggers, payload.Trigger)
+	}
+	assert.Check(t, is.DeepEqual([]string{
+		"sensitive_role",
+		"device_registration",
+		"admin_promotion",
+		"failed_signs",
+	}, triggers))
+}
+
+func TestWebhookBreakGlass(t *testing.T) {
+	recv := newWebhookReceiver(t, "sekrit")
+	defer recv.Close()
+
+	// break-glass use is delivered even with no triggers configured
+	sink := &WebhookSink{Config: WebhookConfig{URL: recv.URL, Secret: "sekrit"}}
+	assert.Check(t, sink.Send(context.Background(), AuditEvent{
+		Type:     AuditBreakGlass,
+		Severity: AuditSeverityHigh,
+		Actor:    "alice",
+		Role:     "emergency",
+		Reason:   "outage",
+	}))
+
+	assert.Assert(t, is.Len(recv.bodies, 1))
+	var payload WebhookPayload
+	assert.Check(t, json.Unmarshal([]byte(recv.bodies[0]), &payload))
+	assert.Check(t, is.Equal("break_glass", payload.Trigger))
+	assert.Check(t, is.Contains(payload.Text, "BREAK-GLASS: alice"))
+}
+
+func TestWebhookSlackFormat(t *testing.T) {
+	recv := newWebhookReceiver(t, "")
+	defer recv.Close()
+
+	sink := &WebhookSink{Config: WebhookConfig{URL: recv.URL, Format: "slack", DeviceRegistration: true}}
+	err := sink.Send(context.Background(), AuditEvent{Type: AuditKeyRegister, Actor: "bob", SourceIP: "192.0.2.1"})
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual([]string{
+		`{"text":":rotating_light: bob registered a new key from 192.0.2.1"}`,
+	}, recv.bodies))
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	recv := newWebhookReceiver(t, "")
+	defer recv.Close()
+
+	sink := &WebhookSink{Config: WebhookConfig{
+		URL:                recv.URL,
+		Template:           `{"summary": {{ json .Text }}, "user": {{ json .Event.Actor }}}`,
+		DeviceRegistration: true,
+	}}
+	err := sink.Send(context.Background(), AuditEvent{Type: AuditKeyRegister, Actor: "bob"})
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual([]string{
+		`{"summary": "bob registered a new key from ", "user": "bob"}`,
+	}, recv.bodies))
+}
+
+func TestWebhookRetry(t *testing.T) {
+	recv := newWebhookReceiver(t, "")
+	defer recv.Close()
+
+	var failures []error
+	sink := &WebhookSink{
+		Config:      WebhookConfig{URL: recv.URL, DeviceRegistration: true},
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+		OnFailure: func(event AuditEvent, err error) {
+			failures = append(failures, err)
+		},
+	}
+
+	t.Run("succeeds after retry", func(t *testing.T) {
+		recv.failures = 2
+		err := sink.Send(context.Background(), AuditEvent{Type: AuditKeyRegister})
+		assert.Check(t, err)
+		assert.Check(t, is.Len(recv.bodies, 1))
+		assert.Check(t, is.Len(failures, 0))
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		recv.failures = 3
+		err := sink.Send(context.Background(), AuditEvent{Type: AuditKeyRegister})
+		assert.Check(t, is.ErrorContains(err, "503 Service Unavailable"))
+		assert.Check(t, is.Len(recv.bodies, 1))
+		assert.Check(t, is.Len(failures, 1))
+	})
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	release := make(chan struct{})
+	recv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer recv.Close()
+	defer close(release)
+
+	timeout := defaultWebhookClient.Timeout
+	defer func() { defaultWebhookClient.Timeout = timeout }()
+	defaultWebhookClient.Timeout = 10 * time.Millisecond
+
+	sink := &WebhookSink{
+		Config:      WebhookConfig{URL: recv.URL, DeviceRegistration: true},
+		MaxAttempts: 1,
+	}
+	err := sink.Send(context.Background(), AuditEvent{Type: AuditKeyRegister})
+	assert.Check(t, is.ErrorContains(err, "Client.Timeout exceeded"))
+}
+
+func TestCloseWithFailingWebhook(t *testing.T) {
+	recv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer recv.Close()
+
+	s, _ := newTestServer(t, Config{Webhooks: []WebhookConfig{{URL: recv.URL, DeviceRegistration: true}}})
+	s.Sinks[0].(*AsyncSink).sink.(*WebhookSink).MaxAttempts = 1
+
+	// the failure is audited while Close delivers the queue, which must
+	// not send to the closed sink
+	s.audit(context.Background(), nil, AuditEvent{Type: AuditKeyRegister})
+	assert.Check(t, s.Close())
+	s.audit(context.Background(), nil, AuditEvent{Type: AuditKeyRegister})
+
+	events, err := s.Store.ListAuditEvents(context.Background(), AuditFilter{Type: AuditWebhookFailed})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(events, 1))
+}
+
+func TestWebhookQueueSize(t *testing.T) {
+	s, _ := newTestServer(t, Config{Webhooks: []WebhookConfig{
+		{URL: "https://example.com/a"},
+		{URL: "https://example.com/b", QueueSize: 5},
+	}})
+	var sizes []int
+	for _, sink := range s.Sinks {
+		if sink, ok := sink.(*AsyncSink); ok {
+			sizes = append(sizes, cap(sink.events))
+		}
+	}
+	assert.Check(t, is.DeepEqual([]int{100, 5}, sizes))
+}